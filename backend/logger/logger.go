@@ -0,0 +1,100 @@
+// Package logger writes leveled log lines through the standard log package.
+// The minimum level is read from the LOG_LEVEL environment variable (debug, info, warn or error).
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log line.
+type Level int32
+
+const (
+	LevelDebug Level = iota // Chatty detail such as per-frame progress
+	LevelInfo               // Regular operation
+	LevelWarn               // Something went wrong but the work goes on
+	LevelError              // An operation failed
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// String returns the lowercase name of the level, as accepted by ParseLevel.
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses "debug", "info", "warn" (or "warning") and "error", case-insensitively.
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", value)
+	}
+}
+
+var minLevel atomic.Int32
+
+func init() {
+	level := LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		parsed, err := ParseLevel(value)
+		if err != nil {
+			log.Printf("WARN %v; using info", err)
+		}
+		level = parsed
+	}
+	SetLevel(level)
+}
+
+// SetLevel sets the minimum level of the lines that are written.
+func SetLevel(level Level) {
+	minLevel.Store(int32(level))
+}
+
+// Enabled reports whether lines of the given level are written.
+func Enabled(level Level) bool {
+	return level >= Level(minLevel.Load())
+}
+
+// Debugf logs at debug level, e.g. every progress report of ffmpeg.
+func Debugf(format string, args ...any) {
+	output(LevelDebug, format, args...)
+}
+
+// Infof logs at info level.
+func Infof(format string, args ...any) {
+	output(LevelInfo, format, args...)
+}
+
+// Warnf logs at warn level.
+func Warnf(format string, args ...any) {
+	output(LevelWarn, format, args...)
+}
+
+// Errorf logs at error level.
+func Errorf(format string, args ...any) {
+	output(LevelError, format, args...)
+}
+
+func output(level Level, format string, args ...any) {
+	if !Enabled(level) {
+		return
+	}
+	log.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, args...))
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/PratikDev/transcoder/logger"
+	"github.com/PratikDev/transcoder/middleware"
 	"github.com/PratikDev/transcoder/services"
 	"github.com/PratikDev/transcoder/services/utils"
 	"github.com/PratikDev/transcoder/types"
@@ -23,33 +40,251 @@ const (
 	serverPort        = ":3000" // Port for the API server
 	maxUploadSize     = 30      // Maximum upload size in MB
 	fileFormFieldName = "video"
+	chaptersFieldName = "chapters"       // Optional ffmetadata chapters, as a file or a plain field
+	maxFormValuesSize = 1 << 20          // Maximum combined size of the non-file form fields in bytes
+	shutdownTimeout   = 30 * time.Second // How long running jobs get to wind down on shutdown
+)
+
+// Build info, set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 var (
 	statusManager *services.StatusManager
+
+	// Parent of every task's context, cancelled with CancelReasonShutdown when the server stops
+	serverCtx, stopServer = context.WithCancelCause(context.Background())
+
+	// Cancelled once jobs have wound down on shutdown, ending the status streams still open
+	statusStreamsCtx, closeStatusStreams = context.WithCancel(context.Background())
+
+	// How long a status stream may stay silent before a keepalive comment is sent
+	sseHeartbeatInterval = utils.GetEnvDuration("SSE_HEARTBEAT_INTERVAL", 15*time.Second)
+
+	// Runs transcoding jobs with bounded concurrency, starting higher priority jobs first
+	jobScheduler = services.NewScheduler(
+		utils.GetEnvInt("MAX_CONCURRENT_JOBS", 2),
+		utils.GetEnvDuration("PRIORITY_AGING_INTERVAL", 2*time.Minute),
+	)
+
+	// How long a job may wait in the queue without starting before it's expired, 0 keeps it queued indefinitely
+	maxQueueWait = utils.GetEnvDuration("MAX_QUEUE_WAIT", 6*time.Hour)
+
+	// How long a cancelOnDisconnect job may go without status subscribers before it's cancelled
+	disconnectGrace = utils.GetEnvDuration("DISCONNECT_GRACE_PERIOD", 30*time.Second)
+
+	// Limits how often a single client can start transcoding jobs
+	transcodeRateLimiter = middleware.NewRateLimiter(
+		utils.GetEnvInt("RATE_LIMIT_RPM", 10),
+		utils.GetEnvInt("RATE_LIMIT_BURST", 5),
+	)
+
+	// Secret granting access to admin-only options, which are disabled when it's empty
+	adminToken = utils.GetEnv("ADMIN_TOKEN", "")
+
+	// How long the archive of a finished task is kept for download before it's deleted
+	archiveTTL = utils.GetEnvDuration("ARCHIVE_TTL", 24*time.Hour)
+
+	// Archived outputs by upload content and options, for identical uploads to reuse
+	artifactIndex = services.NewArtifactIndex()
+
+	// Append-only log of the jobs that failed, kept for later analysis
+	failureRecorder = services.NewFailureRecorder(utils.GetEnv("FAILURE_LOG_FILE", "./failed_jobs.jsonl"))
+
+	// Task IDs of finished tasks whose output folder is zipped on the fly when downloaded
+	streamedOutputs sync.Map
+
+	// Cross-origin policy applied to every endpoint
+	corsPolicy = middleware.NewCORS(utils.GetEnv("ALLOWED_ORIGINS", "*"))
+
+	// Connection timeouts, so slow or hung clients can't hold connections open forever; 0 disables one
+	readHeaderTimeout = utils.GetEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	readTimeout       = utils.GetEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second)
+	writeTimeout      = utils.GetEnvDuration("HTTP_WRITE_TIMEOUT", time.Minute)
+	idleTimeout       = utils.GetEnvDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+
+	// How long receiving an upload and answering it may take, replacing the read and write timeouts
+	// for upload endpoints; 0 disables it
+	uploadTimeout = utils.GetEnvDuration("UPLOAD_TIMEOUT", 15*time.Minute)
 )
 
 func init() {
-	// Initialize the global status manager when the program starts
-	statusManager = services.NewStatusManager()
+	// Operators can tune the resolution ladder without recompiling; anything wrong with the file
+	// leaves the built-in ladder in place
+	if path := utils.GetEnv("RESOLUTION_PRESETS_FILE", ""); path != "" {
+		presets, err := utils.LoadResolutionPresets(path)
+		if err != nil {
+			logger.Warnf("%v; using the built-in resolution presets", err)
+		} else {
+			types.SetPresets(presets)
+			logger.Infof("Loaded %d resolution presets from %s", len(presets), path)
+		}
+	}
+
+	// Initialize the global status manager when the program starts,
+	// using the status backend selected by STATUS_BACKEND (in-memory by default)
+	broker, err := services.NewStatusBrokerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up status backend: %v", err)
+	}
+	statusManager, err = services.NewStatusManagerWithBroker(broker)
+	if err != nil {
+		log.Fatalf("Failed to set up status manager: %v", err)
+	}
+
+	// How many updates a slow status subscriber may fall behind, and what happens beyond that
+	overflowPolicy, err := services.ParseOverflowPolicy(utils.GetEnv("SUBSCRIBER_OVERFLOW_POLICY", string(services.OverflowDrop)))
+	if err != nil {
+		log.Fatalf("Invalid SUBSCRIBER_OVERFLOW_POLICY: %v", err)
+	}
+	statusManager.SetSubscriberBuffer(utils.GetEnvInt("SUBSCRIBER_BUFFER_SIZE", services.DefaultSubscriberBufferSize), overflowPolicy)
+	statusManager.SetMonotonicProgress(utils.GetEnvBool("MONOTONIC_PROGRESS", true))
+
+	// Queued tasks are told where they stand whenever the queue moves
+	jobScheduler.SetQueueListener(func(taskID string, position int, wait time.Duration) {
+		message := fmt.Sprintf("Waiting in the queue at position %d.", position)
+		if wait > 0 {
+			message = fmt.Sprintf("Waiting in the queue at position %d, about %s until it starts.", position, wait.Round(time.Second))
+		}
+		statusManager.SendUpdate(taskID, types.StatusUpdate{
+			Type:    "queued",
+			Message: message,
+			Data:    types.TaskData{QueuePosition: position, EstimatedWaitSeconds: int64(wait.Seconds())},
+		})
+	})
 }
 
 func main() {
-	// Create upload and output directories if they don't exist
-	if err := os.MkdirAll(utils.UPLOAD_DIR, 0755); err != nil {
-		log.Fatalf("Failed to create upload directory %s: %v", utils.UPLOAD_DIR, err)
+	// Create upload and output directories if they don't exist, and make sure we can write to them
+	if err := utils.EnsureWritableDir(utils.UPLOAD_DIR); err != nil {
+		log.Fatalf("Upload directory is not usable: %v", err)
+	}
+	if err := utils.EnsureWritableDir(utils.OUTPUT_DIR); err != nil {
+		log.Fatalf("Output directory is not usable: %v", err)
+	}
+	logger.Infof("Using upload directory %s and output directory %s", utils.UPLOAD_DIR, utils.OUTPUT_DIR)
+
+	// Outputs of tasks finished before a restart no longer have a cleanup timer
+	if removed, err := utils.RemoveExpiredOutputs(archiveTTL); err != nil {
+		logger.Warnf("failed to remove expired outputs: %v", err)
+	} else if removed > 0 {
+		logger.Infof("Removed %d archives and output folders older than %s", removed, archiveTTL)
+	}
+	if adminToken != "" {
+		if err := utils.EnsureWritableDir(utils.SOURCE_ARCHIVE_DIR); err != nil {
+			log.Fatalf("Source archive directory is not usable: %v", err)
+		}
+	}
+
+	// Fail fast if ffmpeg or ffprobe are missing, rather than on the first job
+	for _, binary := range []string{utils.FFMPEG_PATH, utils.FFPROBE_PATH} {
+		if err := utils.EnsureBinary(binary); err != nil {
+			log.Fatalf("Required binary is not usable: %v", err)
+		}
+	}
+	if _, err := serverCapabilities(); err != nil {
+		logger.Warnf("%v", err)
+	}
+	go utils.BenchmarkEncodeSpeed() // Measured in the background, so the first estimate doesn't wait for it
+	if maxQueueWait > 0 {
+		go expireQueuedJobs()
+	}
+
+	http.HandleFunc("/transcode", transcodeRateLimiter.Middleware(handleTranscode))          // Main transcoding endpoint, rate limited per client
+	http.HandleFunc("/transcode/json", transcodeRateLimiter.Middleware(handleTranscodeJSON)) // Same as /transcode, with the file base64-encoded in a JSON body
+	http.HandleFunc("/transcode/status/", middleware.Gzip(handleTranscodeStatusStream))      // SSE endpoint (and JSON snapshot under /snapshot); the stream itself is never compressed
+	http.HandleFunc("/transcode/rerun/", handleRerunTranscode)                               // Re-transcode a kept source with new options (admin only)
+	http.HandleFunc("/transcode/ws/", handleTranscodeStatusWebSocket)                        // WebSocket alternative to the SSE endpoint
+	http.HandleFunc("/transcode/download/", handleDownload)                                  // Zip archive of a finished task, with Range support
+	http.HandleFunc("/transcode/jobs", middleware.Gzip(handleListJobs))
+	http.HandleFunc("/transcode/jobs/", middleware.Gzip(handleJob))         // Details (GET) or cancellation (DELETE) of a single job
+	http.HandleFunc("/media/probe", middleware.Gzip(handleMediaProbe))      // Endpoint to inspect a media file with ffprobe
+	http.HandleFunc("/transcode/estimate", middleware.Gzip(handleEstimate)) // Predicted encode time of an upload with the given options
+	http.HandleFunc("/capabilities", middleware.Gzip(handleCapabilities))
+	http.HandleFunc("/version", handleVersion)
+	http.HandleFunc("/status", handleServerStatus) // For checking server health
+
+	// Uploads, status streams and downloads adjust their own deadlines, see extendUploadDeadlines and disableTimeouts
+	server := &http.Server{
+		Addr:              serverPort,
+		Handler:           middleware.RequestID(middleware.AccessLog(corsPolicy.Middleware(http.DefaultServeMux.ServeHTTP))),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	go func() {
+		logger.Infof("Server starting on port %s", serverPort)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	<-signalCtx.Done()
+	shutdown(server)
+}
+
+// extendUploadDeadlines gives an upload request UPLOAD_TIMEOUT, from now, to send its body and get
+// its response, as a large file on a slow link takes far longer than HTTP_READ_TIMEOUT.
+func extendUploadDeadlines(w http.ResponseWriter) {
+	var deadline time.Time // The zero time disables the deadlines
+	if uploadTimeout > 0 {
+		deadline = time.Now().Add(uploadTimeout)
 	}
-	if err := os.MkdirAll(utils.OUTPUT_DIR, 0755); err != nil {
-		log.Fatalf("Failed to create output directory %s: %v", utils.OUTPUT_DIR, err)
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(deadline); err != nil {
+		logger.Warnf("Failed to extend the upload read deadline: %v", err)
+	}
+	if err := controller.SetWriteDeadline(deadline); err != nil {
+		logger.Warnf("Failed to extend the upload write deadline: %v", err)
+	}
+}
+
+// disableTimeouts lifts HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT for responses that legitimately
+// take long: status streams stay open for the whole job and archives may be large. The read
+// deadline has to go too, as net/http cancels the request once it passes, even with the body read.
+func disableTimeouts(w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(time.Time{}); err != nil {
+		logger.Warnf("Failed to lift the read deadline: %v", err)
+	}
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warnf("Failed to lift the write deadline: %v", err)
+	}
+}
+
+// shutdown stops every task with CancelReasonShutdown, gives them time to report it, then stops the server.
+func shutdown(server *http.Server) {
+	logger.Infof("Shutting down, stopping running and queued jobs...")
+	jobScheduler.Close() // Waiting on the scheduler while jobs are still submitted would miss them
+	stopServer(types.CancelReasonShutdown)
+
+	jobsDone := make(chan struct{})
+	go func() {
+		jobScheduler.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-time.After(shutdownTimeout):
+		logger.Infof("Jobs did not finish within %s", shutdownTimeout)
 	}
 
-	http.HandleFunc("/transcode", handleTranscode)                     // Main transcoding endpoint
-	http.HandleFunc("/transcode/status/", handleTranscodeStatusStream) // SSE endpoint
-	http.HandleFunc("/transcode/jobs/", handleCancelTranscode)         // Endpoint to cancel a transcoding job
-	http.HandleFunc("/status", handleServerStatus)                     // For checking server health
+	// Status streams only end once their task is removed or their client leaves, so any left open,
+	// e.g. of tasks on other instances, would hold up server.Shutdown until it times out
+	closeStatusStreams()
 
-	log.Printf("Server starting on port %s", serverPort)
-	log.Fatal(http.ListenAndServe(serverPort, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("Server shutdown failed: %v", err)
+	}
+	logger.Infof("Server stopped")
 }
 
 func handleTranscode(w http.ResponseWriter, r *http.Request) {
@@ -58,210 +293,1944 @@ func handleTranscode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Wrap the request body with MaxBytesReader to enforce the upload size limit
-	// This limit applies to the entire request body.
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadSize<<20)) // maxUploadSize in MB converted to bytes
+	taskID := uuid.New().String()
+
+	source, ok := saveUpload(w, r, taskID)
+	if !ok {
+		return
+	}
+	transcodeUpload(w, r, taskID, source)
+}
+
+// handleTranscodeJSON is the alternative to /transcode for clients that can't send multipart
+// forms: the file comes base64-encoded in a JSON body, which is otherwise handled like an upload.
+func handleTranscodeJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID := uuid.New().String()
+
+	source, ok := saveJSONUpload(w, r, taskID)
+	if !ok {
+		return
+	}
+	transcodeUpload(w, r, taskID, source)
+}
 
-	// Parse multipart form data.
-	// The maxMemory argument for ParseMultipartForm now dictates how much of the form data
-	// (within the MaxBytesReader limit) is stored in memory before spooling to disk.
-	// It can be the same as maxUploadSize or smaller if you want to control in-memory usage more granularly.
-	err := r.ParseMultipartForm(int64(maxUploadSize << 20)) // Using maxUploadSize for in-memory buffer as well
+// transcodeUpload starts transcoding a freshly saved upload with the options of the request,
+// unless an earlier upload of the same content already produced the output.
+func transcodeUpload(w http.ResponseWriter, r *http.Request, taskID string, source types.TranscoderSource) {
+	options, err := parseTranscodeOptions(r)
 	if err != nil {
-		var maxBytesErr *http.MaxBytesError
-		if errors.As(err, &maxBytesErr) {
-			// This error comes from http.MaxBytesReader
-			log.Printf("Upload failed: File exceeds maximum allowed size of %d MB. Actual size: %d bytes", maxUploadSize, maxBytesErr.Limit)
-			http.Error(w, fmt.Sprintf("Upload failed: File exceeds maximum allowed size of %d MB", maxUploadSize), http.StatusRequestEntityTooLarge)
-			return
-		}
-		// Handle other parsing errors
-		log.Printf("Failed to parse form: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to parse form: %v", err), http.StatusBadRequest)
+		removeUploads(source)
+		http.Error(w, fmt.Sprintf("Invalid transcoding options: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile(fileFormFieldName)
+	// An identical upload with the same options may already have been transcoded
+	key, err := utils.ArtifactKey(source.ContentHash, options)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get video file from form: %v", err), http.StatusBadRequest)
+		logger.Warnf("Not looking up earlier output of %s: %v", source.Filename, err)
+	} else if !options.KeepSource && reuseArtifact(w, r, taskID, source, key) { // A kept source needs a job to keep it
 		return
 	}
-	defer file.Close()
 
-	taskID := uuid.New().String()
+	startTranscode(w, r, taskID, source, options, key, true)
+}
+
+// reuseArtifact answers an upload whose output an earlier task already archived under key: the
+// new task gets that archive, without transcoding, and the upload is removed. It reports whether
+// it responded; if not, the upload has to be transcoded.
+func reuseArtifact(w http.ResponseWriter, r *http.Request, taskID string, source types.TranscoderSource, key string) bool {
+	cachedTaskID, ok := artifactIndex.Lookup(key)
+	if !ok {
+		return false
+	}
+	if err := utils.LinkOutputArchive(cachedTaskID, taskID); err != nil {
+		logger.Warnf("Archive of task %s can't be reused: %v", cachedTaskID, err)
+		artifactIndex.Forget(cachedTaskID)
+		return false
+	}
+	token, err := utils.GenerateToken()
+	if err != nil {
+		utils.RemoveOutputArchive(taskID)
+		logger.Warnf("Archive of task %s can't be reused: %v", cachedTaskID, err)
+		return false
+	}
+
+	removeUploads(source)
+	statusManager.StoreRetainedToken(taskID, token)
+	artifactIndex.Store(key, taskID) // The newest copy outlives the others
+	time.AfterFunc(archiveTTL, func() { expireArchive(taskID) })
+	logger.Infof("Received file: %s, identical to the upload of task %s. Assigned Task ID: %s, request ID: %s", source.Filename, cachedTaskID, taskID, middleware.RequestIDFromContext(r.Context()))
+
+	response := map[string]any{
+		"message":     fmt.Sprintf("%s was already transcoded with these options; its output is ready.", source.Filename),
+		"taskId":      taskID,
+		"token":       token,
+		"cached":      true,
+		"downloadUrl": fmt.Sprintf("/transcode/download/%s?token=%s", taskID, token),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	return true
+}
+
+// handleRerunTranscode starts a new job from the source kept by an earlier task (see keepSource),
+// with the options given in this request. The kept source is left in place for further reruns.
+func handleRerunTranscode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Invalid or missing admin token", http.StatusForbidden)
+		return
+	}
 
-	// Extract file info
-	fileName := header.Filename
-	extName := strings.ToLower(filepath.Ext(fileName))
-	uniqueFileName := fmt.Sprintf("%s%s", taskID, extName)
-	tempFilePath := filepath.Join(utils.UPLOAD_DIR, uniqueFileName)
+	sourceTaskID := strings.TrimPrefix(r.URL.Path, "/transcode/rerun/")
+	if sourceTaskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
 
-	// Save the uploaded file temporarily
-	dst, err := os.Create(tempFilePath)
+	sourcePath, err := utils.FindArchivedSource(sourceTaskID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create temp file: %v", err), http.StatusInternalServerError)
+		logger.Infof("No kept source for task %s: %v", sourceTaskID, err)
+		http.Error(w, fmt.Sprintf("No kept source found for task %s.", sourceTaskID), http.StatusNotFound)
 		return
 	}
-	defer dst.Close() // Close the file after writing
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+
+	options, err := parseTranscodeOptions(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid transcoding options: %v", err), http.StatusBadRequest)
 		return
 	}
+	options.KeepSource = false // The source is already kept
 
-	// Prepare TranscoderSource
 	source := types.TranscoderSource{
-		File:     tempFilePath,
-		Filename: fileName,
-		Extname:  extName,
+		File:     sourcePath,
+		Filename: filepath.Base(sourcePath),
+		Extname:  filepath.Ext(sourcePath),
+	}
+	taskID := uuid.New().String()
+	logger.Infof("Rerunning kept source of task %s as Task ID: %s", sourceTaskID, taskID)
+	startTranscode(w, r, taskID, source, options, "", false)
+}
+
+// startTranscode queues a transcoding job for source and responds with the task's ID and token.
+// If ownsSource is set, the source is an upload of this task and is removed (or kept, see keepSource) once the job ends.
+// The archived output is indexed under artifactKey, unless it's empty, for identical uploads to reuse.
+func startTranscode(w http.ResponseWriter, r *http.Request, taskID string, source types.TranscoderSource, options types.TranscodeOptions, artifactKey string, ownsSource bool) {
+	tempFilePath := source.File
+	fileName := source.Filename
+
+	// The token is only handed to this client and must be presented to follow or cancel the task
+	token, err := utils.GenerateToken()
+	if err != nil {
+		if ownsSource {
+			removeUploads(source)
+		}
+		http.Error(w, fmt.Sprintf("Failed to create task: %v", err), http.StatusInternalServerError)
+		return
 	}
 
-	// Create a new context that can be cancelled.
-	ctx, cancelFunc := context.WithCancel(context.Background())
+	// Create a new context that can be cancelled, either by the client or by the server shutting down.
+	ctx, cancelFunc := context.WithCancelCause(serverCtx)
 
 	// Store the cancel function in the status manager, keyed by taskID.
-	statusManager.StoreCancelFunc(taskID, cancelFunc)
+	statusManager.StoreCancelCauseFunc(taskID, cancelFunc)
+	statusManager.StoreToken(taskID, token)
+	statusManager.StoreRequestID(taskID, middleware.RequestIDFromContext(r.Context()))
+	if options.CancelOnDisconnect {
+		statusManager.SetCancelOnDisconnect(taskID, disconnectGrace)
+	}
+
+	logger.Infof("Received file: %s, saved to %s. Assigned Task ID: %s, request ID: %s", fileName, tempFilePath, taskID, middleware.RequestIDFromContext(r.Context()))
+
+	statusManager.SendUpdate(taskID, types.StatusUpdate{
+		Type:    "queued",
+		Message: fmt.Sprintf("Transcoding of %s queued with %s priority.", fileName, options.Priority),
+	})
 
-	log.Printf("Received file: %s, saved to %s. Assigned Task ID: %s", fileName, tempFilePath, taskID)
+	logTag := statusManager.LogTag(taskID)
 
-	// Initiate transcoding in a goroutine (non-blocking)
-	go func(ctx context.Context, currentTaskID string, currentTempFilePath string, currentFileName string) {
-		// This defer ensures the temp file is removed after the goroutine finishes,
+	// Queue the transcoding job; the scheduler runs it in the background once a worker is free (non-blocking)
+	_, err = jobScheduler.Submit(taskID, options.Priority, func() {
+		// This defer ensures the temp file is removed after the job finishes,
 		// regardless of whether transcoding succeeded or failed.
 		defer func() {
-			cancelFunc() // Ensure context resources are freed
-			if err := os.Remove(tempFilePath); err != nil {
-				log.Printf("[%s] Error removing temporary file %s: %v", taskID, tempFilePath, err)
-			} else {
-				log.Printf("[%s] Successfully removed temporary file: %s", taskID, tempFilePath)
+			cancelFunc(nil) // Ensure context resources are freed
+			if options.KeepSource {
+				// A kept source is moved away first, so removing the uploads below leaves it alone
+				if archivedPath, err := utils.ArchiveSource(taskID, source.File); err != nil {
+					logger.Errorf("[%s] Failed to keep source: %v", logTag, err)
+				} else {
+					logger.Infof("[%s] Kept source at %s", logTag, archivedPath)
+				}
+			}
+			if ownsSource {
+				removeUploads(source)
+				logger.Infof("[%s] Removed temporary file %s and %d uploaded parts", logTag, tempFilePath, len(source.Parts))
 			}
 
-			// Remove the task from StatusManager when it's completely done
+			// Remove the task from StatusManager when it's completely done. Its archive outlives the
+			// task record for archiveTTL, and so does the token needed to download it.
+			if _, err := utils.FindOutputArchive(taskID); err == nil {
+				statusManager.RetainToken(taskID)
+				if artifactKey != "" {
+					artifactIndex.Store(artifactKey, taskID)
+				}
+				time.AfterFunc(archiveTTL, func() { expireArchive(taskID) })
+			} else if info, err := os.Stat(utils.GetOutputDirectory(taskID)); err == nil && info.IsDir() {
+				// Failed and cancelled jobs leave no output folder, so this one is complete
+				if options.ZipOnDownload {
+					statusManager.RetainToken(taskID)
+					streamedOutputs.Store(taskID, struct{}{})
+				}
+				time.AfterFunc(archiveTTL, func() { expireOutput(taskID) })
+			}
+			if final, ok := statusManager.GetStatus(taskID); ok && services.IsFailureStatus(final.Type) {
+				err := failureRecorder.Record(services.FailureRecord{
+					TaskID:    taskID,
+					Filename:  fileName,
+					Status:    final.Type,
+					Message:   final.Message,
+					ErrorCode: final.Data.ErrorCode,
+					Reason:    final.Data.Reason,
+					Options:   options,
+					Timestamp: time.UnixMilli(final.Timestamp).UTC(),
+				})
+				if err != nil {
+					logger.Errorf("[%s] %v", logTag, err)
+				}
+			}
 			statusManager.RemoveTask(taskID)
-			log.Printf("[%s] Task removed from status manager.", taskID)
+			logger.Infof("[%s] Task removed from status manager.", logTag)
 		}()
 
-		log.Printf("[%s] Starting transcoding for %s in background...", taskID, fileName)
+		// The task may have been cancelled or expired while it was waiting in the queue
+		if types.CancelReasonFromContext(ctx) == types.CancelReasonExpired {
+			logger.Infof("[%s] Task expired before it started", logTag)
+			statusManager.SendUpdate(taskID, types.StatusUpdate{
+				Type:    "expired",
+				Message: fmt.Sprintf("Transcoding of %s expired after waiting more than %s in the queue", fileName, maxQueueWait),
+				Data:    types.TaskData{Reason: types.CancelReasonExpired},
+			})
+			return
+		}
+		if ctx.Err() != nil {
+			logger.Infof("[%s] Task was cancelled before it started: %v", logTag, context.Cause(ctx))
+			statusManager.SendUpdate(taskID, types.StatusUpdate{
+				Type:    "cancelled",
+				Message: fmt.Sprintf("Transcoding cancelled for %s", fileName),
+				Data:    types.TaskData{Reason: types.CancelReasonFromContext(ctx)},
+			})
+			return
+		}
+
+		logger.Infof("[%s] Starting transcoding for %s in background...", logTag, fileName)
 		startTime := time.Now()
 
-		transcoder := services.NewTranscoder(source, utils.OUTPUT_DIR, statusManager, taskID)
-		if transcoder == nil {
-			// If transcoder is nil, it means initialization failed for some reason.
+		// Several uploaded parts are stitched into a single source first
+		if len(source.Parts) > 0 {
+			statusManager.SendUpdate(taskID, types.StatusUpdate{
+				Type:    "progress",
+				Message: fmt.Sprintf("Concatenating %d uploaded parts...", len(source.Parts)),
+			})
+			// Run through the status manager, so the task can be paused while its parts are concatenated
+			concatCtx := utils.WithCommandRunner(ctx, statusManager.CommandRunner(taskID))
+			if err := utils.ConcatParts(concatCtx, source.Parts, source.File); err != nil {
+				if ctx.Err() != nil {
+					logger.Infof("[%s] Concatenation stopped: %v", logTag, context.Cause(ctx))
+					statusManager.SendUpdate(taskID, types.StatusUpdate{
+						Type:    "cancelled",
+						Message: fmt.Sprintf("Transcoding cancelled for %s", fileName),
+						Data:    types.TaskData{Reason: types.CancelReasonFromContext(ctx)},
+					})
+					return
+				}
+				logger.Errorf("[%s] Failed to concatenate parts: %v", logTag, err)
+				statusManager.SendUpdate(taskID, types.StatusUpdate{
+					Type:    "failed",
+					Message: fmt.Sprintf("Failed to concatenate uploaded parts: %v", err),
+				})
+				return
+			}
+		}
+
+		transcoder, err := services.NewTranscoder(source, options, utils.OUTPUT_DIR, statusManager, taskID)
+		if err != nil {
+			// Initialization failed, e.g. the source couldn't be probed or the options don't fit it.
 			// We need to send a failure status and ensure the task is cleaned up.
-			errMsg := fmt.Sprintf("Failed to initialize transcoder for %s", fileName)
-			log.Printf("[%s] %s", taskID, errMsg)
+			errMsg := fmt.Sprintf("Failed to initialize transcoder for %s: %v", fileName, err)
+			logger.Errorf("[%s] %s", logTag, errMsg)
+			code, msg := services.InitFailure(err)
+			if msg == "" {
+				msg = errMsg
+			}
 			statusManager.SendUpdate(taskID, types.StatusUpdate{
 				Type:    "failed",
-				Message: errMsg,
+				Message: msg,
+				Data:    types.TaskData{ErrorCode: code},
 			})
+			// Nothing should have been written yet, but don't leave a partial output folder behind
+			if err := utils.RemoveOutputDirectory(taskID); err != nil {
+				logger.Errorf("[%s] %v", logTag, err)
+			}
+			return
 		}
 		transcoder.Process(ctx)
 
 		elapsedTime := time.Since(startTime)
-		log.Printf("[%s] Transcoding for %s completed. Total time: %s", taskID, fileName, elapsedTime)
-	}(ctx, taskID, tempFilePath, fileName)
+		logger.Infof("[%s] Transcoding for %s completed. Total time: %s", logTag, fileName, elapsedTime)
+	})
+	if err != nil {
+		// The server is shutting down
+		logger.Warnf("[%s] Job not queued: %v", logTag, err)
+		statusManager.RemoveTask(taskID)
+		if ownsSource {
+			removeUploads(source)
+		}
+		http.Error(w, "The server is shutting down. Please try again shortly.", http.StatusServiceUnavailable)
+		return
+	}
 
 	response := map[string]any{
 		"message":         fmt.Sprintf("Transcoding of %s started successfully.", fileName),
 		"taskId":          taskID,
-		"statusStreamUrl": fmt.Sprintf("/transcode/status/%s", taskID),
+		"priority":        options.Priority.String(),
+		"token":           token,
+		"statusStreamUrl": fmt.Sprintf("/transcode/status/%s?token=%s", taskID, token),
 	}
-	w.WriteHeader(http.StatusAccepted) // 202 Accepted means processing has started
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted) // 202 Accepted means processing has started
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleTranscodeStatusStream(w http.ResponseWriter, r *http.Request) {
-	// Extract taskID from the URL path
-	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/status/")
-	if taskID == "" {
-		http.Error(w, "Task ID is required", http.StatusBadRequest)
-		return
+// expireQueuedJobs periodically expires the jobs that have been queued longer than maxQueueWait,
+// so jobs stuck behind a busy queue don't hold on to their uploads forever.
+func expireQueuedJobs() {
+	ticker := time.NewTicker(max(maxQueueWait/10, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		jobScheduler.ExpireQueued(maxQueueWait, func(taskID string) {
+			if err := statusManager.CancelTaskWithReason(taskID, types.CancelReasonExpired); err != nil {
+				logger.Warnf("[%s] Failed to expire queued task: %v", taskID, err)
+			}
+		})
 	}
+}
 
-	// Set headers for Server-Sent Events
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // TODO: Set CORS policy
+// expireArchive deletes the archive of a finished task once its download window is over, along
+// with any output folder left next to it.
+func expireArchive(taskID string) {
+	artifactIndex.Forget(taskID)
+	statusManager.ForgetToken(taskID)
+	archiveErr := utils.RemoveOutputArchive(taskID)
+	if archiveErr != nil {
+		logger.Errorf("[%s] Failed to remove expired archive: %v", taskID, archiveErr)
+	}
+	if err := utils.RemoveOutputDirectory(taskID); err != nil {
+		logger.Errorf("[%s] Failed to remove expired output: %v", taskID, err)
+		return
+	}
+	if archiveErr == nil {
+		logger.Infof("[%s] Archive expired after %s and was removed", taskID, archiveTTL)
+	}
+}
 
-	// Register the client with the StatusManager to receive updates
-	clientChan, err := statusManager.RegisterSubscriber(taskID)
-	if err != nil {
-		// Error occurred during registration, likely task not found or not active.
-		log.Printf("Error registering subscriber for task %s: %v", taskID, err)
-		// Respond with HTTP 404 Not Found if the task is not found or not active.
-		http.Error(w, fmt.Sprintf("Cannot subscribe to task status: %s. Task not found, not active, or already completed.", taskID), http.StatusNotFound)
+// expireOutput deletes the output folder a finished task kept unzipped, with zip=false or
+// zip=stream, once its download window is over.
+func expireOutput(taskID string) {
+	streamedOutputs.Delete(taskID)
+	statusManager.ForgetToken(taskID)
+	if err := utils.RemoveOutputDirectory(taskID); err != nil {
+		logger.Errorf("[%s] Failed to remove expired output: %v", taskID, err)
 		return
 	}
+	logger.Infof("[%s] Output expired after %s and was removed", taskID, archiveTTL)
+}
 
-	// Log the successful subscription
-	log.Printf("Client connected to status stream for Task ID: %s", taskID)
+// saveUpload streams the multipart upload from the request straight into the upload directory,
+// storing the video file under the given ID. Nothing is spooled to the OS temp directory, which may
+// sit on a small root filesystem. The remaining form fields are made available through r.FormValue.
+// On failure it writes the HTTP error itself and returns false.
+func saveUpload(w http.ResponseWriter, r *http.Request, id string) (types.TranscoderSource, bool) {
+	extendUploadDeadlines(w)
 
-	// Deregister the client when this handler function returns
-	defer statusManager.DeregisterSubscriber(taskID, clientChan)
+	// Wrap the request body with MaxBytesReader to enforce the upload size limit
+	// This limit applies to the entire request body.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadSize<<20)) // maxUploadSize in MB converted to bytes
 
-	// Keep the connection open and send updates
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeUploadError(w, http.StatusBadRequest, uploadErrMalformedForm, fmt.Sprintf("Failed to parse form: %v", err))
+		return types.TranscoderSource{}, false
+	}
+
+	var source types.TranscoderSource
+	var partHashes []string // SHA-256 of every uploaded part, computed while it's written
+	var partTypes []string  // Media type of every uploaded part, sniffed from its content
+	values := url.Values{}
+	valuesSize := 0
 	for {
-		select {
-		case update, ok := <-clientChan:
-			if !ok {
-				// Channel has been closed by StatusManager.RemoveTask, meaning the task is done.
-				log.Printf("[%s] Status channel closed by manager (task completed or removed). Client handler exiting for channel %p.", taskID, clientChan)
-				return // Exit loop, defer will call DeregisterSubscriber
-			}
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			removeUploads(source)
+			uploadError(w, err)
+			return types.TranscoderSource{}, false
+		}
 
-			// Marshal the update struct to JSON
-			jsonData, err := json.Marshal(update)
-			if err != nil {
-				log.Printf("[%s] Error marshalling status update: %v", taskID, err)
-				continue // Skip this update, but keep connection alive
+		switch {
+		case part.FormName() == fileFormFieldName && part.FileName() != "":
+			// Every video is saved as a part first; a single one is moved to the source path below
+			partPath := filepath.Join(utils.UPLOAD_DIR, fmt.Sprintf("%s_part%03d%s", id, len(source.Parts), strings.ToLower(filepath.Ext(part.FileName()))))
+			source.Parts = append(source.Parts, partPath) // Appended first so a partially written part is cleaned up too
+			if source.Filename == "" {
+				source.Filename = part.FileName()
 			}
-
-			// Send as an SSE event
-			_, err = fmt.Fprintf(w, "data: %s\n\n", jsonData)
-			if err != nil {
-				// Client disconnected or network error
-				log.Printf("[%s] Client disconnected or write error: %v", taskID, err)
-				return // Exit the loop and close handler
+			hash := sha256.New()
+			var written int64
+			written, err = saveUploadedFile(io.TeeReader(part, hash), partPath)
+			if err == nil && written == 0 {
+				err = errEmptyUpload
+			}
+			partHashes = append(partHashes, hex.EncodeToString(hash.Sum(nil)))
+			if err == nil {
+				var mediaType string
+				mediaType, err = checkUploadType(partPath, part.FileName())
+				partTypes = append(partTypes, mediaType)
 			}
 
-			// Flush the response writer to send the data immediately
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
+		case part.FileName() == "" || part.FormName() == chaptersFieldName:
+			// A chapters file is small text, read like a regular field
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, maxFormValuesSize-int64(valuesSize)+1))
+			valuesSize += len(value)
+			if err == nil && valuesSize > maxFormValuesSize {
+				err = fmt.Errorf("form fields exceed %d bytes", maxFormValuesSize)
 			}
+			values.Add(part.FormName(), string(value))
+		}
+		part.Close()
 
-		case <-r.Context().Done():
-			// Client disconnected
-			log.Printf("[%s] Client connection closed.", taskID)
-			return // Exit the loop and close handler
+		if err != nil {
+			removeUploads(source)
+			uploadError(w, err)
+			return types.TranscoderSource{}, false
 		}
 	}
-}
 
-func handleCancelTranscode(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "DELETE" {
-		http.Error(w, "Only DELETE requests are allowed", http.StatusMethodNotAllowed)
-		return
+	// Expose the form fields as ParseMultipartForm would, so the options can be read with r.FormValue
+	r.MultipartForm = &multipart.Form{Value: values}
+	r.PostForm = values
+	r.Form = r.URL.Query()
+	for name, fieldValues := range values {
+		r.Form[name] = append(r.Form[name], fieldValues...)
 	}
 
-	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/jobs/")
-	if taskID == "" {
-		http.Error(w, "Task ID is required", http.StatusBadRequest)
-		return
+	if len(source.Parts) == 0 {
+		writeUploadError(w, http.StatusBadRequest, uploadErrNoFile, fmt.Sprintf("No file provided in the %q form field", fileFormFieldName))
+		return types.TranscoderSource{}, false
 	}
 
-	log.Printf("Received cancellation request for Task ID: %s", taskID)
+	// A single upload is identified by its own hash, several by the hash of their hashes in order
+	source.ContentHash = partHashes[0]
+	if len(partHashes) > 1 {
+		sum := sha256.Sum256([]byte(strings.Join(partHashes, "\n")))
+		source.ContentHash = hex.EncodeToString(sum[:])
+	}
 
-	err := statusManager.CancelTask(taskID)
+	// A single upload is transcoded directly; several are kept as parts to be concatenated into File
+	if len(source.Parts) == 1 {
+		if err := storeSingleUpload(&source, id, partTypes[0]); err != nil {
+			removeUploads(source)
+			http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+			return types.TranscoderSource{}, false
+		}
+		return source, true
+	}
+
+	// Parts may differ in container, so they are merged into Matroska, which can hold any of them
+	source.MediaType = "video/x-matroska"
+	source.Extname = ".mkv"
+	source.File = filepath.Join(utils.UPLOAD_DIR, fmt.Sprintf("%s%s", id, source.Extname))
+	return source, true
+}
+
+// storeSingleUpload moves the only uploaded part of source to its File, named with the ID and the
+// extension of its content, which may differ from a valid but unusual name.
+func storeSingleUpload(source *types.TranscoderSource, id, mediaType string) error {
+	source.MediaType = mediaType
+	source.Extname = utils.MediaTypeExtension(mediaType)
+	if source.Extname == "" {
+		source.Extname = strings.ToLower(filepath.Ext(source.Filename))
+	}
+	source.File = filepath.Join(utils.UPLOAD_DIR, fmt.Sprintf("%s%s", id, source.Extname))
+	if err := os.Rename(source.Parts[0], source.File); err != nil {
+		return err
+	}
+	source.Parts = nil
+	return nil
+}
+
+// jsonUpload holds the fields of a /transcode/json body other than the base64 "data", which is
+// decoded straight to disk. Options carries the same fields as the /transcode form, with string,
+// number or boolean values.
+type jsonUpload struct {
+	Filename string                     `json:"filename"`
+	Options  map[string]json.RawMessage `json:"options"`
+}
+
+// saveJSONUpload stores the file of a /transcode/json body under the given ID, decoding its base64
+// data while the body is read, so neither the encoded nor the decoded file is held in memory. The
+// size limit of /transcode applies to the decoded file. The options are made available through
+// r.FormValue, as with saveUpload. On failure it writes the HTTP error itself and returns false.
+func saveJSONUpload(w http.ResponseWriter, r *http.Request, id string) (types.TranscoderSource, bool) {
+	// The encoded file is a third larger, and the body also carries the name and options
+	maxBodySize := int64(base64.StdEncoding.EncodedLen(maxUploadSize<<20) + maxFormValuesSize)
+	if r.ContentLength > maxBodySize {
+		uploadError(w, &http.MaxBytesError{Limit: maxBodySize}) // Rejected before reading any of it
+		return types.TranscoderSource{}, false
+	}
+	extendUploadDeadlines(w)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	var source types.TranscoderSource
+	hash := sha256.New()
+	var written int64
+	upload, err := readJSONUpload(r.Body, func(data io.Reader) error {
+		partPath := filepath.Join(utils.UPLOAD_DIR, fmt.Sprintf("%s_part000", id)) // The name may only follow the data
+		source.Parts = []string{partPath}
+		var err error
+		written, err = saveUploadedFile(io.TeeReader(io.LimitReader(data, maxUploadSize<<20+1), hash), partPath)
+		if err == nil && written > maxUploadSize<<20 {
+			err = &http.MaxBytesError{Limit: maxUploadSize << 20}
+		}
+		return err
+	})
+	if err == nil && len(source.Parts) == 0 {
+		writeUploadError(w, http.StatusBadRequest, uploadErrNoFile, `No file provided in the "data" field`)
+		return types.TranscoderSource{}, false
+	}
+	if err == nil && written == 0 {
+		err = errEmptyUpload
+	}
+	if err == nil && upload.Filename == "" {
+		err = errors.New(`the "filename" field is required`)
+	}
+	var values url.Values
+	if err == nil {
+		values, err = jsonUploadValues(upload.Options)
+	}
+	var mediaType string
+	if err == nil {
+		source.Filename = filepath.Base(upload.Filename)
+		mediaType, err = checkUploadType(source.Parts[0], source.Filename)
+	}
 	if err != nil {
-		log.Printf("Failed to cancel task %s: %v", taskID, err)
-		// We send a 404 Not Found if the task doesn't exist to be cancelled.
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+		removeUploads(source)
+		uploadError(w, err)
+		return types.TranscoderSource{}, false
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Task %s cancelled successfully.\n", taskID)
+	r.PostForm = values
+	r.Form = r.URL.Query()
+	for name, fieldValues := range values {
+		r.Form[name] = append(r.Form[name], fieldValues...)
+	}
+
+	source.ContentHash = hex.EncodeToString(hash.Sum(nil))
+	if err := storeSingleUpload(&source, id, mediaType); err != nil {
+		removeUploads(source)
+		http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+		return types.TranscoderSource{}, false
+	}
+	return source, true
+}
+
+// jsonUploadValues turns the options of a JSON upload into form values.
+func jsonUploadValues(options map[string]json.RawMessage) (url.Values, error) {
+	values := url.Values{}
+	for name, raw := range options {
+		var value string
+		switch {
+		case bytes.Equal(raw, []byte("null")):
+			continue
+		case json.Unmarshal(raw, &value) == nil:
+		case raw[0] == '{' || raw[0] == '[':
+			return nil, fmt.Errorf("option %q must be a string, number or boolean", name)
+		default:
+			value = string(raw)
+		}
+		values.Set(name, value)
+	}
+	return values, nil
+}
+
+// readJSONUpload reads a JSON object from body field by field. The base64 string under "data" is
+// handed to saveData, decoded, as it's read; the other fields are returned.
+func readJSONUpload(body io.Reader, saveData func(io.Reader) error) (jsonUpload, error) {
+	var upload jsonUpload
+	reader := bufio.NewReader(body)
+
+	// readValue decodes the next JSON value, then hands what the decoder read ahead back to reader
+	readValue := func(dst any) error {
+		decoder := json.NewDecoder(reader)
+		err := decoder.Decode(dst)
+		reader = bufio.NewReader(io.MultiReader(decoder.Buffered(), reader))
+		return err
+	}
+
+	if err := expectJSONDelim(reader, '{'); err != nil {
+		return upload, err
+	}
+	if next, err := peekJSON(reader); err != nil {
+		return upload, err
+	} else if next == '}' {
+		return upload, nil
+	}
+	seen := map[string]bool{}
+	for {
+		var key string
+		if err := readValue(&key); err != nil {
+			return upload, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if seen[key] {
+			return upload, fmt.Errorf("invalid JSON body: %q is given more than once", key)
+		}
+		seen[key] = true
+		if err := expectJSONDelim(reader, ':'); err != nil {
+			return upload, err
+		}
+
+		var err error
+		switch key {
+		case "data":
+			if err = expectJSONDelim(reader, '"'); err != nil {
+				return upload, fmt.Errorf(`invalid JSON body: "data" must be a base64 string: %w`, err)
+			}
+			err = saveData(base64.NewDecoder(base64.StdEncoding, &jsonStringReader{reader: reader}))
+			if errors.As(err, new(base64.CorruptInputError)) || errors.Is(err, io.ErrUnexpectedEOF) { // The latter for truncated data
+				err = fmt.Errorf("%w: %v", errInvalidBase64, err)
+			}
+		case "filename":
+			err = readValue(&upload.Filename)
+		case "options":
+			err = readValue(&upload.Options)
+		default:
+			err = readValue(new(json.RawMessage)) // Unknown fields are ignored, as with form fields
+		}
+		if err != nil {
+			return upload, err
+		}
+
+		next, err := peekJSON(reader)
+		if err != nil {
+			return upload, err
+		}
+		reader.ReadByte()
+		switch next {
+		case ',':
+		case '}':
+			return upload, nil
+		default:
+			return upload, fmt.Errorf("invalid JSON body: unexpected %q after %q", next, key)
+		}
+	}
+}
+
+// peekJSON skips whitespace and returns the next byte of reader without consuming it.
+func peekJSON(reader *bufio.Reader) (byte, error) {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("invalid JSON body: unexpected end of input")
+			}
+			return 0, err
+		}
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return next[0], nil
+		}
+	}
+}
+
+// expectJSONDelim consumes the next non-whitespace byte of reader, which must be delim.
+func expectJSONDelim(reader *bufio.Reader, delim byte) error {
+	next, err := peekJSON(reader)
+	if err != nil {
+		return err
+	}
+	if next != delim {
+		return fmt.Errorf("invalid JSON body: expected %q, got %q", delim, next)
+	}
+	reader.ReadByte()
+	return nil
+}
+
+// jsonStringReader reads the content of a JSON string whose opening quote was consumed, up to its
+// closing quote. Base64 needs no escapes other than the "\/" some encoders write for a slash.
+type jsonStringReader struct {
+	reader *bufio.Reader
+	done   bool // The closing quote was read
+}
+
+func (s *jsonStringReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !s.done {
+		c, err := s.reader.ReadByte()
+		if err == io.EOF {
+			err = errors.New("invalid JSON body: unterminated string")
+		}
+		if err != nil {
+			return n, err
+		}
+		switch c {
+		case '"':
+			s.done = true
+			continue
+		case '\\':
+			if c, err = s.reader.ReadByte(); err != nil || c != '/' {
+				return n, errors.New("invalid JSON body: base64 data may only escape '/'")
+			}
+		}
+		p[n] = c
+		n++
+	}
+	if n == 0 && s.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Codes sent as "errorCode" with rejected uploads, so clients can tell the failures apart.
+const (
+	uploadErrNoFile        = "no_file"            // The request has no file in the video field
+	uploadErrEmptyFile     = "empty_file"         // An uploaded file has no content
+	uploadErrMalformedForm = "malformed_form"     // The body isn't a readable multipart form, or JSON body for /transcode/json
+	uploadErrInvalidBase64 = "invalid_base64"     // The data of a JSON upload isn't valid base64
+	uploadErrTooLarge      = "file_too_large"     // The body exceeds maxUploadSize
+	uploadErrUnsupported   = "unsupported_type"   // An uploaded file isn't a video or audio file
+	uploadErrTypeMismatch  = "type_mismatch"      // An uploaded file's extension doesn't match its content
+	uploadErrUnavailable   = "ffmpeg_unavailable" // ffprobe is missing, so uploads can't be checked
+)
+
+// errEmptyUpload is returned for uploaded files without any content.
+var errEmptyUpload = errors.New("uploaded file is empty")
+
+// errInvalidBase64 is returned for JSON uploads whose data isn't valid base64.
+var errInvalidBase64 = errors.New("data is not valid base64")
+
+// uploadTypeError is returned for uploaded files whose content is rejected, with the upload error code to respond with.
+type uploadTypeError struct {
+	code    string
+	message string
+}
+
+func (e *uploadTypeError) Error() string { return e.message }
+
+// checkUploadType sniffs the media type of an uploaded file saved at path, rejecting content that
+// isn't media and names whose extension belongs to a different type than the content.
+func checkUploadType(path, filename string) (string, error) {
+	mediaType, err := utils.SniffMediaType(path)
+	if errors.Is(err, utils.ErrFFmpegNotInstalled) {
+		return "", err // Not the upload's fault
+	}
+	if err != nil || !utils.IsMediaType(mediaType) {
+		if err == nil {
+			err = fmt.Errorf("content is %s", mediaType)
+		}
+		return "", &uploadTypeError{uploadErrUnsupported, fmt.Sprintf("Upload failed: %s is not a video or audio file: %v", filename, err)}
+	}
+	if ext := filepath.Ext(filename); !utils.ExtensionMatchesMediaType(ext, mediaType) {
+		return "", &uploadTypeError{uploadErrTypeMismatch, fmt.Sprintf("Upload failed: %s is named %s but its content is %s", filename, ext, mediaType)}
+	}
+	return mediaType, nil
+}
+
+// uploadError responds to a failed upload, telling size limit violations, empty files and rejected content apart from malformed forms.
+func uploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *uploadTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		// This error comes from http.MaxBytesReader
+		writeUploadError(w, http.StatusRequestEntityTooLarge, uploadErrTooLarge, fmt.Sprintf("Upload failed: File exceeds maximum allowed size of %d MB", maxUploadSize))
+	case errors.Is(err, errInvalidBase64):
+		writeUploadError(w, http.StatusBadRequest, uploadErrInvalidBase64, fmt.Sprintf("Upload failed: %v", err))
+	case errors.Is(err, errEmptyUpload):
+		writeUploadError(w, http.StatusBadRequest, uploadErrEmptyFile, "Upload failed: The uploaded file is empty")
+	case errors.As(err, &typeErr):
+		writeUploadError(w, http.StatusUnsupportedMediaType, typeErr.code, typeErr.message)
+	case errors.Is(err, utils.ErrFFmpegNotInstalled):
+		logger.Errorf("Upload can't be checked: %v", err)
+		writeUploadError(w, http.StatusServiceUnavailable, uploadErrUnavailable, "Upload failed: ffmpeg is not installed on the server. Please try again later.")
+	default:
+		writeUploadError(w, http.StatusBadRequest, uploadErrMalformedForm, fmt.Sprintf("Failed to read upload: %v", err))
+	}
+}
+
+// writeUploadError logs a rejected upload and responds with a JSON body carrying the message and its error code.
+func writeUploadError(w http.ResponseWriter, status int, code, message string) {
+	logger.Warnf("Upload rejected (%s): %s", code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message, "errorCode": code})
+}
+
+// saveUploadedFile copies an uploaded file to dstPath and returns the number of bytes written.
+func saveUploadedFile(file io.Reader, dstPath string) (int64, error) {
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", dstPath, err)
+	}
+	defer dst.Close() // Close the file after writing
+	written, err := io.Copy(dst, file)
+	if err != nil {
+		return written, fmt.Errorf("failed to write %s: %w", dstPath, err)
+	}
+
+	return written, nil
+}
+
+// removeUploads deletes the uploaded file and any uploaded parts of a source.
+func removeUploads(source types.TranscoderSource) {
+	for _, path := range append([]string{source.File}, source.Parts...) {
+		utils.ForgetProbe(path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Errorf("Error removing uploaded file %s: %v", path, err)
+		}
+	}
+}
+
+// parseTranscodeOptions reads the optional transcoding settings from the already parsed form.
+// Fields that are not present keep their defaults.
+func parseTranscodeOptions(r *http.Request) (types.TranscodeOptions, error) {
+	options := types.DefaultTranscodeOptions()
+
+	// "stream" keeps the output folder, which the download endpoint zips on the fly
+	if strings.EqualFold(strings.TrimSpace(r.FormValue("zip")), "stream") {
+		options.Zip = false
+		options.ZipOnDownload = true
+	} else if err := parseBoolField(r, "zip", &options.Zip); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "smartCopy", &options.SmartCopy); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "iframePlaylist", &options.IFramePlaylist); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "verifyAlignment", &options.VerifyAlignment); err != nil {
+		return options, err
+	}
+
+	if err := parseBoolField(r, "throttle", &options.Throttle); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "sceneCut", &options.SceneCut); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "subtitles", &options.Subtitles); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "audioTracks", &options.AudioTracks); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "tonemap", &options.Tonemap); err != nil {
+		return options, err
+	}
+	if value := r.FormValue("deinterlace"); value != "" {
+		mode, err := types.ParseDeinterlaceMode(value)
+		if err != nil {
+			return options, err
+		}
+		options.Deinterlace = mode
+	}
+	if value := r.FormValue("denoise"); value != "" {
+		strength, err := utils.ParseDenoise(value)
+		if err != nil {
+			return options, err
+		}
+		options.Denoise = strength
+	}
+	if err := parsePadFields(r, &options); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "cancelOnDisconnect", &options.CancelOnDisconnect); err != nil {
+		return options, err
+	}
+	if err := parseBoolField(r, "keepSource", &options.KeepSource); err != nil {
+		return options, err
+	}
+	if options.KeepSource && !isAdmin(r) {
+		return options, fmt.Errorf("keepSource requires a valid X-Admin-Token header")
+	}
+	if err := parseIntField(r, "maxThreads", 1, runtime.NumCPU(), &options.MaxThreads); err != nil {
+		return options, err
+	}
+	if err := parseIntField(r, "maxRenditions", 1, len(types.Presets()), &options.MaxRenditions); err != nil {
+		return options, err
+	}
+	// Requests can only lower the server's ceiling
+	maxHeight := math.MaxInt
+	if utils.MAX_OUTPUT_HEIGHT > 0 {
+		maxHeight = utils.MAX_OUTPUT_HEIGHT
+	}
+	if err := parseIntField(r, "maxHeight", utils.MinLadderHeight(), maxHeight, &options.MaxHeight); err != nil {
+		return options, err
+	}
+
+	if value := r.FormValue("priority"); value != "" {
+		priority, err := types.ParseJobPriority(value)
+		if err != nil {
+			return options, err
+		}
+		options.Priority = priority
+	}
+
+	if err := parseTrimFields(r, &options); err != nil {
+		return options, err
+	}
+
+	if err := parsePlaylistFields(r, &options); err != nil {
+		return options, err
+	}
+
+	if err := parseCodecFields(r, &options); err != nil {
+		return options, err
+	}
+
+	if value := r.FormValue("segmentType"); value != "" {
+		segmentType, err := types.ParseSegmentType(value)
+		if err != nil {
+			return options, err
+		}
+		if err := utils.ValidateSegmentType(utils.CodecEncoders[options.Codec].Video, segmentType); err != nil {
+			return options, err
+		}
+		if segmentType == types.SegmentFMP4 && options.IFramePlaylist {
+			return options, fmt.Errorf("iframePlaylist is not supported with segmentType fmp4")
+		}
+		options.SegmentType = segmentType
+	}
+
+	if value := r.FormValue("layout"); value != "" {
+		layout, err := types.ParseOutputLayout(value)
+		if err != nil {
+			return options, err
+		}
+		if layout == types.LayoutFlat && options.Format == types.FormatDASH {
+			return options, fmt.Errorf("layout flat is not supported with format dash, whose renditions need their own folders")
+		}
+		options.Layout = layout
+	}
+
+	if err := parseAudioCodecField(r, &options); err != nil {
+		return options, err
+	}
+
+	if value := r.FormValue("failurePolicy"); value != "" {
+		policy, err := types.ParseFailurePolicy(value)
+		if err != nil {
+			return options, err
+		}
+		options.FailurePolicy = policy
+	}
+
+	if value := r.FormValue("audioFormat"); value != "" {
+		if err := utils.ValidateAudioFormat(value); err != nil {
+			return options, err
+		}
+		options.AudioFormat = value
+	}
+
+	if err := parsePreviewFields(r, &options); err != nil {
+		return options, err
+	}
+
+	if value := r.FormValue("pixFmt"); value != "" {
+		if _, err := utils.PixelFormatProfile(utils.CodecEncoders[options.Codec].Video, value); err != nil {
+			return options, err
+		}
+		options.PixFmt = value
+	}
+
+	if err := parseProfileFields(r, &options); err != nil {
+		return options, err
+	}
+
+	bitrates, err := utils.ParseBitrateOverrides(r.FormValue("bitrates"))
+	if err != nil {
+		return options, err
+	}
+	options.Bitrates = bitrates
+
+	if value := r.FormValue(chaptersFieldName); value != "" {
+		if options.Format == types.FormatDASH {
+			return options, fmt.Errorf("chapters are not supported with format dash")
+		}
+		chapters, err := utils.ParseChapters(value)
+		if err != nil {
+			return options, fmt.Errorf("chapters: %w", err)
+		}
+		options.Chapters = chapters
+	}
+
+	if err := parseIntField(r, "targetSize", 1, 1<<20, &options.TargetSizeMB); err != nil {
+		return options, err
+	}
+	if options.TargetSizeMB > 0 && len(options.Bitrates) > 0 {
+		return options, fmt.Errorf("targetSize can't be combined with bitrates")
+	}
+
+	if err := parseLadderField(r, &options); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// isAdmin reports whether the request carries the admin token in its X-Admin-Token header.
+func isAdmin(r *http.Request) bool {
+	token := r.Header.Get("X-Admin-Token")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// requestToken returns the task token sent with the request, or "" if there is none.
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("X-Task-Token"); token != "" {
+		return token
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorizeTask checks the task token sent with the request, as the X-Task-Token header, as a
+// bearer token in the Authorization header, or as a "token" query parameter (EventSource clients
+// can't set headers).
+// On failure it writes the HTTP error itself and returns false.
+func authorizeTask(w http.ResponseWriter, r *http.Request, taskID string) bool {
+	err := statusManager.Authorize(taskID, requestToken(r))
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, services.ErrTaskNotFound):
+		http.Error(w, fmt.Sprintf("Task %s not found, not active, or already completed.", taskID), http.StatusNotFound)
+	default:
+		logger.Warnf("Rejected access to task %s: %v", taskID, err)
+		http.Error(w, "Invalid or missing task token", http.StatusForbidden)
+	}
+	return false
+}
+
+// parseTrimFields reads startTime and either endTime or duration. Whether they fit within the
+// source is only known once it has been probed, which NewTranscoder checks.
+func parseTrimFields(r *http.Request, options *types.TranscodeOptions) error {
+	if value := r.FormValue("startTime"); value != "" {
+		start, err := utils.ParseTimestamp(value)
+		if err != nil {
+			return fmt.Errorf("startTime: %w", err)
+		}
+		options.StartTime = start
+	}
+
+	endValue, durationValue := r.FormValue("endTime"), r.FormValue("duration")
+	switch {
+	case endValue != "" && durationValue != "":
+		return fmt.Errorf("endTime and duration can't be used together")
+	case endValue != "":
+		end, err := utils.ParseTimestamp(endValue)
+		if err != nil {
+			return fmt.Errorf("endTime: %w", err)
+		}
+		if end <= options.StartTime {
+			return fmt.Errorf("endTime must be after startTime")
+		}
+		options.EndTime = end
+	case durationValue != "":
+		duration, err := utils.ParseTimestamp(durationValue)
+		if err != nil {
+			return fmt.Errorf("duration: %w", err)
+		}
+		if duration <= 0 {
+			return fmt.Errorf("duration must be positive")
+		}
+		options.EndTime = options.StartTime + duration
+	}
+
+	return nil
+}
+
+// parseLadderField reads the "ladder" preset, which picks the resolutions, bitrates and codec itself.
+func parseLadderField(r *http.Request, options *types.TranscodeOptions) error {
+	value := r.FormValue("ladder")
+	if value == "" {
+		return nil
+	}
+	for _, name := range []string{"codec", "bitrates", "targetSize", "maxRenditions"} {
+		if r.FormValue(name) != "" {
+			return fmt.Errorf("ladder can't be combined with %s, which the ladder sets", name)
+		}
+	}
+
+	ladder, err := utils.ResolveLadder(value)
+	if err != nil {
+		return err
+	}
+	options.Ladder = ladder
+	options.Codec = ladder[0].Codec // Every ladder is H.264, the default the codec-dependent options were checked against
+	options.Bitrates = make(map[types.Resolutions]int, len(ladder))
+	for _, spec := range ladder {
+		options.Bitrates[spec.Resolution] = spec.Bitrate
+	}
+	return nil
+}
+
+// parsePadFields reads "pad", the exact frame to letterbox the video into, and "padColor", the
+// color of the bars.
+func parsePadFields(r *http.Request, options *types.TranscodeOptions) error {
+	value := r.FormValue("pad")
+	color := r.FormValue("padColor")
+	if value == "" {
+		if color != "" {
+			return fmt.Errorf("padColor requires pad")
+		}
+		return nil
+	}
+
+	pad, err := utils.ParsePad(value)
+	if err != nil {
+		return err
+	}
+	if color != "" {
+		if pad.Color, err = utils.ParsePadColor(color); err != nil {
+			return err
+		}
+	}
+	options.Pad = pad
+	return nil
+}
+
+// parsePreviewFields reads "previewFormat" and its "previewStart" and "previewDuration" fields.
+// The start is relative to the trimmed portion, and is moved back if the clip wouldn't fit.
+func parsePreviewFields(r *http.Request, options *types.TranscodeOptions) error {
+	startValue, durationValue := r.FormValue("previewStart"), r.FormValue("previewDuration")
+	value := r.FormValue("previewFormat")
+	if value == "" {
+		if startValue != "" || durationValue != "" {
+			return fmt.Errorf("previewStart and previewDuration require previewFormat")
+		}
+		return nil
+	}
+	if err := utils.ValidatePreviewFormat(value); err != nil {
+		return err
+	}
+	options.PreviewFormat = value
+
+	options.PreviewDuration = utils.DefaultPreviewDuration
+	if durationValue != "" {
+		duration, err := utils.ParseTimestamp(durationValue)
+		if err != nil {
+			return fmt.Errorf("previewDuration: %w", err)
+		}
+		if duration <= 0 || duration > utils.MaxPreviewDuration {
+			return fmt.Errorf("previewDuration must be positive and at most %gs", utils.MaxPreviewDuration)
+		}
+		options.PreviewDuration = duration
+	}
+	if startValue != "" {
+		start, err := utils.ParseTimestamp(startValue)
+		if err != nil {
+			return fmt.Errorf("previewStart: %w", err)
+		}
+		options.PreviewStart = start
+	}
+
+	return nil
+}
+
+// parseBoolField sets dst from the named form field if it is present.
+func parseBoolField(r *http.Request, name string, dst *bool) error {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s must be a boolean, got %q", name, value)
+	}
+	*dst = parsed
+	return nil
+}
+
+// parseIntField sets dst from the named form field if it is present, requiring it to be within [minValue, maxValue].
+func parseIntField(r *http.Request, name string, minValue, maxValue int, dst *int) error {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s must be an integer, got %q", name, value)
+	}
+	if parsed < minValue || parsed > maxValue {
+		return fmt.Errorf("%s must be between %d and %d, got %d", name, minValue, maxValue, parsed)
+	}
+	*dst = parsed
+	return nil
+}
+
+// parsePlaylistFields reads the "playlistType" and "listSize" fields into options. "liveWindowSegments"
+// is accepted in place of listSize and selects a live playlist when no playlistType is given.
+// A sliding window only makes sense for live playlists, and I-frame playlists need every segment to be kept.
+func parsePlaylistFields(r *http.Request, options *types.TranscodeOptions) error {
+	sizeField := "listSize"
+	if r.FormValue("liveWindowSegments") != "" {
+		if r.FormValue("listSize") != "" {
+			return fmt.Errorf("liveWindowSegments and listSize can't be combined")
+		}
+		sizeField = "liveWindowSegments"
+		options.PlaylistType = types.PlaylistLive
+	}
+
+	if value := r.FormValue("playlistType"); value != "" {
+		playlistType, err := types.ParsePlaylistType(value)
+		if err != nil {
+			return err
+		}
+		options.PlaylistType = playlistType
+	}
+
+	if options.PlaylistType != types.PlaylistLive {
+		if r.FormValue(sizeField) != "" {
+			return fmt.Errorf("%s is only supported with playlistType live", sizeField)
+		}
+		return nil
+	}
+
+	if options.IFramePlaylist {
+		return fmt.Errorf("iframePlaylist is not supported with playlistType live")
+	}
+	options.ListSize = types.DefaultLiveListSize
+	return parseIntField(r, sizeField, 1, 1000, &options.ListSize)
+}
+
+// parseCodecFields reads codec, format and speed. Codecs other than h264 must be available in the
+// ffmpeg build. VP9 renditions are WebM, which only DASH can deliver; the HLS-only options
+// (iframePlaylist, verifyAlignment, segmentType and non-vod playlistType) are rejected with DASH.
+// AV1 renditions default to fmp4 segments, and their encoder's speed preset can be chosen.
+func parseCodecFields(r *http.Request, options *types.TranscodeOptions) error {
+	if value := r.FormValue("codec"); value != "" {
+		codec, err := types.ParseCodec(value)
+		if err != nil {
+			return err
+		}
+		if codec != types.CodecH264 {
+			capabilities, err := serverCapabilities()
+			if err != nil {
+				return fmt.Errorf("codec %s is not available: %w", codec, err)
+			}
+			if !slices.Contains(capabilities.Codecs, string(codec)) {
+				return fmt.Errorf("codec %s is not available on this server", codec)
+			}
+		}
+		options.Codec = codec
+		options.Format = utils.CodecFormats[codec][0] // Unless another format is requested
+	}
+
+	if options.Codec == types.CodecAV1 {
+		if options.IFramePlaylist {
+			return fmt.Errorf("iframePlaylist is not supported with codec av1, whose segments are fmp4")
+		}
+		options.SegmentType = types.SegmentFMP4
+		options.Speed = utils.DefaultAV1Speed
+		if err := parseIntField(r, "speed", utils.MinAV1Speed, utils.MaxAV1Speed, &options.Speed); err != nil {
+			return err
+		}
+	} else if r.FormValue("speed") != "" {
+		return fmt.Errorf("speed is only supported with codec av1")
+	}
+	if value := r.FormValue("format"); value != "" {
+		format, err := types.ParseOutputFormat(value)
+		if err != nil {
+			return err
+		}
+		options.Format = format
+	}
+	if err := utils.ValidateCodecFormat(options.Codec, options.Format); err != nil {
+		return err
+	}
+
+	if options.Format != types.FormatDASH {
+		return nil
+	}
+	switch {
+	case options.IFramePlaylist:
+		return fmt.Errorf("iframePlaylist is not supported with format dash")
+	case options.VerifyAlignment:
+		return fmt.Errorf("verifyAlignment is not supported with format dash")
+	case options.Subtitles:
+		return fmt.Errorf("subtitles is not supported with format dash")
+	case options.AudioTracks:
+		return fmt.Errorf("audioTracks is not supported with format dash")
+	case options.PlaylistType != types.PlaylistVOD:
+		return fmt.Errorf("playlistType %s is not supported with format dash", options.PlaylistType)
+	case r.FormValue("segmentType") != "":
+		return fmt.Errorf("segmentType is not supported with format dash, which always uses WebM segments")
+	}
+	return nil
+}
+
+// parseProfileFields reads the "profile" and "level" fields into options. Both only apply to the
+// H.264 encoder; VP9 and AV1 profiles follow from the pixel format.
+func parseProfileFields(r *http.Request, options *types.TranscodeOptions) error {
+	profile, level := r.FormValue("profile"), r.FormValue("level")
+	if profile == "" && level == "" {
+		return nil
+	}
+	if options.Codec != types.CodecH264 {
+		return fmt.Errorf("profile and level are only supported with codec h264")
+	}
+	if profile != "" {
+		profile = strings.ToLower(strings.TrimSpace(profile))
+		if err := utils.ValidateH264Profile(profile, options.PixFmt); err != nil {
+			return err
+		}
+		options.Profile = profile
+	}
+	if level != "" {
+		if _, err := utils.ParseH264Level(level); err != nil {
+			return err
+		}
+		options.Level = strings.TrimSpace(level)
+	}
+	return nil
+}
+
+// parseAudioCodecField reads "audioCodec" into options, defaulting to the audio codec of the video codec.
+// The codec must fit the segments it's carried in, so it's read after format and segmentType.
+func parseAudioCodecField(r *http.Request, options *types.TranscodeOptions) error {
+	options.AudioCodec = utils.CodecEncoders[options.Codec].Audio
+	if value := r.FormValue("audioCodec"); value != "" {
+		codec, err := types.ParseAudioCodec(value)
+		if err != nil {
+			return err
+		}
+		if codec != options.AudioCodec {
+			capabilities, err := serverCapabilities()
+			if err != nil {
+				return fmt.Errorf("audio codec %s is not available: %w", codec, err)
+			}
+			if !slices.Contains(capabilities.AudioCodecs, utils.AudioEncoders[codec]) {
+				return fmt.Errorf("audio codec %s is not available on this server", codec)
+			}
+		}
+		options.AudioCodec = codec
+	}
+	return utils.ValidateAudioCodec(options.AudioCodec, options.Format, options.SegmentType)
+}
+
+func handleTranscodeStatusStream(w http.ResponseWriter, r *http.Request) {
+	// Extract taskID from the URL path
+	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/status/")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Non-streaming clients can ask for a one-off JSON snapshot instead
+	if id, ok := strings.CutSuffix(taskID, "/snapshot"); ok {
+		handleTranscodeStatusSnapshot(w, r, id)
+		return
+	}
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+	disableTimeouts(w)
+
+	// Set headers for Server-Sent Events
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Register the client with the StatusManager to receive updates
+	clientChan, err := statusManager.RegisterSubscriber(taskID)
+	if err != nil {
+		// Error occurred during registration, likely task not found or not active.
+		logger.Warnf("Error registering subscriber for task %s: %v", taskID, err)
+		// Respond with HTTP 404 Not Found if the task is not found or not active.
+		http.Error(w, fmt.Sprintf("Cannot subscribe to task status: %s. Task not found, not active, or already completed.", taskID), http.StatusNotFound)
+		return
+	}
+
+	// Log the successful subscription
+	logger.Infof("Client connected to status stream for Task ID: %s", taskID)
+
+	// Deregister the client when this handler function returns
+	defer statusManager.DeregisterSubscriber(taskID, clientChan)
+
+	// Send a keepalive comment whenever the stream has been idle for a while, so proxies don't drop it.
+	// It is handled in the same loop as real updates, so writes to w never race.
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// Keep the connection open and send updates
+	for {
+		select {
+		case update, ok := <-clientChan:
+			if !ok {
+				// Channel has been closed by StatusManager.RemoveTask, meaning the task is done.
+				logger.Infof("[%s] Status channel closed by manager (task completed or removed). Client handler exiting for channel %p.", taskID, clientChan)
+				return // Exit loop, defer will call DeregisterSubscriber
+			}
+
+			// Marshal the update struct to JSON
+			jsonData, err := json.Marshal(update)
+			if err != nil {
+				logger.Errorf("[%s] Error marshalling status update: %v", taskID, err)
+				continue // Skip this update, but keep connection alive
+			}
+
+			// Send as an SSE event
+			_, err = fmt.Fprintf(w, "data: %s\n\n", jsonData)
+			if err != nil {
+				// Client disconnected or network error
+				logger.Warnf("[%s] Client disconnected or write error: %v", taskID, err)
+				return // Exit the loop and close handler
+			}
+
+			// Flush the response writer to send the data immediately
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			heartbeat.Reset(sseHeartbeatInterval)
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				logger.Warnf("[%s] Client disconnected or write error: %v", taskID, err)
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+
+		case <-r.Context().Done():
+			// Client disconnected
+			logger.Infof("[%s] Client connection closed.", taskID)
+			return // Exit the loop and close handler
+
+		case <-statusStreamsCtx.Done():
+			logger.Infof("[%s] Closing status stream, the server is shutting down.", taskID)
+			return
+		}
+	}
+}
+
+// handleTranscodeStatusWebSocket streams the same status updates as the SSE endpoint over a WebSocket.
+// Browsers can't set headers on WebSocket requests, so the token is usually passed as the token query parameter.
+func handleTranscodeStatusWebSocket(w http.ResponseWriter, r *http.Request) {
+	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/ws/")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+
+	// Subscribe before upgrading, so an unknown task still gets a regular HTTP error
+	clientChan, err := statusManager.RegisterSubscriber(taskID)
+	if err != nil {
+		logger.Warnf("Error registering subscriber for task %s: %v", taskID, err)
+		http.Error(w, fmt.Sprintf("Cannot subscribe to task status: %s. Task not found, not active, or already completed.", taskID), http.StatusNotFound)
+		return
+	}
+	defer statusManager.DeregisterSubscriber(taskID, clientChan)
+
+	ws, err := services.UpgradeWebSocket(w, r)
+	if err != nil {
+		logger.Warnf("[%s] WebSocket upgrade failed: %v", taskID, err)
+		return
+	}
+	logger.Infof("Client connected to WebSocket status stream for Task ID: %s", taskID)
+
+	// Ping idle connections, so proxies don't drop them and dead clients are noticed
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case update, ok := <-clientChan:
+			if !ok {
+				logger.Infof("[%s] Status channel closed by manager (task completed or removed). Closing WebSocket.", taskID)
+				ws.Close(services.WebSocketCloseNormal, "task finished")
+				return
+			}
+
+			jsonData, err := json.Marshal(update)
+			if err != nil {
+				logger.Errorf("[%s] Error marshalling status update: %v", taskID, err)
+				continue
+			}
+			if err := ws.WriteText(jsonData); err != nil {
+				logger.Warnf("[%s] Client disconnected or write error: %v", taskID, err)
+				ws.Close(services.WebSocketCloseGoingAway, "")
+				return
+			}
+			heartbeat.Reset(sseHeartbeatInterval)
+
+		case <-heartbeat.C:
+			if err := ws.WritePing(); err != nil {
+				logger.Warnf("[%s] Client disconnected or write error: %v", taskID, err)
+				ws.Close(services.WebSocketCloseGoingAway, "")
+				return
+			}
+
+		case <-ws.Done():
+			logger.Infof("[%s] WebSocket connection closed by client.", taskID)
+			return
+
+		case <-statusStreamsCtx.Done():
+			logger.Infof("[%s] Closing WebSocket status stream, the server is shutting down.", taskID)
+			ws.Close(services.WebSocketCloseGoingAway, "server shutting down")
+			return
+		}
+	}
+}
+
+func handleTranscodeStatusSnapshot(w http.ResponseWriter, r *http.Request, taskID string) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+
+	update, ok := statusManager.GetStatus(taskID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Task %s not found, not active, or already completed.", taskID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(update)
+}
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Admins see every job; anyone else only the jobs their task token grants access to
+	jobs := jobScheduler.Jobs()
+	if !isAdmin(r) {
+		token := requestToken(r)
+		if token == "" {
+			http.Error(w, "Invalid or missing task or admin token", http.StatusForbidden)
+			return
+		}
+		owned := make([]types.JobInfo, 0, 1)
+		for _, job := range jobs {
+			if statusManager.Authorize(job.TaskID, token) == nil {
+				owned = append(owned, job)
+			}
+		}
+		jobs = owned
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"jobs": jobs,
+	})
+}
+
+// handleJob serves a single job: GET returns its details and DELETE cancels it.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if taskID, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/transcode/jobs/"), "/"); ok {
+		handleJobAction(w, r, taskID, action)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleJobDetails(w, r)
+	case "DELETE":
+		handleCancelTranscode(w, r)
+	default:
+		http.Error(w, "Only GET and DELETE requests are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJobAction pauses or resumes the ffmpeg runs of a running job, for POST /transcode/jobs/<task_id>/pause
+// and /resume. Its ffmpeg processes are stopped and continued with SIGSTOP and SIGCONT.
+func handleJobAction(w http.ResponseWriter, r *http.Request, taskID, action string) {
+	if action != "pause" && action != "resume" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+
+	var err error
+	if action == "pause" {
+		err = statusManager.PauseTask(taskID)
+	} else {
+		err = statusManager.ResumeTask(taskID)
+	}
+	switch {
+	case errors.Is(err, services.ErrTaskNotFound):
+		http.Error(w, fmt.Sprintf("Task %s not found, not active, or already completed.", taskID), http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrTaskNotRunning), errors.Is(err, services.ErrTaskPaused), errors.Is(err, services.ErrTaskNotPaused):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errors.ErrUnsupported):
+		http.Error(w, "Pausing jobs is not supported on this platform", http.StatusNotImplemented)
+		return
+	case err != nil:
+		logger.Errorf("Failed to %s task %s: %v", action, taskID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	update := types.StatusUpdate{Type: "paused", Message: "Transcoding paused."}
+	note := ""
+	if action == "resume" {
+		update = types.StatusUpdate{Type: "resumed", Message: "Transcoding resumed."}
+	} else if deadline, ok := statusManager.Deadline(taskID); ok {
+		// Pausing doesn't postpone the timeout, so a forgotten pause can't hold a worker forever
+		remaining := max(0, time.Until(deadline))
+		note = fmt.Sprintf(" Its timeout keeps running while paused: it times out in %s.", remaining.Round(time.Second))
+		update.Message += note
+		update.Data.TimeoutSeconds = int64(remaining.Seconds())
+	}
+	statusManager.SendUpdate(taskID, update)
+	logger.Infof("Task %s %s", taskID, update.Type)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Task %s %s.%s\n", taskID, update.Type, note)
+}
+
+func handleJobDetails(w http.ResponseWriter, r *http.Request) {
+	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/jobs/")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+
+	// A removed task whose token was retained is still described by the output it left behind
+	update, ok := statusManager.GetStatus(taskID)
+	details := types.JobDetails{
+		JobInfo:     types.JobInfo{TaskID: taskID, State: "finished"},
+		Status:      update,
+		Resolutions: map[string]types.TaskData{},
+	}
+	if _, err := utils.FindOutputArchive(taskID); err == nil {
+		details.ArchiveAvailable = true
+	}
+	if _, ok := streamedOutputs.Load(taskID); ok {
+		details.ArchiveAvailable = true // Zipped when it's downloaded
+	}
+	if info, err := os.Stat(utils.GetOutputDirectory(taskID)); err == nil && info.IsDir() {
+		details.OutputAvailable = true
+	}
+	if !ok && !details.ArchiveAvailable && !details.OutputAvailable {
+		http.Error(w, fmt.Sprintf("Task %s not found, not active, or already completed.", taskID), http.StatusNotFound)
+		return
+	}
+
+	// Tasks running on another instance are only known through their last update
+	if resolutions, ok := statusManager.ResolutionProgress(taskID); ok && resolutions != nil {
+		details.Resolutions = resolutions
+	} else if update.Resolutions != nil {
+		details.Resolutions = update.Resolutions
+	}
+	if job, ok := jobScheduler.Job(taskID); ok {
+		details.JobInfo = job
+		since := job.SubmittedAt
+		if job.StartedAt > 0 {
+			since = job.StartedAt
+		}
+		details.ElapsedMs = time.Now().UnixMilli() - since
+		if statusManager.IsPaused(taskID) {
+			details.State = "paused"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(details)
+}
+
+func handleCancelTranscode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Only DELETE requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/jobs/")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	logger.Infof("Received cancellation request for Task ID: %s", taskID)
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+
+	err := statusManager.CancelTask(taskID)
+	if err != nil {
+		logger.Warnf("Failed to cancel task %s: %v", taskID, err)
+		// We send a 404 Not Found if the task doesn't exist to be cancelled.
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Task %s cancelled successfully.\n", taskID)
+}
+
+// handleDownload serves the zip archive of a finished task. http.ServeContent answers Range and
+// conditional requests, so download managers can resume interrupted downloads.
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET and HEAD requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID := strings.TrimPrefix(r.URL.Path, "/transcode/download/")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeTask(w, r, taskID) {
+		return
+	}
+	disableTimeouts(w)
+
+	if _, ok := streamedOutputs.Load(taskID); ok {
+		streamOutputZip(w, r, taskID)
+		return
+	}
+
+	archivePath, err := utils.FindOutputArchive(taskID)
+	if err != nil {
+		logger.Warnf("Download of task %s failed: %v", taskID, err)
+		http.Error(w, fmt.Sprintf("No archive available for task %s", taskID), http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(archivePath)))
+	http.ServeContent(w, r, filepath.Base(archivePath), info.ModTime(), file)
+}
+
+// streamOutputZip responds with a zip of the task's output folder, written as it's read. The size
+// isn't known upfront, so there is no Content-Length and no Range support.
+func streamOutputZip(w http.ResponseWriter, r *http.Request, taskID string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", taskID+".zip"))
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	// Once the first bytes are out, a failure can only cut the response short
+	if err := utils.WriteZip(w, utils.GetOutputDirectory(taskID)); err != nil {
+		logger.Errorf("[%s] Streaming the output zip failed: %v", taskID, err)
+	}
+}
+
+// mediaErrorStatus returns the status for a failure to process an upload: 503 if ffmpeg or ffprobe
+// is missing on the server, 422 otherwise as the upload is to blame.
+func mediaErrorStatus(err error) int {
+	if errors.Is(err, utils.ErrFFmpegNotInstalled) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnprocessableEntity
+}
+
+func handleMediaProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source, ok := saveUpload(w, r, uuid.New().String())
+	if !ok {
+		return
+	}
+	if len(source.Parts) > 0 {
+		removeUploads(source)
+		http.Error(w, "Only a single file can be probed at a time", http.StatusBadRequest)
+		return
+	}
+	// The probed file is not needed once we have its info
+	defer removeUploads(source)
+
+	info, err := utils.ProbeMedia(source.File)
+	if err != nil {
+		logger.Errorf("Failed to probe %s: %v", source.Filename, err)
+		http.Error(w, fmt.Sprintf("Failed to probe %s: %v", source.Filename, err), mediaErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleEstimate predicts how long transcoding the uploaded file with the given options would take
+// on this server, per rendition and in total, without starting a job. It takes the same form as /transcode.
+func handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID := uuid.New().String()
+	source, ok := saveUpload(w, r, taskID)
+	if !ok {
+		return
+	}
+	if len(source.Parts) > 0 {
+		removeUploads(source)
+		http.Error(w, "Only a single file can be estimated at a time", http.StatusBadRequest)
+		return
+	}
+	// The file is only probed, never transcoded
+	defer removeUploads(source)
+
+	options, err := parseTranscodeOptions(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid transcoding options: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	transcoder, err := services.NewTranscoder(source, options, utils.OUTPUT_DIR, statusManager, taskID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to estimate %s: %v", source.Filename, err), mediaErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(transcoder.Estimate(utils.BenchmarkEncodeSpeed()))
+}
+
+// binaryVersions holds the ffmpeg and ffprobe versions, looked up once since they don't change while running.
+var binaryVersions = sync.OnceValue(func() map[string]string {
+	versions := map[string]string{}
+	for name, path := range map[string]string{"ffmpeg": utils.FFMPEG_PATH, "ffprobe": utils.FFPROBE_PATH} {
+		v, err := utils.BinaryVersion(path)
+		if err != nil {
+			logger.Warnf("%v", err)
+			v = "unknown"
+		}
+		versions[name] = v
+	}
+	return versions
+})
+
+// serverCapabilities holds the options the ffmpeg build supports. It is probed at startup and cached,
+// since the binary doesn't change while the server runs.
+var serverCapabilities = sync.OnceValues(utils.DetectCapabilities)
+
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	capabilities, err := serverCapabilities()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, utils.ErrFFmpegNotInstalled) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("Failed to detect capabilities: %v", err), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(capabilities)
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	versions := binaryVersions()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+		"goVersion": runtime.Version(),
+		"ffmpeg":    versions["ffmpeg"],
+		"ffprobe":   versions["ffprobe"],
+	})
 }
 
 func handleServerStatus(w http.ResponseWriter, r *http.Request) {
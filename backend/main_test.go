@@ -0,0 +1,1117 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/middleware"
+	"github.com/PratikDev/transcoder/services"
+	"github.com/PratikDev/transcoder/services/utils"
+	"github.com/PratikDev/transcoder/types"
+	"github.com/google/uuid"
+)
+
+// useOutputDir points OUTPUT_DIR at a fresh temporary directory for the duration of the test.
+func useOutputDir(t *testing.T) string {
+	t.Helper()
+	previous := utils.OUTPUT_DIR
+	utils.OUTPUT_DIR = t.TempDir()
+	t.Cleanup(func() { utils.OUTPUT_DIR = previous })
+	return utils.OUTPUT_DIR
+}
+
+// writeOutput creates the output folder of taskID with a master playlist, and its archive if archived.
+func writeOutput(t *testing.T, taskID string, archived bool) {
+	t.Helper()
+	outputDir := utils.GetOutputDirectory(taskID)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "main.m3u8"), []byte("#EXTM3U\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if archived {
+		if err := os.WriteFile(outputDir+".zip", []byte("zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpireArchiveRemovesArchiveAndOutput(t *testing.T) {
+	useOutputDir(t)
+	taskID := uuid.NewString()
+	writeOutput(t, taskID, true)
+
+	expireArchive(taskID)
+
+	for _, path := range []string{utils.GetOutputDirectory(taskID), utils.GetOutputDirectory(taskID) + ".zip"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after expiry", filepath.Base(path))
+		}
+	}
+}
+
+func TestExpireOutputRemovesUnzippedOutput(t *testing.T) {
+	useOutputDir(t)
+	taskID := uuid.NewString()
+	writeOutput(t, taskID, false)
+	streamedOutputs.Store(taskID, struct{}{})
+
+	expireOutput(taskID)
+
+	if _, err := os.Stat(utils.GetOutputDirectory(taskID)); !os.IsNotExist(err) {
+		t.Error("output folder still exists after expiry")
+	}
+	if _, ok := streamedOutputs.Load(taskID); ok {
+		t.Error("task is still listed as a streamed output")
+	}
+}
+
+func TestSaveUploadedFile(t *testing.T) {
+	dstPath := filepath.Join(t.TempDir(), "upload.mp4")
+	written, err := saveUploadedFile(strings.NewReader("video data"), dstPath)
+	if err != nil || written != int64(len("video data")) {
+		t.Fatalf("saveUploadedFile = %d, %v", written, err)
+	}
+	if content, _ := os.ReadFile(dstPath); string(content) != "video data" {
+		t.Errorf("saved %q", content)
+	}
+
+	// A body over the size limit must still be recognized by uploadError once wrapped
+	tooLarge := http.MaxBytesReader(nil, io.NopCloser(strings.NewReader("0123456789")), 4)
+	_, err = saveUploadedFile(tooLarge, dstPath)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		t.Errorf("saveUploadedFile over the limit returned %v, want a wrapped MaxBytesError", err)
+	}
+
+	_, err = saveUploadedFile(strings.NewReader("x"), filepath.Join(t.TempDir(), "missing", "upload.mp4"))
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to create ") || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("saveUploadedFile into a missing folder returned %v, want a wrapped os.ErrNotExist", err)
+	}
+}
+
+// multipartRequest returns a POST /transcode request with a multipart body holding the given
+// form fields and, if fileName isn't empty, a video file with the given content.
+func multipartRequest(t *testing.T, fields map[string]string, fileName, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fileName != "" {
+		part, err := writer.CreateFormFile(fileFormFieldName, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, content)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/transcode", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func TestSaveUploadRejectsMissingAndEmptyFiles(t *testing.T) {
+	previous := utils.UPLOAD_DIR
+	utils.UPLOAD_DIR = t.TempDir()
+	t.Cleanup(func() { utils.UPLOAD_DIR = previous })
+
+	plain := httptest.NewRequest(http.MethodPost, "/transcode", strings.NewReader("video=clip.mp4"))
+	plain.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		code    string
+	}{
+		{name: "no video field", request: multipartRequest(t, map[string]string{"zip": "false"}, "", ""), code: uploadErrNoFile},
+		{name: "zero-byte file", request: multipartRequest(t, nil, "clip.mp4", ""), code: uploadErrEmptyFile},
+		{name: "not multipart", request: plain, code: uploadErrMalformedForm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			if _, ok := saveUpload(recorder, tt.request, uuid.NewString()); ok {
+				t.Fatal("saveUpload accepted the upload")
+			}
+			var body map[string]string
+			if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+				t.Fatalf("response isn't JSON: %v", err)
+			}
+			if recorder.Code != http.StatusBadRequest || body["errorCode"] != tt.code || body["error"] == "" {
+				t.Errorf("response = %d %v, want 400 with error code %s", recorder.Code, body, tt.code)
+			}
+		})
+	}
+
+	// Nothing of the rejected uploads is left behind
+	if entries, _ := os.ReadDir(utils.UPLOAD_DIR); len(entries) != 0 {
+		t.Errorf("upload directory holds %d files after rejected uploads", len(entries))
+	}
+}
+
+func TestSaveUploadChecksContentType(t *testing.T) {
+	previous := utils.UPLOAD_DIR
+	utils.UPLOAD_DIR = t.TempDir()
+	t.Cleanup(func() { utils.UPLOAD_DIR = previous })
+	const mp4 = "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2"
+
+	// A QuickTime name on MP4 content is fine, and the file is stored under its content's extension
+	source, ok := saveUpload(httptest.NewRecorder(), multipartRequest(t, nil, "clip.mov", mp4), "accepted")
+	if !ok {
+		t.Fatal("saveUpload rejected MP4 content named .mov")
+	}
+	if source.MediaType != "video/mp4" || source.Extname != ".mp4" || filepath.Base(source.File) != "accepted.mp4" {
+		t.Errorf("source = %+v, want video/mp4 stored as accepted.mp4", source)
+	}
+
+	recorder := httptest.NewRecorder()
+	if _, ok := saveUpload(recorder, multipartRequest(t, nil, "clip.mkv", mp4), "spoofed"); ok {
+		t.Fatal("saveUpload accepted MP4 content named .mkv")
+	}
+	var body map[string]string
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+		t.Fatalf("response isn't JSON: %v", err)
+	}
+	if recorder.Code != http.StatusUnsupportedMediaType || body["errorCode"] != uploadErrTypeMismatch {
+		t.Errorf("response = %d %v, want 415 with error code %s", recorder.Code, body, uploadErrTypeMismatch)
+	}
+	if entries, _ := os.ReadDir(utils.UPLOAD_DIR); len(entries) != 1 {
+		t.Errorf("upload directory holds %d files, want only the accepted upload", len(entries))
+	}
+}
+
+func TestSaveUploadWithoutFFprobe(t *testing.T) {
+	previousDir, previousProbe := utils.UPLOAD_DIR, utils.FFPROBE_PATH
+	utils.UPLOAD_DIR, utils.FFPROBE_PATH = t.TempDir(), filepath.Join(t.TempDir(), "ffprobe")
+	t.Cleanup(func() { utils.UPLOAD_DIR, utils.FFPROBE_PATH = previousDir, previousProbe })
+
+	// Content without a known signature has to be checked by ffprobe
+	recorder := httptest.NewRecorder()
+	if _, ok := saveUpload(recorder, multipartRequest(t, nil, "clip.ts", "no known signature"), "unchecked"); ok {
+		t.Fatal("saveUpload accepted an upload it couldn't check")
+	}
+	var body map[string]string
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+		t.Fatalf("response isn't JSON: %v", err)
+	}
+	if recorder.Code != http.StatusServiceUnavailable || body["errorCode"] != uploadErrUnavailable {
+		t.Errorf("response = %d %v, want 503 with error code %s", recorder.Code, body, uploadErrUnavailable)
+	}
+}
+
+// jsonUploadRequest returns a POST /transcode/json request with the given body.
+func jsonUploadRequest(body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/transcode/json", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func TestSaveJSONUpload(t *testing.T) {
+	previous := utils.UPLOAD_DIR
+	utils.UPLOAD_DIR = t.TempDir()
+	t.Cleanup(func() { utils.UPLOAD_DIR = previous })
+	content := "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2\xff\xff\xff"
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	if !strings.Contains(encoded, "/") {
+		t.Fatalf("%s has no slash to escape", encoded)
+	}
+
+	// The data comes first and with escaped slashes, so it's saved before the name is known
+	body := fmt.Sprintf(`{"data": "%s", "filename": "uploads/clip.mov", "options": {"maxRenditions": 2, "zip": false, "codec": "h264", "trim": null}, "extra": [1]}`,
+		strings.ReplaceAll(encoded, "/", `\/`))
+	request := jsonUploadRequest(body)
+	source, ok := saveJSONUpload(httptest.NewRecorder(), request, "accepted")
+	if !ok {
+		t.Fatal("saveJSONUpload rejected the upload")
+	}
+	if source.Filename != "clip.mov" || source.MediaType != "video/mp4" || filepath.Base(source.File) != "accepted.mp4" || len(source.Parts) != 0 {
+		t.Errorf("source = %+v, want clip.mov stored as accepted.mp4", source)
+	}
+	if saved, _ := os.ReadFile(source.File); string(saved) != content {
+		t.Errorf("saved %q, want the decoded data", saved)
+	}
+	if sum := sha256.Sum256([]byte(content)); source.ContentHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("ContentHash = %s, want the hash of the decoded data", source.ContentHash)
+	}
+	for name, want := range map[string]string{"maxRenditions": "2", "zip": "false", "codec": "h264", "trim": ""} {
+		if got := request.FormValue(name); got != want {
+			t.Errorf("FormValue(%s) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSaveJSONUploadRejects(t *testing.T) {
+	previous := utils.UPLOAD_DIR
+	utils.UPLOAD_DIR = t.TempDir()
+	t.Cleanup(func() { utils.UPLOAD_DIR = previous })
+	data := base64.StdEncoding.EncodeToString([]byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2"))
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "invalid base64", body: `{"filename": "clip.mp4", "data": "not*base64"}`, status: http.StatusBadRequest, code: uploadErrInvalidBase64},
+		{name: "truncated base64", body: `{"filename": "clip.mp4", "data": "AAA"}`, status: http.StatusBadRequest, code: uploadErrInvalidBase64},
+		{name: "data not a string", body: `{"filename": "clip.mp4", "data": 12}`, status: http.StatusBadRequest, code: uploadErrMalformedForm},
+		{name: "empty data", body: `{"filename": "clip.mp4", "data": ""}`, status: http.StatusBadRequest, code: uploadErrEmptyFile},
+		{name: "no data", body: `{"filename": "clip.mp4"}`, status: http.StatusBadRequest, code: uploadErrNoFile},
+		{name: "no filename", body: `{"data": "` + data + `"}`, status: http.StatusBadRequest, code: uploadErrMalformedForm},
+		{name: "duplicate data", body: `{"filename": "clip.mp4", "data": "` + data + `", "data": "` + data + `"}`, status: http.StatusBadRequest, code: uploadErrMalformedForm},
+		{name: "nested option", body: `{"filename": "clip.mp4", "data": "` + data + `", "options": {"trim": {"start": 1}}}`, status: http.StatusBadRequest, code: uploadErrMalformedForm},
+		{name: "not an object", body: `["clip.mp4"]`, status: http.StatusBadRequest, code: uploadErrMalformedForm},
+		{name: "unterminated", body: `{"filename": "clip.mp4", "data": "` + data, status: http.StatusBadRequest, code: uploadErrMalformedForm},
+		{name: "type mismatch", body: `{"filename": "clip.mkv", "data": "` + data + `"}`, status: http.StatusUnsupportedMediaType, code: uploadErrTypeMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			if _, ok := saveJSONUpload(recorder, jsonUploadRequest(tt.body), "rejected"); ok {
+				t.Fatal("saveJSONUpload accepted it")
+			}
+			var body map[string]string
+			if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+				t.Fatalf("response isn't JSON: %v", err)
+			}
+			if recorder.Code != tt.status || body["errorCode"] != tt.code {
+				t.Errorf("response = %d %v, want %d with error code %s", recorder.Code, body, tt.status, tt.code)
+			}
+			if entries, _ := os.ReadDir(utils.UPLOAD_DIR); len(entries) != 0 {
+				t.Errorf("upload directory holds %d files after a rejected upload", len(entries))
+			}
+		})
+	}
+
+	// A body announced as too large is rejected before any of it is read
+	request := jsonUploadRequest(`{"filename": "clip.mp4", "data": "` + data + `"}`)
+	request.ContentLength = 1 << 40
+	recorder := httptest.NewRecorder()
+	if _, ok := saveJSONUpload(recorder, request, "rejected"); ok || recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("saveJSONUpload of a %d byte body = %v, %d, want 413", request.ContentLength, ok, recorder.Code)
+	}
+}
+
+func TestMediaErrorStatus(t *testing.T) {
+	missing := utils.MissingBinary("ffprobe", exec.ErrNotFound)
+	if status := mediaErrorStatus(fmt.Errorf("failed to detect input duration: %w", missing)); status != http.StatusServiceUnavailable {
+		t.Errorf("mediaErrorStatus(missing ffprobe) = %d, want 503", status)
+	}
+	if status := mediaErrorStatus(errors.New("ffprobe command failed")); status != http.StatusUnprocessableEntity {
+		t.Errorf("mediaErrorStatus(probe failure) = %d, want 422", status)
+	}
+}
+
+func TestJobDetailsOfRemovedTaskWithOutput(t *testing.T) {
+	useOutputDir(t)
+	taskID := uuid.NewString()
+	writeOutput(t, taskID, true)
+	statusManager.StoreRetainedToken(taskID, "secret")
+	t.Cleanup(func() { statusManager.ForgetToken(taskID) })
+
+	request := httptest.NewRequest(http.MethodGet, "/transcode/jobs/"+taskID, nil)
+	request.Header.Set("X-Task-Token", "secret")
+	recorder := httptest.NewRecorder()
+	handleJobDetails(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	var details types.JobDetails
+	if err := json.NewDecoder(recorder.Body).Decode(&details); err != nil {
+		t.Fatal(err)
+	}
+	if details.TaskID != taskID || details.State != "finished" || !details.ArchiveAvailable || !details.OutputAvailable {
+		t.Errorf("details = %+v, want a finished task with its archive and output available", details)
+	}
+
+	// Once the output has expired, the task is gone even though its token is still known
+	expireArchive(taskID)
+	recorder = httptest.NewRecorder()
+	handleJobDetails(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status after expiry = %d, want 404", recorder.Code)
+	}
+}
+
+func TestPauseReportsTimeout(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("no sleep binary to pause")
+	}
+	taskID := uuid.NewString()
+	statusManager.StoreToken(taskID, "secret")
+	statusManager.StoreDeadline(taskID, time.Now().Add(10*time.Minute))
+
+	// Stands in for one of the task's ffmpeg runs
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		statusManager.RunProcess(taskID, exec.CommandContext(ctx, sleep, "30"))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		statusManager.RemoveTask(taskID)
+	})
+
+	action := func(name string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/transcode/jobs/"+taskID+"/"+name, nil)
+		request.Header.Set("X-Task-Token", "secret")
+		recorder := httptest.NewRecorder()
+		handleJobAction(recorder, request, taskID, name)
+		return recorder
+	}
+
+	// The process is tracked once it started; until then there's nothing to pause
+	recorder := action("pause")
+	for start := time.Now(); recorder.Code == http.StatusConflict && time.Since(start) < 5*time.Second; recorder = action("pause") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("pause status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, "timeout keeps running") || !strings.Contains(body, "times out in 10m0s") {
+		t.Errorf("pause response = %q, want the time left before the job times out", body)
+	}
+	update, _ := statusManager.GetStatus(taskID)
+	if update.Type != "paused" || update.Data.TimeoutSeconds < 590 || update.Data.TimeoutSeconds > 600 {
+		t.Errorf("update = %+v, want paused with about 600 timeoutSeconds", update)
+	}
+
+	if recorder := action("resume"); recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), "timeout") {
+		t.Errorf("resume = %d %q, want 200 without a timeout note", recorder.Code, recorder.Body)
+	}
+}
+
+func TestListJobsOnlyShowsOwnJobsWithoutAdminToken(t *testing.T) {
+	previousScheduler, previousAdminToken := jobScheduler, adminToken
+	jobScheduler, adminToken = services.NewScheduler(1, 0), "admin secret"
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		jobScheduler.Wait()
+		jobScheduler, adminToken = previousScheduler, previousAdminToken
+	})
+
+	mine, theirs := uuid.NewString(), uuid.NewString()
+	for taskID, token := range map[string]string{mine: "mine", theirs: "theirs"} {
+		statusManager.StoreToken(taskID, token)
+		t.Cleanup(func() { statusManager.RemoveTask(taskID) })
+		jobScheduler.Submit(taskID, types.PriorityNormal, func() { <-release })
+	}
+
+	listJobs := func(header, value string) (int, []types.JobInfo) {
+		request := httptest.NewRequest(http.MethodGet, "/transcode/jobs", nil)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		recorder := httptest.NewRecorder()
+		handleListJobs(recorder, request)
+		var body struct{ Jobs []types.JobInfo }
+		json.NewDecoder(recorder.Body).Decode(&body)
+		return recorder.Code, body.Jobs
+	}
+
+	if code, _ := listJobs("", ""); code != http.StatusForbidden {
+		t.Errorf("without a token: status = %d, want 403", code)
+	}
+	if code, jobs := listJobs("X-Task-Token", "mine"); code != http.StatusOK || len(jobs) != 1 || jobs[0].TaskID != mine {
+		t.Errorf("with a task token: status = %d, jobs = %+v, want only its own job", code, jobs)
+	}
+	if code, jobs := listJobs("X-Task-Token", "unknown"); code != http.StatusOK || len(jobs) != 0 {
+		t.Errorf("with an unknown token: status = %d, jobs = %+v, want none", code, jobs)
+	}
+	if code, jobs := listJobs("X-Admin-Token", "admin secret"); code != http.StatusOK || len(jobs) != 2 {
+		t.Errorf("with the admin token: status = %d, jobs = %+v, want both", code, jobs)
+	}
+}
+
+func TestFailedJobIsLogged(t *testing.T) {
+	useOutputDir(t)
+	logPath := filepath.Join(t.TempDir(), "logs", "failed_jobs.jsonl")
+	previousScheduler, previousRecorder := jobScheduler, failureRecorder
+	previousDir, previousProbe := utils.UPLOAD_DIR, utils.FFPROBE_PATH
+	jobScheduler, failureRecorder = services.NewScheduler(1, 0), services.NewFailureRecorder(logPath)
+	utils.UPLOAD_DIR, utils.FFPROBE_PATH = t.TempDir(), filepath.Join(t.TempDir(), "ffprobe")
+	t.Cleanup(func() {
+		jobScheduler, failureRecorder = previousScheduler, previousRecorder
+		utils.UPLOAD_DIR, utils.FFPROBE_PATH = previousDir, previousProbe
+	})
+
+	// Without ffprobe the job fails as soon as it starts
+	taskID := uuid.NewString()
+	source := types.TranscoderSource{File: filepath.Join(utils.UPLOAD_DIR, taskID+".mp4"), Filename: "clip.mp4"}
+	if err := os.WriteFile(source.File, []byte("not really video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := types.DefaultTranscodeOptions()
+	options.MaxRenditions = 2
+	startTranscode(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/transcode", nil), taskID, source, options, "", true)
+	jobScheduler.Wait()
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("failure log: %v", err)
+	}
+	var record services.FailureRecord
+	if err := json.Unmarshal(data, &record); err != nil || bytes.Count(data, []byte("\n")) != 1 {
+		t.Fatalf("failure log = %q, %v, want one record", data, err)
+	}
+	if record.TaskID != taskID || record.Filename != "clip.mp4" || record.Status != "failed" || record.ErrorCode != "ffmpeg_unavailable" ||
+		record.Options.MaxRenditions != 2 || record.Timestamp.IsZero() {
+		t.Errorf("record = %+v, want the failed job", record)
+	}
+	if _, ok := statusManager.GetStatus(taskID); ok {
+		t.Error("the failed task is still in the status manager")
+	}
+}
+
+func TestKeepSource(t *testing.T) {
+	for _, keepSource := range []bool{false, true} {
+		t.Run(fmt.Sprint("keepSource=", keepSource), func(t *testing.T) {
+			useOutputDir(t)
+			previousScheduler, previousProbe := jobScheduler, utils.FFPROBE_PATH
+			previousUploads, previousArchive := utils.UPLOAD_DIR, utils.SOURCE_ARCHIVE_DIR
+			jobScheduler, utils.FFPROBE_PATH = services.NewScheduler(1, 0), filepath.Join(t.TempDir(), "ffprobe")
+			utils.UPLOAD_DIR, utils.SOURCE_ARCHIVE_DIR = t.TempDir(), t.TempDir()
+			t.Cleanup(func() {
+				jobScheduler, utils.FFPROBE_PATH = previousScheduler, previousProbe
+				utils.UPLOAD_DIR, utils.SOURCE_ARCHIVE_DIR = previousUploads, previousArchive
+			})
+
+			// Without ffprobe the job fails as soon as it starts, and the source is cleaned up either way
+			taskID := uuid.NewString()
+			source := types.TranscoderSource{File: filepath.Join(utils.UPLOAD_DIR, taskID+".mp4"), Filename: "clip.mp4"}
+			if err := os.WriteFile(source.File, []byte("not really video"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			options := types.DefaultTranscodeOptions()
+			options.KeepSource = keepSource
+			startTranscode(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/transcode", nil), taskID, source, options, "", true)
+			jobScheduler.Wait()
+
+			if _, err := os.Stat(source.File); !os.IsNotExist(err) {
+				t.Errorf("the temporary upload is still there: %v", err)
+			}
+			archivedPath, err := utils.FindArchivedSource(taskID)
+			if !keepSource {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("FindArchivedSource = %q, %v, want no kept source", archivedPath, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindArchivedSource: %v", err)
+			}
+			if filepath.Dir(archivedPath) != utils.SOURCE_ARCHIVE_DIR {
+				t.Errorf("kept source at %s, want it in %s", archivedPath, utils.SOURCE_ARCHIVE_DIR)
+			}
+			if data, err := os.ReadFile(archivedPath); err != nil || string(data) != "not really video" {
+				t.Errorf("kept source = %q, %v, want the upload", data, err)
+			}
+		})
+	}
+}
+
+func TestParseKeepSourceNeedsAdmin(t *testing.T) {
+	previous := adminToken
+	adminToken = "admin secret"
+	t.Cleanup(func() { adminToken = previous })
+
+	if _, err := parseTranscodeOptions(formRequest("keepSource=true")); err == nil {
+		t.Error("keepSource was accepted without an admin token")
+	}
+	r := formRequest("keepSource=true")
+	r.Header.Set("X-Admin-Token", "admin secret")
+	if options, err := parseTranscodeOptions(r); err != nil || !options.KeepSource {
+		t.Errorf("parseTranscodeOptions(keepSource=true) as admin = %v, %v, want the source kept", options.KeepSource, err)
+	}
+}
+
+func TestStatusStreamIsNeverGzipped(t *testing.T) {
+	taskID := uuid.NewString()
+	statusManager.StoreToken(taskID, "secret")
+	statusManager.SendUpdate(taskID, types.StatusUpdate{Type: "queued", Message: "queued"})
+	t.Cleanup(func() { statusManager.RemoveTask(taskID) })
+	server := httptest.NewServer(middleware.Gzip(handleTranscodeStatusStream))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/transcode/status/"+taskID, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	request.Header.Set("X-Task-Token", "secret")
+	response, err := http.DefaultTransport.RoundTrip(request) // No transparent decompression
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.Header.Get("Content-Encoding") != "" || !strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("headers = %v, want an uncompressed event stream", response.Header)
+	}
+	// The current status arrives while the stream is still open, so it was flushed through the wrapper
+	reader := bufio.NewReader(response.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before the current status: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if !strings.Contains(line, `"queued"`) {
+				t.Errorf("first event = %q, want the queued status", line)
+			}
+			break
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		query   string
+		want    string
+	}{
+		{name: "header", headers: map[string]string{"X-Task-Token": "secret"}, want: "secret"},
+		{name: "bearer", headers: map[string]string{"Authorization": "Bearer secret"}, want: "secret"},
+		{name: "bearer in lowercase", headers: map[string]string{"Authorization": "bearer secret"}, want: "secret"},
+		{name: "other scheme", headers: map[string]string{"Authorization": "Basic c2VjcmV0"}, want: ""},
+		{name: "query", query: "?token=secret", want: "secret"},
+		{name: "header before query", headers: map[string]string{"X-Task-Token": "header"}, query: "?token=query", want: "header"},
+		{name: "none", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/transcode/status/task"+tt.query, nil)
+			for key, value := range tt.headers {
+				request.Header.Set(key, value)
+			}
+			if got := requestToken(request); got != tt.want {
+				t.Errorf("requestToken = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// formRequest returns a POST /transcode request carrying the given URL-encoded form.
+func formRequest(form string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/transcode", strings.NewReader(form))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestParseTrimFields(t *testing.T) {
+	tests := []struct {
+		form       string
+		start, end float64
+		wantErr    bool
+	}{
+		{form: "", start: 0, end: 0},
+		{form: "startTime=01:30", start: 90, end: 0},
+		{form: "startTime=10&endTime=00:00:25.5", start: 10, end: 25.5},
+		{form: "startTime=10&duration=5", start: 10, end: 15},
+		{form: "endTime=20", start: 0, end: 20},
+		{form: "startTime=10&endTime=10", wantErr: true},
+		{form: "startTime=10&endTime=5", wantErr: true},
+		{form: "endTime=20&duration=5", wantErr: true},
+		{form: "duration=0", wantErr: true},
+		{form: "startTime=-1", wantErr: true},
+		{form: "endTime=soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		var options types.TranscodeOptions
+		err := parseTrimFields(formRequest(tt.form), &options)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTrimFields(%q) accepted %+v", tt.form, options)
+			}
+			continue
+		}
+		if err != nil || options.StartTime != tt.start || options.EndTime != tt.end {
+			t.Errorf("parseTrimFields(%q) = %v-%v, %v; want %v-%v", tt.form, options.StartTime, options.EndTime, err, tt.start, tt.end)
+		}
+	}
+}
+
+func TestParseSegmentType(t *testing.T) {
+	tests := []struct {
+		form    string
+		want    types.SegmentType
+		wantErr bool
+	}{
+		{form: "", want: types.SegmentTS},
+		{form: "segmentType=FMP4", want: types.SegmentFMP4},
+		{form: "segmentType=fmp4&iframePlaylist=true", wantErr: true},
+		{form: "segmentType=mkv", wantErr: true},
+	}
+	for _, tt := range tests {
+		options, err := parseTranscodeOptions(formRequest(tt.form))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTranscodeOptions(%q) accepted segment type %q", tt.form, options.SegmentType)
+			}
+			continue
+		}
+		if err != nil || options.SegmentType != tt.want {
+			t.Errorf("parseTranscodeOptions(%q) = %q, %v; want %q", tt.form, options.SegmentType, err, tt.want)
+		}
+	}
+}
+
+func TestParsePlaylistFields(t *testing.T) {
+	tests := []struct {
+		form         string
+		wantType     types.PlaylistType
+		wantListSize int
+		wantErr      bool
+	}{
+		{form: "", wantType: types.PlaylistVOD},
+		{form: "playlistType=EVENT", wantType: types.PlaylistEvent},
+		{form: "playlistType=live", wantType: types.PlaylistLive, wantListSize: types.DefaultLiveListSize},
+		{form: "playlistType=live&listSize=12", wantType: types.PlaylistLive, wantListSize: 12},
+		{form: "liveWindowSegments=8", wantType: types.PlaylistLive, wantListSize: 8},
+		{form: "playlistType=dvr", wantErr: true},
+		{form: "listSize=12", wantErr: true},
+		{form: "playlistType=event&listSize=12", wantErr: true},
+		{form: "playlistType=live&listSize=0", wantErr: true},
+		{form: "liveWindowSegments=8&listSize=8", wantErr: true},
+		{form: "playlistType=live&iframePlaylist=true", wantErr: true},
+	}
+	for _, tt := range tests {
+		options, err := parseTranscodeOptions(formRequest(tt.form))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTranscodeOptions(%q) accepted playlist type %q", tt.form, options.PlaylistType)
+			}
+			continue
+		}
+		if err != nil || options.PlaylistType != tt.wantType || options.ListSize != tt.wantListSize {
+			t.Errorf("parseTranscodeOptions(%q) = %q (list size %d), %v; want %q (list size %d)", tt.form, options.PlaylistType, options.ListSize, err, tt.wantType, tt.wantListSize)
+		}
+	}
+}
+
+func TestParseAudioCodecField(t *testing.T) {
+	tests := []struct {
+		form    string
+		want    types.AudioCodec
+		wantErr bool
+	}{
+		{form: "", want: types.AudioAAC}, // The default of H.264
+		{form: "audioCodec=aac", want: types.AudioAAC},
+		{form: "audioCodec=%20AAC%20", want: types.AudioAAC},
+		{form: "audioCodec=mp3", wantErr: true},
+	}
+	for _, tt := range tests {
+		options := types.DefaultTranscodeOptions()
+		err := parseAudioCodecField(formRequest(tt.form), &options)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseAudioCodecField(%q) accepted %s", tt.form, options.AudioCodec)
+			}
+			continue
+		}
+		if err != nil || options.AudioCodec != tt.want {
+			t.Errorf("parseAudioCodecField(%q) = %s, %v, want %s", tt.form, options.AudioCodec, err, tt.want)
+		}
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		form    string
+		want    types.OutputLayout
+		wantErr bool
+	}{
+		{form: "", want: types.LayoutNested},
+		{form: "layout=nested", want: types.LayoutNested},
+		{form: "layout=FLAT", want: types.LayoutFlat},
+		{form: "layout=tiled", wantErr: true},
+	}
+	for _, tt := range tests {
+		options, err := parseTranscodeOptions(formRequest(tt.form))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTranscodeOptions(%q) accepted layout %s", tt.form, options.Layout)
+			}
+			continue
+		}
+		if err != nil || options.Layout != tt.want {
+			t.Errorf("parseTranscodeOptions(%q) = %s, %v, want %s", tt.form, options.Layout, err, tt.want)
+		}
+	}
+}
+
+func TestParseProfileFields(t *testing.T) {
+	tests := []struct {
+		form           string
+		codec          types.Codec
+		pixFmt         string
+		profile, level string
+		wantErr        bool
+	}{
+		{form: ""},
+		{form: "profile=Baseline", profile: "baseline"},
+		{form: "profile=main&level=3.1", profile: "main", level: "3.1"},
+		{form: "level=%204.0%20", level: "4.0"},
+		{form: "profile=extended", wantErr: true},
+		{form: "level=3.3", wantErr: true},
+		{form: "profile=high", pixFmt: "yuv422p", wantErr: true},
+		{form: "level=4", codec: types.CodecVP9, wantErr: true},
+		{form: "", codec: types.CodecVP9}, // Nothing to reject when neither is set
+	}
+	for _, tt := range tests {
+		options := types.DefaultTranscodeOptions()
+		if tt.codec != "" {
+			options.Codec = tt.codec
+		}
+		if tt.pixFmt != "" {
+			options.PixFmt = tt.pixFmt
+		}
+		err := parseProfileFields(formRequest(tt.form), &options)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseProfileFields(%q) accepted profile %q, level %q", tt.form, options.Profile, options.Level)
+			}
+			continue
+		}
+		if err != nil || options.Profile != tt.profile || options.Level != tt.level {
+			t.Errorf("parseProfileFields(%q) = %q, %q, %v, want %q, %q", tt.form, options.Profile, options.Level, err, tt.profile, tt.level)
+		}
+	}
+}
+
+func TestParseLadderField(t *testing.T) {
+	options := types.DefaultTranscodeOptions()
+	if err := parseLadderField(formRequest("ladder=Mobile"), &options); err != nil {
+		t.Fatalf("parseLadderField: %v", err)
+	}
+	want := map[types.Resolutions]int{types.P480: 1200, types.P360: 700}
+	if len(options.Ladder) != 2 || options.Codec != types.CodecH264 || !maps.Equal(options.Bitrates, want) {
+		t.Errorf("options = %+v, want the mobile ladder's renditions and bitrates", options)
+	}
+
+	for _, form := range []string{
+		"ladder=tv",
+		"ladder=web&codec=h264",
+		"ladder=web&bitrates=720:3000",
+		"ladder=web&targetSize=50",
+		"ladder=web&maxRenditions=2",
+	} {
+		options := types.DefaultTranscodeOptions()
+		if err := parseLadderField(formRequest(form), &options); err == nil {
+			t.Errorf("parseLadderField(%q) accepted it", form)
+		}
+	}
+}
+
+func TestParseMaxRenditions(t *testing.T) {
+	presets := len(types.Presets())
+	for _, maxRenditions := range []int{1, presets} {
+		form := fmt.Sprintf("maxRenditions=%d", maxRenditions)
+		if options, err := parseTranscodeOptions(formRequest(form)); err != nil || options.MaxRenditions != maxRenditions {
+			t.Errorf("parseTranscodeOptions(%q) = %d, %v, want %d", form, options.MaxRenditions, err, maxRenditions)
+		}
+	}
+	for _, form := range []string{"maxRenditions=0", "maxRenditions=-1", fmt.Sprintf("maxRenditions=%d", presets+1), "maxRenditions=all"} {
+		if _, err := parseTranscodeOptions(formRequest(form)); err == nil {
+			t.Errorf("parseTranscodeOptions(%q) accepted it with %d presets", form, presets)
+		}
+	}
+}
+
+func TestParseMaxHeight(t *testing.T) {
+	old := utils.MAX_OUTPUT_HEIGHT
+	t.Cleanup(func() { utils.MAX_OUTPUT_HEIGHT = old })
+
+	utils.MAX_OUTPUT_HEIGHT = 0
+	options, err := parseTranscodeOptions(formRequest("maxHeight=2160"))
+	if err != nil || options.MaxHeight != 2160 {
+		t.Errorf("parseTranscodeOptions(maxHeight=2160) = %d, %v, want 2160 without a server ceiling", options.MaxHeight, err)
+	}
+
+	utils.MAX_OUTPUT_HEIGHT = 1080
+	options, err = parseTranscodeOptions(formRequest("maxHeight=720"))
+	if err != nil || options.MaxHeight != 720 {
+		t.Errorf("parseTranscodeOptions(maxHeight=720) = %d, %v, want 720", options.MaxHeight, err)
+	}
+	for _, form := range []string{"maxHeight=1440", "maxHeight=100", "maxHeight=tall"} {
+		if _, err := parseTranscodeOptions(formRequest(form)); err == nil {
+			t.Errorf("parseTranscodeOptions(%q) accepted it with a 1080 ceiling", form)
+		}
+	}
+}
+
+func TestParsePadFields(t *testing.T) {
+	for form, want := range map[string]types.PadSpec{
+		"":                                 {},
+		"pad=1080x1080":                    {Width: 1080, Height: 1080, Color: "black"},
+		"pad=1080x1920&padColor=%231a1a1a": {Width: 1080, Height: 1920, Color: "0x1a1a1a"},
+	} {
+		options, err := parseTranscodeOptions(formRequest(form))
+		if err != nil || options.Pad != want {
+			t.Errorf("parseTranscodeOptions(%q) = %+v, %v, want pad %+v", form, options.Pad, err, want)
+		}
+	}
+	for _, form := range []string{"pad=1081x1080", "pad=square", "pad=1080x1080&padColor=beige", "padColor=black"} {
+		if _, err := parseTranscodeOptions(formRequest(form)); err == nil {
+			t.Errorf("parseTranscodeOptions(%q) accepted it", form)
+		}
+	}
+}
+
+func TestParsePixelFormat(t *testing.T) {
+	options, err := parseTranscodeOptions(formRequest("pixFmt=yuv420p10le"))
+	if err != nil || options.PixFmt != "yuv420p10le" {
+		t.Errorf("parseTranscodeOptions(pixFmt=yuv420p10le) = %q, %v, want yuv420p10le", options.PixFmt, err)
+	}
+	for _, form := range []string{"pixFmt=nv12", "pixFmt=rgb24"} {
+		if _, err := parseTranscodeOptions(formRequest(form)); err == nil {
+			t.Errorf("parseTranscodeOptions(%q) accepted a format libx264 can't encode", form)
+		}
+	}
+}
+
+func TestParseCancelOnDisconnect(t *testing.T) {
+	for form, want := range map[string]bool{"": false, "cancelOnDisconnect=true": true, "cancelOnDisconnect=false": false} {
+		options, err := parseTranscodeOptions(formRequest(form))
+		if err != nil || options.CancelOnDisconnect != want {
+			t.Errorf("parseTranscodeOptions(%q) = %v, %v, want cancelOnDisconnect %v", form, options.CancelOnDisconnect, err, want)
+		}
+	}
+	if _, err := parseTranscodeOptions(formRequest("cancelOnDisconnect=maybe")); err == nil {
+		t.Error("parseTranscodeOptions accepted cancelOnDisconnect=maybe")
+	}
+}
+
+func TestDownloadServesRanges(t *testing.T) {
+	useOutputDir(t)
+	taskID := uuid.NewString()
+	writeOutput(t, taskID, false)
+	archive := make([]byte, 1000)
+	for i := range archive {
+		archive[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(utils.GetOutputDirectory(taskID)+".zip", archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	statusManager.StoreRetainedToken(taskID, "secret")
+	t.Cleanup(func() { statusManager.ForgetToken(taskID) })
+
+	download := func(token, byteRange string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/transcode/download/"+taskID, nil)
+		request.Header.Set("X-Task-Token", token)
+		if byteRange != "" {
+			request.Header.Set("Range", byteRange)
+		}
+		recorder := httptest.NewRecorder()
+		handleDownload(recorder, request)
+		return recorder
+	}
+
+	full := download("secret", "")
+	if full.Code != http.StatusOK || !bytes.Equal(full.Body.Bytes(), archive) || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("full download: status %d, %d bytes, Accept-Ranges %q", full.Code, full.Body.Len(), full.Header().Get("Accept-Ranges"))
+	}
+
+	partial := download("secret", "bytes=100-199")
+	if partial.Code != http.StatusPartialContent {
+		t.Fatalf("ranged download status = %d, want 206", partial.Code)
+	}
+	if got := partial.Header().Get("Content-Range"); got != "bytes 100-199/1000" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if !bytes.Equal(partial.Body.Bytes(), archive[100:200]) {
+		t.Error("ranged download returned the wrong bytes")
+	}
+
+	// Resuming the end of the file
+	if tail := download("secret", "bytes=900-"); tail.Code != http.StatusPartialContent || !bytes.Equal(tail.Body.Bytes(), archive[900:]) {
+		t.Errorf("open-ended range: status %d, %d bytes", tail.Code, tail.Body.Len())
+	}
+	if beyond := download("secret", "bytes=2000-"); beyond.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range beyond the archive: status %d, want 416", beyond.Code)
+	}
+	if denied := download("wrong", "bytes=0-9"); denied.Code == http.StatusPartialContent || denied.Code == http.StatusOK {
+		t.Errorf("download with a wrong token: status %d", denied.Code)
+	}
+}
+
+// readWebSocketFrame reads a single unmasked server frame and returns its opcode and payload.
+func readWebSocketFrame(t *testing.T, conn net.Conn, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(reader, ext[:]); err != nil {
+			t.Fatalf("read frame length: %v", err)
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestStatusWebSocketStreamsUpdatesUntilTaskEnds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handleTranscodeStatusWebSocket))
+	defer server.Close()
+
+	taskID := uuid.NewString()
+	statusManager.StoreToken(taskID, "secret")
+	statusManager.SendUpdate(taskID, types.StatusUpdate{Type: "progress", Message: "queued"})
+	t.Cleanup(func() { statusManager.RemoveTask(taskID) })
+
+	// A wrong token is refused before upgrading
+	response, err := http.Get(server.URL + "/transcode/ws/" + taskID + "?token=wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("status with a wrong token = %d, want 403", response.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	handshake := "GET /transcode/ws/" + taskID + "?token=secret HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	if response, err := http.ReadResponse(reader, nil); err != nil || response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake = %v, %v, want 101", response, err)
+	}
+
+	// The latest update is sent right away, later ones as they happen
+	statusManager.SendUpdate(taskID, types.StatusUpdate{Type: "progress", Message: "encoding"})
+	for _, want := range []string{"queued", "encoding"} {
+		opcode, payload := readWebSocketFrame(t, conn, reader)
+		var update types.StatusUpdate
+		if opcode != 0x1 || json.Unmarshal(payload, &update) != nil || update.Message != want {
+			t.Fatalf("received opcode %#x with %s, want a text message with the %q update", opcode, payload, want)
+		}
+	}
+
+	statusManager.RemoveTask(taskID)
+	opcode, payload := readWebSocketFrame(t, conn, reader)
+	if opcode != 0x8 || len(payload) < 2 || binary.BigEndian.Uint16(payload) != services.WebSocketCloseNormal {
+		t.Fatalf("received opcode %#x with %v once the task ended, want a normal close", opcode, payload)
+	}
+}
+
+// zipContents returns the files of a zip archive by name, failing the test if it can't be read.
+func zipContents(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	files := map[string]string{}
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", file.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read %s: %v", file.Name, err)
+		}
+		files[file.Name] = string(content)
+	}
+	return files
+}
+
+func TestStreamedZipMatchesArchive(t *testing.T) {
+	useOutputDir(t)
+	taskID := uuid.NewString()
+	writeOutput(t, taskID, false)
+	outputDir := utils.GetOutputDirectory(taskID)
+	for name, content := range map[string]string{
+		"720P/index.m3u8":        "#EXTM3U\n#EXTINF:4,\nsegment0.ts\n",
+		"720P/segment0.ts":       strings.Repeat("\x47video", 4096),
+		"subtitles/0.vtt":        "WEBVTT\n",
+		"chapters.json":          "[]",
+		"deeply/nested/file.bin": "\x00\x01\x02",
+	} {
+		path := filepath.Join(outputDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "output.zip")
+	if err := utils.ZipOutputFolder(outputDir, archivePath); err != nil {
+		t.Fatalf("ZipOutputFolder: %v", err)
+	}
+	archived, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	streamOutputZip(recorder, httptest.NewRequest(http.MethodGet, "/transcode/download/"+taskID, nil), taskID)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, Content-Type = %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	want, got := zipContents(t, archived), zipContents(t, recorder.Body.Bytes())
+	if len(want) != 6 {
+		t.Fatalf("archive holds %d files, want 6", len(want))
+	}
+	if len(got) != len(want) {
+		t.Errorf("streamed zip holds %d files, archive %d", len(got), len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s differs between the streamed zip and the archive", name)
+		}
+	}
+}
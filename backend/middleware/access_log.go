@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/PratikDev/transcoder/logger"
+)
+
+// accessLogWriter records the status code and body size written through it.
+// It passes Flush and Hijack through, so SSE and WebSocket handlers keep working.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (a *accessLogWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessLogWriter) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessLogWriter) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to set deadlines.
+func (a *accessLogWriter) Unwrap() http.ResponseWriter { return a.ResponseWriter }
+
+func (a *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		a.hijacked = true
+		a.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// loggedPath is the path of u with its query, if any. Values of "token" are redacted, as the task
+// token is sent that way by clients that can't set headers.
+func loggedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query := u.Query()
+	for key := range query {
+		if key == "token" {
+			query[key] = []string{"REDACTED"}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// AccessLog wraps next, logging one line per request with its method, path, status, response size,
+// duration, client IP and request ID as key=value pairs. Streaming responses (SSE and WebSockets) stay open for
+// as long as the client follows a task, so their duration is logged as "connected" rather than
+// "duration" to keep them apart from regular request latencies.
+func AccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		next(aw, r)
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK // Nothing was written, which net/http answers with 200
+		}
+		elapsed := time.Since(start).Round(time.Microsecond)
+
+		mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if aw.hijacked || mediaType == "text/event-stream" {
+			logger.Infof("access method=%s path=%s status=%d bytes=%d connected=%s client=%s request_id=%s stream=true",
+				r.Method, loggedPath(r.URL), status, aw.bytes, elapsed, ClientIP(r), RequestIDFromContext(r.Context()))
+			return
+		}
+		logger.Infof("access method=%s path=%s status=%d bytes=%d duration=%s client=%s request_id=%s",
+			r.Method, loggedPath(r.URL), status, aw.bytes, elapsed, ClientIP(r), RequestIDFromContext(r.Context()))
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLoggedPathRedactsTokens(t *testing.T) {
+	tests := map[string]string{
+		"/transcode/status/abc":                           "/transcode/status/abc",
+		"/transcode/ws/abc?token=secret":                  "/transcode/ws/abc?token=REDACTED",
+		"/transcode/ws/abc?lastEventId=3&token=a&token=b": "/transcode/ws/abc?lastEventId=3&token=REDACTED",
+	}
+	for raw, want := range tests {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loggedPath(u); got != want {
+			t.Errorf("loggedPath(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, Authorization, X-Task-Token, X-Admin-Token, X-Request-ID"
+	corsExposedHeaders = "X-Request-ID"
+	corsMaxAge         = 10 * time.Minute // How long browsers may cache a preflight response
+)
+
+// CORS applies a cross-origin policy based on a list of allowed origins.
+// With the wildcard origin "*" any site may call the API, but without credentials;
+// with explicit origins the request's origin is echoed back and credentials are allowed.
+type CORS struct {
+	allowAll bool
+	origins  map[string]bool
+}
+
+// NewCORS creates a CORS policy from a comma-separated list of origins, e.g.
+// "https://app.example.com,https://admin.example.com" or "*".
+func NewCORS(allowedOrigins string) *CORS {
+	c := &CORS{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			c.allowAll = true
+		default:
+			c.origins[origin] = true
+		}
+	}
+	return c
+}
+
+// Middleware wraps next, adding CORS headers for allowed origins and answering preflight requests.
+// Preflight requests from origins that aren't allowed are rejected with 403 Forbidden.
+func (c *CORS) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		allowed := origin != "" && c.allows(origin)
+		if allowed {
+			if c.origins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// allows reports whether requests from origin may be served.
+func (c *CORS) allows(origin string) bool {
+	return c.allowAll || c.origins[origin]
+}
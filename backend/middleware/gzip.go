@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// uncompressedContentTypes are never gzipped: event streams must reach the client unbuffered,
+// and archives are already compressed.
+var uncompressedContentTypes = map[string]bool{
+	"text/event-stream": true,
+	"application/zip":   true,
+}
+
+// gzipResponseWriter compresses the response body, deciding on the first write
+// whether the response's content type should be compressed at all.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz       *gzip.Writer
+	decided  bool
+	compress bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.decided {
+		g.decide(status)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.compress {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client, so streaming handlers keep working through the wrapper.
+func (g *gzipResponseWriter) Flush() {
+	if g.compress {
+		g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to set deadlines.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+// decide picks whether to compress based on the status and the headers set by the handler.
+func (g *gzipResponseWriter) decide(status int) {
+	g.decided = true
+
+	header := g.Header()
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if status == http.StatusNoContent || status == http.StatusNotModified ||
+		header.Get("Content-Encoding") != "" || uncompressedContentTypes[mediaType] {
+		return
+	}
+
+	g.compress = true
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length") // The compressed length isn't known up front
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+}
+
+// close flushes the remaining compressed data, if any.
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// Gzip wraps next, compressing its responses for clients that accept gzip.
+// Event streams and zip archives are passed through untouched.
+func Gzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the client listed gzip in its Accept-Encoding header.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
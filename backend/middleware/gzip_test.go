@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gzipRequest returns a GET request accepting gzip.
+func gzipRequest() *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Accept-Encoding", "gzip, deflate")
+	return request
+}
+
+func TestGzipCompressesJSON(t *testing.T) {
+	body := `{"jobs":[` + strings.Repeat(`{"state":"queued"},`, 50) + `{}]}`
+	handler := Gzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "999")
+		io.WriteString(w, body)
+	})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, gzipRequest())
+
+	header := recorder.Header()
+	if header.Get("Content-Encoding") != "gzip" || header.Get("Vary") != "Accept-Encoding" || header.Get("Content-Length") != "" {
+		t.Fatalf("headers = %v, want gzip encoding, Vary: Accept-Encoding and no Content-Length", header)
+	}
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("body isn't gzipped: %v", err)
+	}
+	if decoded, err := io.ReadAll(reader); err != nil || string(decoded) != body {
+		t.Errorf("decoded body = %q, %v, want the handler's JSON", decoded, err)
+	}
+
+	// Clients that don't accept gzip get the body as is, still varying on Accept-Encoding
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("Vary") != "Accept-Encoding" || recorder.Body.String() != body {
+		t.Errorf("without Accept-Encoding: headers = %v, body = %q, want it uncompressed", recorder.Header(), recorder.Body)
+	}
+}
+
+func TestGzipSkipsZipArchives(t *testing.T) {
+	archive := "PK\x03\x04 already compressed"
+	recorder := httptest.NewRecorder()
+	Gzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Length", "26")
+		io.WriteString(w, archive)
+	})(recorder, gzipRequest())
+
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("Content-Length") != "26" || recorder.Body.String() != archive {
+		t.Errorf("headers = %v, body = %q, want the archive untouched", recorder.Header(), recorder.Body)
+	}
+}
+
+func TestGzipPassesEventStreamsThrough(t *testing.T) {
+	sent := make(chan struct{})
+	server := httptest.NewServer(Gzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		// The client must see the event while the handler is still running
+		select {
+		case <-sent:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request) // No transparent decompression
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("event stream sent with Content-Encoding %q", response.Header.Get("Content-Encoding"))
+	}
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Fatalf("first line = %q, %v, want the flushed event before the handler returns", line, err)
+	}
+	close(sent)
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "\ndata: second\n\n" {
+		t.Errorf("rest of the stream = %q", rest)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, GZIP;q=0.5": true,
+		"br, gzip; q=0":       false,
+		"identity":            false,
+		"x-gzip":              false,
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(request); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
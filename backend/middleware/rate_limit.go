@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PratikDev/transcoder/logger"
+)
+
+// bucketIdleTimeout is how long a client's bucket is kept after its last request.
+const bucketIdleTimeout = 10 * time.Minute
+
+// tokenBucket tracks the available requests of a single client.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimiter is a per-client token bucket rate limiter.
+// Each client (identified by IP) may make burst requests at once, refilled at requestsPerMinute.
+type RateLimiter struct {
+	ratePerSecond float64
+	burst         float64
+	buckets       map[string]*tokenBucket
+	mu            sync.Mutex
+}
+
+// NewRateLimiter creates a RateLimiter allowing requestsPerMinute per client with the given burst.
+func NewRateLimiter(requestsPerMinute, burst int) *RateLimiter {
+	rl := &RateLimiter{
+		ratePerSecond: float64(requestsPerMinute) / 60,
+		burst:         float64(max(burst, 1)),
+		buckets:       make(map[string]*tokenBucket),
+	}
+	go rl.pruneLoop()
+	return rl
+}
+
+// Allow takes a token from the client's bucket. If none is available it returns false
+// and how long the client has to wait for the next token.
+func (rl *RateLimiter) Allow(client string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := rl.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[client] = bucket
+	}
+
+	// Refill for the time elapsed since the last request
+	bucket.tokens = min(rl.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rl.ratePerSecond)
+	bucket.lastSeen = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / rl.ratePerSecond * float64(time.Second))
+	return false, wait
+}
+
+// Middleware wraps next, rejecting requests over the limit with 429 Too Many Requests.
+func (rl *RateLimiter) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := ClientIP(r)
+
+		allowed, wait := rl.Allow(client)
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			logger.Infof("Rate limit exceeded for %s on %s, retry after %ds", client, r.URL.Path, retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too many requests, please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// pruneLoop periodically forgets clients that haven't made a request in a while.
+func (rl *RateLimiter) pruneLoop() {
+	ticker := time.NewTicker(bucketIdleTimeout)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rl.mu.Lock()
+		for client, bucket := range rl.buckets {
+			if time.Since(bucket.lastSeen) > bucketIdleTimeout {
+				delete(rl.buckets, client)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// ClientIP returns the IP address of the client that made the request.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
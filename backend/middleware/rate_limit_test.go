@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := NewRateLimiter(6, 3) // A token every 10 seconds
+	handler := limiter.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/transcode", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	for i := range 3 {
+		if w := request("192.0.2.1:1000"); w.Code != http.StatusAccepted {
+			t.Fatalf("request %d within the burst got %d", i+1, w.Code)
+		}
+	}
+
+	// Another port of the same client shares its bucket
+	w := request("192.0.2.1:2000")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst got %d, want 429", w.Code)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 10 {
+		t.Errorf("Retry-After = %q, want 1 to 10 seconds", w.Header().Get("Retry-After"))
+	}
+
+	if w := request("192.0.2.2:1000"); w.Code != http.StatusAccepted {
+		t.Errorf("another client got %d", w.Code)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := NewRateLimiter(60, 1)
+
+	if allowed, _ := limiter.Allow("client"); !allowed {
+		t.Fatal("first request rejected")
+	}
+	if allowed, wait := limiter.Allow("client"); allowed || wait <= 0 || wait > time.Second {
+		t.Fatalf("Allow = %v, %v; want a rejection for under a second", allowed, wait)
+	}
+
+	// Pretend a second went by since the last request
+	limiter.mu.Lock()
+	limiter.buckets["client"].lastSeen = time.Now().Add(-time.Second)
+	limiter.mu.Unlock()
+	if allowed, _ := limiter.Allow("client"); !allowed {
+		t.Error("request rejected after the bucket refilled")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for remoteAddr, want := range map[string]string{
+		"192.0.2.1:1234":   "192.0.2.1",
+		"[2001:db8::1]:80": "2001:db8::1",
+		"no-port":          "no-port",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		if got := ClientIP(r); got != want {
+			t.Errorf("ClientIP(%q) = %q, want %q", remoteAddr, got, want)
+		}
+	}
+}
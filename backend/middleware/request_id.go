@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the correlation ID of a request, both from the client and back to it.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128 // Longer client IDs are replaced, to keep log lines bounded
+
+type requestIDKey struct{}
+
+// RequestID wraps next, giving every request a correlation ID. The client's X-Request-ID is kept
+// when it's a reasonable printable value, otherwise a new one is generated. The ID is echoed in
+// the response header and available to handlers through RequestIDFromContext.
+func RequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// RequestIDFromContext returns the correlation ID RequestID stored in ctx, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether id can be logged as is: non-empty, bounded, printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
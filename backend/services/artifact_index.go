@@ -0,0 +1,52 @@
+package services
+
+import "sync"
+
+// ArtifactIndex maps artifact keys (see utils.ArtifactKey) to the task whose archive holds that
+// output, so identical uploads can reuse it instead of being transcoded again. The index lives in
+// memory; after a restart the archives left behind are no longer found through it.
+type ArtifactIndex struct {
+	mu     sync.Mutex
+	tasks  map[string]string // Artifact key -> task ID
+	byTask map[string]string // Task ID -> artifact key, to forget a task's entry
+}
+
+// NewArtifactIndex creates an empty ArtifactIndex.
+func NewArtifactIndex() *ArtifactIndex {
+	return &ArtifactIndex{
+		tasks:  make(map[string]string),
+		byTask: make(map[string]string),
+	}
+}
+
+// Lookup returns the task whose archive holds the output for key, if any.
+func (ai *ArtifactIndex) Lookup(key string) (string, bool) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+
+	taskID, ok := ai.tasks[key]
+	return taskID, ok
+}
+
+// Store records that the archive of taskID holds the output for key, replacing any earlier task.
+func (ai *ArtifactIndex) Store(key, taskID string) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+
+	if previous, ok := ai.tasks[key]; ok {
+		delete(ai.byTask, previous)
+	}
+	ai.tasks[key] = taskID
+	ai.byTask[taskID] = key
+}
+
+// Forget drops the entry of taskID, once its archive is gone. Entries of other tasks are kept.
+func (ai *ArtifactIndex) Forget(taskID string) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+
+	if key, ok := ai.byTask[taskID]; ok {
+		delete(ai.byTask, taskID)
+		delete(ai.tasks, key)
+	}
+}
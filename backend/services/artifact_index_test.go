@@ -0,0 +1,31 @@
+package services
+
+import "testing"
+
+func TestArtifactIndex(t *testing.T) {
+	ai := NewArtifactIndex()
+	if _, ok := ai.Lookup("key"); ok {
+		t.Fatal("empty index found a task")
+	}
+
+	ai.Store("key", "first")
+	ai.Store("other key", "other")
+	if taskID, ok := ai.Lookup("key"); !ok || taskID != "first" {
+		t.Fatalf("Lookup(key) = %q, %t, want first", taskID, ok)
+	}
+
+	// A newer archive replaces the entry; forgetting the replaced task leaves it alone
+	ai.Store("key", "second")
+	ai.Forget("first")
+	if taskID, ok := ai.Lookup("key"); !ok || taskID != "second" {
+		t.Fatalf("Lookup(key) after forgetting the replaced task = %q, %t, want second", taskID, ok)
+	}
+
+	ai.Forget("second")
+	if _, ok := ai.Lookup("key"); ok {
+		t.Error("Lookup(key) found a forgotten task")
+	}
+	if taskID, ok := ai.Lookup("other key"); !ok || taskID != "other" {
+		t.Errorf("Lookup(other key) = %q, %t, want other", taskID, ok)
+	}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// FailureRecord describes a job that ended in failure, as written to the failure log.
+type FailureRecord struct {
+	TaskID    string                 `json:"taskId"`
+	Filename  string                 `json:"filename"`
+	Status    string                 `json:"status"` // Type of the job's final update: "failed" or "timed_out"
+	Message   string                 `json:"message"`
+	ErrorCode string                 `json:"errorCode,omitempty"`
+	Reason    types.CancelReason     `json:"reason,omitempty"`
+	Options   types.TranscodeOptions `json:"options"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// IsFailureStatus reports whether a job whose final update has the given type failed, as opposed
+// to completing or being cancelled or expired on purpose.
+func IsFailureStatus(updateType string) bool {
+	return updateType == "failed" || updateType == "timed_out"
+}
+
+// FailureRecorder appends a FailureRecord for every failed job to a JSON lines file, so failures
+// can be analyzed after their task is long gone from the StatusManager. The file is only ever
+// appended to; rotating it is left to the operator.
+type FailureRecorder struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFailureRecorder creates a FailureRecorder appending to the file at path, creating the file
+// and its directory on the first failure.
+func NewFailureRecorder(path string) *FailureRecorder {
+	return &FailureRecorder{path: path}
+}
+
+// Record appends record to the log as one line of JSON.
+func (fr *FailureRecorder) Record(record FailureRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode failure record of task %s: %w", record.TaskID, err)
+	}
+	line = append(line, '\n')
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(fr.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of failure log %s: %w", fr.path, err)
+	}
+	file, err := os.OpenFile(fr.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open failure log %s: %w", fr.path, err)
+	}
+	// A single write of a whole line keeps lines intact even with other processes appending
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write failure log %s: %w", fr.path, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// readFailureLog returns the records in the failure log at path.
+func readFailureLog(t *testing.T, path string) []FailureRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []FailureRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record FailureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("bad failure log line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestFailureRecorderAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "failed_jobs.jsonl")
+	recorder := NewFailureRecorder(path)
+	options := types.DefaultTranscodeOptions()
+	options.MaxRenditions = 2
+	first := FailureRecord{
+		TaskID:    "first",
+		Filename:  "clip.mp4",
+		Status:    "failed",
+		Message:   "Transcoding failed",
+		ErrorCode: errCodeInvalidInput,
+		Options:   options,
+		Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	second := FailureRecord{TaskID: "second", Status: "timed_out", Reason: types.CancelReasonTimeout, Timestamp: first.Timestamp.Add(time.Minute)}
+
+	for _, record := range []FailureRecord{first, second} {
+		if err := recorder.Record(record); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	records := readFailureLog(t, path)
+	if len(records) != 2 || records[0].TaskID != "first" || records[1].TaskID != "second" {
+		t.Fatalf("records = %+v, want both in order", records)
+	}
+	got := records[0]
+	if got.Filename != first.Filename || got.Status != first.Status || got.Message != first.Message || got.ErrorCode != first.ErrorCode ||
+		got.Options.MaxRenditions != 2 || !got.Timestamp.Equal(first.Timestamp) {
+		t.Errorf("record = %+v, want %+v", got, first)
+	}
+	if records[1].Reason != types.CancelReasonTimeout {
+		t.Errorf("reason = %q, want %q", records[1].Reason, types.CancelReasonTimeout)
+	}
+}
+
+func TestFailureRecorderKeepsLinesWhole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed_jobs.jsonl")
+	recorder := NewFailureRecorder(path)
+	message := strings.Repeat("x", 64<<10) // Larger than a pipe buffer, so interleaving would show
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := recorder.Record(FailureRecord{TaskID: "task", Status: "failed", Message: message}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if records := readFailureLog(t, path); len(records) != 20 {
+		t.Errorf("log holds %d whole records, want 20", len(records))
+	}
+}
+
+func TestFailureRecorderUnwritablePath(t *testing.T) {
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := NewFailureRecorder(filepath.Join(notADir, "failed_jobs.jsonl")).Record(FailureRecord{TaskID: "task"})
+	if err == nil || !strings.Contains(err.Error(), "failure log") {
+		t.Errorf("Record under a file = %v, want an error naming the failure log", err)
+	}
+}
+
+func TestIsFailureStatus(t *testing.T) {
+	for updateType, want := range map[string]bool{
+		"failed": true, "timed_out": true,
+		"completed": false, "cancelled": false, "expired": false, "progress": false,
+	} {
+		if got := IsFailureStatus(updateType); got != want {
+			t.Errorf("IsFailureStatus(%q) = %v, want %v", updateType, got, want)
+		}
+	}
+}
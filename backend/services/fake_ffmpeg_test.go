@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/services/utils"
+)
+
+// Behaviours of the fake ffmpeg, selected through FAKE_FFMPEG.
+const (
+	fakeSucceed = "succeed" // Report progress, write a two-segment rendition and exit cleanly. Misleading stats go to stderr
+	fakeFail    = "fail"    // Print FAKE_STDERR, or an invalid input error, to stderr and exit with status 1
+	fakeHang    = "hang"    // Report some progress, then block until killed
+	fakeFlood   = "flood"   // Like fakeSucceed, but report progress a thousand times as fast as it can
+	fakeBroken  = "broken"  // Exit cleanly after writing a rendition whose segments are empty
+)
+
+// TestHelperProcess isn't a real test. It's the fake ffmpeg and ffprobe started by useFakeFFmpeg:
+// ffprobe prints the JSON file named by FAKE_PROBE, and ffmpeg behaves as FAKE_FFMPEG says,
+// after appending its arguments to FAKE_ARGS_LOG if set. ffmpeg fails instead if any of its
+// arguments contains FAKE_FAIL_ARG, so a single rendition can be made to fail, writes a broken
+// rendition if any contains FAKE_BROKEN_ARG, or hangs if any contains FAKE_HANG_ARG.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	name, args := args[0], args[1:]
+
+	if filepath.Base(name) == "ffprobe" {
+		data, err := os.ReadFile(os.Getenv("FAKE_PROBE"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(data)
+		os.Exit(0)
+	}
+
+	if path := os.Getenv("FAKE_ARGS_LOG"); path != "" {
+		logArgs(path, args)
+	}
+
+	behaviour := os.Getenv("FAKE_FFMPEG")
+	if failArg := os.Getenv("FAKE_FAIL_ARG"); failArg != "" {
+		if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, failArg) }) {
+			behaviour = fakeFail
+		}
+	}
+	if brokenArg := os.Getenv("FAKE_BROKEN_ARG"); brokenArg != "" {
+		if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, brokenArg) }) {
+			behaviour = fakeBroken
+		}
+	}
+	if hangArg := os.Getenv("FAKE_HANG_ARG"); hangArg != "" {
+		if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, hangArg) }) {
+			behaviour = fakeHang
+		}
+	}
+
+	switch behaviour {
+	case fakeSucceed:
+		// The stats line ffmpeg prints without -nostats; progress must only be read from stdout
+		fmt.Fprint(os.Stderr, "frame=  240 fps=0.0 q=-1.0 Lsize=N/A time=00:00:07.98 bitrate=N/A speed=99x\r")
+		fmt.Print("frame=60\nfps=30.00\nbitrate=1500.0kbits/s\nout_time_us=2000000\nout_time=00:00:02.000000\nspeed=2.00x\nprogress=continue\n")
+		fmt.Print("frame=120\nfps=30.00\nbitrate=1500.0kbits/s\nout_time_us=4000000\nout_time=00:00:04.000000\nspeed=2.00x\nprogress=continue\n")
+		writeFakeRendition(args)
+		fmt.Print("frame=240\nfps=30.00\nbitrate=1500.0kbits/s\nout_time_us=7980000\nout_time=00:00:07.980000\nspeed=2.00x\nprogress=end\n")
+		os.Exit(0)
+	case fakeFlood:
+		for frame := range 1000 {
+			us := frame * 7980
+			fmt.Printf("frame=%d\nout_time_us=%d\nout_time=00:00:%02d.%06d\nspeed=2.00x\nprogress=continue\n", frame, us, us/1e6, us%1e6)
+		}
+		writeFakeRendition(args)
+		fmt.Print("frame=1000\nout_time_us=7980000\nout_time=00:00:07.980000\nprogress=end\n")
+		os.Exit(0)
+	case fakeBroken:
+		writeFakeRendition(args)
+		segmentPattern := args[slices.Index(args, "-hls_segment_filename")+1]
+		for i := range 2 {
+			os.Truncate(fmt.Sprintf(segmentPattern, i), 0)
+		}
+		os.Exit(0)
+	case fakeFail:
+		stderr := os.Getenv("FAKE_STDERR")
+		if stderr == "" {
+			stderr = "source.mp4: Invalid data found when processing input"
+		}
+		fmt.Fprintln(os.Stderr, stderr)
+		os.Exit(1)
+	case fakeHang:
+		fmt.Print("frame=30\nout_time_us=1000000\nout_time=00:00:01.000000\nspeed=1.00x\nprogress=continue\n")
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "unknown FAKE_FFMPEG %q\n", os.Getenv("FAKE_FFMPEG"))
+	os.Exit(2)
+}
+
+// writeFakeRendition writes the playlist ffmpeg was asked for, its last argument, with two
+// four-second segments named after -hls_segment_filename. Runs without HLS output, such as
+// subtitle extraction, get their output file written with placeholder content.
+func writeFakeRendition(args []string) {
+	playlist := args[len(args)-1]
+	segmentFlag := slices.Index(args, "-hls_segment_filename")
+	if segmentFlag < 0 {
+		if err := os.WriteFile(playlist, []byte("WEBVTT\n"), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	segmentPattern := args[segmentFlag+1]
+
+	content := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-PLAYLIST-TYPE:VOD\n"
+	for i := range 2 {
+		segment := fmt.Sprintf(segmentPattern, i)
+		if err := os.WriteFile(segment, []byte(strings.Repeat("\x47", 188*16)), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		content += fmt.Sprintf("#EXTINF:4.000000,\n%s\n", filepath.Base(segment))
+	}
+	content += "#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(playlist, []byte(content), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// logArgs appends args to the file at path as one line of JSON.
+func logArgs(path string, args []string) {
+	line, _ := json.Marshal(args)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// recordFFmpegArgs makes the fake ffmpeg log its arguments for the rest of the test.
+// The returned function lists the arguments of every ffmpeg run so far, in order.
+func recordFFmpegArgs(t *testing.T) func() [][]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "args.log")
+	t.Setenv("FAKE_ARGS_LOG", path)
+
+	return func() [][]string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		var runs [][]string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var args []string
+			if err := json.Unmarshal([]byte(line), &args); err != nil {
+				t.Fatalf("bad args log line %q: %v", line, err)
+			}
+			runs = append(runs, args)
+		}
+		return runs
+	}
+}
+
+// argValue returns the value following the first occurrence of flag in args, or "" if absent.
+func argValue(args []string, flag string) string {
+	if i := slices.Index(args, flag); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+// useFakeFFmpeg makes ExecCommand start TestHelperProcess instead of ffmpeg and ffprobe until the
+// test ends. ffprobe reports testdata/source_720p.json and ffmpeg behaves as behaviour says.
+func useFakeFFmpeg(t *testing.T, behaviour string) {
+	t.Helper()
+	useFakeFFmpegWithSource(t, behaviour, "source_720p")
+}
+
+// useFakeFFmpegWithSource is useFakeFFmpeg with ffprobe reporting testdata/<fixture>.json.
+func useFakeFFmpegWithSource(t *testing.T, behaviour, fixture string) {
+	t.Helper()
+	probe, err := filepath.Abs(filepath.Join("testdata", fixture+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := utils.ExecCommand
+	utils.ExecCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--", name}, args...)...)
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_PROBE="+probe, "FAKE_FFMPEG="+behaviour)
+		return cmd
+	}
+	t.Cleanup(func() { utils.ExecCommand = previous })
+}
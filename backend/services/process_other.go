@@ -0,0 +1,17 @@
+//go:build !unix
+
+package services
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// startInOwnGroup does nothing where there are no process groups.
+func startInOwnGroup(cmd *exec.Cmd) {}
+
+// signalPause fails where processes can't be stopped and continued with signals.
+func signalPause(process *os.Process, pause bool) error {
+	return errors.ErrUnsupported
+}
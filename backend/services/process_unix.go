@@ -0,0 +1,24 @@
+//go:build unix
+
+package services
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startInOwnGroup makes cmd start in a process group of its own, so signals pausing the group
+// reach ffmpeg and anything it spawns, but never the server itself.
+func startInOwnGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalPause stops (SIGSTOP) or continues (SIGCONT) the process group led by process.
+func signalPause(process *os.Process, pause bool) error {
+	signal := syscall.SIGCONT
+	if pause {
+		signal = syscall.SIGSTOP
+	}
+	return syscall.Kill(-process.Pid, signal)
+}
@@ -0,0 +1,363 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PratikDev/transcoder/logger"
+	"github.com/PratikDev/transcoder/types"
+)
+
+const (
+	redisKeyPrefix     = "transcoder:task:"   // Key holding a task's latest status update
+	redisTokenPrefix   = "transcoder:token:"  // Key holding a task's access token
+	redisChannelPrefix = "transcoder:status:" // Pub/sub channel carrying a task's updates
+	redisStatusTTL     = 24 * time.Hour       // Safety expiry for status keys of tasks that never got removed
+	redisDialTimeout   = 5 * time.Second
+	redisRetryDelay    = 2 * time.Second
+)
+
+// redisMessage is the payload published on a task's channel.
+type redisMessage struct {
+	Removed bool               `json:"removed,omitempty"`
+	Update  types.StatusUpdate `json:"update"`
+}
+
+// RedisStatusBroker shares task status between replicas through Redis.
+// The latest update of each task is stored under a key, so any replica can check that a task exists,
+// and every update is published on a per-task channel that all replicas listen to.
+type RedisStatusBroker struct {
+	addr     string
+	password string
+	db       string
+
+	cmd   *respConn  // Connection used for regular commands
+	cmdMu sync.Mutex // Serializes commands on cmd
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewRedisStatusBroker connects to Redis at addr and returns a broker using it.
+func NewRedisStatusBroker(addr, password, db string) (*RedisStatusBroker, error) {
+	if _, err := strconv.Atoi(db); err != nil {
+		return nil, fmt.Errorf("invalid redis database %q: %w", db, err)
+	}
+
+	b := &RedisStatusBroker{
+		addr:     addr,
+		password: password,
+		db:       db,
+		closed:   make(chan struct{}),
+	}
+
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.cmd = conn
+
+	logger.Infof("Using Redis status broker at %s", addr)
+	return b, nil
+}
+
+func (b *RedisStatusBroker) Listen(onUpdate func(taskID string, update types.StatusUpdate), onRemove func(taskID string)) error {
+	conn, err := b.dial()
+	if err != nil {
+		return err
+	}
+	go b.listen(conn, onUpdate, onRemove)
+	return nil
+}
+
+// listen reads pub/sub messages until the broker is closed, reconnecting on failure.
+func (b *RedisStatusBroker) listen(conn *respConn, onUpdate func(taskID string, update types.StatusUpdate), onRemove func(taskID string)) {
+	for {
+		err := b.consume(conn, onUpdate, onRemove)
+		conn.Close()
+
+		select {
+		case <-b.closed:
+			return
+		default:
+		}
+		logger.Warnf("Redis status subscription lost: %v. Reconnecting in %s...", err, redisRetryDelay)
+
+		for {
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(redisRetryDelay):
+			}
+
+			conn, err = b.dial()
+			if err == nil {
+				break
+			}
+			logger.Errorf("Failed to reconnect to Redis: %v", err)
+		}
+	}
+}
+
+// consume subscribes to all task channels on conn and dispatches messages until an error occurs.
+func (b *RedisStatusBroker) consume(conn *respConn, onUpdate func(taskID string, update types.StatusUpdate), onRemove func(taskID string)) error {
+	if err := conn.send("PSUBSCRIBE", redisChannelPrefix+"*"); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		// Messages arrive as ["pmessage", pattern, channel, payload]
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 4 || parts[0] != "pmessage" {
+			continue
+		}
+		channel, _ := parts[2].(string)
+		payload, _ := parts[3].(string)
+		taskID := strings.TrimPrefix(channel, redisChannelPrefix)
+
+		var msg redisMessage
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			logger.Warnf("Ignoring malformed status message for task %s: %v", taskID, err)
+			continue
+		}
+
+		if msg.Removed {
+			onRemove(taskID)
+		} else {
+			onUpdate(taskID, msg.Update)
+		}
+	}
+}
+
+func (b *RedisStatusBroker) Publish(taskID string, update types.StatusUpdate) error {
+	payload, err := json.Marshal(redisMessage{Update: update})
+	if err != nil {
+		return fmt.Errorf("failed to marshal status update for task %s: %w", taskID, err)
+	}
+	updateJSON, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal status update for task %s: %w", taskID, err)
+	}
+
+	ttl := strconv.Itoa(int(redisStatusTTL.Seconds()))
+	if _, err := b.do("SET", redisKeyPrefix+taskID, string(updateJSON), "EX", ttl); err != nil {
+		return fmt.Errorf("failed to store status for task %s: %w", taskID, err)
+	}
+	if _, err := b.do("PUBLISH", redisChannelPrefix+taskID, string(payload)); err != nil {
+		return fmt.Errorf("failed to publish status for task %s: %w", taskID, err)
+	}
+	return nil
+}
+
+func (b *RedisStatusBroker) Lookup(taskID string) (types.StatusUpdate, bool, error) {
+	reply, err := b.do("GET", redisKeyPrefix+taskID)
+	if err != nil {
+		return types.StatusUpdate{}, false, fmt.Errorf("failed to look up task %s: %w", taskID, err)
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return types.StatusUpdate{}, false, nil // Key doesn't exist
+	}
+
+	var update types.StatusUpdate
+	if err := json.Unmarshal([]byte(value), &update); err != nil {
+		return types.StatusUpdate{}, false, fmt.Errorf("failed to parse stored status for task %s: %w", taskID, err)
+	}
+	return update, true, nil
+}
+
+func (b *RedisStatusBroker) StoreToken(taskID, token string) error {
+	ttl := strconv.Itoa(int(redisStatusTTL.Seconds()))
+	if _, err := b.do("SET", redisTokenPrefix+taskID, token, "EX", ttl); err != nil {
+		return fmt.Errorf("failed to store token for task %s: %w", taskID, err)
+	}
+	return nil
+}
+
+func (b *RedisStatusBroker) Token(taskID string) (string, bool, error) {
+	reply, err := b.do("GET", redisTokenPrefix+taskID)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up token for task %s: %w", taskID, err)
+	}
+
+	token, ok := reply.(string)
+	return token, ok, nil
+}
+
+func (b *RedisStatusBroker) Remove(taskID string) error {
+	payload, err := json.Marshal(redisMessage{Removed: true})
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.do("DEL", redisKeyPrefix+taskID, redisTokenPrefix+taskID); err != nil {
+		return fmt.Errorf("failed to delete status for task %s: %w", taskID, err)
+	}
+	if _, err := b.do("PUBLISH", redisChannelPrefix+taskID, string(payload)); err != nil {
+		return fmt.Errorf("failed to publish removal of task %s: %w", taskID, err)
+	}
+	return nil
+}
+
+func (b *RedisStatusBroker) Close() error {
+	b.once.Do(func() { close(b.closed) })
+
+	b.cmdMu.Lock()
+	defer b.cmdMu.Unlock()
+	if b.cmd != nil {
+		return b.cmd.Close()
+	}
+	return nil
+}
+
+// do runs a command on the shared command connection, reconnecting once if the connection broke.
+func (b *RedisStatusBroker) do(args ...string) (any, error) {
+	b.cmdMu.Lock()
+	defer b.cmdMu.Unlock()
+
+	if b.cmd != nil {
+		reply, err := b.cmd.do(args...)
+		var redisErr respError
+		if err == nil || errors.As(err, &redisErr) {
+			return reply, err
+		}
+		b.cmd.Close()
+		b.cmd = nil
+	}
+
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.cmd = conn
+	return b.cmd.do(args...)
+}
+
+// dial opens a new connection, authenticating and selecting the database if configured.
+func (b *RedisStatusBroker) dial() (*respConn, error) {
+	netConn, err := net.DialTimeout("tcp", b.addr, redisDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", b.addr, err)
+	}
+	conn := &respConn{conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if b.password != "" {
+		if _, err := conn.do("AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	if b.db != "0" {
+		if _, err := conn.do("SELECT", b.db); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to select redis database %s: %w", b.db, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// respError is an error reply sent by the Redis server.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respConn is a minimal client for the Redis serialization protocol (RESP2),
+// covering just what the status broker needs.
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *respConn) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *respConn) send(args ...string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.conn, sb.String())
+	return err
+}
+
+// read parses a single reply. Bulk strings become string (or nil when missing),
+// integers become int64 and arrays become []any.
+func (c *respConn) read() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q: %w", line, err)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2) // Payload followed by \r\n
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q: %w", line, err)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, 0, count)
+		for range count {
+			item, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
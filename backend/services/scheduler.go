@@ -0,0 +1,369 @@
+package services
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/PratikDev/transcoder/logger"
+	"github.com/PratikDev/transcoder/types"
+)
+
+// scheduledJob is a job waiting in or taken from the scheduler's queue.
+type scheduledJob struct {
+	taskID      string
+	priority    types.JobPriority
+	submittedAt time.Time
+	startedAt   time.Time
+	run         func()
+
+	effective types.JobPriority // Priority after aging, refreshed before every dispatch
+	index     int               // Position in the heap
+}
+
+// jobQueue is a heap ordered by effective priority, then submission time.
+type jobQueue []*scheduledJob
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].effective != q[j].effective {
+		return q[i].effective > q[j].effective
+	}
+	return q[i].submittedAt.Before(q[j].submittedAt)
+}
+
+func (q jobQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *jobQueue) Push(x any) {
+	job := x.(*scheduledJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+
+func (q *jobQueue) Pop() any {
+	old := *q
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+	*q = old[:n-1]
+	return job
+}
+
+// ErrSchedulerClosed is returned by Submit once the scheduler was closed.
+var ErrSchedulerClosed = errors.New("scheduler is closed")
+
+// recentJobsTracked is how many of the latest finished jobs queue wait estimates are based on.
+const recentJobsTracked = 20
+
+// QueueListener is told the position of a queued job, 1 being the next to start, and how long it's
+// expected to wait, 0 while no job has finished yet to base the estimate on.
+type QueueListener func(taskID string, position int, wait time.Duration)
+
+// queuePosition is what a QueueListener is told about one queued job.
+type queuePosition struct {
+	taskID   string
+	position int
+	wait     time.Duration
+}
+
+// queueSnapshot holds the positions of every queued job at one point in time.
+type queueSnapshot struct {
+	seq       uint64 // Taken in increasing order, so a snapshot can tell whether a newer one was delivered
+	listener  QueueListener
+	positions []queuePosition
+}
+
+// Scheduler runs at most maxWorkers jobs at once and queues the rest by priority.
+// To keep low-priority jobs from starving, a queued job gains one priority level
+// for every agingInterval it has been waiting.
+type Scheduler struct {
+	maxWorkers    int
+	agingInterval time.Duration
+	queue         jobQueue
+	running       map[string]*scheduledJob
+	durations     []time.Duration // Run times of the latest finished jobs, oldest first
+	listener      QueueListener
+	mu            sync.Mutex
+	wg            sync.WaitGroup // Tracks submitted jobs until they finish
+	closed        bool           // Set by Close, after which no job is accepted
+
+	snapshotSeq  uint64     // Sequence number of the latest queue snapshot taken, guarded by mu
+	notifyMu     sync.Mutex // Serializes the delivery of queue snapshots to the listener
+	deliveredSeq uint64     // Sequence number of the latest snapshot delivered, guarded by notifyMu
+}
+
+// NewScheduler creates a Scheduler running up to maxWorkers jobs concurrently.
+func NewScheduler(maxWorkers int, agingInterval time.Duration) *Scheduler {
+	return &Scheduler{
+		maxWorkers:    max(maxWorkers, 1),
+		agingInterval: agingInterval,
+		running:       make(map[string]*scheduledJob),
+	}
+}
+
+// SetQueueListener sets the listener told about every queued job whenever the queue changes.
+// It's called without the scheduler locked, and is never told about a queue older than one it
+// was already told about.
+func (s *Scheduler) SetQueueListener(listener QueueListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listener = listener
+}
+
+// Submit queues run under taskID and starts it as soon as a worker is free.
+// It reports whether the job had to wait in the queue, or ErrSchedulerClosed once Close was called.
+func (s *Scheduler) Submit(taskID string, priority types.JobPriority, run func()) (bool, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, ErrSchedulerClosed
+	}
+	s.wg.Add(1)
+	heap.Push(&s.queue, &scheduledJob{
+		taskID:      taskID,
+		priority:    priority,
+		submittedAt: time.Now(),
+		run:         run,
+		effective:   priority,
+	})
+	logger.Infof("[%s] Job queued with %s priority (%d queued, %d running)", taskID, priority, len(s.queue), len(s.running))
+
+	s.dispatch()
+	snapshot := s.snapshotQueue()
+	_, started := s.running[taskID]
+	s.mu.Unlock()
+
+	s.notifyQueued(snapshot)
+	return !started, nil
+}
+
+// Jobs returns the running jobs followed by the queued ones in the order they will start.
+func (s *Scheduler) Jobs() []types.JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]types.JobInfo, 0, len(s.running)+len(s.queue))
+	for _, job := range s.running {
+		jobs = append(jobs, types.JobInfo{
+			TaskID:      job.taskID,
+			Priority:    job.priority.String(),
+			State:       "running",
+			SubmittedAt: job.submittedAt.UnixMilli(),
+			StartedAt:   job.startedAt.UnixMilli(),
+		})
+	}
+
+	for _, job := range s.queuedInOrder() {
+		jobs = append(jobs, types.JobInfo{
+			TaskID:      job.taskID,
+			Priority:    job.priority.String(),
+			State:       "queued",
+			SubmittedAt: job.submittedAt.UnixMilli(),
+		})
+	}
+	return jobs
+}
+
+// Job returns the running or queued job with the given task ID.
+func (s *Scheduler) Job(taskID string) (types.JobInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.running[taskID]; ok {
+		return types.JobInfo{
+			TaskID:      job.taskID,
+			Priority:    job.priority.String(),
+			State:       "running",
+			SubmittedAt: job.submittedAt.UnixMilli(),
+			StartedAt:   job.startedAt.UnixMilli(),
+		}, true
+	}
+	for _, job := range s.queue {
+		if job.taskID == taskID {
+			return types.JobInfo{
+				TaskID:      job.taskID,
+				Priority:    job.priority.String(),
+				State:       "queued",
+				SubmittedAt: job.submittedAt.UnixMilli(),
+			}, true
+		}
+	}
+	return types.JobInfo{}, false
+}
+
+// queuedInOrder returns the queued jobs in the order they would be started. Callers must hold s.mu.
+func (s *Scheduler) queuedInOrder() []*scheduledJob {
+	s.age()
+	ordered := make(jobQueue, len(s.queue))
+	copy(ordered, s.queue)
+
+	result := make([]*scheduledJob, 0, len(ordered))
+	for ordered.Len() > 0 {
+		job := heap.Pop(&ordered).(*scheduledJob)
+		result = append(result, job)
+	}
+
+	// Popping from the copy moved the shared jobs' indexes, so restore them
+	for i, job := range s.queue {
+		job.index = i
+	}
+	return result
+}
+
+// age refreshes the effective priority of queued jobs and restores the heap order. Callers must hold s.mu.
+func (s *Scheduler) age() {
+	if s.agingInterval <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, job := range s.queue {
+		levels := types.JobPriority(now.Sub(job.submittedAt) / s.agingInterval)
+		job.effective = min(job.priority+levels, types.PriorityHigh)
+	}
+	heap.Init(&s.queue)
+}
+
+// dispatch starts queued jobs while workers are available. Callers must hold s.mu.
+func (s *Scheduler) dispatch() {
+	s.age()
+
+	for len(s.running) < s.maxWorkers && s.queue.Len() > 0 {
+		job := heap.Pop(&s.queue).(*scheduledJob)
+		job.startedAt = time.Now()
+		s.running[job.taskID] = job
+		logger.Infof("[%s] Job started after waiting %s", job.taskID, job.startedAt.Sub(job.submittedAt).Round(time.Millisecond))
+
+		go func() {
+			defer s.wg.Done()
+			defer s.finish(job.taskID)
+			job.run()
+		}()
+	}
+}
+
+// ExpireQueued removes the jobs that have been queued longer than maxWait without starting.
+// expire is called with each of their task IDs, without the scheduler locked, after which the job
+// is run outside the worker limit so it can notice it was expired and clean up after itself.
+// It returns the expired task IDs.
+func (s *Scheduler) ExpireQueued(maxWait time.Duration, expire func(taskID string)) []string {
+	s.mu.Lock()
+	var stale []*scheduledJob
+	now := time.Now()
+	for _, job := range s.queue {
+		if now.Sub(job.submittedAt) > maxWait {
+			stale = append(stale, job)
+		}
+	}
+
+	expired := make([]string, 0, len(stale))
+	for _, job := range stale {
+		heap.Remove(&s.queue, job.index)
+		expired = append(expired, job.taskID)
+		logger.Infof("[%s] Job expired after waiting %s in the queue", job.taskID, now.Sub(job.submittedAt).Round(time.Second))
+	}
+	var snapshot queueSnapshot
+	if len(expired) > 0 {
+		snapshot = s.snapshotQueue()
+	}
+	s.mu.Unlock()
+
+	// Expiring a task may mean I/O such as removing its output, which mustn't hold up the scheduler
+	for _, job := range stale {
+		expire(job.taskID)
+		go func() {
+			defer s.wg.Done()
+			job.run()
+		}()
+	}
+	s.notifyQueued(snapshot)
+	return expired
+}
+
+// Close stops the scheduler from accepting jobs. Jobs already submitted still run.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+}
+
+// Wait blocks until every submitted job, queued or running, has finished. Jobs must not be
+// submitted meanwhile, so the scheduler has to be closed first.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// finish frees the worker of a completed job and starts the next one.
+func (s *Scheduler) finish(taskID string) {
+	s.mu.Lock()
+	if job, ok := s.running[taskID]; ok {
+		s.durations = append(s.durations, time.Since(job.startedAt))
+		if len(s.durations) > recentJobsTracked {
+			s.durations = s.durations[1:]
+		}
+	}
+	delete(s.running, taskID)
+	s.dispatch()
+	snapshot := s.snapshotQueue()
+	s.mu.Unlock()
+
+	s.notifyQueued(snapshot)
+}
+
+// snapshotQueue records the position and expected wait of every queued job, for notifyQueued to
+// deliver once s.mu is released. Callers must hold s.mu.
+func (s *Scheduler) snapshotQueue() queueSnapshot {
+	if s.listener == nil {
+		return queueSnapshot{}
+	}
+	s.snapshotSeq++
+	snapshot := queueSnapshot{seq: s.snapshotSeq, listener: s.listener}
+	for i, job := range s.queuedInOrder() {
+		snapshot.positions = append(snapshot.positions, queuePosition{taskID: job.taskID, position: i + 1, wait: s.estimateWait(i + 1)})
+	}
+	return snapshot
+}
+
+// notifyQueued tells the listener about every job of a snapshot taken by snapshotQueue. The
+// listener may be slow, e.g. publishing to Redis, so callers must not hold s.mu. Snapshots taken
+// concurrently may arrive out of order; one older than a snapshot already delivered is dropped.
+func (s *Scheduler) notifyQueued(snapshot queueSnapshot) {
+	if snapshot.listener == nil {
+		return
+	}
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	if snapshot.seq <= s.deliveredSeq {
+		return
+	}
+	s.deliveredSeq = snapshot.seq
+	for _, queued := range snapshot.positions {
+		snapshot.listener(queued.taskID, queued.position, queued.wait)
+	}
+}
+
+// estimateWait returns how long the job at position is expected to wait before it starts: the
+// average run time of the latest finished jobs for every round of jobs the workers have to get
+// through first. It returns 0 while no job has finished. Callers must hold s.mu.
+func (s *Scheduler) estimateWait(position int) time.Duration {
+	if len(s.durations) == 0 || position < 1 {
+		return 0
+	}
+	var total time.Duration
+	for _, duration := range s.durations {
+		total += duration
+	}
+	average := total / time.Duration(len(s.durations))
+	rounds := (position + s.maxWorkers - 1) / s.maxWorkers
+	return average * time.Duration(rounds)
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// withTimeout fails the test if f doesn't return within a second, e.g. because it deadlocked.
+func withTimeout(t *testing.T, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not return", what)
+	}
+}
+
+// blockingJob returns a job that runs until release is closed, signalling started once it runs.
+func blockingJob(started chan<- string, taskID string, release <-chan struct{}) func() {
+	return func() {
+		if started != nil {
+			started <- taskID
+		}
+		<-release
+	}
+}
+
+func TestSchedulerRunsByPriorityWithinWorkerLimit(t *testing.T) {
+	s := NewScheduler(1, 0)
+	release := make(chan struct{})
+	started := make(chan string, 4)
+
+	if queued, err := s.Submit("first", types.PriorityNormal, blockingJob(started, "first", release)); err != nil || queued {
+		t.Error("first job was queued with a free worker")
+	}
+	if got := <-started; got != "first" {
+		t.Fatalf("started %s, want first", got)
+	}
+	s.Submit("low", types.PriorityLow, blockingJob(started, "low", release))
+	s.Submit("high", types.PriorityHigh, blockingJob(started, "high", release))
+
+	jobs := s.Jobs()
+	if len(jobs) != 3 || jobs[0].TaskID != "first" || jobs[1].TaskID != "high" || jobs[2].TaskID != "low" {
+		t.Fatalf("Jobs() = %+v, want first running, then high and low queued", jobs)
+	}
+
+	close(release)
+	for _, want := range []string{"high", "low"} {
+		if got := <-started; got != want {
+			t.Errorf("started %s, want %s", got, want)
+		}
+	}
+	s.Wait()
+}
+
+func TestSchedulerNotifiesQueueWithoutHoldingTheLock(t *testing.T) {
+	s := NewScheduler(1, 0)
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	positions := map[string]int{}
+	s.SetQueueListener(func(taskID string, position int, wait time.Duration) {
+		// A listener calling back into the scheduler deadlocks if it's called with the lock held
+		s.Job(taskID)
+		mu.Lock()
+		positions[taskID] = position
+		mu.Unlock()
+	})
+
+	withTimeout(t, "Submit", func() {
+		s.Submit("running", types.PriorityNormal, blockingJob(nil, "running", release))
+		s.Submit("second", types.PriorityNormal, blockingJob(nil, "second", release))
+		s.Submit("third", types.PriorityNormal, blockingJob(nil, "third", release))
+	})
+
+	mu.Lock()
+	if positions["second"] != 1 || positions["third"] != 2 {
+		t.Errorf("positions = %v, want second at 1 and third at 2", positions)
+	}
+	if _, ok := positions["running"]; ok {
+		t.Error("the running job was notified as queued")
+	}
+	mu.Unlock()
+
+	withTimeout(t, "finishing the jobs", func() {
+		close(release)
+		s.Wait()
+	})
+}
+
+func TestSchedulerEstimatesQueueWait(t *testing.T) {
+	s := NewScheduler(1, 0)
+	release := make(chan struct{})
+
+	type notification struct {
+		position int
+		wait     time.Duration
+	}
+	var mu sync.Mutex
+	notified := map[string][]notification{}
+	s.SetQueueListener(func(taskID string, position int, wait time.Duration) {
+		mu.Lock()
+		notified[taskID] = append(notified[taskID], notification{position, wait})
+		mu.Unlock()
+	})
+
+	// Every job runs for at least 20ms once released
+	for _, taskID := range []string{"a", "b", "c", "d"} {
+		s.Submit(taskID, types.PriorityNormal, func() {
+			<-release
+			time.Sleep(20 * time.Millisecond)
+		})
+	}
+
+	// No job has finished yet, so there's nothing to base an estimate on
+	mu.Lock()
+	for _, taskID := range []string{"b", "c", "d"} {
+		for _, n := range notified[taskID] {
+			if n.wait != 0 {
+				t.Errorf("%s was told to wait %s at position %d before any job finished", taskID, n.wait, n.position)
+			}
+		}
+	}
+	mu.Unlock()
+
+	withTimeout(t, "finishing the jobs", func() {
+		close(release)
+		s.Wait()
+	})
+
+	s.mu.Lock()
+	durations := slices.Clone(s.durations)
+	s.mu.Unlock()
+	if len(durations) != 4 {
+		t.Fatalf("durations = %v, want one per job", durations)
+	}
+	for _, duration := range durations {
+		if duration < 20*time.Millisecond {
+			t.Errorf("durations = %v, want each at least 20ms", durations)
+		}
+	}
+
+	// Once a finished, c is next and d has c ahead of it; once b finished too, d is next
+	mu.Lock()
+	defer mu.Unlock()
+	wantC := notification{position: 1, wait: durations[0]}
+	wantD := []notification{{position: 2, wait: 2 * durations[0]}, {position: 1, wait: (durations[0] + durations[1]) / 2}}
+	if got := notified["c"]; !slices.Contains(got, wantC) {
+		t.Errorf("c was notified %v, want %v", got, wantC)
+	}
+	for _, want := range wantD {
+		if got := notified["d"]; !slices.Contains(got, want) {
+			t.Errorf("d was notified %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSchedulerEstimateWait(t *testing.T) {
+	tests := []struct {
+		maxWorkers int
+		durations  []time.Duration
+		position   int
+		want       time.Duration
+	}{
+		{maxWorkers: 1, position: 1, want: 0},
+		{maxWorkers: 1, position: 3, want: 0},
+		{maxWorkers: 1, durations: []time.Duration{time.Minute}, position: 1, want: time.Minute},
+		{maxWorkers: 1, durations: []time.Duration{time.Minute, 3 * time.Minute}, position: 1, want: 2 * time.Minute},
+		{maxWorkers: 1, durations: []time.Duration{time.Minute, 3 * time.Minute}, position: 3, want: 6 * time.Minute},
+		// Two workers get through two jobs per round
+		{maxWorkers: 2, durations: []time.Duration{time.Minute, 3 * time.Minute}, position: 2, want: 2 * time.Minute},
+		{maxWorkers: 2, durations: []time.Duration{time.Minute, 3 * time.Minute}, position: 3, want: 4 * time.Minute},
+		{maxWorkers: 1, durations: []time.Duration{time.Minute}, position: 0, want: 0},
+	}
+	for _, tt := range tests {
+		s := NewScheduler(tt.maxWorkers, 0)
+		s.durations = tt.durations
+		if got := s.estimateWait(tt.position); got != tt.want {
+			t.Errorf("estimateWait(%d) with %d workers and durations %v = %s, want %s", tt.position, tt.maxWorkers, tt.durations, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulerTracksRecentDurations(t *testing.T) {
+	s := NewScheduler(1, 0)
+	for i := range recentJobsTracked + 5 {
+		s.running["job"] = &scheduledJob{taskID: "job", startedAt: time.Now().Add(-time.Duration(i+1) * time.Hour)}
+		s.finish("job")
+	}
+	if len(s.durations) != recentJobsTracked {
+		t.Fatalf("tracked %d durations, want the latest %d", len(s.durations), recentJobsTracked)
+	}
+	// The oldest jobs, which ran 1 to 5 hours, were dropped
+	if s.durations[0] < 6*time.Hour {
+		t.Errorf("oldest tracked duration = %s, want the first five dropped", s.durations[0])
+	}
+}
+
+func TestSchedulerDropsOutdatedQueueSnapshots(t *testing.T) {
+	s := NewScheduler(1, 0)
+	var notified []int
+	s.SetQueueListener(func(taskID string, position int, wait time.Duration) {
+		notified = append(notified, position)
+	})
+
+	newer := queueSnapshot{seq: 2, listener: s.listener, positions: []queuePosition{{taskID: "a", position: 1}}}
+	older := queueSnapshot{seq: 1, listener: s.listener, positions: []queuePosition{{taskID: "a", position: 2}}}
+	s.notifyQueued(newer)
+	s.notifyQueued(older)
+
+	if len(notified) != 1 || notified[0] != 1 {
+		t.Errorf("notified positions %v, want only the newer snapshot's [1]", notified)
+	}
+}
+
+func TestSchedulerExpiresQueuedJobsWithoutHoldingTheLock(t *testing.T) {
+	s := NewScheduler(1, 0)
+	release := make(chan struct{})
+	s.Submit("running", types.PriorityNormal, blockingJob(nil, "running", release))
+
+	ran := make(chan string, 1)
+	s.Submit("stale", types.PriorityNormal, func() { ran <- "stale" })
+	time.Sleep(20 * time.Millisecond)
+
+	var expired []string
+	withTimeout(t, "ExpireQueued", func() {
+		expired = s.ExpireQueued(10*time.Millisecond, func(taskID string) {
+			// Expiring does I/O in practice; the scheduler must stay usable meanwhile
+			if _, ok := s.Job(taskID); ok {
+				t.Errorf("%s is still listed while it's expired", taskID)
+			}
+		})
+	})
+	if len(expired) != 1 || expired[0] != "stale" {
+		t.Fatalf("expired = %v, want [stale]", expired)
+	}
+
+	// The expired job still runs, outside the worker limit, to clean up after itself
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("expired job never ran")
+	}
+	if expired := s.ExpireQueued(0, func(string) {}); len(expired) != 0 {
+		t.Errorf("running jobs were expired: %v", expired)
+	}
+	close(release)
+	s.Wait()
+}
+
+func TestSchedulerRejectsJobsOnceClosed(t *testing.T) {
+	s := NewScheduler(1, 0)
+	release := make(chan struct{})
+	ran := make(chan string, 2)
+	s.Submit("running", types.PriorityNormal, func() { <-release; ran <- "running" })
+	s.Submit("queued", types.PriorityNormal, func() { ran <- "queued" })
+
+	s.Close()
+	if _, err := s.Submit("late", types.PriorityNormal, func() { ran <- "late" }); !errors.Is(err, ErrSchedulerClosed) {
+		t.Fatalf("Submit after Close returned %v, want ErrSchedulerClosed", err)
+	}
+
+	// Jobs submitted before closing still run, and Wait covers them
+	close(release)
+	withTimeout(t, "Wait", s.Wait)
+	close(ran)
+	var got []string
+	for taskID := range ran {
+		got = append(got, taskID)
+	}
+	if len(got) != 2 || got[0] != "running" || got[1] != "queued" {
+		t.Errorf("ran %v, want [running queued]", got)
+	}
+}
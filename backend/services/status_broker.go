@@ -0,0 +1,94 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PratikDev/transcoder/services/utils"
+	"github.com/PratikDev/transcoder/types"
+)
+
+// StatusBroker fans status updates out to every StatusManager that may have subscribers for a task.
+// The in-memory broker only reaches the local process; the Redis broker reaches every replica.
+type StatusBroker interface {
+	// Listen registers the callbacks invoked for every update and task removal published by any instance.
+	Listen(onUpdate func(taskID string, update types.StatusUpdate), onRemove func(taskID string)) error
+	// Publish records update as the latest status of taskID and delivers it to all listeners.
+	Publish(taskID string, update types.StatusUpdate) error
+	// Lookup returns the latest published status of taskID, if the task is known to the broker.
+	Lookup(taskID string) (types.StatusUpdate, bool, error)
+	// StoreToken records the access token of taskID so any instance can authorize requests for it.
+	StoreToken(taskID, token string) error
+	// Token returns the access token of taskID, if the task is known to the broker.
+	Token(taskID string) (string, bool, error)
+	// Remove forgets taskID and notifies all listeners that the task is done.
+	Remove(taskID string) error
+	// Close releases any resources held by the broker.
+	Close() error
+}
+
+// NewStatusBrokerFromEnv returns the broker selected by the STATUS_BACKEND environment variable
+// ("memory" by default, or "redis" configured through REDIS_ADDR, REDIS_PASSWORD and REDIS_DB).
+func NewStatusBrokerFromEnv() (StatusBroker, error) {
+	switch backend := strings.ToLower(utils.GetEnv("STATUS_BACKEND", "memory")); backend {
+	case "memory":
+		return NewMemoryStatusBroker(), nil
+	case "redis":
+		return NewRedisStatusBroker(
+			utils.GetEnv("REDIS_ADDR", "localhost:6379"),
+			utils.GetEnv("REDIS_PASSWORD", ""),
+			utils.GetEnv("REDIS_DB", "0"),
+		)
+	default:
+		return nil, fmt.Errorf("unknown STATUS_BACKEND %q, expected \"memory\" or \"redis\"", backend)
+	}
+}
+
+// MemoryStatusBroker delivers updates to listeners in the same process.
+type MemoryStatusBroker struct {
+	onUpdate func(taskID string, update types.StatusUpdate)
+	onRemove func(taskID string)
+}
+
+// NewMemoryStatusBroker creates a broker that only reaches the local process.
+func NewMemoryStatusBroker() *MemoryStatusBroker {
+	return &MemoryStatusBroker{}
+}
+
+func (b *MemoryStatusBroker) Listen(onUpdate func(taskID string, update types.StatusUpdate), onRemove func(taskID string)) error {
+	b.onUpdate = onUpdate
+	b.onRemove = onRemove
+	return nil
+}
+
+func (b *MemoryStatusBroker) Publish(taskID string, update types.StatusUpdate) error {
+	if b.onUpdate != nil {
+		b.onUpdate(taskID, update)
+	}
+	return nil
+}
+
+// Lookup always reports unknown; in a single process the StatusManager already holds every task.
+func (b *MemoryStatusBroker) Lookup(taskID string) (types.StatusUpdate, bool, error) {
+	return types.StatusUpdate{}, false, nil
+}
+
+// StoreToken is a no-op; the StatusManager keeps the tokens of its own tasks.
+func (b *MemoryStatusBroker) StoreToken(taskID, token string) error {
+	return nil
+}
+
+func (b *MemoryStatusBroker) Token(taskID string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (b *MemoryStatusBroker) Remove(taskID string) error {
+	if b.onRemove != nil {
+		b.onRemove(taskID)
+	}
+	return nil
+}
+
+func (b *MemoryStatusBroker) Close() error {
+	return nil
+}
@@ -1,46 +1,141 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/PratikDev/transcoder/logger"
 	"github.com/PratikDev/transcoder/services/utils"
 	"github.com/PratikDev/transcoder/types"
 )
 
+// Errors returned by Authorize.
+var (
+	ErrTaskNotFound     = errors.New("task not found or not active")
+	ErrInvalidTaskToken = errors.New("invalid task access token")
+)
+
+// Errors returned by PauseTask and ResumeTask.
+var (
+	ErrTaskNotRunning = errors.New("task has no running encoding to pause")
+	ErrTaskPaused     = errors.New("task is already paused")
+	ErrTaskNotPaused  = errors.New("task is not paused")
+)
+
+// DefaultSubscriberBufferSize is how many updates a subscriber's channel holds unless configured otherwise.
+const DefaultSubscriberBufferSize = 5
+
+// OverflowPolicy decides what happens to an update when a subscriber's channel is full.
+type OverflowPolicy string
+
+const (
+	OverflowDrop   OverflowPolicy = "drop"   // The new update is skipped, the subscriber catches up with later ones
+	OverflowLatest OverflowPolicy = "latest" // The oldest buffered update is discarded, so the newest state always gets through
+)
+
+// ParseOverflowPolicy parses "drop" or "latest" (case-insensitive).
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case OverflowDrop, OverflowLatest:
+		return policy, nil
+	default:
+		return OverflowDrop, fmt.Errorf("invalid overflow policy %q, expected drop or latest", value)
+	}
+}
+
 // StatusManager handles tracking and broadcasting transcoding progress.
+// Tasks owned by this instance live in tasks; updates reach subscribers through the broker,
+// which may also carry updates of tasks running on other instances.
 type StatusManager struct {
 	tasks       map[string]types.TaskStatus                     // Store last known status for each task
 	subscribers map[string]map[chan types.StatusUpdate]struct{} // Map of taskID to a map of subscriber channels
+	broker      StatusBroker                                    // Distributes updates to every instance's subscribers
 	mu          sync.RWMutex                                    // Mutex for concurrent access to maps
+
+	retainedTokens map[string]string // Tokens of removed tasks whose output can still be downloaded
+
+	bufferSize int            // Capacity of each subscriber's channel
+	overflow   OverflowPolicy // What to do with updates for a subscriber whose channel is full
+
+	monotonicProgress bool // Never let the progress reported for a resolution go backward
 }
 
-// NewStatusManager creates and returns a new StatusManager instance.
+// NewStatusManager creates and returns a new StatusManager instance backed by an in-memory broker.
 func NewStatusManager() *StatusManager {
-	return &StatusManager{
+	sm, _ := NewStatusManagerWithBroker(NewMemoryStatusBroker()) // The in-memory broker never fails to listen
+	return sm
+}
+
+// NewStatusManagerWithBroker creates a StatusManager that distributes updates through the given broker.
+func NewStatusManagerWithBroker(broker StatusBroker) (*StatusManager, error) {
+	sm := &StatusManager{
 		tasks:       make(map[string]types.TaskStatus),
 		subscribers: make(map[string]map[chan types.StatusUpdate]struct{}),
+		broker:      broker,
+
+		retainedTokens: make(map[string]string),
+		bufferSize:     DefaultSubscriberBufferSize,
+		overflow:       OverflowDrop,
+
+		monotonicProgress: true,
+	}
+
+	if err := broker.Listen(sm.broadcast, sm.closeSubscribers); err != nil {
+		return nil, fmt.Errorf("failed to listen for status updates: %w", err)
 	}
+	return sm, nil
 }
 
-// RegisterSubscriber registers a new client subscriber for a given taskID.
-// It returns a read-only channel where updates will be sent.
-func (sm *StatusManager) RegisterSubscriber(taskID string) (chan types.StatusUpdate, error) {
+// SetSubscriberBuffer configures the channel capacity and overflow policy of subscribers registered from now on.
+func (sm *StatusManager) SetSubscriberBuffer(size int, policy OverflowPolicy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.bufferSize = max(size, 1)
+	sm.overflow = policy
+}
+
+// SetMonotonicProgress configures whether the progress of each resolution is clamped to the highest
+// value reported so far. ffmpeg's position can briefly jump back, and a retried rendition starts
+// over, either of which makes progress bars jump backward.
+func (sm *StatusManager) SetMonotonicProgress(enabled bool) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	sm.monotonicProgress = enabled
+}
+
+// RegisterSubscriber registers a new client subscriber for a given taskID.
+// It returns a read-only channel where updates will be sent.
+func (sm *StatusManager) RegisterSubscriber(taskID string) (chan types.StatusUpdate, error) {
 	// Check if the task is active and known.
 	// A task is considered active if it exists in the sm.tasks map.
 	// SendUpdate adds tasks to sm.tasks, and RemoveTask deletes them.
-	currentStatus, taskExists := sm.tasks[taskID]
+	// Tasks running on another instance are only known to the broker, which is asked before
+	// locking as it may be a network round trip.
+	lastUpdate, taskExists := sm.lastUpdate(taskID)
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	// A local task may have moved on meanwhile
+	if task, ok := sm.tasks[taskID]; ok {
+		lastUpdate, taskExists = task.LastUpdate, true
+	}
 	if !taskExists {
 		// If task is not in sm.tasks, it means it hasn't received its first update,
 		// has already completed and been removed, or never existed.
-		log.Printf("Attempt to subscribe to non-existent or inactive task: %s", taskID)
+		logger.Infof("Attempt to subscribe to non-existent or inactive task: %s", taskID)
 		return nil, fmt.Errorf("task '%s' not found or not active", taskID)
 	}
 
@@ -49,24 +144,69 @@ func (sm *StatusManager) RegisterSubscriber(taskID string) (chan types.StatusUpd
 		sm.subscribers[taskID] = make(map[chan types.StatusUpdate]struct{})
 	}
 
+	// A client came back in time, so the task is no longer orphaned
+	if task := sm.tasks[taskID]; task.OrphanTimer != nil {
+		task.OrphanTimer.Stop()
+		task.OrphanTimer = nil
+		sm.tasks[taskID] = task
+		logger.Infof("Task %s has a subscriber again; not cancelling it", taskID)
+	}
+
 	// Create a buffered channel to prevent blocking the sender if the receiver is slow
 	// Buffer size can be tuned. A small buffer prevents excessive buffering.
-	clientChan := make(chan types.StatusUpdate, 5) // Buffer 5 updates
+	clientChan := make(chan types.StatusUpdate, sm.bufferSize)
 	sm.subscribers[taskID][clientChan] = struct{}{}
-	log.Printf("New subscriber registered for task: %s", taskID)
+	logger.Infof("New subscriber registered for task: %s", taskID)
 
 	// Send the last known status immediately to the new subscriber
-	// We already fetched currentStatus and know taskExists is true.
+	// We already fetched lastUpdate and know taskExists is true.
 	select {
-	case clientChan <- currentStatus.LastUpdate:
+	case clientChan <- lastUpdate:
 		// Sent successfully
 	default:
-		log.Printf("Failed to send initial status to a new subscriber for task: %s (channel: %p). Channel might be full or closed.", taskID, clientChan)
+		logger.Warnf("Failed to send initial status to a new subscriber for task: %s (channel: %p). Channel might be full or closed.", taskID, clientChan)
 	}
 
 	return clientChan, nil
 }
 
+// GetStatus returns the last known status update for a given taskID.
+// The boolean is false if the task is unknown or has already been removed.
+func (sm *StatusManager) GetStatus(taskID string) (types.StatusUpdate, bool) {
+	return sm.lastUpdate(taskID)
+}
+
+// ResolutionProgress returns a copy of the latest data reported for each rendition of a task
+// owned by this instance, keyed by resolution. The boolean is false if the task isn't known locally.
+func (sm *StatusManager) ResolutionProgress(taskID string) (map[string]types.TaskData, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	task, ok := sm.tasks[taskID]
+	if !ok {
+		return nil, false
+	}
+	return maps.Clone(task.Resolutions), true
+}
+
+// lastUpdate looks a task up locally first and then in the broker. Callers must not hold sm.mu,
+// so a slow broker doesn't hold up every other task.
+func (sm *StatusManager) lastUpdate(taskID string) (types.StatusUpdate, bool) {
+	sm.mu.RLock()
+	task, ok := sm.tasks[taskID]
+	sm.mu.RUnlock()
+	if ok {
+		return task.LastUpdate, true
+	}
+
+	update, ok, err := sm.broker.Lookup(taskID)
+	if err != nil {
+		logger.Errorf("Failed to look up task %s in status broker: %v", taskID, err)
+		return types.StatusUpdate{}, false
+	}
+	return update, ok
+}
+
 // DeregisterSubscriber removes a client subscriber for a given taskID.
 func (sm *StatusManager) DeregisterSubscriber(taskID string, clientChan chan types.StatusUpdate) {
 	sm.mu.Lock()
@@ -77,57 +217,207 @@ func (sm *StatusManager) DeregisterSubscriber(taskID string, clientChan chan typ
 		close(clientChan)         // Close the channel to signal done to client
 		if len(chans) == 0 {
 			delete(sm.subscribers, taskID) // Clean up if no more subscribers for this task
-			log.Printf("All subscribers deregistered for task: %s", taskID)
+			logger.Infof("All subscribers deregistered for task: %s", taskID)
+			sm.watchOrphan(taskID)
 		}
 	}
-	log.Printf("Subscriber deregistered for task: %s", taskID)
+	logger.Infof("Subscriber deregistered for task: %s", taskID)
 }
 
-// SendUpdate broadcasts a status update for a specific taskID to all its subscribers.
-func (sm *StatusManager) SendUpdate(taskID string, update types.StatusUpdate) {
+// SetCancelOnDisconnect has a task cancelled with CancelReasonDisconnected once all of its
+// subscribers have left and none subscribed again within grace. A task nobody ever subscribed to
+// is left running, as it may be followed by other means such as polling.
+func (sm *StatusManager) SetCancelOnDisconnect(taskID string, grace time.Duration) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	task := sm.tasks[taskID]
+	task.DisconnectGrace = grace
+	sm.tasks[taskID] = task
+}
+
+// watchOrphan schedules the cancellation of a task that just lost its last subscriber, if it asked
+// for that. The caller must hold sm.mu. Removed tasks aren't in sm.tasks, so they aren't watched.
+func (sm *StatusManager) watchOrphan(taskID string) {
+	task, ok := sm.tasks[taskID]
+	if !ok || task.DisconnectGrace <= 0 || task.OrphanTimer != nil {
+		return
+	}
+
+	logger.Infof("Task %s has no subscribers left; cancelling it unless one subscribes within %s", taskID, task.DisconnectGrace)
+	task.OrphanTimer = time.AfterFunc(task.DisconnectGrace, func() { sm.cancelOrphan(taskID) })
+	sm.tasks[taskID] = task
+}
+
+// cancelOrphan cancels a task whose grace period without subscribers is over, unless one has
+// subscribed meanwhile.
+func (sm *StatusManager) cancelOrphan(taskID string) {
+	sm.mu.Lock()
+	task, ok := sm.tasks[taskID]
+	if !ok || task.OrphanTimer == nil || len(sm.subscribers[taskID]) > 0 {
+		sm.mu.Unlock()
+		return
+	}
+	task.OrphanTimer = nil
+	sm.tasks[taskID] = task
+	sm.mu.Unlock()
+
+	logger.Infof("Cancelling task %s, as no client has been following it for %s", taskID, task.DisconnectGrace)
+	if err := sm.CancelTaskWithReason(taskID, types.CancelReasonDisconnected); err != nil {
+		logger.Warnf("Failed to cancel orphaned task %s: %v", taskID, err)
+	}
+}
+
+// SendUpdate broadcasts a status update for a specific taskID to all its subscribers.
+// Updates of a task are published one at a time, in the order they're recorded.
+func (sm *StatusManager) SendUpdate(taskID string, update types.StatusUpdate) {
+	publishMu := sm.publishLock(taskID)
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	sm.mu.Lock()
 	update.Timestamp = time.Now().UnixMilli() // Set timestamp for the update
 
 	// Update the last known status for this task
-	// Only update the LastUpdate field, preserving other fields like Cancel
+	// Only update the LastUpdate and Resolutions fields, preserving other fields like Cancel
 	task := sm.tasks[taskID]
+	if update.Data.Resolution != "" {
+		// Renditions run concurrently, so each keeps its own latest state
+		if task.Resolutions == nil {
+			task.Resolutions = make(map[string]types.TaskData)
+		}
+		if previous, ok := task.Resolutions[update.Data.Resolution]; ok && sm.monotonicProgress && update.Type == "progress" {
+			update.Data.Progress = max(update.Data.Progress, previous.Progress)
+		}
+		task.Resolutions[update.Data.Resolution] = update.Data
+		update.Resolutions = maps.Clone(task.Resolutions)
+	}
 	task.LastUpdate = update
 	sm.tasks[taskID] = task
+	sm.mu.Unlock()
+
+	// The broker calls back into broadcast, so it must be invoked without holding the lock
+	if err := sm.broker.Publish(taskID, update); err != nil {
+		logger.Errorf("Failed to publish update for task %s: %v", taskID, err)
+	}
+}
+
+// publishLock returns the mutex serializing the updates of taskID, creating the task entry if needed.
+// It must be locked without holding sm.mu, as it's held while publishing.
+func (sm *StatusManager) publishLock(taskID string) *sync.Mutex {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	task := sm.tasks[taskID]
+	if task.PublishMu == nil {
+		task.PublishMu = &sync.Mutex{}
+		sm.tasks[taskID] = task
+	}
+	return task.PublishMu
+}
+
+// broadcast delivers an update to all of this instance's subscribers of a task.
+func (sm *StatusManager) broadcast(taskID string, update types.StatusUpdate) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 
 	// Iterate over all subscribers for this task and send the update
 	if chans, ok := sm.subscribers[taskID]; ok {
 		for clientChan := range chans {
+			if sm.overflow == OverflowLatest {
+				sendLatest(clientChan, update)
+				continue
+			}
+
 			select {
 			case clientChan <- update:
 				// Sent successfully
 			default:
 				// If the client's channel is full, skip sending to avoid blocking
-				log.Printf("Skipping update for a slow subscriber for task %s, channel full.", taskID)
+				logger.Warnf("Skipping update for a slow subscriber for task %s, channel full.", taskID)
 			}
 		}
 	} else {
 		// If no subscribers, just log the update (useful for tasks that might run unattended)
 		jsonUpdate, _ := json.Marshal(update)
-		log.Printf("No subscribers for task %s, last update: %s", taskID, jsonUpdate)
+		logger.Debugf("No subscribers for task %s, last update: %s", taskID, jsonUpdate)
 	}
 }
 
-// RemoveTask clears a task's status and subscribers when it's fully done.
-func (sm *StatusManager) RemoveTask(taskID string) {
+// sendLatest sends update without blocking, discarding the oldest buffered updates while the channel is full.
+func sendLatest(clientChan chan types.StatusUpdate, update types.StatusUpdate) {
+	for {
+		select {
+		case clientChan <- update:
+			return
+		default:
+		}
+
+		// Make room; the subscriber may have drained the channel in the meantime, which is fine too
+		select {
+		case <-clientChan:
+		default:
+		}
+	}
+}
+
+// RetainToken keeps the access token of taskID once the task is removed, so its archived output
+// can still be downloaded. Must be called before RemoveTask.
+func (sm *StatusManager) RetainToken(taskID string) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	if task, ok := sm.tasks[taskID]; ok && task.Token != "" {
+		sm.retainedTokens[taskID] = task.Token
+	}
+}
+
+// StoreRetainedToken keeps token for taskID as RetainToken does, for a task that only exists as
+// downloadable output, e.g. one reusing the archive of an identical earlier job.
+func (sm *StatusManager) StoreRetainedToken(taskID, token string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.retainedTokens[taskID] = token
+}
+
+// ForgetToken drops the token kept by RetainToken, once the task's output is gone.
+func (sm *StatusManager) ForgetToken(taskID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.retainedTokens, taskID)
+}
+
+// RemoveTask clears a task's status and subscribers when it's fully done.
+func (sm *StatusManager) RemoveTask(taskID string) {
+	sm.mu.Lock()
 	// Clean up the cancel function if it exists to prevent memory leaks
 	if task, ok := sm.tasks[taskID]; ok {
 		if task.Cancel != nil {
 			// This is good practice although the context is likely already done.
-			task.Cancel()
+			task.Cancel(nil)
+		}
+		if task.OrphanTimer != nil {
+			task.OrphanTimer.Stop()
 		}
 	}
 
 	delete(sm.tasks, taskID)
+	sm.mu.Unlock()
+
+	// Let every instance close its subscribers for this task
+	if err := sm.broker.Remove(taskID); err != nil {
+		logger.Errorf("Failed to publish removal of task %s: %v", taskID, err)
+	}
+	logger.Infof("Task %s and its status/subscribers removed.", taskID)
+}
+
+// closeSubscribers closes and forgets all of this instance's subscribers of a task.
+func (sm *StatusManager) closeSubscribers(taskID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
 	// Subscribers should ideally be handled by DeregisterSubscriber, but this ensures cleanup
 	if chans, ok := sm.subscribers[taskID]; ok {
 		for clientChan := range chans {
@@ -135,11 +425,17 @@ func (sm *StatusManager) RemoveTask(taskID string) {
 		}
 		delete(sm.subscribers, taskID)
 	}
-	log.Printf("Task %s and its status/subscribers removed.", taskID)
+	logger.Infof("Subscribers of task %s closed.", taskID)
 }
 
-// CancelTask finds the cancel function for a task and executes it.
+// CancelTask finds the cancel function for a task and executes it, recording that the client asked for it.
+// Only tasks running on this instance can be cancelled.
 func (sm *StatusManager) CancelTask(taskID string) error {
+	return sm.CancelTaskWithReason(taskID, types.CancelReasonUser)
+}
+
+// CancelTaskWithReason cancels a task like CancelTask, with reason as the cause of its context.
+func (sm *StatusManager) CancelTaskWithReason(taskID string, reason types.CancelReason) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -155,33 +451,224 @@ func (sm *StatusManager) CancelTask(taskID string) error {
 		return fmt.Errorf("no cancel function registered for task %s", taskID)
 	}
 
-	task.Cancel() // Execute the context cancel function
-	log.Printf("Cancellation signal sent for task: %s", taskID)
+	task.Cancel(reason) // Execute the context cancel function, recording why
+	logger.Infof("Cancellation signal (%s) sent for task: %s", reason, taskID)
 
 	// remove the output directory for this task
 	if err := utils.RemoveOutputDirectory(taskID); err != nil {
 		errMsg := fmt.Sprintf("failed to remove output directory for task %s: %v", taskID, err)
-		log.Println(errMsg)
+		logger.Warnf("%s", errMsg)
 		return fmt.Errorf("%s", errMsg)
 	}
 
 	return nil
 }
 
+// TrackProcess records a running ffmpeg process of a task so PauseTask and ResumeTask can signal
+// it, stopping it right away if the task is paused. The returned function forgets the process
+// again and must be called once it has exited, before its PID can be reused.
+func (sm *StatusManager) TrackProcess(taskID string, process *os.Process) (untrack func()) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	task := sm.tasks[taskID]
+	if task.Processes == nil {
+		task.Processes = make(map[*os.Process]struct{})
+	}
+	task.Processes[process] = struct{}{}
+	sm.tasks[taskID] = task
+	if task.Paused {
+		if err := signalPause(process, true); err != nil {
+			logger.Warnf("Failed to pause new process %d of paused task %s: %v", process.Pid, taskID, err)
+		}
+	}
+
+	return func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+		if task, ok := sm.tasks[taskID]; ok {
+			delete(task.Processes, process)
+		}
+	}
+}
+
+// RunProcess runs cmd to completion as a process of the task, tracked with TrackProcess so pausing
+// the task stops it, and returns its combined output like exec.Cmd.CombinedOutput.
+func (sm *StatusManager) RunProcess(taskID string, cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	startInOwnGroup(cmd) // The task can be paused by stopping the group
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	untrack := sm.TrackProcess(taskID, cmd.Process)
+	err := cmd.Wait()
+	untrack()
+	return output.Bytes(), err
+}
+
+// CommandRunner returns a utils.CommandRunner running commands with RunProcess, for the ffmpeg
+// runs of utils to be paused along with the rest of the task.
+func (sm *StatusManager) CommandRunner(taskID string) utils.CommandRunner {
+	return func(cmd *exec.Cmd) ([]byte, error) {
+		return sm.RunProcess(taskID, cmd)
+	}
+}
+
+// StoreDeadline records when a started task times out, for clients pausing it to be told.
+func (sm *StatusManager) StoreDeadline(taskID string, deadline time.Time) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	task := sm.tasks[taskID]
+	task.Deadline = deadline
+	sm.tasks[taskID] = task
+}
+
+// Deadline returns when a task times out, and false if it has no timeout (yet).
+func (sm *StatusManager) Deadline(taskID string) (time.Time, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	deadline := sm.tasks[taskID].Deadline
+	return deadline, !deadline.IsZero()
+}
+
+// PauseTask stops the running ffmpeg processes of a task with SIGSTOP until ResumeTask is called.
+// Every ffmpeg run of a task can be paused, as long as it goes through TrackProcess or RunProcess,
+// but a task that is queued or between steps has nothing to pause.
+// A paused task keeps its worker, and its timeout keeps running (see Deadline), so a forgotten
+// pause can't hold a worker forever.
+func (sm *StatusManager) PauseTask(taskID string) error {
+	return sm.setPaused(taskID, true)
+}
+
+// ResumeTask continues the ffmpeg processes of a task paused with PauseTask.
+func (sm *StatusManager) ResumeTask(taskID string) error {
+	return sm.setPaused(taskID, false)
+}
+
+// IsPaused reports whether a task of this instance is paused.
+func (sm *StatusManager) IsPaused(taskID string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.tasks[taskID].Paused
+}
+
+func (sm *StatusManager) setPaused(taskID string, pause bool) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	task, ok := sm.tasks[taskID]
+	switch {
+	case !ok:
+		return ErrTaskNotFound
+	case pause && task.Paused:
+		return ErrTaskPaused
+	case !pause && !task.Paused:
+		return ErrTaskNotPaused
+	case pause && len(task.Processes) == 0:
+		return ErrTaskNotRunning
+	}
+
+	for process := range task.Processes {
+		if err := signalPause(process, pause); err != nil {
+			return fmt.Errorf("failed to signal process %d of task %s: %w", process.Pid, taskID, err)
+		}
+	}
+	task.Paused = pause
+	sm.tasks[taskID] = task
+	logger.Infof("Task %s paused: %t (%d processes)", taskID, pause, len(task.Processes))
+	return nil
+}
+
+// StoreToken stores the access token for a given taskID.
+func (sm *StatusManager) StoreToken(taskID, token string) {
+	sm.mu.Lock()
+	task := sm.tasks[taskID]
+	task.Token = token
+	sm.tasks[taskID] = task
+	sm.mu.Unlock()
+
+	if err := sm.broker.StoreToken(taskID, token); err != nil {
+		logger.Errorf("Failed to share token of task %s: %v", taskID, err)
+	}
+}
+
+// StoreRequestID records the correlation ID of the request that created taskID.
+func (sm *StatusManager) StoreRequestID(taskID, requestID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	task := sm.tasks[taskID]
+	task.RequestID = requestID
+	sm.tasks[taskID] = task
+}
+
+// LogTag returns the identifier to put in log lines about taskID: the task ID,
+// followed by the correlation ID of the request that created it, if known.
+func (sm *StatusManager) LogTag(taskID string) string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if requestID := sm.tasks[taskID].RequestID; requestID != "" {
+		return fmt.Sprintf("%s request_id=%s", taskID, requestID)
+	}
+	return taskID
+}
+
+// Authorize checks that token grants access to taskID.
+// It returns ErrTaskNotFound for unknown tasks and ErrInvalidTaskToken on a mismatch.
+func (sm *StatusManager) Authorize(taskID, token string) error {
+	sm.mu.RLock()
+	task, ok := sm.tasks[taskID]
+	expected := task.Token
+	if !ok {
+		expected, ok = sm.retainedTokens[taskID]
+	}
+	sm.mu.RUnlock()
+
+	if !ok {
+		// Tasks running on another instance are only known to the broker.
+		var err error
+		expected, ok, err = sm.broker.Token(taskID)
+		if err != nil {
+			logger.Errorf("Failed to look up token of task %s: %v", taskID, err)
+		}
+		if !ok {
+			return ErrTaskNotFound
+		}
+	}
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return ErrInvalidTaskToken
+	}
+	return nil
+}
+
 // StoreCancelFunc stores the cancel function for a given taskID.
+// The task's cancellation cause is then only what its context reports on its own;
+// use StoreCancelCauseFunc to have CancelTask record CancelReasonUser.
 func (sm *StatusManager) StoreCancelFunc(taskID string, cancel context.CancelFunc) {
+	sm.StoreCancelCauseFunc(taskID, func(error) { cancel() })
+}
+
+// StoreCancelCauseFunc stores the cancel function for a given taskID.
+// CancelTask calls it with CancelReasonUser as the cause, CancelTaskWithReason with its reason.
+func (sm *StatusManager) StoreCancelCauseFunc(taskID string, cancel context.CancelCauseFunc) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
 	// It's possible the first status update hasn't happened yet,
 	// so we ensure the task entry exists.
 	if task, ok := sm.tasks[taskID]; ok {
-		log.Printf("Storing cancel function for task: %s", taskID)
+		logger.Debugf("Storing cancel function for task: %s", taskID)
 
 		task.Cancel = cancel
 		sm.tasks[taskID] = task
 	} else {
-		log.Printf("Creating new task entry for cancel function: %s", taskID)
+		logger.Debugf("Creating new task entry for cancel function: %s", taskID)
 
 		sm.tasks[taskID] = types.TaskStatus{Cancel: cancel}
 	}
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/services/utils"
+	"github.com/PratikDev/transcoder/types"
+)
+
+// fakeBroker is a StatusBroker whose calls can be slowed down or blocked, delivering to its
+// listener in process like MemoryStatusBroker.
+type fakeBroker struct {
+	MemoryStatusBroker
+
+	lookupStarted chan string   // Receives the task ID of every Lookup, if set
+	lookupRelease chan struct{} // Lookup blocks until it's closed, if set
+	onPublish     func(taskID string, update types.StatusUpdate)
+}
+
+func (b *fakeBroker) Lookup(taskID string) (types.StatusUpdate, bool, error) {
+	if b.lookupStarted != nil {
+		b.lookupStarted <- taskID
+	}
+	if b.lookupRelease != nil {
+		<-b.lookupRelease
+	}
+	return types.StatusUpdate{}, false, nil
+}
+
+func (b *fakeBroker) Publish(taskID string, update types.StatusUpdate) error {
+	if b.onPublish != nil {
+		b.onPublish(taskID, update)
+	}
+	return b.MemoryStatusBroker.Publish(taskID, update)
+}
+
+func newTestStatusManager(t *testing.T, broker StatusBroker) *StatusManager {
+	t.Helper()
+	sm, err := NewStatusManagerWithBroker(broker)
+	if err != nil {
+		t.Fatalf("NewStatusManagerWithBroker: %v", err)
+	}
+	return sm
+}
+
+func TestStatusManagerBrokerLookupDoesNotBlockOtherTasks(t *testing.T) {
+	broker := &fakeBroker{lookupStarted: make(chan string, 1), lookupRelease: make(chan struct{})}
+	sm := newTestStatusManager(t, broker)
+	sm.SendUpdate("local", types.StatusUpdate{Type: "progress", Message: "working"})
+
+	// A task only the broker could know about is looked up, and the broker hangs
+	remoteDone := make(chan struct{})
+	go func() {
+		defer close(remoteDone)
+		sm.GetStatus("remote")
+	}()
+	<-broker.lookupStarted
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sm.SendUpdate("local", types.StatusUpdate{Type: "progress", Message: "still working"})
+		if update, ok := sm.GetStatus("local"); !ok || update.Message != "still working" {
+			t.Errorf("GetStatus(local) = %+v, %t", update, ok)
+		}
+		clientChan, err := sm.RegisterSubscriber("local")
+		if err != nil {
+			t.Errorf("RegisterSubscriber(local): %v", err)
+			return
+		}
+		sm.DeregisterSubscriber("local", clientChan)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a pending broker lookup blocked updates and lookups of another task")
+	}
+	close(broker.lookupRelease)
+	<-remoteDone
+}
+
+func TestStatusManagerPublishesUpdatesInOrder(t *testing.T) {
+	broker := &fakeBroker{}
+	sm := newTestStatusManager(t, broker)
+	sm.SetMonotonicProgress(false)
+
+	// While an update is being published, no later one may have been recorded yet; otherwise
+	// subscribers could receive the two out of order
+	var mu sync.Mutex
+	var published []float64
+	broker.onPublish = func(taskID string, update types.StatusUpdate) {
+		time.Sleep(time.Duration(rand.IntN(200)) * time.Microsecond)
+		if latest, _ := sm.GetStatus(taskID); latest.Data.Progress != update.Data.Progress {
+			t.Errorf("publishing progress %v while %v is already recorded", update.Data.Progress, latest.Data.Progress)
+		}
+		mu.Lock()
+		published = append(published, update.Data.Progress)
+		mu.Unlock()
+	}
+
+	const senders, updates = 8, 25
+	var wg sync.WaitGroup
+	for sender := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range updates {
+				sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Data: types.TaskData{Progress: float64(sender*updates + i)}})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(published) != senders*updates {
+		t.Fatalf("published %d updates, want %d", len(published), senders*updates)
+	}
+	latest, _ := sm.GetStatus("task")
+	if last := published[len(published)-1]; latest.Data.Progress != last {
+		t.Errorf("last published progress %v, but %v is recorded as the latest", last, latest.Data.Progress)
+	}
+}
+
+func TestStatusManagerSubscriberReceivesLatestAndLaterUpdates(t *testing.T) {
+	sm := NewStatusManager()
+	sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Message: "first"})
+
+	clientChan, err := sm.RegisterSubscriber("task")
+	if err != nil {
+		t.Fatalf("RegisterSubscriber: %v", err)
+	}
+	sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Message: "second"})
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case update := <-clientChan:
+			if update.Message != want {
+				t.Errorf("received %q, want %q", update.Message, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no update %q received", want)
+		}
+	}
+
+	sm.RemoveTask("task")
+	if _, ok := <-clientChan; ok {
+		t.Error("subscriber channel still open after RemoveTask")
+	}
+	if _, err := sm.RegisterSubscriber("task"); err == nil {
+		t.Error("RegisterSubscriber succeeded for a removed task")
+	}
+}
+
+func TestStatusManagerOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy OverflowPolicy
+		want   []string
+	}{
+		{policy: OverflowDrop, want: []string{"update 0", "update 1", "update 2"}},   // Later updates are skipped
+		{policy: OverflowLatest, want: []string{"update 7", "update 8", "update 9"}}, // Older updates make room
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			sm := NewStatusManager()
+			sm.SetSubscriberBuffer(3, tt.policy)
+			sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Message: "update 0"})
+
+			// The subscriber doesn't read until all updates are sent, overflowing its channel
+			clientChan, err := sm.RegisterSubscriber("task")
+			if err != nil {
+				t.Fatalf("RegisterSubscriber: %v", err)
+			}
+			if cap(clientChan) != 3 {
+				t.Errorf("channel capacity = %d, want 3", cap(clientChan))
+			}
+			for i := 1; i < 10; i++ {
+				sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Message: fmt.Sprintf("update %d", i)})
+			}
+
+			var received []string
+			for len(clientChan) > 0 {
+				received = append(received, (<-clientChan).Message)
+			}
+			if !slices.Equal(received, tt.want) {
+				t.Errorf("received %v, want %v", received, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusManagerMonotonicProgress(t *testing.T) {
+	// Out of order, with a jump back and a retry of 720P starting over, and 480P reporting in between
+	sent := []types.TaskData{
+		{Resolution: "720P", Progress: 10},
+		{Resolution: "720P", Progress: 40},
+		{Resolution: "720P", Progress: 35},
+		{Resolution: "480P", Progress: 5},
+		{Resolution: "720P", Progress: 0},
+		{Resolution: "720P", Progress: 55},
+		{Resolution: "480P", Progress: 3},
+	}
+	tests := []struct {
+		monotonic bool
+		want      []float64
+	}{
+		{monotonic: true, want: []float64{10, 40, 40, 5, 40, 55, 5}},
+		{monotonic: false, want: []float64{10, 40, 35, 5, 0, 55, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.monotonic), func(t *testing.T) {
+			var mu sync.Mutex
+			var published []float64
+			sm := newTestStatusManager(t, &fakeBroker{onPublish: func(taskID string, update types.StatusUpdate) {
+				mu.Lock()
+				defer mu.Unlock()
+				published = append(published, update.Data.Progress)
+			}})
+			sm.SetMonotonicProgress(tt.monotonic)
+
+			for _, data := range sent {
+				sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Data: data})
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(published, tt.want) {
+				t.Errorf("published progress = %v, want %v", published, tt.want)
+			}
+			update, _ := sm.GetStatus("task")
+			if got := update.Resolutions["480P"].Progress; got != tt.want[len(tt.want)-1] {
+				t.Errorf("Resolutions[480P].Progress = %v, want %v", got, tt.want[len(tt.want)-1])
+			}
+		})
+	}
+
+	// Only progress updates are clamped; a rendition's failure reports where it really stopped
+	sm := NewStatusManager()
+	sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Data: types.TaskData{Resolution: "720P", Progress: 60}})
+	sm.SendUpdate("task", types.StatusUpdate{Type: "failed", Data: types.TaskData{Resolution: "720P", Progress: 20}})
+	if update, _ := sm.GetStatus("task"); update.Data.Progress != 20 {
+		t.Errorf("failed update progress = %v, want 20 as sent", update.Data.Progress)
+	}
+}
+
+func TestStatusManagerCancelsOrphanedTasks(t *testing.T) {
+	previous := utils.OUTPUT_DIR
+	utils.OUTPUT_DIR = t.TempDir() // Cancelling removes the task's output folder
+	t.Cleanup(func() { utils.OUTPUT_DIR = previous })
+	const grace = 20 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		subscribe func(sm *StatusManager) // Subscribes and leaves in some pattern
+		cancelled bool
+	}{
+		{
+			name: "last subscriber left", enabled: true, cancelled: true,
+			subscribe: func(sm *StatusManager) {
+				first, _ := sm.RegisterSubscriber("task")
+				second, _ := sm.RegisterSubscriber("task")
+				sm.DeregisterSubscriber("task", first)
+				sm.DeregisterSubscriber("task", second)
+			},
+		},
+		{
+			name: "subscriber came back", enabled: true,
+			subscribe: func(sm *StatusManager) {
+				ch, _ := sm.RegisterSubscriber("task")
+				sm.DeregisterSubscriber("task", ch)
+				sm.RegisterSubscriber("task")
+			},
+		},
+		{
+			name: "one subscriber left", enabled: true,
+			subscribe: func(sm *StatusManager) {
+				first, _ := sm.RegisterSubscriber("task")
+				sm.RegisterSubscriber("task")
+				sm.DeregisterSubscriber("task", first)
+			},
+		},
+		{name: "never subscribed", enabled: true, subscribe: func(sm *StatusManager) {}},
+		{
+			name: "option off",
+			subscribe: func(sm *StatusManager) {
+				ch, _ := sm.RegisterSubscriber("task")
+				sm.DeregisterSubscriber("task", ch)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewStatusManager()
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			sm.StoreCancelCauseFunc("task", cancel)
+			if tt.enabled {
+				sm.SetCancelOnDisconnect("task", grace)
+			}
+
+			tt.subscribe(sm)
+			if tt.cancelled {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			} else {
+				time.Sleep(5 * grace)
+			}
+
+			cause := context.Cause(ctx)
+			if got := errors.Is(cause, types.CancelReasonDisconnected); got != tt.cancelled {
+				t.Errorf("cancel cause = %v, want cancelled for disconnection: %v", cause, tt.cancelled)
+			}
+			// Stops a pending timer, and waits for a cancellation in progress to finish with the
+			// output folder, before OUTPUT_DIR is restored
+			sm.RemoveTask("task")
+		})
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for value, want := range map[string]OverflowPolicy{"drop": OverflowDrop, " Latest ": OverflowLatest} {
+		if got, err := ParseOverflowPolicy(value); err != nil || got != want {
+			t.Errorf("ParseOverflowPolicy(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseOverflowPolicy("block"); err == nil {
+		t.Error("ParseOverflowPolicy accepted block")
+	}
+}
+
+func TestStatusManagerTracksConcurrentResolutions(t *testing.T) {
+	sm := NewStatusManager()
+	resolutions := []string{"1080P", "720P", "480P"}
+
+	var wg sync.WaitGroup
+	for _, res := range resolutions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for progress := range 51 {
+				sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Data: types.TaskData{Resolution: res, Progress: float64(progress * 2)}})
+			}
+		}()
+	}
+	wg.Wait()
+	sm.SendUpdate("task", types.StatusUpdate{Type: "progress", Data: types.TaskData{Resolution: "720P", Progress: 100, Frame: "last"}})
+
+	update, ok := sm.GetStatus("task")
+	if !ok {
+		t.Fatal("task unknown")
+	}
+	if len(update.Resolutions) != len(resolutions) {
+		t.Fatalf("Resolutions = %+v, want an entry per rendition", update.Resolutions)
+	}
+	for _, res := range resolutions {
+		if data := update.Resolutions[res]; data.Resolution != res || data.Progress != 100 {
+			t.Errorf("Resolutions[%s] = %+v, want it at 100%%", res, data)
+		}
+	}
+	if update.Resolutions["720P"].Frame != "last" {
+		t.Error("the latest update of a rendition didn't replace its earlier state")
+	}
+}
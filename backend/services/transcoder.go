@@ -3,17 +3,22 @@ package services
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/PratikDev/transcoder/logger"
 	"github.com/PratikDev/transcoder/services/utils"
 	"github.com/PratikDev/transcoder/types"
 )
@@ -21,81 +26,349 @@ import (
 // Transcoder handles the video transcoding process.
 type Transcoder struct {
 	source        types.TranscoderSource
+	options       types.TranscodeOptions
 	resolutions   []types.Resolutions
+	native        *types.ResolutionPreset // Set when the source is smaller than every preset and is transcoded as is
+	tonemap       bool                    // Whether the source is HDR and has to be tone-mapped to SDR
+	streamCopy    bool                    // Whether the source is segmented as is instead of being re-encoded
+	inputFilters  []string                // Filters normalizing the source (deinterlacing, square pixels) before scaling
+	sourceKbps    int                     // Video bitrate of the source that renditions are capped at, 0 if unknown
+	hasAudio      bool                    // Whether the source has an audio stream
+	frameRate     string                  // Frame rate of the source as ffprobe reports it, e.g. "30000/1001"
+	subtitles     []types.SubtitleStream  // Subtitle streams of the source, only detected when they're to be extracted
+	audioStreams  []types.AudioStream     // Audio streams of the source, only detected when they're to be encoded separately
 	output        string
 	statusMgr     *StatusManager // Reference to the StatusManager
 	taskID        string         // Unique ID for this transcoding task
+	logTag        string         // Task ID and request correlation ID, prefixed to log lines about this task
 	inputDuration float64        // Store input video duration for progress calculation
+
+	subtitleTracks []types.SubtitleTrack // Subtitles extracted for the master playlist
+	audioTracks    []types.AudioTrack    // Audio renditions encoded for the master playlist
+
+	outputBytes atomic.Int64 // Bytes written to the output folder so far
+
+	speedMu   sync.Mutex
+	speeds    map[types.Resolutions]utils.SpeedAverage // ffmpeg speed samples of every finished rendition
+	errorCode atomic.Value                             // Code of the last classified failure (string), reported with the job's final failure
 }
 
 // NewTranscoder creates a new Transcoder instance.
-func NewTranscoder(source types.TranscoderSource, outputDir string, statusMgr *StatusManager, taskID string) *Transcoder {
+// It returns an error if the source can't be probed or the options don't fit it.
+func NewTranscoder(source types.TranscoderSource, options types.TranscodeOptions, outputDir string, statusMgr *StatusManager, taskID string) (*Transcoder, error) {
+	// The container is identified by ffprobe rather than trusted from the file extension,
+	// so any format ffmpeg can demux (e.g. .ts, .flv, .wmv, .mkv) is accepted.
+	info, err := utils.ProbeMedia(source.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe source: %w", err)
+	}
+	stream, ok := utils.VideoStream(info)
+	if !ok {
+		return nil, fmt.Errorf("%s has no video stream", source.Filename)
+	}
+	if utils.IsStillImage(info) {
+		return nil, fmt.Errorf("%w: %s is a still image (%s)", ErrZeroDuration, source.Filename, info.Format.FormatName)
+	}
+	inputFilters := utils.InputFilters(stream, options.Deinterlace, options.Denoise)
+	logger.Infof("[info]: %s is %s video in %s; input filters: %v", source.File, stream.CodecName, info.Format.FormatName, inputFilters)
+
 	// Get video resolution
-	vidResolution, err := utils.DetectVideoResolution(source.File)
+	width, height, err := utils.VideoDimensions(info)
 	if err != nil {
-		log.Printf("[error]: failed to detect video resolution for %s: %v", source.File, err)
-		return nil
+		return nil, fmt.Errorf("failed to detect video resolution: %w", err)
+	}
+	sourceHeight := height // Of the source itself, for the stream copy check
+
+	// A padded video is the frame it's padded to as far as the ladder is concerned
+	if options.Pad.Width > 0 {
+		logger.Infof("[info]: %s is %dx%d; padding it to %dx%d", source.File, width, height, options.Pad.Width, options.Pad.Height)
+		width, height = options.Pad.Width, options.Pad.Height
 	}
 
-	// Get target targetResolutions based on the detected video resolution
-	targetResolutions := utils.GetTargetResolutions(vidResolution)
+	// Rotated sources (typically phone videos) are rotated upright by ffmpeg while decoding,
+	// so the dimensions above are already the upright ones.
+	rotation := utils.StreamRotation(stream)
+	if rotation != 0 {
+		logger.Infof("[info]: %s is rotated by %d degrees; transcoding it upright as %dx%d", source.File, rotation, width, height)
+	}
+
+	// Get target targetResolutions based on the detected video resolution.
+	// Sources below the smallest preset get a single rendition at their own size instead.
+	var targetResolutions []types.Resolutions
+	var native *types.ResolutionPreset
+	if height < utils.MinLadderHeight() {
+		preset := utils.NativePreset(width, height)
+		native = &preset
+		targetResolutions = []types.Resolutions{types.Resolutions(preset.Height)}
+		logger.Infof("[info]: %s is %dx%d, below every preset; using a native %dx%d rendition", source.File, width, height, preset.Width, preset.Height)
+	} else {
+		targetResolutions = utils.GetTargetResolutions(utils.MatchResolution(width, height), options.MaxRenditions, options.MaxHeight)
+		if len(options.Ladder) > 0 {
+			targetResolutions = utils.FitLadder(targetResolutions, options.Ladder)
+		}
+	}
 	if len(targetResolutions) == 0 {
-		log.Printf("[error]: no valid resolutions found for %s", source.File)
-		return nil
+		return nil, fmt.Errorf("no valid resolutions found for %dx%d below the maximum output height", width, height)
 	}
 
 	// Get the input video duration
-	inputDuration, err := utils.DetectInputDuration(source.File)
+	inputDuration, err := utils.InputDuration(info)
 	if err != nil {
-		log.Printf("[error]: failed to detect input duration for %s: %v", source.File, err)
-		return nil
+		return nil, fmt.Errorf("failed to detect input duration: %w", err)
 	}
 	if inputDuration <= 0 {
-		log.Printf("[error]: invalid input duration for %s: %f", source.File, inputDuration)
-		return nil
+		return nil, fmt.Errorf("%w: %s has a duration of %f", ErrZeroDuration, source.Filename, inputDuration)
+	}
+
+	// Tone-mapping is only applied to sources that actually are HDR
+	tonemap := false
+	if options.Tonemap {
+		transfer := utils.ColorTransfer(info)
+		tonemap = utils.IsHDRTransfer(transfer)
+		logger.Infof("[info]: %s has color transfer %q; tone-mapping: %t", source.File, transfer, tonemap)
+	}
+
+	// Only the trimmed portion is transcoded, so progress is measured against its length
+	if options.StartTime > 0 || options.EndTime > 0 {
+		if options.StartTime >= inputDuration {
+			return nil, fmt.Errorf("start time %.3fs is beyond the input duration of %.3fs", options.StartTime, inputDuration)
+		}
+		if options.EndTime > inputDuration {
+			return nil, fmt.Errorf("end time %.3fs is beyond the input duration of %.3fs", options.EndTime, inputDuration)
+		}
+		inputDuration = utils.TrimmedDuration(inputDuration, options.StartTime, options.EndTime)
+	}
+
+	// Chapters are given against the source; only the transcoded portion keeps them
+	if len(options.Chapters) > 0 {
+		count := len(options.Chapters)
+		options.Chapters = utils.NormalizeChapters(options.Chapters, options.StartTime, inputDuration)
+		logger.Infof("[info]: %s has %d of %d chapters within the output", source.File, len(options.Chapters), count)
+	}
+
+	// Sources that already are small H.264/AAC are segmented as they are; encoding would only lose quality
+	streamCopy := false
+	if options.SmartCopy {
+		var reason string
+		streamCopy, reason = utils.CanStreamCopy(info, sourceHeight, rotation, options.PixFmt)
+		switch {
+		case !streamCopy:
+			logger.Infof("[info]: %s needs re-encoding: %s", source.File, reason)
+		case tonemap || options.TargetSizeMB > 0 || len(options.Bitrates) > 0 || options.Codec != types.CodecH264 || options.AudioCodec != types.AudioAAC ||
+			options.Profile != "" || options.Level != "" || options.Deinterlace == types.DeinterlaceOn || options.Denoise > 0 || options.Pad.Width > 0:
+			// Tone-mapping, bitrate, codec, profile and filter choices only take effect when encoding
+			streamCopy = false
+			logger.Infof("[info]: %s needs re-encoding for the requested options", source.File)
+		default:
+			logger.Infof("[info]: %s already matches the %s rendition; segmenting it with stream copy", source.File, targetResolutions[0])
+			if kbps, err := strconv.Atoi(stream.BitRate); err == nil && kbps > 0 {
+				// The source bitrate is what the master playlist should advertise for the copied rendition
+				options.Bitrates = map[types.Resolutions]int{targetResolutions[0]: max(kbps/1000, 1)}
+			}
+		}
+	}
+
+	// Renditions are never encoded at a higher bitrate than the source has
+	sourceKbps, err := utils.SourceBitrate(info)
+	if err != nil {
+		logger.Warnf("[warning]: %s has no known bitrate, renditions are not capped: %v", source.File, err)
+		sourceKbps = 0
+	} else {
+		logger.Infof("[info]: %s has a video bitrate of %d kbps", source.File, sourceKbps)
+	}
+
+	// A target size replaces the preset bitrates with a budget, dropping renditions that don't fit it
+	if options.TargetSizeMB > 0 {
+		presets := make(map[types.Resolutions]types.ResolutionPreset, len(targetResolutions))
+		for _, res := range targetResolutions {
+			if native != nil {
+				presets[res] = *native
+			} else {
+				presets[res] = types.Presets()[res]
+			}
+		}
+		targetResolutions, options.Bitrates, err = utils.BudgetBitrates(targetResolutions, presets, options.TargetSizeMB, inputDuration)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("[info]: %s budgeted to %d MB with video bitrates %v", source.File, options.TargetSizeMB, options.Bitrates)
+	}
+
+	var audioStreams []types.AudioStream
+	if options.AudioTracks {
+		audioStreams = utils.AudioStreams(info)
+		logger.Infof("[info]: %s has %d audio streams", source.File, len(audioStreams))
+	}
+
+	var subtitles []types.SubtitleStream
+	if options.Subtitles {
+		subtitles = utils.SubtitleStreams(info)
+		logger.Infof("[info]: %s has %d subtitle streams", source.File, len(subtitles))
 	}
 
 	return &Transcoder{
 		source:        source,
+		options:       options,
 		resolutions:   targetResolutions,
+		native:        native,
+		tonemap:       tonemap,
+		streamCopy:    streamCopy,
+		inputFilters:  inputFilters,
+		sourceKbps:    sourceKbps,
+		hasAudio:      slices.ContainsFunc(info.Streams, func(s types.FFProbeStream) bool { return s.CodecType == "audio" }),
+		frameRate:     stream.RFrameRate,
+		subtitles:     subtitles,
+		audioStreams:  audioStreams,
 		output:        outputDir,
 		statusMgr:     statusMgr,
 		taskID:        taskID,
+		logTag:        statusMgr.LogTag(taskID),
 		inputDuration: inputDuration,
-	}
+	}, nil
 }
 
 // Process starts the transcoding process for the source video.
+// The job is aborted with a "timed_out" status if it runs longer than its timeout.
 func (t *Transcoder) Process(ctx context.Context) {
 	item := t.source
+
+	timeout := utils.JobTimeout(t.inputDuration)
+	if t.options.Codec == types.CodecAV1 {
+		// AV1 is far slower than H.264; the job gets correspondingly more time and the client is told to expect it
+		slowdown := utils.AV1Slowdown(t.options.Speed)
+		timeout *= time.Duration(slowdown)
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+			Type:    "warning",
+			Message: fmt.Sprintf("AV1 encoding at speed %d takes about %dx as long as H.264; this job may run for up to %s.", t.options.Speed, slowdown, timeout),
+		})
+	}
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, timeout, types.CancelReasonTimeout)
+	defer cancelTimeout()
+	logger.Infof("[%s] Job timeout set to %s", t.logTag, timeout)
+	if deadline, ok := ctx.Deadline(); ok {
+		t.statusMgr.StoreDeadline(t.taskID, deadline)
+	}
+	// The ffmpeg runs of utils, such as audio extraction or the preview, are paused with the task too
+	ctx = utils.WithCommandRunner(ctx, t.statusMgr.CommandRunner(t.taskID))
 	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "started", Message: fmt.Sprintf("Transcoding started for %s", item.Filename)})
 
+	if t.native != nil {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+			Type:    "progress",
+			Message: fmt.Sprintf("Source is smaller than the lowest preset; producing a single %dx%d rendition", t.native.Width, t.native.Height),
+		})
+	}
+
 	// Create output directory for this task
 	outputFolder, err := utils.CreateOutputDirectory(t.taskID)
 	if err != nil {
-		log.Printf("[failed]: %v", err)
+		logger.Errorf("[failed]: %v", err)
 		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to create output directory for %s", item.Filename)})
 		return
 	}
 
-	success := t.transcodeResolutions(ctx, outputFolder)
+	// Every folder is created and checked up front, so a storage problem fails the job before any encode starts
+	if err := t.prepareOutputFolders(outputFolder); err != nil {
+		logger.Errorf("[failed]: %v", err)
+		t.discardOutput(outputFolder)
+		code, msg := errCodeOutputUnwritable, fmt.Sprintf("The output of %s can't be written on the server.", item.Filename)
+		if errors.Is(err, syscall.ENOSPC) {
+			code, msg = errCodeStorageFull, storageFullMessage
+		}
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: msg, Data: types.TaskData{ErrorCode: code}})
+		return
+	}
+
+	// Keep track of the output size while transcoding, aborting the renditions if it exceeds the quota
+	transcodeCtx, stopTranscode := context.WithCancelCause(ctx)
+	watcherDone := make(chan struct{})
+	go t.watchOutputSize(transcodeCtx, stopTranscode, outputFolder, watcherDone)
+
+	playlists, failed, success := t.transcodeResolutions(transcodeCtx, outputFolder)
+	audioPath := ""
+	if success && t.options.AudioFormat != "" {
+		audioPath, success = t.extractAudio(transcodeCtx, outputFolder)
+	}
+	previewPath := ""
+	if success && t.options.PreviewFormat != "" {
+		previewPath, success = t.generatePreview(transcodeCtx, outputFolder)
+	}
+	quotaExceeded := types.CancelReasonFromContext(transcodeCtx) == types.CancelReasonQuota
+	stopTranscode(nil)
+	<-watcherDone
+
 	if !success {
-		// Check if the context was cancelled.
-		if ctx.Err() == context.Canceled {
-			log.Printf("[cancelled]: Transcoding for %s was cancelled by user.", item.Filename)
-			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "cancelled", Message: fmt.Sprintf("Transcoding cancelled for %s", item.Filename)})
-		} else {
-			log.Printf("[failed]: Transcoding for %s failed.", item.Filename)
-			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Transcoding failed for %s", item.Filename)})
+		// Partial output of a failed job is of no use to anyone
+		t.discardOutput(outputFolder)
+
+		// Tell the client why the task stopped, based on the cause its context was cancelled with.
+		reason := types.CancelReasonFromContext(ctx)
+		if quotaExceeded {
+			reason = types.CancelReasonQuota
+		}
+
+		switch reason {
+		case types.CancelReasonQuota:
+			errMsg := fmt.Sprintf("Transcoding of %s aborted: output exceeded the quota of %d MB", item.Filename, utils.OUTPUT_QUOTA_MB)
+			logger.Errorf("[failed]: %s", errMsg)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: errMsg, Data: types.TaskData{OutputBytes: t.outputBytes.Load(), Reason: reason}})
+		case types.CancelReasonTimeout:
+			logger.Infof("[timed out]: Transcoding for %s exceeded its %s timeout.", item.Filename, timeout)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "timed_out", Message: fmt.Sprintf("Transcoding timed out for %s after %s", item.Filename, timeout), Data: types.TaskData{Reason: reason}})
+		case types.CancelReasonUser:
+			logger.Infof("[cancelled]: Transcoding for %s was cancelled by user.", item.Filename)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "cancelled", Message: fmt.Sprintf("Transcoding cancelled for %s", item.Filename), Data: types.TaskData{Reason: reason}})
+		case types.CancelReasonDisconnected:
+			logger.Infof("[cancelled]: Transcoding for %s was cancelled as no client was following it.", item.Filename)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "cancelled", Message: fmt.Sprintf("Transcoding cancelled for %s as no client was following it", item.Filename), Data: types.TaskData{Reason: reason}})
+		case types.CancelReasonShutdown:
+			logger.Infof("[cancelled]: Transcoding for %s was stopped by server shutdown.", item.Filename)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "cancelled", Message: fmt.Sprintf("Transcoding of %s stopped because the server is shutting down", item.Filename), Data: types.TaskData{Reason: reason}})
+		default:
+			logger.Errorf("[failed]: Transcoding for %s failed.", item.Filename)
+			code, _ := t.errorCode.Load().(string)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Transcoding failed for %s", item.Filename), Data: types.TaskData{ErrorCode: code}})
 		}
 		return
 	}
 
-	log.Printf("[finished]: %s file successfully processed", item.Filename)
+	logger.Infof("[finished]: %s file successfully processed", item.Filename)
+
+	t.updateOutputSize(outputFolder)
+	files, err := utils.BuildOutputManifest(outputFolder)
+	if err != nil {
+		// The manifest is informational only, so a failure here shouldn't fail the job
+		logger.Warnf("[%s] %v", t.logTag, err)
+	}
+
+	completion := &types.CompletionData{
+		Files:            files,
+		AudioPath:        audioPath,
+		PreviewPath:      previewPath,
+		FailedRenditions: failed,
+	}
+	completion.AvgSpeed, completion.RenditionSpeeds = t.averageSpeeds()
+	for _, track := range t.subtitleTracks {
+		completion.Subtitles = append(completion.Subtitles, track.PlaylistPath)
+	}
+	for _, track := range t.audioTracks {
+		completion.AudioTracks = append(completion.AudioTracks, track.PlaylistPath)
+	}
+	if t.options.TargetSizeMB > 0 {
+		completion.Bitrates = make(map[string]int, len(t.options.Bitrates))
+		for res, bitrate := range t.options.Bitrates {
+			completion.Bitrates[res.String()] = bitrate
+		}
+	}
+
+	if !t.options.Zip {
+		t.completeWithoutArchive(outputFolder, playlists, completion)
+		return
+	}
 
 	// Define the path for the output zip file.
 	zipFilePath := outputFolder + ".zip"
-	log.Printf("[%s] Zipping output folder %s to %s", t.taskID, outputFolder, zipFilePath)
+	logger.Infof("[%s] Zipping output folder %s to %s", t.logTag, outputFolder, zipFilePath)
 	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
 		Type:    "progress",
 		Message: "Archiving transcoded files...",
@@ -103,7 +376,8 @@ func (t *Transcoder) Process(ctx context.Context) {
 
 	err = utils.ZipOutputFolder(outputFolder, zipFilePath)
 	if err != nil {
-		log.Printf("[%s] Failed to zip output folder: %v", t.taskID, err)
+		logger.Errorf("[%s] Failed to zip output folder: %v", t.logTag, err)
+		t.discardOutput(outputFolder)
 		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
 			Type:    "failed",
 			Message: fmt.Sprintf("Failed to archive files: %v", err),
@@ -111,27 +385,418 @@ func (t *Transcoder) Process(ctx context.Context) {
 		return
 	}
 
-	log.Printf("[%s] Successfully created zip archive: %s", t.taskID, zipFilePath)
+	logger.Infof("[%s] Successfully created zip archive: %s", t.logTag, zipFilePath)
+
+	completion.ArchivePath = filepath.Base(zipFilePath)
+	if info, err := os.Stat(zipFilePath); err == nil {
+		completion.ArchiveSize = info.Size()
+	} else {
+		logger.Warnf("[%s] Failed to stat zip archive %s: %v", t.logTag, zipFilePath, err)
+	}
 
 	// Output folder cleanup
 	if err := os.RemoveAll(outputFolder); err != nil {
-		log.Printf("[%s] Warning: Failed to clean up output folder %s: %v", t.taskID, outputFolder, err)
+		logger.Warnf("[%s] Failed to clean up output folder %s: %v", t.logTag, outputFolder, err)
 	}
 
 	// Send a final "completed" status update.
-	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+	t.sendCompleted(types.StatusUpdate{
 		Type:    "completed",
 		Message: "Transcoding and archiving complete. Your download is ready.",
+		Data: types.TaskData{
+			Progress:    100.0,
+			Completion:  completion,
+			OutputBytes: t.outputBytes.Load(),
+		},
+	})
+}
+
+// extractAudio exports the source audio next to the renditions, returning its path relative to the output folder.
+// A failed extraction (e.g. a source without audio) only produces a warning; ok is false if ctx was cancelled.
+func (t *Transcoder) extractAudio(ctx context.Context, outputFolder string) (audioPath string, ok bool) {
+	audioPath = fmt.Sprintf("%s.%s", utils.GetFilenameLessExt(t.source.Filename), t.options.AudioFormat)
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: fmt.Sprintf("Extracting %s audio...", t.options.AudioFormat)})
+
+	err := utils.ExtractAudio(ctx, t.source.File, filepath.Join(outputFolder, audioPath), t.options.AudioFormat, t.options.StartTime, t.options.EndTime)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", false
+		}
+		logger.Warnf("[%s] %v", t.logTag, err)
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "warning", Message: fmt.Sprintf("Audio could not be exported as %s", t.options.AudioFormat)})
+		return "", true
+	}
+
+	logger.Infof("[completed]: %s audio for %s; output %s", t.options.AudioFormat, t.source.Filename, audioPath)
+	return audioPath, true
+}
+
+// generatePreview writes a short preview clip next to the renditions, returning its path relative to the output folder.
+// The clip is moved back to fit within the transcoded portion, and shortened if that portion is shorter.
+// Like extractAudio, a failure only produces a warning; ok is false if ctx was cancelled.
+func (t *Transcoder) generatePreview(ctx context.Context, outputFolder string) (previewPath string, ok bool) {
+	previewPath = "preview." + t.options.PreviewFormat
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: fmt.Sprintf("Generating %s preview...", t.options.PreviewFormat)})
+
+	duration := min(t.options.PreviewDuration, t.inputDuration)
+	offset := min(t.options.PreviewStart, t.inputDuration-duration)
+	err := utils.GeneratePreviewClip(ctx, t.source.File, filepath.Join(outputFolder, previewPath), t.options.StartTime+offset, duration, t.options.PreviewFormat)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", false
+		}
+		logger.Warnf("[%s] %v", t.logTag, err)
+		os.Remove(filepath.Join(outputFolder, previewPath)) // A partial preview is of no use
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "warning", Message: fmt.Sprintf("A %s preview could not be generated", t.options.PreviewFormat)})
+		return "", true
+	}
+
+	logger.Infof("[completed]: %s preview of %.1fs at %.1fs for %s; output %s", t.options.PreviewFormat, duration, offset, t.source.Filename, previewPath)
+	return previewPath, true
+}
+
+// extractSubtitles converts the text subtitle streams of the source to WebVTT, each with a playlist
+// for the master playlist to list. Sources without subtitles, bitmap subtitles and streams that fail
+// to convert only produce warnings; it returns false if ctx was cancelled.
+func (t *Transcoder) extractSubtitles(ctx context.Context, outputFolder string) bool {
+	if len(t.subtitles) == 0 {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "warning", Message: fmt.Sprintf("%s has no subtitles to extract", t.source.Filename)})
+		return true
+	}
+	subtitlesFolder := filepath.Join(outputFolder, utils.SubtitlesFolder)
+	if err := os.MkdirAll(subtitlesFolder, 0755); err != nil {
+		logger.Warnf("[%s] failed to create subtitles folder: %v", t.logTag, err)
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "warning", Message: "Subtitles could not be extracted"})
+		return true
+	}
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: fmt.Sprintf("Extracting %d subtitle streams...", len(t.subtitles))})
+
+	var skipped []string
+	for _, stream := range t.subtitles {
+		label := fmt.Sprintf("stream %d (%s)", stream.Index, stream.Codec)
+		if !utils.IsTextSubtitle(stream.Codec) {
+			skipped = append(skipped, label)
+			continue
+		}
+
+		number := len(t.subtitleTracks)
+		vttName := fmt.Sprintf("%d.vtt", number)
+		err := utils.ExtractSubtitle(ctx, t.source.File, filepath.Join(subtitlesFolder, vttName), stream.Index, t.options.StartTime, t.options.EndTime)
+		if err == nil {
+			playlist := utils.SubtitlePlaylist(vttName, t.inputDuration)
+			err = utils.WriteFileAtomic(filepath.Join(subtitlesFolder, fmt.Sprintf("%d.m3u8", number)), []byte(playlist), 0644)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			logger.Warnf("[%s] %v", t.logTag, err)
+			skipped = append(skipped, label)
+			continue
+		}
+
+		t.subtitleTracks = append(t.subtitleTracks, types.SubtitleTrack{
+			SubtitleStream: stream,
+			Name:           renditionName(stream.Title, stream.Language, "Subtitles", number),
+			PlaylistPath:   filepath.ToSlash(filepath.Join(utils.SubtitlesFolder, fmt.Sprintf("%d.m3u8", number))),
+		})
+	}
+	defaults := make([]*bool, len(t.subtitleTracks))
+	for i := range t.subtitleTracks {
+		defaults[i] = &t.subtitleTracks[i].Default
+	}
+	singleDefault(defaults, false)
+
+	if len(skipped) > 0 {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+			Type:    "warning",
+			Message: fmt.Sprintf("Subtitles that couldn't be converted to WebVTT were skipped: %s", strings.Join(skipped, ", ")),
+		})
+	}
+	logger.Infof("[completed]: %d subtitle tracks for %s", len(t.subtitleTracks), t.source.Filename)
+	return true
+}
+
+// renditionName is the name viewers see for the rendition of a source stream: its title, else its
+// language, else "<kind> N" for the number-th (counting from 0) rendition of its group.
+func renditionName(title, language, kind string, number int) string {
+	switch {
+	case title != "":
+		return title
+	case language != "":
+		return language
+	}
+	return fmt.Sprintf("%s %d", kind, number+1)
+}
+
+// singleDefault clears all but the first of the default flags of a rendition group that are set,
+// as a group can only have one default rendition. With required, the first rendition becomes the
+// default if none is flagged.
+func singleDefault(defaults []*bool, required bool) {
+	found := false
+	for _, isDefault := range defaults {
+		if *isDefault && found {
+			*isDefault = false
+		}
+		found = found || *isDefault
+	}
+	if required && !found && len(defaults) > 0 {
+		*defaults[0] = true
+	}
+}
+
+// separateAudio reports whether the audio of the source is encoded to renditions of its own, which
+// leaves the video renditions without audio.
+func (t *Transcoder) separateAudio() bool {
+	return t.options.AudioTracks && len(t.audioStreams) > 0
+}
+
+// encodeAudioTracks encodes every audio stream of the source to an HLS audio rendition of its own,
+// for the master playlist to list as alternatives to each other. Streams that fail to encode are
+// skipped with a warning; it returns false if none could be encoded, as the video renditions have
+// no audio of their own, or if ctx was cancelled.
+func (t *Transcoder) encodeAudioTracks(ctx context.Context, outputFolder string) bool {
+	if len(t.audioStreams) == 0 {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "warning", Message: fmt.Sprintf("%s has no audio tracks to encode", t.source.Filename)})
+		return true
+	}
+	audioFolder := filepath.Join(outputFolder, utils.AudioTracksFolder)
+	if err := os.MkdirAll(audioFolder, 0755); err != nil {
+		logger.Errorf("[%s] failed to create audio folder: %v", t.logTag, err)
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to create audio folder: %v", err)})
+		return false
+	}
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: fmt.Sprintf("Encoding %d audio tracks...", len(t.audioStreams))})
+
+	var skipped []string
+	for number, stream := range t.audioStreams {
+		playlistName := fmt.Sprintf("%d.m3u8", number)
+		if err := t.encodeAudioTrack(ctx, stream, audioFolder, number); err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			if errors.Is(err, utils.ErrFFmpegNotInstalled) {
+				t.errorCode.Store(errCodeFFmpegUnavailable)
+				t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: ffmpegUnavailableMessage})
+				return false
+			}
+			logger.Warnf("[%s] %v", t.logTag, err)
+			skipped = append(skipped, fmt.Sprintf("stream %d (%s)", stream.Index, stream.Codec))
+			continue
+		}
+
+		t.audioTracks = append(t.audioTracks, types.AudioTrack{
+			AudioStream:  stream,
+			Name:         renditionName(stream.Title, stream.Language, "Audio", number),
+			PlaylistPath: filepath.ToSlash(filepath.Join(utils.AudioTracksFolder, playlistName)),
+		})
+	}
+
+	if len(t.audioTracks) == 0 {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: "None of the audio tracks could be encoded."})
+		return false
+	}
+	// Players need a default audio rendition to start with, even if the source flags none
+	defaults := make([]*bool, len(t.audioTracks))
+	for i := range t.audioTracks {
+		defaults[i] = &t.audioTracks[i].Default
+	}
+	singleDefault(defaults, true)
+	if len(skipped) > 0 {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+			Type:    "warning",
+			Message: fmt.Sprintf("Audio tracks that couldn't be encoded were skipped: %s", strings.Join(skipped, ", ")),
+		})
+	}
+	logger.Infof("[completed]: %d audio tracks for %s", len(t.audioTracks), t.source.Filename)
+	return true
+}
+
+// encodeAudioTrack encodes an audio stream of the source to the HLS audio rendition <number>.m3u8
+// in audioFolder, trimmed and segmented like the video renditions so players can switch between
+// them at any segment.
+func (t *Transcoder) encodeAudioTrack(ctx context.Context, stream types.AudioStream, audioFolder string, number int) error {
+	var args []string
+	if t.options.StartTime > 0 {
+		args = append(args, "-ss", utils.FormatSeconds(t.options.StartTime))
+	}
+	args = append(args, "-i", t.source.File)
+	if t.options.EndTime > 0 {
+		args = append(args, "-t", utils.FormatSeconds(t.options.EndTime-t.options.StartTime))
+	}
+	args = append(args,
+		"-map", fmt.Sprintf("0:%d", stream.Index),
+		"-vn",
+		"-c:a", utils.AudioEncoders[t.options.AudioCodec],
+		"-b:a", fmt.Sprintf("%dk", utils.AudioBitrate),
+		"-hls_time", strconv.Itoa(utils.SegmentDuration),
+		"-hls_segment_filename", filepath.Join(audioFolder, fmt.Sprintf("%d_%%03d%s", number, t.segmentExtension())),
+	)
+	args = append(args, t.playlistArgs()...)
+	if t.options.SegmentType == types.SegmentFMP4 {
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", fmt.Sprintf("%d_init.mp4", number))
+	}
+	args = append(args, filepath.Join(audioFolder, fmt.Sprintf("%d.m3u8", number)))
+
+	logger.Infof("[started]: audio track %d (stream %d) for %s", number, stream.Index, t.source.Filename)
+	output, err := t.statusMgr.RunProcess(t.taskID, utils.ExecCommand(ctx, utils.FFMPEG_PATH, args...))
+	if err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if missing := utils.MissingBinary(utils.FFMPEG_PATH, err); missing != nil {
+			return missing
+		}
+		return fmt.Errorf("[ffmpeg error]: audio track %d (stream %d) failed for %s: %v, output: %s", number, stream.Index, t.source.Filename, err, output)
+	}
+	logger.Infof("[completed]: audio track %d (stream %d) for %s", number, stream.Index, t.source.Filename)
+	return nil
+}
+
+// outputSizeCheckInterval is how often the output folder size is measured while transcoding.
+const outputSizeCheckInterval = 5 * time.Second
+
+// watchOutputSize periodically measures the output folder until ctx is done,
+// aborting with CancelReasonQuota if the per-task output quota is exceeded. It closes done when it returns.
+func (t *Transcoder) watchOutputSize(ctx context.Context, abort context.CancelCauseFunc, outputFolder string, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(outputSizeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if t.updateOutputSize(outputFolder) {
+			logger.Infof("[%s] Output of %s exceeded the %d MB quota; aborting", t.logTag, t.source.Filename, utils.OUTPUT_QUOTA_MB)
+			abort(types.CancelReasonQuota)
+			return
+		}
+	}
+}
+
+// updateOutputSize records the current size of the output folder and reports whether it exceeds the quota.
+func (t *Transcoder) updateOutputSize(outputFolder string) bool {
+	size, err := utils.DirSize(outputFolder)
+	if err != nil {
+		logger.Warnf("[%s] %v", t.logTag, err)
+		return false
+	}
+	t.outputBytes.Store(size)
+
+	return utils.OUTPUT_QUOTA_MB > 0 && size > int64(utils.OUTPUT_QUOTA_MB)<<20
+}
+
+// recordSpeeds keeps the speed samples of a finished rendition for the job's averages.
+func (t *Transcoder) recordSpeeds(resolution types.Resolutions, speeds utils.SpeedAverage) {
+	t.speedMu.Lock()
+	defer t.speedMu.Unlock()
+
+	if t.speeds == nil {
+		t.speeds = make(map[types.Resolutions]utils.SpeedAverage)
+	}
+	t.speeds[resolution] = speeds
+}
+
+// averageSpeeds returns the average encoding speed over every sample of the job, and per rendition.
+func (t *Transcoder) averageSpeeds() (float64, map[string]float64) {
+	t.speedMu.Lock()
+	defer t.speedMu.Unlock()
+
+	var total utils.SpeedAverage
+	perRendition := make(map[string]float64, len(t.speeds))
+	for resolution, speeds := range t.speeds {
+		if mean := speeds.Mean(); mean > 0 {
+			perRendition[resolution.String()] = mean
+		}
+		total.Merge(speeds)
+	}
+	return total.Mean(), perRendition
+}
+
+// sendCompleted sends the terminal "completed" update of the job, always preceded by an aggregate
+// progress update at 100%, since the last per-resolution progress reported by ffmpeg may fall short of it.
+func (t *Transcoder) sendCompleted(update types.StatusUpdate) {
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+		Type:    "progress",
+		Message: fmt.Sprintf("All renditions of %s are done.", t.source.Filename),
+		Data:    types.TaskData{Progress: 100.0},
 	})
+	t.statusMgr.SendUpdate(t.taskID, update)
+}
+
+// renditionFolder returns the folder, relative to the output folder, the files of a rendition are
+// written to: its own folder in the nested layout, or the output folder itself in the flat one.
+func (t *Transcoder) renditionFolder(resolution types.Resolutions) string {
+	if t.options.Layout == types.LayoutFlat {
+		return "."
+	}
+	return resolution.String()
+}
+
+// renditionPrefix returns the name every file of a rendition starts with, which tells the
+// renditions apart in the flat layout.
+func (t *Transcoder) renditionPrefix(resolution string) string {
+	return fmt.Sprintf("%s_%s", utils.GetFilenameLessExt(t.source.Filename), resolution)
+}
+
+// removeRenditionOutput removes the files written for a rendition.
+func (t *Transcoder) removeRenditionOutput(outputFolder string, resolution string) error {
+	if t.options.Layout != types.LayoutFlat {
+		return os.RemoveAll(filepath.Join(outputFolder, resolution))
+	}
+
+	entries, err := os.ReadDir(outputFolder)
+	if err != nil {
+		return err
+	}
+	prefix := t.renditionPrefix(resolution)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			if err := os.Remove(filepath.Join(outputFolder, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepareOutputFolders verifies that files can be written to the task's output folder and creates
+// the folder of every rendition in it.
+func (t *Transcoder) prepareOutputFolders(outputFolder string) error {
+	if err := utils.EnsureWritableDir(outputFolder); err != nil {
+		return err
+	}
+	for _, resolution := range t.resolutions {
+		resolutionOutput := filepath.Join(outputFolder, t.renditionFolder(resolution))
+		if err := os.MkdirAll(resolutionOutput, 0755); err != nil {
+			return fmt.Errorf("failed to create resolution output folder %s: %w", resolutionOutput, err)
+		}
+	}
+	return nil
+}
 
+// discardOutput removes the output folder of a failed job, along with any partially written archive.
+func (t *Transcoder) discardOutput(outputFolder string) {
+	for _, path := range []string{outputFolder, outputFolder + ".zip"} {
+		if err := os.RemoveAll(path); err != nil {
+			logger.Warnf("[%s] Failed to remove output %s of failed job: %v", t.logTag, path, err)
+		}
+	}
 }
 
 // transcodeResolutions transcodes the source video into multiple resolutions.
-func (t *Transcoder) transcodeResolutions(ctx context.Context, outputFolder string) bool {
+// It returns the generated resolution playlists, the renditions that failed and whether the whole process succeeded.
+// Under the bestEffort failure policy, failed renditions are removed and the job succeeds as long as one rendition is left.
+func (t *Transcoder) transcodeResolutions(ctx context.Context, outputFolder string) ([]types.TranscoderPlaylist, []string, bool) {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	playlistChan := make(chan types.TranscoderPlaylist, len(t.resolutions))
-	errorOccurred := false // Flag to track if any transcoding failed
+	failed := []string{} // Renditions that failed for reasons other than cancellation
 
 	for _, resolution := range t.resolutions {
 		wg.Add(1)
@@ -141,16 +806,16 @@ func (t *Transcoder) transcodeResolutions(ctx context.Context, outputFolder stri
 
 			playlist, err := t.transcode(ctx, res, outputFolder)
 			if err != nil {
-				// Check if the error was due to the context being canceled.
-				if errors.Is(err, context.Canceled) {
-					log.Printf("[cancelled]: Transcoding %s was cancelled.", res.String())
+				// Check if the error was due to the context being cancelled, whatever the cause.
+				if ctx.Err() != nil {
+					logger.Infof("[cancelled]: Transcoding %s was stopped: %v", res.String(), err)
 					// Don't treat cancellation as a regular error that sets the errorOccurred flag.
 					return
 				}
 
-				log.Printf("[skipping]: %s for %s; %v", res.String(), t.source.Filename, err)
+				logger.Warnf("[skipping]: %s for %s; %v", res.String(), t.source.Filename, err)
 				mu.Lock()
-				errorOccurred = true
+				failed = append(failed, res.String())
 				mu.Unlock()
 				t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Skipping %s: %v", res.String(), err)})
 				return
@@ -165,14 +830,10 @@ func (t *Transcoder) transcodeResolutions(ctx context.Context, outputFolder stri
 	wg.Wait()
 	close(playlistChan)
 
-	// After waiting, check if the context was cancelled. If so, the entire operation
+	// After waiting, check if the context was cancelled or timed out. If so, the entire operation
 	// is considered unsuccessful, and we should not proceed.
-	if ctx.Err() == context.Canceled {
-		return false
-	}
-
-	if errorOccurred {
-		return false // If any transcoding failed, consider the whole process failed
+	if ctx.Err() != nil {
+		return nil, nil, false
 	}
 
 	resolutionPlaylists := []types.TranscoderPlaylist{}
@@ -180,13 +841,160 @@ func (t *Transcoder) transcodeResolutions(ctx context.Context, outputFolder stri
 		resolutionPlaylists = append(resolutionPlaylists, playlist)
 	}
 
+	// ffmpeg occasionally succeeds without producing a playable rendition; those count as failed
+	resolutionPlaylists, broken := t.verifyRenditions(resolutionPlaylists)
+	failed = append(failed, broken...)
+
+	if len(failed) > 0 {
+		if t.options.FailurePolicy != types.BestEffort {
+			return nil, failed, false // If any transcoding failed, consider the whole process failed
+		}
+
+		// Drop the partial output of failed renditions, so only playable ones are delivered
+		slices.Sort(failed)
+		for _, res := range failed {
+			if err := t.removeRenditionOutput(outputFolder, res); err != nil {
+				logger.Warnf("[%s] failed to remove output of failed rendition %s: %v", t.logTag, res, err)
+			}
+		}
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+			Type:    "warning",
+			Message: fmt.Sprintf("Continuing without failed renditions: %s", strings.Join(failed, ", ")),
+		})
+	}
+
 	// If no playlists were generated,
 	// don't build the main playlist.
 	if len(resolutionPlaylists) == 0 {
-		return false
+		return nil, failed, false
+	}
+
+	sortVariants(resolutionPlaylists)
+
+	if t.options.VerifyAlignment {
+		t.verifyAlignment(resolutionPlaylists)
 	}
 
-	return t.buildMainPlaylist(resolutionPlaylists, outputFolder)
+	if t.options.Format == types.FormatDASH {
+		return resolutionPlaylists, failed, t.buildDASHManifest(resolutionPlaylists, outputFolder)
+	}
+	if t.options.AudioTracks && !t.encodeAudioTracks(ctx, outputFolder) {
+		return resolutionPlaylists, failed, false
+	}
+	if t.options.Subtitles && !t.extractSubtitles(ctx, outputFolder) {
+		return resolutionPlaylists, failed, false
+	}
+	return resolutionPlaylists, failed, t.buildMainPlaylist(resolutionPlaylists, outputFolder)
+}
+
+// verifyRenditions checks that every rendition is playable (see utils.VerifyRendition), returning
+// the playable ones and the resolutions of the broken ones. DASH renditions are only probed
+// through their init segment, which transcode already did.
+func (t *Transcoder) verifyRenditions(playlists []types.TranscoderPlaylist) ([]types.TranscoderPlaylist, []string) {
+	if t.options.Format == types.FormatDASH {
+		return playlists, nil
+	}
+
+	// A live playlist only keeps its window, so its length says nothing
+	expectedDuration := t.inputDuration
+	if t.options.PlaylistType == types.PlaylistLive {
+		expectedDuration = 0
+	}
+
+	playable := []types.TranscoderPlaylist{}
+	broken := []string{}
+	for _, playlist := range playlists {
+		if err := utils.VerifyRendition(playlist.PlaylistPath, expectedDuration); err != nil {
+			resolution := playlist.Target.String()
+			logger.Errorf("[failed]: %s rendition of %s is broken: %v", resolution, t.source.Filename, err)
+			t.errorCode.Store(errCodeBrokenRendition)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+				Type:    "failed",
+				Message: fmt.Sprintf("The %s rendition is not playable: %v", resolution, err),
+				Data:    types.TaskData{Resolution: resolution, ErrorCode: errCodeBrokenRendition},
+			})
+			broken = append(broken, resolution)
+			continue
+		}
+		playable = append(playable, playlist)
+	}
+	return playable, broken
+}
+
+// verifyAlignment reports renditions whose segment boundaries don't line up.
+// Misalignment doesn't fail the job, as the output is still playable per rendition.
+func (t *Transcoder) verifyAlignment(playlists []types.TranscoderPlaylist) {
+	if err := utils.VerifySegmentAlignment(playlists); err != nil {
+		logger.Warnf("[warning]: %s: %v", t.source.Filename, err)
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "warning", Message: err.Error()})
+		return
+	}
+
+	logger.Infof("[completed]: keyframe alignment verified for %s", t.source.Filename)
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: "Keyframe alignment verified across renditions."})
+}
+
+// completeWithoutArchive finishes a job whose output is kept as a plain folder,
+// reporting the master and rendition playlist paths relative to the output directory.
+func (t *Transcoder) completeWithoutArchive(outputFolder string, playlists []types.TranscoderPlaylist, completion *types.CompletionData) {
+	taskFolder := filepath.Base(outputFolder)
+
+	playlistPaths := make([]string, 0, len(playlists))
+	for _, playlist := range playlists {
+		playlistPaths = append(playlistPaths, filepath.ToSlash(filepath.Join(taskFolder, playlist.PlaylistPathFromMain)))
+	}
+
+	logger.Infof("[%s] Skipping archive; output kept at %s", t.logTag, outputFolder)
+	t.sendCompleted(types.StatusUpdate{
+		Type:    "completed",
+		Message: "Transcoding complete. Your playlists are ready.",
+		Data: types.TaskData{
+			Progress:       100.0,
+			MasterPlaylist: filepath.ToSlash(filepath.Join(taskFolder, "main"+t.playlistExtension())),
+			Playlists:      playlistPaths,
+			Completion:     completion,
+			OutputBytes:    t.outputBytes.Load(),
+		},
+	})
+}
+
+// Estimate predicts how long Process takes, given the H.264 encoding speed of this server in luma
+// samples per second (see utils.BenchmarkEncodeSpeed). Stream-copied renditions take next to no time.
+func (t *Transcoder) Estimate(samplesPerSecond float64) types.EncodeEstimate {
+	estimate := types.EncodeEstimate{
+		Renditions:  []types.RenditionEstimate{},
+		Duration:    t.inputDuration,
+		SpeedFactor: samplesPerSecond,
+	}
+	for _, resolution := range t.resolutions {
+		preset, ok := t.preset(resolution)
+		if !ok {
+			continue
+		}
+		seconds := 0.0
+		if !t.streamCopy {
+			seconds = utils.EstimateEncodeSeconds(preset.Width, preset.Height, utils.ParseFrameRate(t.frameRate),
+				t.inputDuration, t.options.Codec, t.options.Speed, samplesPerSecond)
+		}
+		estimate.Renditions = append(estimate.Renditions, types.RenditionEstimate{
+			Resolution: resolution.String(),
+			Width:      preset.Width,
+			Height:     preset.Height,
+			Seconds:    math.Round(seconds*10) / 10,
+		})
+		estimate.TotalSeconds += seconds
+	}
+	estimate.TotalSeconds = math.Round(estimate.TotalSeconds*10) / 10
+	return estimate
+}
+
+// preset returns the size and bitrate to use for a resolution, including the native fallback rendition.
+func (t *Transcoder) preset(resolution types.Resolutions) (types.ResolutionPreset, bool) {
+	if t.native != nil && resolution == types.Resolutions(t.native.Height) {
+		return *t.native, true
+	}
+	preset, ok := types.Presets()[resolution]
+	return preset, ok
 }
 
 // transcode transcodes the video to a specific resolution and generates an HLS playlist.
@@ -195,183 +1003,722 @@ func (t *Transcoder) transcode(
 	resolution types.Resolutions,
 	outputFolder string,
 ) (*types.TranscoderPlaylist, error) {
-	preset, ok := types.RESOLUTIONS[resolution]
+	preset, ok := t.preset(resolution)
 	if !ok {
 		return nil, fmt.Errorf("[argument error]: Invalid resolution provided: %s", resolution.String())
 	}
 
-	filenameLessExt := utils.GetFilenameLessExt(t.source.Filename)
-	resolutionOutput := filepath.Join(outputFolder, resolution.String())
-	outputFilenameLessExt := fmt.Sprintf("%s_%s", filenameLessExt, resolution.String())
-	outputPlaylist := filepath.Join(resolutionOutput, fmt.Sprintf("%sp.m3u8", outputFilenameLessExt))
-	outputSegment := filepath.Join(resolutionOutput, fmt.Sprintf("%s_%%03d.ts", outputFilenameLessExt))
-	outputPlaylistFromMain := filepath.Join(resolution.String(), fmt.Sprintf("%sp.m3u8", outputFilenameLessExt))
+	bitrate := preset.Bitrate
+	if override, ok := t.options.Bitrates[resolution]; ok {
+		bitrate = override
+	}
+	if capped := utils.CapBitrate(bitrate, t.sourceKbps); capped < bitrate {
+		logger.Infof("[%s] Capping %s at the source bitrate of %d kbps instead of %d kbps", t.logTag, resolution, capped, bitrate)
+		bitrate = capped
+	}
+
+	maxrate, bufsize := utils.VBVRates(bitrate)
+
+	filters := slices.Clone(t.inputFilters)
+	if t.tonemap {
+		filters = append(filters, utils.TonemapFilter(t.options.PixFmt))
+	}
+	if t.options.Pad.Width > 0 {
+		// Padded after tone-mapping, so the background color is in the output's color space
+		filters = append(filters, utils.PadFilter(t.options.Pad))
+	}
+	filters = append(filters, fmt.Sprintf("scale=-2:%d", preset.Height))
+	videoFilter := strings.Join(filters, ",")
+
+	resolutionOutput := filepath.Join(outputFolder, t.renditionFolder(resolution))
+	outputFilenameLessExt := t.renditionPrefix(resolution.String())
+	outputPlaylist := filepath.Join(resolutionOutput, fmt.Sprintf("%sp%s", outputFilenameLessExt, t.playlistExtension()))
+	outputSegment := filepath.Join(resolutionOutput, fmt.Sprintf("%s_%%03d%s", outputFilenameLessExt, t.segmentExtension()))
+	outputPlaylistFromMain := filepath.Join(t.renditionFolder(resolution), fmt.Sprintf("%sp%s", outputFilenameLessExt, t.playlistExtension()))
 
 	if err := os.MkdirAll(resolutionOutput, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create resolution output folder %s: %w", resolutionOutput, err)
 	}
 
 	args := []string{
-		"-i", t.source.File,
-		"-preset", "fast",
-		"-crf", "28",
-		"-sc_threshold", "0",
-		"-g", "48",
-		"-keyint_min", "48",
-		"-hls_time", "4",
-		"-hls_playlist_type", "vod",
-		"-hls_segment_filename", outputSegment,
-		"-vf", fmt.Sprintf("scale=-2:%d", preset.Height),
-		"-b:v", fmt.Sprintf("%dk", preset.Bitrate),
-		"-c:v", "libx264",
-		"-c:a", "aac",
-		"-b:a", "128k",
-		outputPlaylist,
+		"-progress", "pipe:1",
+		"-nostats",
+	}
+	if t.options.Throttle {
+		args = append(args, "-re") // Must come before the input it applies to
 	}
+	if t.options.StartTime > 0 {
+		args = append(args, "-ss", utils.FormatSeconds(t.options.StartTime)) // Input seeking is fast and keyframe accurate
+	}
+	// Rotated sources are decoded upright; this is ffmpeg's default, but the ladder relies on it
+	args = append(args, "-autorotate", "-i", t.source.File)
+	if t.options.EndTime > 0 {
+		args = append(args, "-t", utils.FormatSeconds(t.options.EndTime-t.options.StartTime))
+	}
+	if t.options.Format == types.FormatDASH {
+		// The segments are named by the muxer and written next to the rendition's own manifest
+		args = append(args, utils.DASHMuxerArgs(utils.SegmentDuration, t.hasAudio)...)
+	} else {
+		args = append(args, "-hls_time", strconv.Itoa(utils.SegmentDuration), "-hls_segment_filename", outputSegment)
+		args = append(args, t.playlistArgs()...)
+		if t.options.SegmentType == types.SegmentFMP4 {
+			// The init segment is written next to the playlist, which references it with EXT-X-MAP
+			args = append(args,
+				"-hls_segment_type", "fmp4",
+				"-hls_fmp4_init_filename", fmt.Sprintf("%s_init.mp4", outputFilenameLessExt),
+			)
+		}
+	}
+	if t.streamCopy {
+		// Segments can only be cut at the source's own keyframes
+		args = append(args, "-c", "copy")
+		if t.separateAudio() {
+			args = append(args, "-an")
+		}
+	} else {
+		args = append(args, t.encodingArgs(videoFilter, bitrate, maxrate, bufsize)...)
+	}
+	args = append(args, outputPlaylist)
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd := utils.ExecCommand(ctx, utils.FFMPEG_PATH, args...)
 
-	log.Printf("[started]: transcoding %s for %s", resolution.String(), t.source.Filename)
-	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "started", Message: fmt.Sprintf("Started %s transcoding", resolution.String()), Data: types.TaskData{
+	logger.Infof("[started]: transcoding %s for %s", resolution.String(), t.source.Filename)
+	// Process sends the single job-level "started"; renditions have their own event type
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "resolution_started", Message: fmt.Sprintf("Started %s transcoding", resolution.String()), Data: types.TaskData{
 		Resolution: resolution.String(),
 		Timestamp:  0,
 		Frame:      "",
 		Progress:   0.0,
 	}})
 
-	// Capture stderr to a pipe for progress logging
-	stderrPipe, err := cmd.StderrPipe()
+	// Progress is read from ffmpeg's machine-readable -progress output on stdout.
+	// stderr is only kept for error diagnostics.
+	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get stderr pipe: %w", err)
+		return nil, fmt.Errorf("failed to get stdout pipe: %w", err)
 	}
-	scannerStderr := bufio.NewScanner(stderrPipe)
+	scannerStdout := bufio.NewScanner(stdoutPipe)
 
 	// Use a buffer to capture all stderr for logging in case of command failure
 	var totalStderr bytes.Buffer
+	cmd.Stderr = &totalStderr
 
 	var wgOutput sync.WaitGroup
 	wgOutput.Add(1)
 
 	go func() {
 		defer wgOutput.Done()
-		for scannerStderr.Scan() {
-			line := scannerStderr.Text()
-			fmt.Fprintf(&totalStderr, "%s\n", line) // Capture all stderr
-
-			// Basic progress parsing (can be more robust if needed)
-			if strings.Contains(line, "frame=") && strings.Contains(line, "time=") {
-				frame, timemark, speed := utils.ParseFFmpegProgress(line)
-				if timemark != "" {
-					timemarkParts := strings.Split(timemark, ":")
-					if len(timemarkParts) < 3 {
-						log.Printf("[error]: unexpected timemark format: %s", timemark)
-						continue
-					}
-
-					hours, _ := strconv.ParseFloat(timemarkParts[0], 64)
-					minutes, _ := strconv.ParseFloat(timemarkParts[1], 64)
-					seconds, _ := strconv.ParseFloat(timemarkParts[2], 64)
-					currentSeconds := hours*3600 + minutes*60 + seconds
-
-					progressPercent := 0.0
-					progressPercent = min((currentSeconds/t.inputDuration)*100, 100)
-
-					msg := fmt.Sprintf("Transcoding %s: frame %s, time %s, speed %sx",
-						resolution.String(), frame, timemark, speed)
-
-					log.Printf("[progress]: %s (%.2f%%)", msg, progressPercent)
-					t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
-						Type:    "progress",
-						Message: msg,
-						Data: types.TaskData{
-							Resolution: resolution.String(),
-							Frame:      frame,
-							Timestamp:  int64(currentSeconds),
-							Progress:   progressPercent,
-						},
-					})
-				}
+
+		// Each progress block is a series of key=value lines terminated by "progress=continue" or "progress=end"
+		var block strings.Builder
+		var speeds utils.SpeedAverage // Every block is sampled, including the throttled ones
+		defer func() { t.recordSpeeds(resolution, speeds) }()
+		throttle := progressThrottle{interval: utils.PROGRESS_UPDATE_INTERVAL}
+		for scannerStdout.Scan() {
+			line := scannerStdout.Text()
+			block.WriteString(line)
+			block.WriteByte('\n')
+			if !strings.HasPrefix(line, "progress=") {
+				continue
+			}
+
+			progress := utils.ParseProgressBlock(block.String())
+			block.Reset()
+			speeds.Add(progress.Speed)
+			if progress.Time == "" {
+				continue // No output written yet, or no usable position
+			}
+			progressPercent, ok := utils.ProgressPercent(progress.OutTime, t.inputDuration)
+			if !ok {
+				continue
+			}
+			if !throttle.allow(time.Now(), progress.Done) {
+				continue
+			}
+			if progress.Done {
+				progressPercent = 100 // The last position may fall just short of the probed duration
 			}
+
+			msg := fmt.Sprintf("Transcoding %s: frame %s, time %s, speed %sx (average %.2fx)",
+				resolution.String(), progress.Frame, progress.Time, progress.Speed, speeds.Mean())
+
+			logger.Debugf("[progress]: %s (%.2f%%)", msg, progressPercent)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+				Type:    "progress",
+				Message: msg,
+				Data: types.TaskData{
+					Resolution: resolution.String(),
+					Frame:      progress.Frame,
+					Timestamp:  int64(progress.OutTime),
+					Progress:   progressPercent,
+					FPS:        progress.FPS,
+					Bitrate:    progress.Bitrate,
+					AvgSpeed:   speeds.Mean(),
+
+					OutputBytes: t.outputBytes.Load(),
+				},
+			})
 		}
 	}()
 
+	startInOwnGroup(cmd) // The task can be paused by stopping the group
 	err = cmd.Start()
+	if missing := utils.MissingBinary(utils.FFMPEG_PATH, err); missing != nil {
+		t.errorCode.Store(errCodeFFmpegUnavailable)
+		return nil, missing
+	}
 	if err != nil {
 		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to start %s command: %v", resolution.String(), err)})
 		return nil, fmt.Errorf("failed to start ffmpeg command: %w", err)
 	}
+	untrack := t.statusMgr.TrackProcess(t.taskID, cmd.Process)
 
-	wgOutput.Wait() // Wait for stdout and stderr scanners to finish reading
+	wgOutput.Wait() // Wait for the progress reader to finish
 	err = cmd.Wait()
+	untrack()
 	if err != nil {
-		// Check if the error is because the context was cancelled.
-		if ctx.Err() == context.Canceled {
-			errMsg := fmt.Sprintf("transcoding %s cancelled for %s", resolution.String(), t.source.Filename)
-			log.Println(errMsg)
-			// Return a specific error or nil, signaling cancellation.
-			return nil, ctx.Err()
+		// Check if the error is because the context was cancelled or timed out.
+		if ctx.Err() != nil {
+			errMsg := fmt.Sprintf("transcoding %s stopped for %s: %v", resolution.String(), t.source.Filename, context.Cause(ctx))
+			logger.Infof("%s", errMsg)
+			// Return the cancellation cause, so callers can tell why the rendition stopped.
+			return nil, context.Cause(ctx)
 		}
 
 		// Now you can safely use totalStderr.String() to get all captured stderr
 		errMsg := fmt.Sprintf("[ffmpeg error]: transcoding %s failed for %s: %v, stderr: %s",
 			resolution.String(), t.source.Filename, err, totalStderr.String())
-		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: errMsg})
-		return nil, fmt.Errorf("%s", errMsg)
+		return nil, t.sendFFmpegFailure(resolution, errMsg, totalStderr.String())
 	}
 
-	log.Printf("[completed]: transcoding %s for %s; output %s", resolution.String(), t.source.Filename, outputPlaylist)
+	logger.Infof("[completed]: transcoding %s for %s; output %s", resolution.String(), t.source.Filename, outputPlaylist)
+	t.updateOutputSize(outputFolder) // The watcher enforces the quota; this just keeps the reported size current
 	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "completed", Message: fmt.Sprintf("Completed %s output generation.", resolution.String()), Data: types.TaskData{
-		Resolution: resolution.String(),
-		Timestamp:  0,
-		Frame:      "",
-		Progress:   100.0, // Mark as complete
+		Resolution:  resolution.String(),
+		Timestamp:   0,
+		Frame:       "",
+		Progress:    100.0, // Mark as complete
+		OutputBytes: t.outputBytes.Load(),
 	}})
 
-	detectedRes, err := utils.DetectPlaylistResolution(outputPlaylist)
+	// A DASH rendition's size is read from its init segment, as not every ffprobe build can read manifests
+	probePath := outputPlaylist
+	if t.options.Format == types.FormatDASH {
+		probePath = filepath.Join(resolutionOutput, utils.DASHVideoInitSegment)
+	}
+	detectedRes, err := utils.DetectPlaylistResolution(probePath)
 	if err != nil {
 		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to detect playlist resolution for %s: %v", resolution.String(), err)})
 		return nil, fmt.Errorf("failed to detect playlist resolution for %s: %w", outputPlaylist, err)
 	}
+	detectedRes.Bitrate = maxrate // The peak rate allowed, advertised as BANDWIDTH if the segments can't be measured
 
-	return &types.TranscoderPlaylist{
+	playlist := &types.TranscoderPlaylist{
+		Target:               resolution,
 		Resolution:           detectedRes,
 		PlaylistFilename:     filepath.Base(outputPlaylist),
 		PlaylistPathFromMain: outputPlaylistFromMain,
 		PlaylistPath:         outputPlaylist,
-	}, nil
+	}
+
+	if t.options.IFramePlaylist {
+		iframePlaylistName := fmt.Sprintf("%s_iframes.m3u8", outputFilenameLessExt)
+		if err := t.generateIFramePlaylist(ctx, resolution, outputPlaylist, filepath.Join(resolutionOutput, iframePlaylistName)); err != nil {
+			return nil, err
+		}
+		playlist.IFramePlaylistPathFromMain = filepath.Join(t.renditionFolder(resolution), iframePlaylistName)
+	}
+
+	return playlist, nil
+}
+
+// progressThrottle coalesces the progress updates of a rendition to at most one per interval.
+// The final update always goes through, so clients see the rendition reach 100%.
+type progressThrottle struct {
+	interval time.Duration
+	last     time.Time
+}
+
+// allow reports whether an update observed at now should be sent, recording it if so.
+func (p *progressThrottle) allow(now time.Time, final bool) bool {
+	if !final && !p.last.IsZero() && now.Sub(p.last) < p.interval {
+		return false
+	}
+	p.last = now
+	return true
+}
+
+// generateIFramePlaylist builds an I-frame-only (trick-play) playlist from an already transcoded rendition.
+// The video stream is copied as is, so the keyframes produced by the fixed GOP become the playlist entries.
+func (t *Transcoder) generateIFramePlaylist(ctx context.Context, resolution types.Resolutions, sourcePlaylist, iframePlaylist string) error {
+	iframeSegment := strings.TrimSuffix(iframePlaylist, ".m3u8") + "_%03d.ts"
+
+	args := []string{
+		"-i", sourcePlaylist,
+		"-an",
+		"-c:v", "copy",
+		"-hls_time", strconv.Itoa(utils.SegmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "iframes_only+temp_file",
+		"-hls_segment_filename", iframeSegment,
+		iframePlaylist,
+	}
+
+	logger.Infof("[started]: I-frame playlist %s for %s", resolution.String(), t.source.Filename)
+	output, err := t.statusMgr.RunProcess(t.taskID, utils.ExecCommand(ctx, utils.FFMPEG_PATH, args...))
+	if err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if missing := utils.MissingBinary(utils.FFMPEG_PATH, err); missing != nil {
+			t.errorCode.Store(errCodeFFmpegUnavailable)
+			return missing
+		}
+
+		errMsg := fmt.Sprintf("[ffmpeg error]: I-frame playlist %s failed for %s: %v, output: %s",
+			resolution.String(), t.source.Filename, err, output)
+		return t.sendFFmpegFailure(resolution, errMsg, string(output))
+	}
+
+	logger.Infof("[completed]: I-frame playlist %s for %s; output %s", resolution.String(), t.source.Filename, iframePlaylist)
+	return nil
+}
+
+// Error codes reported in TaskData.ErrorCode for failures that clients can act on.
+const (
+	errCodeStorageFull       = "storage_full"
+	errCodeInvalidInput      = "invalid_input"
+	errCodeUnsupportedCodec  = "unsupported_codec"
+	errCodeOutputUnwritable  = "output_unwritable"
+	errCodeZeroDuration      = "zero_duration"
+	errCodeBrokenRendition   = "broken_rendition"
+	errCodeFFmpegUnavailable = "ffmpeg_unavailable"
+
+	storageFullMessage       = "Server storage is full; the output could not be written. Please try again later."
+	ffmpegUnavailableMessage = "ffmpeg is not installed on the server, so media can't be processed right now. Please try again later."
+)
+
+// ErrZeroDuration is returned by NewTranscoder for sources with nothing to play, such as still
+// images or media without a duration, which would only produce meaningless HLS.
+var ErrZeroDuration = errors.New("source has no playable duration")
+
+// InitFailure returns the error code and a message fit for clients for an error returned by
+// NewTranscoder. Both are empty if the failure isn't one clients can act on.
+func InitFailure(err error) (code, msg string) {
+	switch {
+	case errors.Is(err, ErrZeroDuration):
+		return errCodeZeroDuration, "The uploaded file has no playable duration. Still images and empty media can't be transcoded; please upload a video."
+	case errors.Is(err, utils.ErrFFmpegNotInstalled):
+		return errCodeFFmpegUnavailable, ffmpegUnavailableMessage
+	}
+	return "", ""
+}
+
+// classifyFFmpegError recognizes common failures in ffmpeg's stderr, returning an error code and
+// a message fit for clients. Both are empty if the failure isn't recognized.
+func classifyFFmpegError(stderr string) (code, msg string) {
+	switch {
+	case strings.Contains(stderr, "No space left on device"):
+		return errCodeStorageFull, storageFullMessage
+	case strings.Contains(stderr, "Invalid data found when processing input"),
+		strings.Contains(stderr, "moov atom not found"):
+		return errCodeInvalidInput, "The uploaded file is corrupt or not a supported media file."
+	case strings.Contains(stderr, "Decoder not found"),
+		strings.Contains(stderr, "Unknown decoder"),
+		strings.Contains(stderr, "Encoder not found"),
+		strings.Contains(stderr, "Unknown encoder"):
+		return errCodeUnsupportedCodec, "The media uses a codec this server can't process."
+	default:
+		return "", ""
+	}
+}
+
+// sendFFmpegFailure reports a failed ffmpeg run for a rendition and returns the error to fail it
+// with. Recognized failures get a clear message and error code, and the raw errMsg is only logged,
+// so stderr doesn't reach clients through later updates; anything else is reported with errMsg.
+func (t *Transcoder) sendFFmpegFailure(resolution types.Resolutions, errMsg, stderr string) error {
+	code, msg := classifyFFmpegError(stderr)
+	if code == "" {
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: errMsg})
+		return errors.New(errMsg)
+	}
+
+	logger.Errorf("%s", errMsg)
+	t.errorCode.Store(code)
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{
+		Type:    "failed",
+		Message: fmt.Sprintf("%s failed: %s", resolution.String(), msg),
+		Data:    types.TaskData{Resolution: resolution.String(), ErrorCode: code},
+	})
+	return errors.New(msg)
+}
+
+// encodingArgs returns the ffmpeg output options that re-encode a rendition with the given
+// video filter and rates in kbps, writing segments to outputSegment.
+func (t *Transcoder) encodingArgs(videoFilter string, bitrate, maxrate, bufsize int) []string {
+	encoders := utils.CodecEncoders[t.options.Codec]
+	var args []string
+	switch t.options.Codec {
+	case types.CodecAV1:
+		// Scene-change detection only adds keyframes; segment boundaries still get forced ones
+		sceneDetection := "scd=0"
+		if t.options.SceneCut {
+			sceneDetection = "scd=1"
+		}
+		args = []string{
+			"-preset", strconv.Itoa(t.options.Speed),
+			"-crf", "35",
+			"-g", "48",
+			"-force_key_frames", utils.ForceKeyFramesExpr(utils.SegmentDuration),
+			"-svtav1-params", sceneDetection,
+		}
+	case types.CodecVP9:
+		// Good-quality deadline at a speed fit for a ladder; row-based multithreading helps most at high resolutions.
+		// A DASH manifest with fixed segment durations needs a keyframe at every segment boundary.
+		args = []string{
+			"-deadline", "good",
+			"-cpu-used", "4",
+			"-row-mt", "1",
+			"-crf", "32",
+			"-g", "48",
+			"-force_key_frames", utils.ForceKeyFramesExpr(utils.SegmentDuration),
+		}
+		if !t.options.SceneCut {
+			args = append(args, "-keyint_min", "48") // libvpx places no keyframes of its own closer than this
+		}
+	default:
+		args = []string{
+			"-preset", "fast",
+			"-crf", "28",
+			"-g", "48",
+		}
+		if t.options.SceneCut {
+			// Keyframes are still forced at every segment boundary, keeping the renditions aligned
+			args = append(args, "-force_key_frames", utils.ForceKeyFramesExpr(utils.SegmentDuration))
+		} else {
+			// A fixed GOP without scene-cut keyframes lines segments up across renditions
+			args = append(args, "-sc_threshold", "0", "-keyint_min", "48")
+		}
+	}
+	args = append(args,
+		"-vf", videoFilter,
+		"-b:v", fmt.Sprintf("%dk", bitrate),
+		"-maxrate", fmt.Sprintf("%dk", maxrate),
+		"-bufsize", fmt.Sprintf("%dk", bufsize),
+		"-c:v", encoders.Video,
+		"-pix_fmt", t.options.PixFmt,
+	)
+	if t.separateAudio() {
+		args = append(args, "-an") // The audio tracks are renditions of their own
+	} else {
+		args = append(args, "-c:a", utils.AudioEncoders[t.options.AudioCodec], "-b:a", fmt.Sprintf("%dk", utils.AudioBitrate))
+	}
+	// Formats beyond 8-bit 4:2:0 need a matching encoder profile; options are validated before the job starts
+	if profile := t.videoProfile(); profile != "" {
+		args = append(args, "-profile:v", profile)
+	}
+	if t.options.Level != "" {
+		args = append(args, "-level", t.options.Level)
+	}
+	if t.options.MaxThreads > 0 {
+		args = append(args, "-threads", strconv.Itoa(t.options.MaxThreads))
+	}
+	return args
+}
+
+// videoProfile returns the encoder profile of the renditions: the requested one, or the one the
+// pixel format needs ("" for the encoder's default).
+func (t *Transcoder) videoProfile() string {
+	if t.options.Profile != "" {
+		return t.options.Profile
+	}
+	profile, _ := utils.PixelFormatProfile(utils.CodecEncoders[t.options.Codec].Video, t.options.PixFmt)
+	return profile
+}
+
+// variantCodecs returns the CODECS attribute of a variant in the master playlist, or "" for the
+// H.264 and AAC renditions with the encoder's choice of profile and level it's left out for.
+// Stream-copied renditions are always H.264 and AAC.
+func (t *Transcoder) variantCodecs(resolution types.ResolutionPreset) string {
+	defaultH264 := t.options.Codec == types.CodecH264 && t.options.Profile == "" && t.options.Level == ""
+	if t.streamCopy || (defaultH264 && t.options.AudioCodec == types.AudioAAC) {
+		return ""
+	}
+
+	frameRate := utils.ParseFrameRate(t.frameRate)
+	var codecs string
+	switch t.options.Codec {
+	case types.CodecAV1:
+		codecs = utils.AV1CodecString(resolution.Width, resolution.Height, frameRate, t.options.PixFmt)
+	default:
+		level, _ := utils.ParseH264Level(t.options.Level) // 0 when the encoder picks it
+		codecs = utils.H264CodecString(t.videoProfile(), level, resolution.Width, resolution.Height, frameRate)
+	}
+	if t.hasAudio {
+		codecs += "," + utils.AudioCodecStrings[t.options.AudioCodec]
+	}
+	return codecs
+}
+
+// playlistExtension returns the file extension of the master and rendition playlists (or manifests) of the requested format.
+func (t *Transcoder) playlistExtension() string {
+	if t.options.Format == types.FormatDASH {
+		return ".mpd"
+	}
+	return ".m3u8"
+}
+
+// segmentExtension returns the file extension of media segments for the requested segment type.
+func (t *Transcoder) segmentExtension() string {
+	if t.options.SegmentType == types.SegmentFMP4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// playlistArgs returns the HLS muxer arguments for the requested playlist type. With temp_file,
+// ffmpeg writes playlists and segments under a temporary name and renames them when complete, so
+// players reading the output while it's produced never see a partial file.
+func (t *Transcoder) playlistArgs() []string {
+	switch t.options.PlaylistType {
+	case types.PlaylistEvent:
+		return []string{"-hls_playlist_type", "event", "-hls_list_size", "0", "-hls_flags", "temp_file"}
+	case types.PlaylistLive:
+		// No playlist type tag, so players keep reloading the window; segments leaving it are removed
+		return []string{"-hls_list_size", strconv.Itoa(t.options.ListSize), "-hls_flags", "delete_segments+temp_file"}
+	default:
+		// A VOD playlist keeps every segment
+		return []string{"-hls_playlist_type", "vod", "-hls_list_size", "0", "-hls_flags", "temp_file"}
+	}
+}
+
+// buildDASHManifest creates main.mpd, the DASH manifest listing every rendition, with the audio of the highest one.
+func (t *Transcoder) buildDASHManifest(playlists []types.TranscoderPlaylist, outputFolder string) bool {
+	manifestPath := filepath.Join(outputFolder, "main.mpd")
+	logger.Infof("[started]: generating DASH manifest %s", manifestPath)
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: "Generating DASH manifest..."})
+
+	profile, _ := utils.PixelFormatProfile(utils.CodecEncoders[t.options.Codec].Video, t.options.PixFmt)
+	representations := make([]utils.DASHRepresentation, 0, len(playlists))
+	for _, playlist := range playlists {
+		representations = append(representations, utils.DASHRepresentation{
+			ID:        filepath.Dir(playlist.PlaylistPathFromMain),
+			Codecs:    utils.VP9CodecString(profile, playlist.Resolution.Width, playlist.Resolution.Height, utils.ParseFrameRate(t.frameRate), t.options.PixFmt),
+			Bandwidth: playlist.Resolution.Bitrate,
+			Width:     playlist.Resolution.Width,
+			Height:    playlist.Resolution.Height,
+			FrameRate: t.frameRate,
+		})
+	}
+	audioFrom := ""
+	if t.hasAudio {
+		audioFrom = representations[0].ID
+	}
+
+	manifest, err := utils.DASHManifest(representations, audioFrom, t.inputDuration, utils.SegmentDuration)
+	if err == nil {
+		err = utils.WriteFileAtomic(manifestPath, manifest, 0644)
+	}
+	if err != nil {
+		logger.Errorf("[error]: failed to write DASH manifest %s: %v", manifestPath, err)
+		if errors.Is(err, syscall.ENOSPC) {
+			t.errorCode.Store(errCodeStorageFull)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: storageFullMessage, Data: types.TaskData{ErrorCode: errCodeStorageFull}})
+			return false
+		}
+		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to write DASH manifest: %v", err)})
+		return false
+	}
+
+	logger.Infof("[completed]: generating DASH manifest %s", manifestPath)
+	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "completed", Message: "DASH manifest generated."})
+	return true
+}
+
+// audioGroupID is the GROUP-ID of the audio renditions in the master playlist.
+const audioGroupID = "audio"
+
+// audioMedia returns the EXT-X-MEDIA tag listing an audio track in the master playlist.
+func audioMedia(track types.AudioTrack) string {
+	media := fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\"", audioGroupID, strings.ReplaceAll(track.Name, `"`, "'"))
+	if track.Language != "" {
+		media += fmt.Sprintf(",LANGUAGE=\"%s\"", track.Language)
+	}
+	defaultFlag := "NO"
+	if track.Default {
+		defaultFlag = "YES"
+	}
+	media += fmt.Sprintf(",DEFAULT=%s,AUTOSELECT=YES", defaultFlag)
+	if track.Channels > 0 {
+		media += fmt.Sprintf(",CHANNELS=\"%d\"", track.Channels)
+	}
+	return media + fmt.Sprintf(",URI=\"%s\"", track.PlaylistPath)
+}
+
+// audioBandwidth returns the peak and average bitrates, in bits per second, of the most demanding
+// audio rendition, which a variant's BANDWIDTH has to include as its audio is fetched separately.
+// Renditions that can't be measured count with their target bitrate.
+func (t *Transcoder) audioBandwidth(outputFolder string) (peak, average int) {
+	for _, track := range t.audioTracks {
+		playlistPath := filepath.Join(outputFolder, filepath.FromSlash(track.PlaylistPath))
+		trackAverage, err := utils.DetectPlaylistBitrate(playlistPath)
+		trackPeak := trackAverage
+		if err == nil {
+			trackPeak, err = utils.DetectPlaylistPeakBitrate(playlistPath)
+		}
+		if err != nil {
+			logger.Warnf("[warning]: counting audio track %s at its target bitrate: %v", track.PlaylistPath, err)
+			trackPeak, trackAverage = utils.AudioBitrate*1000, utils.AudioBitrate*1000
+		}
+		peak, average = max(peak, trackPeak), max(average, trackAverage)
+	}
+	return peak, average
+}
+
+// subtitlesGroupID is the GROUP-ID of the subtitle renditions in the master playlist.
+const subtitlesGroupID = "subs"
+
+// subtitleMedia returns the EXT-X-MEDIA tag listing a subtitle track in the master playlist.
+func subtitleMedia(track types.SubtitleTrack) string {
+	yesNo := func(flag bool) string {
+		if flag {
+			return "YES"
+		}
+		return "NO"
+	}
+	media := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\"", subtitlesGroupID, strings.ReplaceAll(track.Name, `"`, "'"))
+	if track.Language != "" {
+		media += fmt.Sprintf(",LANGUAGE=\"%s\"", track.Language)
+	}
+	// AUTOSELECT must be YES for a DEFAULT or FORCED rendition
+	return media + fmt.Sprintf(",DEFAULT=%s,AUTOSELECT=YES,FORCED=%s,URI=\"%s\"", yesNo(track.Default), yesNo(track.Forced), track.PlaylistPath)
+}
+
+// variantBandwidth returns the BANDWIDTH and AVERAGE-BANDWIDTH attributes of a rendition in the
+// master playlist, measured from its segments, plus the peak and average rates of the separate
+// audio renditions, if any. The rates the encoder was given are only upper bounds with CRF
+// encoding, so they're advertised only if the segments can't be measured.
+func variantBandwidth(playlist types.TranscoderPlaylist, audioPeak, audioAverage int) string {
+	average, err := utils.DetectPlaylistBitrate(playlist.PlaylistPath)
+	if err == nil {
+		var peak int
+		peak, err = utils.DetectPlaylistPeakBitrate(playlist.PlaylistPath)
+		if err == nil {
+			return fmt.Sprintf("BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d", peak+audioPeak, average+audioAverage)
+		}
+	}
+	logger.Warnf("[warning]: advertising the target bitrate of %s: %v", playlist.PlaylistPath, err)
+	return fmt.Sprintf("BANDWIDTH=%d", playlist.Resolution.Bitrate*1000+audioPeak)
+}
+
+// sortVariants orders renditions, which finish in any order, highest bitrate first as players
+// expect, so the master playlist is the same for every run.
+func sortVariants(playlists []types.TranscoderPlaylist) {
+	slices.SortFunc(playlists, func(a, b types.TranscoderPlaylist) int {
+		if a.Resolution.Bitrate != b.Resolution.Bitrate {
+			return cmp.Compare(b.Resolution.Bitrate, a.Resolution.Bitrate)
+		}
+		return cmp.Compare(b.Resolution.Height, a.Resolution.Height)
+	})
 }
 
 // buildMainPlaylist creates the master M3U8 playlist.
 func (t *Transcoder) buildMainPlaylist(playlists []types.TranscoderPlaylist, outputFolder string) bool {
 	if len(playlists) == 0 {
-		log.Printf("[skipping]: main playlist for %s; no resolution playlists found", outputFolder)
+		logger.Warnf("[skipping]: main playlist for %s; no resolution playlists found", outputFolder)
 		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: "Skipping main playlist: no resolutions transcoded."})
 		return false
 	}
 
 	mainPlaylistPath := filepath.Join(outputFolder, "main.m3u8")
-	log.Printf("[started]: generating main playlist %s", mainPlaylistPath)
+	logger.Infof("[started]: generating main playlist %s", mainPlaylistPath)
 	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "progress", Message: "Generating master playlist..."})
 
-	mainContent := []string{"#EXTM3U", "#EXT-X-VERSION:3"}
+	// EXT-X-I-FRAME-STREAM-INF requires protocol version 4, and fMP4 segments (EXT-X-MAP in the media playlists) version 7
+	version := 3
+	if t.options.IFramePlaylist {
+		version = 4
+	}
+	if t.options.SegmentType == types.SegmentFMP4 {
+		version = 7
+	}
+	mainContent := []string{"#EXTM3U", fmt.Sprintf("#EXT-X-VERSION:%d", version)}
+
+	for _, track := range t.audioTracks {
+		mainContent = append(mainContent, audioMedia(track))
+	}
+	for _, track := range t.subtitleTracks {
+		mainContent = append(mainContent, subtitleMedia(track))
+	}
+
+	audioPeak, audioAverage := t.audioBandwidth(outputFolder)
+	for _, playlist := range playlists {
+		logger.Infof("[playlist]: %dp for %s", playlist.Resolution.Height, playlist.PlaylistPathFromMain)
+		streamInf := "#EXT-X-STREAM-INF:" + variantBandwidth(playlist, audioPeak, audioAverage) + fmt.Sprintf(",RESOLUTION=%dx%d",
+			playlist.Resolution.Width, playlist.Resolution.Height)
+		if len(t.audioTracks) > 0 {
+			streamInf += fmt.Sprintf(",AUDIO=\"%s\"", audioGroupID)
+		}
+		if len(t.subtitleTracks) > 0 {
+			streamInf += fmt.Sprintf(",SUBTITLES=\"%s\"", subtitlesGroupID)
+		}
+		// Players that can't decode AV1 or the audio codec must be able to skip these variants without fetching them
+		if codecs := t.variantCodecs(playlist.Resolution); codecs != "" {
+			streamInf += fmt.Sprintf(",CODECS=\"%s\"", codecs)
+		}
+		mainContent = append(mainContent, streamInf, playlist.PlaylistPathFromMain)
+	}
 
 	for _, playlist := range playlists {
-		log.Printf("[playlist]: %dp for %s", playlist.Resolution.Height, playlist.PlaylistPathFromMain)
+		if playlist.IFramePlaylistPathFromMain == "" {
+			continue
+		}
 		mainContent = append(mainContent,
-			fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d",
-				playlist.Resolution.Bitrate*1000, playlist.Resolution.Width, playlist.Resolution.Height))
-		mainContent = append(mainContent, playlist.PlaylistPathFromMain)
+			fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,URI=\"%s\"",
+				playlist.Resolution.Bitrate*1000, playlist.Resolution.Width, playlist.Resolution.Height,
+				filepath.ToSlash(playlist.IFramePlaylistPathFromMain)))
+	}
+
+	// Players that support it pick the chapter markers up from the session data, whose URI must
+	// point to JSON; the WebVTT track is written alongside for players using text tracks
+	if len(t.options.Chapters) > 0 {
+		chaptersJSON, err := utils.ChaptersJSON(t.options.Chapters)
+		if err != nil {
+			logger.Errorf("[error]: failed to encode chapters: %v", err)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to write chapters: %v", err)})
+			return false
+		}
+		files := map[string][]byte{
+			"chapters.json": chaptersJSON,
+			"chapters.vtt":  []byte(utils.ChaptersWebVTT(t.options.Chapters)),
+		}
+		for name, content := range files {
+			chaptersPath := filepath.Join(outputFolder, name)
+			if err := utils.WriteFileAtomic(chaptersPath, content, 0644); err != nil {
+				logger.Errorf("[error]: failed to write chapters %s: %v", chaptersPath, err)
+				t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to write chapters: %v", err)})
+				return false
+			}
+		}
+		mainContent = append(mainContent,
+			fmt.Sprintf("#EXT-X-SESSION-DATA:DATA-ID=\"%s\",URI=\"chapters.json\"", utils.ChaptersDataID))
 	}
 
 	finalContent := strings.Join(mainContent, "\n")
 
-	if err := os.WriteFile(mainPlaylistPath, []byte(finalContent), 0644); err != nil {
-		log.Printf("[error]: failed to write main playlist %s: %v", mainPlaylistPath, err)
+	// Written atomically, as players may already be reading the output while it's being produced
+	if err := utils.WriteFileAtomic(mainPlaylistPath, []byte(finalContent), 0644); err != nil {
+		logger.Errorf("[error]: failed to write main playlist %s: %v", mainPlaylistPath, err)
+		if errors.Is(err, syscall.ENOSPC) {
+			t.errorCode.Store(errCodeStorageFull)
+			t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: storageFullMessage, Data: types.TaskData{ErrorCode: errCodeStorageFull}})
+			return false
+		}
 		t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "failed", Message: fmt.Sprintf("Failed to write main playlist: %v", err)})
 		return false
 	}
 
-	log.Printf("[completed]: generating main playlist %s", mainPlaylistPath)
+	logger.Infof("[completed]: generating main playlist %s", mainPlaylistPath)
 	t.statusMgr.SendUpdate(t.taskID, types.StatusUpdate{Type: "completed", Message: "Master playlist generated."})
 	return true
 }
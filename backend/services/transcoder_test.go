@@ -0,0 +1,1560 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/services/utils"
+	"github.com/PratikDev/transcoder/types"
+	"github.com/google/uuid"
+)
+
+// updateRecorder collects the status updates published for a task, in order.
+type updateRecorder struct {
+	mu       sync.Mutex
+	updates  []types.StatusUpdate
+	progress chan struct{} // Signalled on every progress update, without blocking
+}
+
+func (r *updateRecorder) record(taskID string, update types.StatusUpdate) {
+	r.mu.Lock()
+	r.updates = append(r.updates, update)
+	r.mu.Unlock()
+	if update.Type == "progress" && update.Data.Resolution != "" {
+		select {
+		case r.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *updateRecorder) all() []types.StatusUpdate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.updates)
+}
+
+// newFakeTranscoder creates a Transcoder for a fake 8 second 720p source, transcoded to a single
+// 720p rendition kept as a folder in a temporary OUTPUT_DIR, recording every status update.
+// configure may change the options first.
+func newFakeTranscoder(t *testing.T, configure ...func(*types.TranscodeOptions)) (*Transcoder, *updateRecorder) {
+	t.Helper()
+	previousOutputDir, previousInterval := utils.OUTPUT_DIR, utils.PROGRESS_UPDATE_INTERVAL
+	utils.OUTPUT_DIR, utils.PROGRESS_UPDATE_INTERVAL = t.TempDir(), 0
+	t.Cleanup(func() { utils.OUTPUT_DIR, utils.PROGRESS_UPDATE_INTERVAL = previousOutputDir, previousInterval })
+
+	recorder := &updateRecorder{progress: make(chan struct{}, 1)}
+	sm := newTestStatusManager(t, &fakeBroker{onPublish: recorder.record})
+
+	source := filepath.Join(t.TempDir(), "source.mp4")
+	if err := os.WriteFile(source, []byte("not really video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := types.DefaultTranscodeOptions()
+	options.Zip = false
+	options.MaxRenditions = 1
+	for _, c := range configure {
+		c(&options)
+	}
+
+	transcoder, err := NewTranscoder(types.TranscoderSource{File: source, Filename: "source.mp4"}, options, utils.OUTPUT_DIR, sm, uuid.NewString())
+	if err != nil {
+		t.Fatalf("NewTranscoder: %v", err)
+	}
+	return transcoder, recorder
+}
+
+// last returns the last update of the given type, failing the test if there is none.
+func last(t *testing.T, updates []types.StatusUpdate, updateType string) types.StatusUpdate {
+	t.Helper()
+	for i := len(updates) - 1; i >= 0; i-- {
+		if updates[i].Type == updateType {
+			return updates[i]
+		}
+	}
+	t.Fatalf("no %q update among %+v", updateType, updates)
+	return types.StatusUpdate{}
+}
+
+func TestTranscoderReportsProgressAndCompletes(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	updates := recorder.all()
+	var progress []float64
+	for _, update := range updates {
+		if update.Type == "progress" && update.Data.Resolution == "720P" {
+			progress = append(progress, update.Data.Progress)
+			if update.Data.FPS != "30.00" || update.Data.Bitrate != "1500.0" {
+				t.Errorf("progress update without the parsed rates: %+v", update.Data)
+			}
+		}
+	}
+	if !slices.Equal(progress, []float64{25, 50, 100}) {
+		t.Errorf("progress = %v, want [25 50 100]", progress)
+	}
+
+	completed := last(t, updates, "completed")
+	if completed.Data.MasterPlaylist == "" || completed.Data.Progress != 100 {
+		t.Fatalf("completed update = %+v", completed)
+	}
+	master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	if !strings.Contains(string(master), "RESOLUTION=1280x720") {
+		t.Errorf("master playlist doesn't list the 720p rendition:\n%s", master)
+	}
+}
+
+func TestTranscoderReportsFFmpegFailure(t *testing.T) {
+	useFakeFFmpeg(t, fakeFail)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	failed := last(t, recorder.all(), "failed")
+	if failed.Data.ErrorCode != errCodeInvalidInput {
+		t.Errorf("final update = %+v, want error code %s", failed, errCodeInvalidInput)
+	}
+	if _, err := os.Stat(utils.GetOutputDirectory(transcoder.taskID)); !os.IsNotExist(err) {
+		t.Error("output of the failed job was kept")
+	}
+}
+
+func TestTranscoderStopsOnCancellation(t *testing.T) {
+	tests := []struct {
+		reason   types.CancelReason
+		wantType string
+	}{
+		{reason: types.CancelReasonUser, wantType: "cancelled"},
+		{reason: types.CancelReasonTimeout, wantType: "timed_out"},
+		{reason: types.CancelReasonShutdown, wantType: "cancelled"},
+		{reason: types.CancelReasonDisconnected, wantType: "cancelled"},
+		{reason: types.CancelReasonQuota, wantType: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.reason), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeHang)
+			transcoder, recorder := newFakeTranscoder(t)
+
+			ctx, cancel := context.WithCancelCause(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				transcoder.Process(ctx)
+			}()
+
+			select {
+			case <-recorder.progress:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no progress reported by the running ffmpeg")
+			}
+			cancel(tt.reason)
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Process kept running after its context was cancelled")
+			}
+			updates := recorder.all()
+			final := updates[len(updates)-1]
+			if final.Type != tt.wantType || final.Data.Reason != tt.reason {
+				t.Errorf("final update = %+v, want %s with reason %s", final, tt.wantType, tt.reason)
+			}
+			if final.Data.ErrorCode != "" {
+				t.Errorf("final update = %+v, want no error code for a job stopped early", final)
+			}
+			if _, err := os.Stat(utils.GetOutputDirectory(transcoder.taskID)); !os.IsNotExist(err) {
+				t.Error("output of the cancelled job was kept")
+			}
+		})
+	}
+}
+
+func TestTranscoderPausesEveryFFmpegRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		fixture   string
+		hangArg   string // Argument of the ffmpeg run to pause
+		configure func(*types.TranscodeOptions)
+	}{
+		{name: "rendition", fixture: "source_720p", hangArg: "libx264"},
+		{name: "I-frame playlist", fixture: "source_720p", hangArg: "iframes_only", configure: func(options *types.TranscodeOptions) {
+			options.IFramePlaylist = true
+		}},
+		{name: "audio track", fixture: "source_multi_track", hangArg: "0:2", configure: func(options *types.TranscodeOptions) {
+			options.AudioTracks = true
+		}},
+		{name: "subtitles", fixture: "source_subtitles", hangArg: ".vtt", configure: func(options *types.TranscodeOptions) {
+			options.Subtitles = true
+		}},
+		{name: "audio extraction", fixture: "source_720p", hangArg: "source.mp3", configure: func(options *types.TranscodeOptions) {
+			options.AudioFormat = "mp3"
+		}},
+		{name: "preview", fixture: "source_720p", hangArg: "preview.mp4", configure: func(options *types.TranscodeOptions) {
+			options.PreviewFormat, options.PreviewDuration = "mp4", utils.DefaultPreviewDuration
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeFFmpegWithSource(t, fakeSucceed, tt.fixture)
+			t.Setenv("FAKE_HANG_ARG", tt.hangArg)
+			ffmpegArgs := recordFFmpegArgs(t)
+			var configure []func(*types.TranscodeOptions)
+			if tt.configure != nil {
+				configure = append(configure, tt.configure)
+			}
+			transcoder, recorder := newFakeTranscoder(t, configure...)
+			sm := transcoder.statusMgr
+
+			ctx, cancel := context.WithCancelCause(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				transcoder.Process(ctx)
+			}()
+			defer func() {
+				cancel(types.CancelReasonUser)
+				<-done
+			}()
+
+			// Pause once the run to pause has started; until it's tracked, there's nothing to pause
+			err := ErrTaskNotRunning
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				started := slices.ContainsFunc(ffmpegArgs(), func(args []string) bool {
+					return slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, tt.hangArg) })
+				})
+				if started {
+					if err = sm.PauseTask(transcoder.taskID); err == nil {
+						break
+					}
+				}
+			}
+			if err != nil || !sm.IsPaused(transcoder.taskID) {
+				t.Fatalf("PauseTask = %v, want the %s run paused (ffmpeg runs: %q)", err, tt.name, ffmpegArgs())
+			}
+			if err := sm.ResumeTask(transcoder.taskID); err != nil {
+				t.Errorf("ResumeTask: %v", err)
+			}
+
+			cancel(types.CancelReasonUser)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Process kept running after its context was cancelled")
+			}
+			if final := last(t, recorder.all(), "cancelled"); final.Data.Reason != types.CancelReasonUser {
+				t.Errorf("final update = %+v, want cancelled by the user", final)
+			}
+			// The run was forgotten once it exited
+			if err := sm.PauseTask(transcoder.taskID); !errors.Is(err, ErrTaskNotRunning) {
+				t.Errorf("PauseTask after the job = %v, want %v", err, ErrTaskNotRunning)
+			}
+		})
+	}
+}
+
+func TestTranscoderStoresDeadline(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	transcoder, _ := newFakeTranscoder(t)
+	if _, ok := transcoder.statusMgr.Deadline(transcoder.taskID); ok {
+		t.Error("a task that didn't start has a deadline")
+	}
+
+	start := time.Now()
+	transcoder.Process(context.Background())
+	deadline, ok := transcoder.statusMgr.Deadline(transcoder.taskID)
+	if want := start.Add(utils.JobTimeout(transcoder.inputDuration)); !ok || deadline.Before(want) || deadline.After(want.Add(time.Minute)) {
+		t.Errorf("Deadline = %s, %t, want about %s", deadline, ok, want)
+	}
+}
+
+func TestRenditionName(t *testing.T) {
+	tests := []struct {
+		title, language, kind string
+		number                int
+		want                  string
+	}{
+		{title: "Director's commentary", language: "en", kind: "Audio", number: 1, want: "Director's commentary"},
+		{language: "de", kind: "Subtitles", number: 0, want: "de"},
+		{kind: "Audio", number: 0, want: "Audio 1"},
+		{kind: "Subtitles", number: 2, want: "Subtitles 3"},
+	}
+	for _, tt := range tests {
+		if got := renditionName(tt.title, tt.language, tt.kind, tt.number); got != tt.want {
+			t.Errorf("renditionName(%q, %q, %q, %d) = %q, want %q", tt.title, tt.language, tt.kind, tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestSingleDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []bool
+		required bool
+		want     []bool
+	}{
+		{name: "one flagged", flags: []bool{false, true, false}, want: []bool{false, true, false}},
+		{name: "several flagged", flags: []bool{false, true, true}, want: []bool{false, true, false}},
+		{name: "none flagged", flags: []bool{false, false}, want: []bool{false, false}},
+		{name: "none flagged but required", flags: []bool{false, false}, required: true, want: []bool{true, false}},
+		{name: "several flagged and required", flags: []bool{true, true}, required: true, want: []bool{true, false}},
+		{name: "empty group", flags: []bool{}, required: true, want: []bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := slices.Clone(tt.flags)
+			defaults := make([]*bool, len(flags))
+			for i := range flags {
+				defaults[i] = &flags[i]
+			}
+			singleDefault(defaults, tt.required)
+			if !slices.Equal(flags, tt.want) {
+				t.Errorf("singleDefault(%v, %t) left %v, want %v", tt.flags, tt.required, flags, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranscoderAppliesBitrateOverride(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.Bitrates = map[types.Resolutions]int{types.P720: 1500}
+	})
+
+	transcoder.Process(context.Background())
+
+	last(t, recorder.all(), "completed")
+	runs := ffmpegArgs()
+	if len(runs) != 1 {
+		t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+	}
+	maxrate, bufsize := utils.VBVRates(1500)
+	for flag, want := range map[string]string{
+		"-b:v":     "1500k",
+		"-maxrate": fmt.Sprintf("%dk", maxrate),
+		"-bufsize": fmt.Sprintf("%dk", bufsize),
+	} {
+		if got := argValue(runs[0], flag); got != want {
+			t.Errorf("%s = %q, want %q", flag, got, want)
+		}
+	}
+}
+
+func TestEncodingArgsConstrainEveryCodec(t *testing.T) {
+	for _, codec := range []types.Codec{types.CodecH264, types.CodecVP9, types.CodecAV1} {
+		options := types.DefaultTranscodeOptions()
+		options.Codec = codec
+		transcoder := &Transcoder{options: options}
+
+		args := transcoder.encodingArgs("scale=-2:720", 4000, 4280, 6000)
+		for flag, want := range map[string]string{"-b:v": "4000k", "-maxrate": "4280k", "-bufsize": "6000k", "-vf": "scale=-2:720"} {
+			if got := argValue(args, flag); got != want {
+				t.Errorf("%s: %s = %q, want %q", codec, flag, got, want)
+			}
+		}
+	}
+}
+
+func TestTranscoderReadsProgressFromStdout(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	runs := ffmpegArgs()
+	if len(runs) != 1 || argValue(runs[0], "-progress") != "pipe:1" || !slices.Contains(runs[0], "-nostats") {
+		t.Fatalf("ffmpeg args = %q, want -progress pipe:1 and -nostats", runs)
+	}
+	// The fake prints a stats line claiming 99x to stderr; only the stdout blocks may be reported
+	for _, update := range recorder.all() {
+		if update.Type == "progress" && update.Data.Resolution != "" && strings.Contains(update.Message, "99x") {
+			t.Errorf("progress scraped from stderr: %+v", update)
+		}
+	}
+	last(t, recorder.all(), "completed")
+}
+
+func TestTranscoderFallsBackToNativeRendition(t *testing.T) {
+	useFakeFFmpegWithSource(t, fakeSucceed, "source_240p")
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	if transcoder.native == nil || transcoder.native.Width != 320 || transcoder.native.Height != 240 {
+		t.Fatalf("native preset = %+v, want 320x240", transcoder.native)
+	}
+	transcoder.Process(context.Background())
+
+	updates := recorder.all()
+	found := false
+	for _, update := range updates {
+		found = found || strings.Contains(update.Message, "smaller than the lowest preset")
+	}
+	if !found {
+		t.Error("no status update explains the native rendition")
+	}
+	runs := ffmpegArgs()
+	if len(runs) != 1 || !strings.HasSuffix(argValue(runs[0], "-vf"), "scale=-2:240") {
+		t.Errorf("ffmpeg args = %q, want a single rendition scaled to 240 lines", runs)
+	}
+	last(t, updates, "completed")
+}
+
+func TestTranscoderSendsFinalProgressBeforeCompletion(t *testing.T) {
+	for _, zip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("zip=%v", zip), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) { options.Zip = zip })
+
+			transcoder.Process(context.Background())
+
+			updates := recorder.all()
+			completed := len(updates) - 1
+			if completed < 1 || updates[completed].Type != "completed" || updates[completed].Data.Completion == nil {
+				t.Fatalf("job didn't end with its completion: %+v", updates)
+			}
+			final := updates[completed-1]
+			if final.Type != "progress" || final.Data.Resolution != "" || final.Data.Progress != 100 {
+				t.Errorf("update before completion = %+v, want aggregate progress at 100", final)
+			}
+		})
+	}
+}
+
+func TestTranscoderTrimsSource(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.StartTime, options.EndTime = 2, 6
+	})
+	if transcoder.inputDuration != 4 {
+		t.Fatalf("inputDuration = %v, want the trimmed 4 seconds", transcoder.inputDuration)
+	}
+
+	transcoder.Process(context.Background())
+
+	runs := ffmpegArgs()
+	if len(runs) != 1 || argValue(runs[0], "-ss") != "2.000" || argValue(runs[0], "-t") != "4.000" {
+		t.Fatalf("ffmpeg args = %q, want -ss 2.000 and -t 4.000", runs)
+	}
+	// The fake reports 2 seconds written first, half of the trimmed output
+	for _, update := range recorder.all() {
+		if update.Type == "progress" && update.Data.Resolution != "" {
+			if update.Data.Progress != 50 {
+				t.Errorf("first progress = %v, want 50", update.Data.Progress)
+			}
+			break
+		}
+	}
+	last(t, recorder.all(), "completed")
+}
+
+func TestNewTranscoderRejectsTrimBeyondSource(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	sm := newTestStatusManager(t, &fakeBroker{})
+	source := filepath.Join(t.TempDir(), "source.mp4")
+	if err := os.WriteFile(source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trim := range [][2]float64{{8, 0}, {10, 0}, {2, 9}} {
+		options := types.DefaultTranscodeOptions()
+		options.StartTime, options.EndTime = trim[0], trim[1]
+		_, err := NewTranscoder(types.TranscoderSource{File: source, Filename: "source.mp4"}, options, t.TempDir(), sm, uuid.NewString())
+		if err == nil {
+			t.Errorf("trimming the 8 second source to %v was accepted", trim)
+		}
+	}
+}
+
+func TestSortVariants(t *testing.T) {
+	sorted := []types.TranscoderPlaylist{
+		{Resolution: types.ResolutionPreset{Height: 1080, Bitrate: 6500}},
+		{Resolution: types.ResolutionPreset{Height: 720, Bitrate: 4000}},
+		{Resolution: types.ResolutionPreset{Height: 480, Bitrate: 4000}}, // Overridden to 720p's bitrate
+		{Resolution: types.ResolutionPreset{Height: 360, Bitrate: 1000}},
+	}
+	for _, order := range [][]int{{3, 2, 1, 0}, {1, 3, 0, 2}, {2, 0, 3, 1}, {0, 1, 2, 3}} {
+		shuffled := make([]types.TranscoderPlaylist, len(order))
+		for i, j := range order {
+			shuffled[i] = sorted[j]
+		}
+		sortVariants(shuffled)
+		if !slices.Equal(shuffled, sorted) {
+			t.Errorf("sortVariants(order %v) = %+v", order, shuffled)
+		}
+	}
+}
+
+func TestTranscoderListsVariantsHighestFirst(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) { options.MaxRenditions = 0 })
+
+	transcoder.Process(context.Background())
+
+	completed := last(t, recorder.all(), "completed")
+	master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	// The fake ffprobe reports 720p for every rendition, so they're told apart by their URI
+	var variants []string
+	lines := strings.Split(string(master), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") && i+1 < len(lines) {
+			folder, _, _ := strings.Cut(lines[i+1], "/")
+			variants = append(variants, folder)
+		}
+	}
+	if want := []string{"720P", "480P", "360P"}; !slices.Equal(variants, want) {
+		t.Errorf("variants = %v, want %v:\n%s", variants, want, master)
+	}
+}
+
+func TestTranscoderFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy    types.FailurePolicy
+		completed bool
+	}{
+		{policy: types.FailFast, completed: false},
+		{policy: types.BestEffort, completed: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			t.Setenv("FAKE_FAIL_ARG", "scale=-2:480") // Only the 480p rendition fails
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+				options.MaxRenditions = 0
+				options.FailurePolicy = tt.policy
+			})
+
+			transcoder.Process(context.Background())
+
+			updates := recorder.all()
+			outputDir := utils.GetOutputDirectory(transcoder.taskID)
+			if !tt.completed {
+				last(t, updates, "failed")
+				if updates[len(updates)-1].Type == "completed" {
+					t.Error("job completed despite a failed rendition")
+				}
+				if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+					t.Error("output of the failed job was kept")
+				}
+				return
+			}
+
+			completed := last(t, updates, "completed")
+			if completed.Data.Completion == nil || !slices.Equal(completed.Data.Completion.FailedRenditions, []string{"480P"}) {
+				t.Fatalf("completion = %+v, want 480P reported as failed", completed.Data.Completion)
+			}
+			master, err := os.ReadFile(filepath.Join(outputDir, "main.m3u8"))
+			if err != nil {
+				t.Fatalf("master playlist: %v", err)
+			}
+			if strings.Contains(string(master), "480P/") || !strings.Contains(string(master), "720P/") || !strings.Contains(string(master), "360P/") {
+				t.Errorf("master playlist should list only the successful renditions:\n%s", master)
+			}
+			if _, err := os.Stat(filepath.Join(outputDir, "480P")); !os.IsNotExist(err) {
+				t.Error("partial output of the failed rendition was kept")
+			}
+		})
+	}
+}
+
+func TestClassifyFFmpegError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		code   string
+	}{
+		{stderr: "[hls @ 0x5581] Failed to write segment_004.ts: No space left on device\nav_interleaved_write_frame(): No space left on device", code: errCodeStorageFull},
+		{stderr: "source.mp4: Invalid data found when processing input", code: errCodeInvalidInput},
+		{stderr: "[mov,mp4,m4a,3gp,3g2,mj2 @ 0x55d1] moov atom not found\nsource.mp4: Invalid data found when processing input", code: errCodeInvalidInput},
+		{stderr: "Decoder not found for stream #0:0", code: errCodeUnsupportedCodec},
+		{stderr: "Unknown encoder 'libsvtav1'", code: errCodeUnsupportedCodec},
+		{stderr: "Conversion failed!", code: ""},
+		{stderr: "", code: ""},
+	}
+	for _, tt := range tests {
+		code, msg := classifyFFmpegError(tt.stderr)
+		if code != tt.code || (code == "") != (msg == "") {
+			t.Errorf("classifyFFmpegError(%q) = %q, %q; want code %q", tt.stderr, code, msg, tt.code)
+		}
+	}
+}
+
+func TestTranscoderReportsFullStorage(t *testing.T) {
+	useFakeFFmpeg(t, fakeFail)
+	t.Setenv("FAKE_STDERR", "av_interleaved_write_frame(): No space left on device\nError writing trailer: No space left on device")
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	updates := recorder.all()
+	if final := last(t, updates, "failed"); final.Data.ErrorCode != errCodeStorageFull {
+		t.Errorf("final update = %+v, want error code %s", final, errCodeStorageFull)
+	}
+	rendition := slices.IndexFunc(updates, func(u types.StatusUpdate) bool { return u.Type == "failed" && u.Data.Resolution == "720P" })
+	if rendition < 0 || !strings.Contains(updates[rendition].Message, storageFullMessage) {
+		t.Errorf("no 720P failure with the storage full message among %+v", updates)
+	}
+	for _, update := range updates {
+		if strings.Contains(update.Message, "av_interleaved_write_frame") {
+			t.Errorf("raw stderr sent to clients: %q", update.Message)
+		}
+	}
+}
+
+func TestTranscoderWritesFMP4Segments(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.SegmentType = types.SegmentFMP4
+	})
+
+	transcoder.Process(context.Background())
+
+	completed := last(t, recorder.all(), "completed")
+	runs := ffmpegArgs()
+	if len(runs) != 1 {
+		t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+	}
+	args := runs[0]
+	if argValue(args, "-hls_segment_type") != "fmp4" || argValue(args, "-hls_fmp4_init_filename") != "source_720P_init.mp4" {
+		t.Errorf("ffmpeg args = %q, want fmp4 segments with an init segment", args)
+	}
+	if segments := argValue(args, "-hls_segment_filename"); !strings.HasSuffix(segments, ".m4s") {
+		t.Errorf("segments = %q, want .m4s", segments)
+	}
+
+	master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	if !strings.Contains(string(master), "#EXT-X-VERSION:7\n") {
+		t.Errorf("master playlist isn't version 7, which EXT-X-MAP needs:\n%s", master)
+	}
+}
+
+func TestTranscoderStreamCopiesCompatibleSources(t *testing.T) {
+	tests := []struct {
+		name      string
+		fixture   string
+		configure func(*types.TranscodeOptions)
+		copied    bool
+	}{
+		{name: "small h264", fixture: "source_240p", configure: func(o *types.TranscodeOptions) { o.SmartCopy = true }, copied: true},
+		{name: "smartCopy off", fixture: "source_240p", configure: func(o *types.TranscodeOptions) {}},
+		{name: "bitrate override", fixture: "source_240p", configure: func(o *types.TranscodeOptions) {
+			o.SmartCopy = true
+			o.Bitrates = map[types.Resolutions]int{types.P360: 500} // Only takes effect when encoding
+		}},
+		{name: "above the smallest preset", fixture: "source_720p", configure: func(o *types.TranscodeOptions) { o.SmartCopy = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeFFmpegWithSource(t, fakeSucceed, tt.fixture)
+			ffmpegArgs := recordFFmpegArgs(t)
+			transcoder, recorder := newFakeTranscoder(t, tt.configure)
+
+			transcoder.Process(context.Background())
+
+			last(t, recorder.all(), "completed")
+			runs := ffmpegArgs()
+			if len(runs) != 1 {
+				t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+			}
+			copied := argValue(runs[0], "-c") == "copy"
+			if copied != tt.copied || copied == slices.Contains(runs[0], "-c:v") {
+				t.Errorf("ffmpeg args = %q, want stream copy %v", runs[0], tt.copied)
+			}
+		})
+	}
+}
+
+func TestTranscoderSendsStartedOncePerJob(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) { options.MaxRenditions = 0 })
+
+	transcoder.Process(context.Background())
+
+	updates := recorder.all()
+	var started int
+	var renditions []string
+	for _, update := range updates {
+		switch update.Type {
+		case "started":
+			started++
+			if update.Data.Resolution != "" {
+				t.Errorf("job-level started carries resolution %s", update.Data.Resolution)
+			}
+		case "resolution_started":
+			renditions = append(renditions, update.Data.Resolution)
+		}
+	}
+	if started != 1 || updates[0].Type != "started" {
+		t.Errorf("%d started updates, want a single one first", started)
+	}
+	slices.Sort(renditions)
+	if want := []string{"360P", "480P", "720P"}; !slices.Equal(renditions, want) {
+		t.Errorf("resolution_started for %v, want %v", renditions, want)
+	}
+}
+
+func TestProgressThrottle(t *testing.T) {
+	throttle := progressThrottle{interval: 500 * time.Millisecond}
+	start := time.Now()
+
+	allowed := 0
+	for i := range 1000 { // Every 10ms for 10 seconds
+		if throttle.allow(start.Add(time.Duration(i)*10*time.Millisecond), false) {
+			allowed++
+		}
+	}
+	if allowed != 20 {
+		t.Errorf("%d of 1000 updates allowed over 10 seconds, want 20", allowed)
+	}
+	if !throttle.allow(start.Add(9995*time.Millisecond), true) {
+		t.Error("final update throttled")
+	}
+}
+
+func TestTranscoderThrottlesProgressFlood(t *testing.T) {
+	useFakeFFmpeg(t, fakeFlood)
+	transcoder, recorder := newFakeTranscoder(t)
+	previous := utils.PROGRESS_UPDATE_INTERVAL
+	utils.PROGRESS_UPDATE_INTERVAL = time.Hour // Only the first and final updates fit
+	t.Cleanup(func() { utils.PROGRESS_UPDATE_INTERVAL = previous })
+
+	transcoder.Process(context.Background())
+
+	var progress []float64
+	for _, update := range recorder.all() {
+		if update.Type == "progress" && update.Data.Resolution == "720P" {
+			progress = append(progress, update.Data.Progress)
+		}
+	}
+	if len(progress) != 2 || progress[1] != 100 {
+		t.Errorf("progress = %v, want the first of 1000 updates and the final 100", progress)
+	}
+}
+
+func TestTranscoderCapsBitrateAtSource(t *testing.T) {
+	useFakeFFmpegWithSource(t, fakeSucceed, "source_720p_low_bitrate")
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	last(t, recorder.all(), "completed")
+	runs := ffmpegArgs()
+	if len(runs) != 1 || argValue(runs[0], "-b:v") != "1500k" {
+		t.Errorf("ffmpeg args = %q, want the 720p rendition capped at the source's 1500k", runs)
+	}
+}
+
+func TestEncodingArgsSceneCut(t *testing.T) {
+	forced := utils.ForceKeyFramesExpr(utils.SegmentDuration)
+	if forced != fmt.Sprintf("expr:gte(t,n_forced*%d)", utils.SegmentDuration) {
+		t.Fatalf("ForceKeyFramesExpr = %q", forced)
+	}
+
+	tests := []struct {
+		codec    types.Codec
+		sceneCut bool
+		want     map[string]string // Flag to value, "" for flags that must be absent
+	}{
+		{codec: types.CodecH264, sceneCut: false, want: map[string]string{"-sc_threshold": "0", "-keyint_min": "48", "-force_key_frames": ""}},
+		{codec: types.CodecH264, sceneCut: true, want: map[string]string{"-sc_threshold": "", "-keyint_min": "", "-force_key_frames": forced}},
+		{codec: types.CodecVP9, sceneCut: false, want: map[string]string{"-keyint_min": "48", "-force_key_frames": forced}},
+		{codec: types.CodecVP9, sceneCut: true, want: map[string]string{"-keyint_min": "", "-force_key_frames": forced}},
+		{codec: types.CodecAV1, sceneCut: false, want: map[string]string{"-svtav1-params": "scd=0", "-force_key_frames": forced}},
+		{codec: types.CodecAV1, sceneCut: true, want: map[string]string{"-svtav1-params": "scd=1", "-force_key_frames": forced}},
+	}
+	for _, tt := range tests {
+		options := types.DefaultTranscodeOptions()
+		options.Codec, options.SceneCut = tt.codec, tt.sceneCut
+		args := (&Transcoder{options: options}).encodingArgs("scale=-2:720", 4000, 4280, 6000)
+
+		if argValue(args, "-g") != "48" {
+			t.Errorf("%s sceneCut=%v: GOP = %q, want 48", tt.codec, tt.sceneCut, argValue(args, "-g"))
+		}
+		for flag, want := range tt.want {
+			if got := argValue(args, flag); got != want {
+				t.Errorf("%s sceneCut=%v: %s = %q, want %q", tt.codec, tt.sceneCut, flag, got, want)
+			}
+		}
+	}
+}
+
+func TestTranscoderFailsEarlyOnUnwritableOutput(t *testing.T) {
+	tests := []struct {
+		name  string
+		block func(t *testing.T, outputDir string)
+	}{
+		{
+			name: "rendition folder taken by a file",
+			block: func(t *testing.T, outputDir string) {
+				if err := os.WriteFile(filepath.Join(outputDir, "480P"), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "read-only output folder",
+			block: func(t *testing.T, outputDir string) {
+				if os.Geteuid() == 0 {
+					t.Skip("root can write to read-only folders")
+				}
+				if err := os.Chmod(outputDir, 0555); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.Chmod(outputDir, 0755) })
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			ffmpegArgs := recordFFmpegArgs(t)
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) { options.MaxRenditions = 0 })
+			outputDir, err := utils.CreateOutputDirectory(transcoder.taskID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.block(t, outputDir)
+
+			transcoder.Process(context.Background())
+
+			failed := last(t, recorder.all(), "failed")
+			if failed.Data.ErrorCode != errCodeOutputUnwritable {
+				t.Errorf("final update = %+v, want error code %s", failed, errCodeOutputUnwritable)
+			}
+			if runs := ffmpegArgs(); len(runs) != 0 {
+				t.Errorf("ffmpeg ran %d times before the output was known to be writable", len(runs))
+			}
+			if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+				t.Error("partially created output folders were kept")
+			}
+		})
+	}
+}
+
+func TestEncodingArgsVP9(t *testing.T) {
+	options := types.DefaultTranscodeOptions()
+	options.Codec = types.CodecVP9
+	options.Format = types.FormatDASH
+	options.AudioCodec = types.AudioOpus
+	transcoder := &Transcoder{options: options}
+
+	args := transcoder.encodingArgs("scale=-2:720", 2800, 2996, 4200)
+	for flag, want := range map[string]string{"-c:v": "libvpx-vp9", "-deadline": "good", "-row-mt": "1", "-c:a": "libopus"} {
+		if got := argValue(args, flag); got != want {
+			t.Errorf("%s = %q, want %q", flag, got, want)
+		}
+	}
+	if slices.Contains(args, "-preset") || slices.Contains(args, "-sc_threshold") {
+		t.Errorf("args = %q, carry x264 options", args)
+	}
+}
+
+func TestPlaylistArgs(t *testing.T) {
+	tests := []struct {
+		playlistType types.PlaylistType
+		listSize     int
+		wantType     string // "" for no -hls_playlist_type
+		wantListSize string
+		wantFlags    string
+	}{
+		{playlistType: types.PlaylistVOD, wantType: "vod", wantListSize: "0", wantFlags: "temp_file"},
+		{playlistType: types.PlaylistEvent, wantType: "event", wantListSize: "0", wantFlags: "temp_file"},
+		{playlistType: types.PlaylistLive, listSize: 6, wantListSize: "6", wantFlags: "delete_segments+temp_file"},
+		{playlistType: types.PlaylistLive, listSize: 30, wantListSize: "30", wantFlags: "delete_segments+temp_file"},
+	}
+	for _, tt := range tests {
+		options := types.DefaultTranscodeOptions()
+		options.PlaylistType = tt.playlistType
+		options.ListSize = tt.listSize
+		transcoder := &Transcoder{options: options}
+
+		args := transcoder.playlistArgs()
+		if got := argValue(args, "-hls_playlist_type"); got != tt.wantType {
+			t.Errorf("%s: -hls_playlist_type = %q, want %q", tt.playlistType, got, tt.wantType)
+		}
+		if got := argValue(args, "-hls_list_size"); got != tt.wantListSize {
+			t.Errorf("%s: -hls_list_size = %q, want %q", tt.playlistType, got, tt.wantListSize)
+		}
+		if got := argValue(args, "-hls_flags"); got != tt.wantFlags {
+			t.Errorf("%s: -hls_flags = %q, want %q", tt.playlistType, got, tt.wantFlags)
+		}
+	}
+
+	// Options that never set a playlist type still get a VOD playlist
+	transcoder := &Transcoder{options: types.TranscodeOptions{}}
+	if got := argValue(transcoder.playlistArgs(), "-hls_playlist_type"); got != "vod" {
+		t.Errorf("zero options: -hls_playlist_type = %q, want vod", got)
+	}
+}
+
+func TestTranscoderWritesVODPlaylistsByDefault(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+	last(t, recorder.all(), "completed")
+	runs := 0
+	for _, args := range ffmpegArgs() {
+		if !slices.Contains(args, "-hls_segment_filename") {
+			continue
+		}
+		runs++
+		if got := argValue(args, "-hls_playlist_type"); got != "vod" {
+			t.Errorf("-hls_playlist_type = %q, want vod: %q", got, args)
+		}
+		if slices.Contains(args, "delete_segments+temp_file") {
+			t.Errorf("a VOD rendition deletes segments: %q", args)
+		}
+	}
+	if runs == 0 {
+		t.Fatalf("no rendition encode in %q", ffmpegArgs())
+	}
+}
+
+func TestEncodingArgsPixelFormat(t *testing.T) {
+	tests := []struct {
+		codec       types.Codec
+		pixFmt      string
+		profile     string // Requested profile, "" to leave it to the pixel format
+		wantProfile string // "" for no -profile:v
+	}{
+		{codec: types.CodecH264, pixFmt: "yuv420p"},
+		{codec: types.CodecH264, pixFmt: "yuv420p10le", wantProfile: "high10"},
+		{codec: types.CodecH264, pixFmt: "yuv422p", wantProfile: "high422"},
+		{codec: types.CodecH264, pixFmt: "yuv444p10le", wantProfile: "high444"},
+		{codec: types.CodecH264, pixFmt: "yuv420p", profile: "baseline", wantProfile: "baseline"},
+		{codec: types.CodecVP9, pixFmt: "yuv420p"},
+		{codec: types.CodecVP9, pixFmt: "yuv444p", wantProfile: "1"},
+		{codec: types.CodecVP9, pixFmt: "yuv420p10le", wantProfile: "2"},
+		{codec: types.CodecAV1, pixFmt: "yuv420p10le"},
+	}
+	for _, tt := range tests {
+		options := types.DefaultTranscodeOptions()
+		options.Codec = tt.codec
+		options.PixFmt = tt.pixFmt
+		options.Profile = tt.profile
+		transcoder := &Transcoder{options: options}
+
+		args := transcoder.encodingArgs("scale=-2:720", 2800, 2996, 4200)
+		if got := argValue(args, "-pix_fmt"); got != tt.pixFmt {
+			t.Errorf("%s %s: -pix_fmt = %q, want %q", tt.codec, tt.pixFmt, got, tt.pixFmt)
+		}
+		if got := argValue(args, "-profile:v"); got != tt.wantProfile {
+			t.Errorf("%s %s: -profile:v = %q, want %q", tt.codec, tt.pixFmt, got, tt.wantProfile)
+		}
+	}
+}
+
+func TestTranscoderEncodesAV1(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.Codec = types.CodecAV1
+		options.SegmentType = types.SegmentFMP4
+		options.Speed = 2
+	})
+
+	transcoder.Process(context.Background())
+
+	warning := last(t, recorder.all(), "warning")
+	if !strings.Contains(warning.Message, "speed 2 takes about 40x as long") {
+		t.Errorf("warning = %q, want the expected slowdown", warning.Message)
+	}
+	runs := ffmpegArgs()
+	if len(runs) != 1 || argValue(runs[0], "-c:v") != "libsvtav1" || argValue(runs[0], "-preset") != "2" {
+		t.Fatalf("ffmpeg args = %q, want libsvtav1 at preset 2", runs)
+	}
+
+	completed := last(t, recorder.all(), "completed")
+	master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	if !strings.Contains(string(master), `CODECS="av01.0.05M.08,mp4a.40.2"`) {
+		t.Errorf("master playlist lacks the AV1 CODECS attribute:\n%s", master)
+	}
+}
+
+func TestTranscoderEstimate(t *testing.T) {
+	realtime720p := float64(1280 * 720 * 30) // Encodes the 8 s 720p30 fixture in 8 s
+	tests := []struct {
+		name      string
+		fixture   string
+		configure func(*types.TranscodeOptions)
+		want      float64
+	}{
+		{name: "h264", fixture: "source_720p", configure: func(o *types.TranscodeOptions) {}, want: 8},
+		{name: "vp9", fixture: "source_720p", configure: func(o *types.TranscodeOptions) {
+			o.Codec, o.Format, o.AudioCodec = types.CodecVP9, types.FormatDASH, types.AudioOpus
+		}, want: 24},
+		{name: "stream copy", fixture: "source_240p", configure: func(o *types.TranscodeOptions) { o.SmartCopy = true }, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useFakeFFmpegWithSource(t, fakeSucceed, test.fixture)
+			transcoder, _ := newFakeTranscoder(t, test.configure)
+
+			estimate := transcoder.Estimate(realtime720p)
+			if len(estimate.Renditions) != 1 || estimate.Renditions[0].Seconds != test.want || estimate.TotalSeconds != test.want {
+				t.Errorf("Estimate = %+v, want one rendition taking %v s", estimate, test.want)
+			}
+			if estimate.Duration != 8 || estimate.SpeedFactor != realtime720p {
+				t.Errorf("Estimate = %+v, want the source duration and speed factor", estimate)
+			}
+		})
+	}
+}
+
+func TestTranscoderReportsAverageSpeed(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	// The fake reports every block at 2x; its 99x stats line on stderr must not count
+	for _, update := range recorder.all() {
+		if update.Type == "progress" && update.Data.Resolution != "" && update.Data.AvgSpeed != 2 {
+			t.Errorf("progress avgSpeed = %v, want 2: %+v", update.Data.AvgSpeed, update)
+		}
+	}
+	completion := last(t, recorder.all(), "completed").Data.Completion
+	if completion == nil || completion.AvgSpeed != 2 || !maps.Equal(completion.RenditionSpeeds, map[string]float64{"720P": 2}) {
+		t.Errorf("completion = %+v, want avgSpeed 2 for the job and 720P", completion)
+	}
+}
+
+func TestTranscoderAveragesSpeedsAcrossRenditions(t *testing.T) {
+	var high, low utils.SpeedAverage
+	high.Add("2")
+	high.Add("3")
+	low.Add("6")
+
+	transcoder := &Transcoder{}
+	transcoder.recordSpeeds(types.Resolutions(720), high)
+	transcoder.recordSpeeds(types.Resolutions(360), low)
+	transcoder.recordSpeeds(types.Resolutions(240), utils.SpeedAverage{}) // Failed before its first frame
+
+	average, perRendition := transcoder.averageSpeeds()
+	if average != 3.67 {
+		t.Errorf("job average = %v, want 3.67 over every sample", average)
+	}
+	if want := map[string]float64{"720P": 2.5, "360P": 6}; !maps.Equal(perRendition, want) {
+		t.Errorf("rendition averages = %v, want %v", perRendition, want)
+	}
+}
+
+func TestTranscoderEncodesAudioCodec(t *testing.T) {
+	tests := []struct {
+		codec   types.AudioCodec
+		encoder string
+		codecs  string // CODECS attribute of the variant, "" if it must be left out
+	}{
+		{codec: types.AudioAAC, encoder: "aac", codecs: ""},
+		{codec: types.AudioAC3, encoder: "ac3", codecs: "avc1.64001F,ac-3"},
+		{codec: types.AudioOpus, encoder: "libopus", codecs: "avc1.64001F,opus"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.codec), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			ffmpegArgs := recordFFmpegArgs(t)
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+				options.AudioCodec = test.codec
+				options.SegmentType = types.SegmentFMP4 // Opus isn't carried in MPEG-TS
+			})
+
+			transcoder.Process(context.Background())
+
+			runs := ffmpegArgs()
+			if len(runs) != 1 || argValue(runs[0], "-c:a") != test.encoder {
+				t.Fatalf("ffmpeg args = %q, want -c:a %s", runs, test.encoder)
+			}
+			completed := last(t, recorder.all(), "completed")
+			master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+			if err != nil {
+				t.Fatalf("master playlist: %v", err)
+			}
+			if test.codecs == "" && strings.Contains(string(master), "CODECS=") {
+				t.Errorf("master playlist lists CODECS for H.264 and AAC:\n%s", master)
+			}
+			if test.codecs != "" && !strings.Contains(string(master), fmt.Sprintf("CODECS=%q", test.codecs)) {
+				t.Errorf("master playlist lacks CODECS=%q:\n%s", test.codecs, master)
+			}
+		})
+	}
+}
+
+func TestNewTranscoderReencodesForAudioCodec(t *testing.T) {
+	useFakeFFmpegWithSource(t, fakeSucceed, "source_240p")
+	transcoder, _ := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.SmartCopy = true
+		options.AudioCodec = types.AudioAC3
+	})
+	if transcoder.streamCopy {
+		t.Error("an H.264 and AAC source is stream-copied although AC-3 audio was requested")
+	}
+}
+
+func TestTranscoderOutputLayouts(t *testing.T) {
+	tests := []struct {
+		layout types.OutputLayout
+		folder string // Folder of the 720P rendition within the output folder
+	}{
+		{layout: types.LayoutNested, folder: "720P"},
+		{layout: types.LayoutFlat, folder: "."},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.layout), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			ffmpegArgs := recordFFmpegArgs(t)
+			t.Setenv("FAKE_FAIL_ARG", "scale=-2:480") // The failed rendition's files must be removed in either layout
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+				options.MaxRenditions = 0
+				options.FailurePolicy = types.BestEffort
+				options.Layout = tt.layout
+			})
+
+			transcoder.Process(context.Background())
+
+			last(t, recorder.all(), "completed")
+			outputDir := utils.GetOutputDirectory(transcoder.taskID)
+			wantPlaylist := filepath.Join(outputDir, tt.folder, "source_720Pp.m3u8")
+			wantSegments := filepath.Join(outputDir, tt.folder, "source_720P_%03d.ts")
+			var found bool
+			for _, args := range ffmpegArgs() {
+				if args[len(args)-1] == wantPlaylist {
+					found = true
+					if segments := argValue(args, "-hls_segment_filename"); segments != wantSegments {
+						t.Errorf("segments = %q, want %q", segments, wantSegments)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("no ffmpeg run wrote %s: %q", wantPlaylist, ffmpegArgs())
+			}
+
+			master, err := os.ReadFile(filepath.Join(outputDir, "main.m3u8"))
+			if err != nil {
+				t.Fatalf("master playlist: %v", err)
+			}
+			var uris []string
+			for _, line := range strings.Split(string(master), "\n") {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					uris = append(uris, line)
+				}
+			}
+			want := []string{"720P/source_720Pp.m3u8", "360P/source_360Pp.m3u8"}
+			if tt.layout == types.LayoutFlat {
+				want = []string{"source_720Pp.m3u8", "source_360Pp.m3u8"}
+			}
+			if !slices.Equal(uris, want) {
+				t.Errorf("master playlist URIs = %q, want %q", uris, want)
+			}
+			for _, uri := range uris {
+				if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(uri))); err != nil {
+					t.Errorf("master playlist references a missing playlist: %v", err)
+				}
+			}
+
+			entries, err := os.ReadDir(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), "source_480P") || entry.Name() == "480P" {
+					t.Errorf("output of the failed rendition was kept: %s", entry.Name())
+				}
+				if tt.layout == types.LayoutFlat && entry.IsDir() {
+					t.Errorf("flat output holds a folder: %s", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestTranscoderAppliesProfileAndLevel(t *testing.T) {
+	tests := []struct {
+		profile, level string
+		codecs         string
+	}{
+		{profile: "baseline", codecs: "avc1.42E01F,mp4a.40.2"},
+		{profile: "main", level: "4.0", codecs: "avc1.4D4028,mp4a.40.2"},
+		{level: "3.1", codecs: "avc1.64001F,mp4a.40.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile+tt.level, func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			ffmpegArgs := recordFFmpegArgs(t)
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+				options.Profile = tt.profile
+				options.Level = tt.level
+			})
+
+			transcoder.Process(context.Background())
+
+			runs := ffmpegArgs()
+			if len(runs) != 1 {
+				t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+			}
+			if got := argValue(runs[0], "-profile:v"); got != tt.profile {
+				t.Errorf("-profile:v = %q, want %q", got, tt.profile)
+			}
+			if got := argValue(runs[0], "-level"); got != tt.level {
+				t.Errorf("-level = %q, want %q", got, tt.level)
+			}
+			completed := last(t, recorder.all(), "completed")
+			master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+			if err != nil {
+				t.Fatalf("master playlist: %v", err)
+			}
+			if !strings.Contains(string(master), fmt.Sprintf("CODECS=%q", tt.codecs)) {
+				t.Errorf("master playlist lacks CODECS=%q:\n%s", tt.codecs, master)
+			}
+		})
+	}
+}
+
+func TestNewTranscoderRejectsZeroDuration(t *testing.T) {
+	for _, fixture := range []string{"source_zero_duration", "still_image"} {
+		t.Run(fixture, func(t *testing.T) {
+			useFakeFFmpegWithSource(t, fakeSucceed, fixture)
+			sm := newTestStatusManager(t, &fakeBroker{})
+			source := filepath.Join(t.TempDir(), "source.mp4")
+			if err := os.WriteFile(source, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewTranscoder(types.TranscoderSource{File: source, Filename: "source.mp4"}, types.DefaultTranscodeOptions(), t.TempDir(), sm, uuid.NewString())
+			if !errors.Is(err, ErrZeroDuration) {
+				t.Fatalf("NewTranscoder = %v, want ErrZeroDuration", err)
+			}
+			code, msg := InitFailure(err)
+			if code != errCodeZeroDuration || !strings.Contains(msg, "no playable duration") {
+				t.Errorf("InitFailure = %q, %q, want %s with an explanation", code, msg, errCodeZeroDuration)
+			}
+		})
+	}
+}
+
+func TestInitFailureOfOtherErrors(t *testing.T) {
+	if code, msg := InitFailure(errors.New("failed to detect input duration")); code != "" || msg != "" {
+		t.Errorf("InitFailure = %q, %q, want neither for an unrecognized error", code, msg)
+	}
+}
+
+func TestTranscoderAdvertisesMeasuredBitrates(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	transcoder, recorder := newFakeTranscoder(t)
+
+	transcoder.Process(context.Background())
+
+	completed := last(t, recorder.all(), "completed")
+	master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	// The fake segments hold 3008 bytes per four seconds, far below the 720p preset
+	if !strings.Contains(string(master), "#EXT-X-STREAM-INF:BANDWIDTH=6016,AVERAGE-BANDWIDTH=6016,RESOLUTION=1280x720") {
+		t.Errorf("master playlist doesn't advertise the measured bitrate:\n%s", master)
+	}
+}
+
+func TestVariantBandwidthFallsBackToTarget(t *testing.T) {
+	playlist := types.TranscoderPlaylist{
+		PlaylistPath: filepath.Join(t.TempDir(), "video_720Pp.m3u8"),
+		Resolution:   types.ResolutionPreset{Height: 720, Width: 1280, Bitrate: 4000},
+	}
+	if got := variantBandwidth(playlist, 0, 0); got != "BANDWIDTH=4000000" {
+		t.Errorf("variantBandwidth of an unreadable playlist = %q, want the target bitrate", got)
+	}
+}
+
+func TestTranscoderEncodesAudioTracks(t *testing.T) {
+	useFakeFFmpegWithSource(t, fakeSucceed, "source_multi_track")
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.MaxRenditions = 0
+		options.AudioTracks = true
+	})
+
+	wantStreams := []types.AudioStream{
+		{Index: 1, Codec: "aac", Language: "en", Channels: 2, Default: true},
+		{Index: 2, Codec: "ac3", Language: "es", Title: `Español "5.1"`, Channels: 6, Default: true},
+		{Index: 3, Codec: "aac", Channels: 2},
+	}
+	if !slices.Equal(transcoder.audioStreams, wantStreams) {
+		t.Fatalf("audio streams = %+v, want %+v", transcoder.audioStreams, wantStreams)
+	}
+
+	transcoder.Process(context.Background())
+
+	completed := last(t, recorder.all(), "completed")
+	if want := []string{"audio/0.m3u8", "audio/1.m3u8", "audio/2.m3u8"}; completed.Data.Completion == nil || !slices.Equal(completed.Data.Completion.AudioTracks, want) {
+		t.Errorf("completion = %+v, want audio tracks %v", completed.Data.Completion, want)
+	}
+
+	var mapped []string
+	videoRuns := 0
+	for _, args := range ffmpegArgs() {
+		switch {
+		case slices.Contains(args, "-vn"):
+			mapped = append(mapped, argValue(args, "-map"))
+			if argValue(args, "-c:a") != "aac" || !strings.HasSuffix(args[len(args)-1], filepath.Join(utils.AudioTracksFolder, fmt.Sprintf("%d.m3u8", len(mapped)-1))) {
+				t.Errorf("audio run = %v, want AAC into its numbered playlist", args)
+			}
+		case argValue(args, "-vf") != "":
+			videoRuns++
+			if !slices.Contains(args, "-an") || argValue(args, "-c:a") != "" {
+				t.Errorf("video run = %v, want it without audio", args)
+			}
+		}
+	}
+	if !slices.Equal(mapped, []string{"0:1", "0:2", "0:3"}) || videoRuns != 3 {
+		t.Errorf("audio runs mapped %v and %d video runs, want 0:1, 0:2 and 0:3 and three video runs", mapped, videoRuns)
+	}
+
+	master, err := os.ReadFile(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	// The source flags two defaults, but a group can only have one; quotes can't appear in names
+	for _, want := range []string{
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="en",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio/0.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="Español '5.1'",LANGUAGE="es",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="6",URI="audio/1.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="Audio 3",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="2",URI="audio/2.m3u8"`,
+	} {
+		if !strings.Contains(string(master), want+"\n") {
+			t.Errorf("master playlist lacks %s:\n%s", want, master)
+		}
+	}
+	variants := 0
+	for _, line := range strings.Split(string(master), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			variants++
+			if !strings.Contains(line, `,AUDIO="audio"`) {
+				t.Errorf("variant %s doesn't refer to the audio group", line)
+			}
+		}
+	}
+	if variants != 3 {
+		t.Errorf("master playlist lists %d variants, want 3:\n%s", variants, master)
+	}
+}
+
+func TestTranscoderExtractsSubtitles(t *testing.T) {
+	useFakeFFmpegWithSource(t, fakeSucceed, "source_subtitles")
+	ffmpegArgs := recordFFmpegArgs(t)
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.MaxRenditions = 2
+		options.Subtitles = true
+	})
+
+	transcoder.Process(context.Background())
+
+	updates := recorder.all()
+	completed := last(t, updates, "completed")
+	if want := []string{"subtitles/0.m3u8", "subtitles/1.m3u8"}; completed.Data.Completion == nil || !slices.Equal(completed.Data.Completion.Subtitles, want) {
+		t.Errorf("completion = %+v, want subtitles %v", completed.Data.Completion, want)
+	}
+	if warning := last(t, updates, "warning"); !strings.Contains(warning.Message, "stream 3 (hdmv_pgs_subtitle)") {
+		t.Errorf("warning = %q, want the bitmap stream reported as skipped", warning.Message)
+	}
+
+	// The bitmap stream is never handed to ffmpeg
+	var mapped []string
+	for _, args := range ffmpegArgs() {
+		if argValue(args, "-c:s") == "webvtt" {
+			mapped = append(mapped, argValue(args, "-map"))
+		}
+	}
+	if !slices.Equal(mapped, []string{"0:2", "0:4"}) {
+		t.Errorf("subtitle runs mapped %v, want 0:2 and 0:4", mapped)
+	}
+
+	outputFolder := filepath.Dir(filepath.Join(utils.OUTPUT_DIR, filepath.FromSlash(completed.Data.MasterPlaylist)))
+	playlist, err := os.ReadFile(filepath.Join(outputFolder, "subtitles", "1.m3u8"))
+	if err != nil || !strings.Contains(string(playlist), "#EXTINF:8.000,\n1.vtt\n") {
+		t.Errorf("subtitle playlist = %q, %v, want 1.vtt covering the whole video", playlist, err)
+	}
+
+	master, err := os.ReadFile(filepath.Join(outputFolder, "main.m3u8"))
+	if err != nil {
+		t.Fatalf("master playlist: %v", err)
+	}
+	// Only the skipped bitmap stream was flagged as default, so neither rendition is
+	for _, want := range []string{
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="en",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="subtitles/0.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Español 'forzado'",LANGUAGE="es",DEFAULT=NO,AUTOSELECT=YES,FORCED=YES,URI="subtitles/1.m3u8"`,
+	} {
+		if !strings.Contains(string(master), want+"\n") {
+			t.Errorf("master playlist lacks %s:\n%s", want, master)
+		}
+	}
+	variants := 0
+	for _, line := range strings.Split(string(master), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			variants++
+			if !strings.Contains(line, `,SUBTITLES="subs"`) {
+				t.Errorf("variant %s doesn't refer to the subtitles group", line)
+			}
+		}
+	}
+	if variants != 2 || strings.Contains(string(master), `LANGUAGE="de"`) {
+		t.Errorf("master playlist should list two variants and no German subtitles:\n%s", master)
+	}
+}
+
+func TestNewTranscoderWithoutFFprobe(t *testing.T) {
+	previous := utils.FFPROBE_PATH
+	utils.FFPROBE_PATH = filepath.Join(t.TempDir(), "ffprobe")
+	t.Cleanup(func() { utils.FFPROBE_PATH = previous })
+
+	source := filepath.Join(t.TempDir(), "source.mp4")
+	if err := os.WriteFile(source, []byte("not really video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewTranscoder(types.TranscoderSource{File: source, Filename: "source.mp4"}, types.DefaultTranscodeOptions(), t.TempDir(), newTestStatusManager(t, &fakeBroker{}), "task")
+	if !errors.Is(err, utils.ErrFFmpegNotInstalled) {
+		t.Fatalf("NewTranscoder = %v, want ErrFFmpegNotInstalled", err)
+	}
+	if code, msg := InitFailure(err); code != errCodeFFmpegUnavailable || msg != ffmpegUnavailableMessage {
+		t.Errorf("InitFailure = %q, %q, want %s", code, msg, errCodeFFmpegUnavailable)
+	}
+}
+
+func TestTranscoderFitsLadder(t *testing.T) {
+	useFakeFFmpeg(t, fakeSucceed)
+	ffmpegArgs := recordFFmpegArgs(t)
+	ladder, err := utils.ResolveLadder("mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+		options.MaxRenditions = 0
+		options.Ladder = ladder
+		options.Bitrates = map[types.Resolutions]int{types.P480: 1200, types.P360: 700}
+	})
+
+	if !slices.Equal(transcoder.resolutions, []types.Resolutions{types.P480, types.P360}) {
+		t.Fatalf("resolutions = %v, want only the mobile ladder's 480P and 360P", transcoder.resolutions)
+	}
+	transcoder.Process(context.Background())
+
+	last(t, recorder.all(), "completed")
+	bitrates := map[string]string{}
+	for _, args := range ffmpegArgs() {
+		bitrates[argValue(args, "-vf")] = argValue(args, "-b:v")
+	}
+	want := map[string]string{"scale=-2:480": "1200k", "scale=-2:360": "700k"}
+	if !maps.Equal(bitrates, want) {
+		t.Errorf("encoded %v, want %v", bitrates, want)
+	}
+}
+
+func TestTranscoderPadsToFrame(t *testing.T) {
+	// The source is 1280x720; the ladder is picked as if it were the padded frame
+	tests := []struct {
+		pad        types.PadSpec
+		resolution types.Resolutions
+	}{
+		{pad: types.PadSpec{Width: 1080, Height: 1080, Color: "black"}, resolution: types.P1080},
+		{pad: types.PadSpec{Width: 720, Height: 1280, Color: "0x1a1a1a"}, resolution: types.P1080},
+		{pad: types.PadSpec{Width: 1280, Height: 720, Color: "white"}, resolution: types.P720},
+		{pad: types.PadSpec{Width: 640, Height: 480, Color: "black"}, resolution: types.P480},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d", tt.pad.Width, tt.pad.Height), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			ffmpegArgs := recordFFmpegArgs(t)
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+				options.Pad = tt.pad
+			})
+			if !slices.Equal(transcoder.resolutions, []types.Resolutions{tt.resolution}) {
+				t.Fatalf("resolutions = %v, want %s", transcoder.resolutions, tt.resolution)
+			}
+
+			transcoder.Process(context.Background())
+
+			last(t, recorder.all(), "completed")
+			runs := ffmpegArgs()
+			want := utils.PadFilter(tt.pad) + fmt.Sprintf(",scale=-2:%d", int(tt.resolution))
+			if len(runs) != 1 || argValue(runs[0], "-vf") != want {
+				t.Errorf("runs = %v, want one with -vf %s", runs, want)
+			}
+		})
+	}
+}
+
+func TestTranscoderFailsBrokenRenditions(t *testing.T) {
+	tests := []struct {
+		policy    types.FailurePolicy
+		completed bool
+	}{
+		{policy: types.FailFast, completed: false},
+		{policy: types.BestEffort, completed: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			useFakeFFmpeg(t, fakeSucceed)
+			t.Setenv("FAKE_BROKEN_ARG", "scale=-2:480") // ffmpeg succeeds, but the 480p segments are empty
+			transcoder, recorder := newFakeTranscoder(t, func(options *types.TranscodeOptions) {
+				options.MaxRenditions = 0
+				options.FailurePolicy = tt.policy
+			})
+
+			transcoder.Process(context.Background())
+
+			updates := recorder.all()
+			var reported bool
+			for _, update := range updates {
+				if update.Type == "failed" && update.Data.Resolution == "480P" && update.Data.ErrorCode == errCodeBrokenRendition {
+					reported = true
+				}
+			}
+			if !reported {
+				t.Errorf("no %s failure reported for 480P among %+v", errCodeBrokenRendition, updates)
+			}
+
+			final := updates[len(updates)-1]
+			if !tt.completed {
+				if final.Type != "failed" || final.Data.ErrorCode != errCodeBrokenRendition {
+					t.Errorf("final update = %+v, want the job failed with %s", final, errCodeBrokenRendition)
+				}
+				return
+			}
+			completed := last(t, updates, "completed")
+			if completed.Data.Completion == nil || !slices.Equal(completed.Data.Completion.FailedRenditions, []string{"480P"}) {
+				t.Errorf("completion = %+v, want 480P reported as failed", completed.Data.Completion)
+			}
+			master, err := os.ReadFile(filepath.Join(utils.GetOutputDirectory(transcoder.taskID), "main.m3u8"))
+			if err != nil {
+				t.Fatalf("master playlist: %v", err)
+			}
+			if strings.Contains(string(master), "480P/") {
+				t.Errorf("master playlist lists the broken rendition:\n%s", master)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// AudioTracksFolder is the folder of the output holding the audio renditions and their playlists.
+const AudioTracksFolder = "audio"
+
+// AudioStreams returns the audio streams of a probed file, in stream order.
+func AudioStreams(info types.FFProbeOutput) []types.AudioStream {
+	var streams []types.AudioStream
+	for _, stream := range info.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		streams = append(streams, types.AudioStream{
+			Index:    stream.Index,
+			Codec:    stream.CodecName,
+			Language: LanguageTag(stream.Tags["language"]),
+			Title:    stream.Tags["title"],
+			Channels: stream.Channels,
+			Default:  stream.Disposition["default"] == 1,
+		})
+	}
+	return streams
+}
+
+// AudioFormats maps the supported standalone audio formats to their ffmpeg encoder arguments.
+var AudioFormats = map[string][]string{
+	"mp3": {"-c:a", "libmp3lame", "-b:a", "192k"},
+	"m4a": {"-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart"},
+}
+
+// ValidateAudioFormat checks that format is one of AudioFormats.
+func ValidateAudioFormat(format string) error {
+	if _, ok := AudioFormats[format]; ok {
+		return nil
+	}
+
+	supported := make([]string, 0, len(AudioFormats))
+	for name := range AudioFormats {
+		supported = append(supported, name)
+	}
+	slices.Sort(supported)
+	return fmt.Errorf("audio format %q is not supported (supported: %s)", format, strings.Join(supported, ", "))
+}
+
+// ExtractAudio writes the audio of inputPath, between startTime and endTime (0 meaning the end),
+// to outPath as a standalone file in the given format.
+func ExtractAudio(ctx context.Context, inputPath, outPath, format string, startTime, endTime float64) error {
+	if err := ValidateAudioFormat(format); err != nil {
+		return err
+	}
+
+	args := []string{"-y"}
+	if startTime > 0 {
+		args = append(args, "-ss", FormatSeconds(startTime))
+	}
+	args = append(args, "-i", inputPath)
+	if endTime > 0 {
+		args = append(args, "-t", FormatSeconds(endTime-startTime))
+	}
+	args = append(args, "-vn")
+	args = append(args, AudioFormats[format]...)
+	args = append(args, outPath)
+
+	return runFFmpeg(ctx, "audio extraction", args)
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestAudioStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams []types.FFProbeStream
+		want    []types.AudioStream
+	}{
+		{name: "no streams"},
+		{name: "video only", streams: []types.FFProbeStream{{Index: 0, CodecType: "video", CodecName: "h264"}}},
+		{
+			name: "several languages",
+			streams: []types.FFProbeStream{
+				{Index: 0, CodecType: "video", CodecName: "h264"},
+				{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2, Tags: map[string]string{"language": "eng"}, Disposition: map[string]int{"default": 1}},
+				{Index: 2, CodecType: "subtitle", CodecName: "subrip", Tags: map[string]string{"language": "eng"}},
+				{Index: 3, CodecType: "audio", CodecName: "ac3", Channels: 6, Tags: map[string]string{"language": "GER", "title": "Deutsch 5.1"}},
+				{Index: 4, CodecType: "audio", CodecName: "opus", Tags: map[string]string{"language": "und"}, Disposition: map[string]int{"default": 0}},
+				{Index: 5, CodecType: "audio", CodecName: "aac", Tags: map[string]string{"language": "tlh"}},
+			},
+			want: []types.AudioStream{
+				{Index: 1, Codec: "aac", Language: "en", Channels: 2, Default: true},
+				{Index: 3, Codec: "ac3", Language: "de", Title: "Deutsch 5.1", Channels: 6},
+				{Index: 4, Codec: "opus"},
+				{Index: 5, Codec: "aac", Language: "tlh"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := AudioStreams(types.FFProbeOutput{Streams: tt.streams}); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: AudioStreams = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/PratikDev/transcoder/logger"
+	"github.com/PratikDev/transcoder/types"
+)
+
+// Synthetic clip encoded by BenchmarkEncodeSpeed: long enough to amortize ffmpeg's startup,
+// short enough not to hold up the first estimate.
+const (
+	benchmarkWidth    = 640
+	benchmarkHeight   = 360
+	benchmarkRate     = 30
+	benchmarkDuration = 2
+)
+
+// fallbackEncodeSpeed is assumed when the benchmark can't run, in luma samples per second:
+// 1080p at about 15 fps, a modest machine.
+const fallbackEncodeSpeed = 1920 * 1080 * 15
+
+// BenchmarkEncodeSpeed returns how many luma samples per second this machine encodes with the
+// H.264 settings of the renditions. The first call encodes a small synthetic clip and the result
+// is cached; if the benchmark fails, a conservative default is returned.
+func BenchmarkEncodeSpeed() float64 {
+	return encodeSpeed()
+}
+
+var encodeSpeed = sync.OnceValue(func() float64 {
+	speed, err := measureEncodeSpeed()
+	if err != nil {
+		logger.Warnf("Encode benchmark failed, assuming %d samples/s: %v", fallbackEncodeSpeed, err)
+		return fallbackEncodeSpeed
+	}
+	logger.Infof("Encode benchmark: %.0f samples/s", speed)
+	return speed
+})
+
+func measureEncodeSpeed() (float64, error) {
+	source := fmt.Sprintf("testsrc2=size=%dx%d:rate=%d:duration=%d", benchmarkWidth, benchmarkHeight, benchmarkRate, benchmarkDuration)
+	cmd := ExecCommand(context.Background(), FFMPEG_PATH,
+		"-hide_banner", "-nostats",
+		"-f", "lavfi", "-i", source,
+		"-c:v", VideoCodec, "-preset", "fast", "-crf", "28",
+		"-f", "null", "-",
+	)
+
+	start := time.Now()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if missing := MissingBinary(FFMPEG_PATH, err); missing != nil {
+			return 0, missing
+		}
+		return 0, fmt.Errorf("ffmpeg failed: %w, output: %s", err, output)
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return 0, fmt.Errorf("benchmark took no measurable time")
+	}
+	return benchmarkWidth * benchmarkHeight * benchmarkRate * benchmarkDuration / elapsed, nil
+}
+
+// CodecSlowdown returns roughly how many times longer encoding takes with codec than with H.264.
+// speed is the AV1 speed preset and is ignored for other codecs.
+func CodecSlowdown(codec types.Codec, speed int) float64 {
+	switch codec {
+	case types.CodecVP9:
+		return 3
+	case types.CodecAV1:
+		return float64(AV1Slowdown(speed))
+	default:
+		return 1
+	}
+}
+
+// EstimateEncodeSeconds predicts how long encoding duration seconds of video at width x height and
+// frameRate (0 meaning 30 fps) takes with codec, given the H.264 encoding speed in luma samples per second.
+func EstimateEncodeSeconds(width, height int, frameRate, duration float64, codec types.Codec, speed int, samplesPerSecond float64) float64 {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	if samplesPerSecond <= 0 {
+		samplesPerSecond = fallbackEncodeSpeed
+	}
+	samples := float64(width*height) * frameRate * duration
+	return samples / samplesPerSecond * CodecSlowdown(codec, speed)
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestEstimateEncodeSeconds(t *testing.T) {
+	realtime720p := float64(1280 * 720 * 30) // Encodes 720p30 in real time
+	tests := []struct {
+		name             string
+		width, height    int
+		frameRate        float64
+		duration         float64
+		codec            types.Codec
+		speed            int
+		samplesPerSecond float64
+		want             float64
+	}{
+		{name: "real time", width: 1280, height: 720, frameRate: 30, duration: 10, codec: types.CodecH264, samplesPerSecond: realtime720p, want: 10},
+		{name: "unknown frame rate", width: 1280, height: 720, duration: 10, codec: types.CodecH264, samplesPerSecond: realtime720p, want: 10},
+		{name: "half the pixels", width: 640, height: 720, frameRate: 30, duration: 10, codec: types.CodecH264, samplesPerSecond: realtime720p, want: 5},
+		{name: "double the rate", width: 1280, height: 720, frameRate: 60, duration: 10, codec: types.CodecH264, samplesPerSecond: realtime720p, want: 20},
+		{name: "vp9", width: 1280, height: 720, frameRate: 30, duration: 10, codec: types.CodecVP9, samplesPerSecond: realtime720p, want: 30},
+		{name: "av1 default speed", width: 1280, height: 720, frameRate: 30, duration: 10, codec: types.CodecAV1, speed: DefaultAV1Speed, samplesPerSecond: realtime720p, want: 50},
+		{name: "av1 slowest", width: 1280, height: 720, frameRate: 30, duration: 10, codec: types.CodecAV1, speed: MinAV1Speed, samplesPerSecond: realtime720p, want: 400},
+		{name: "no benchmark", width: 1920, height: 1080, frameRate: 15, duration: 10, codec: types.CodecH264, want: 10},
+	}
+	for _, test := range tests {
+		got := EstimateEncodeSeconds(test.width, test.height, test.frameRate, test.duration, test.codec, test.speed, test.samplesPerSecond)
+		if got != test.want {
+			t.Errorf("%s: EstimateEncodeSeconds = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMeasureEncodeSpeedFailsWithoutFFmpeg(t *testing.T) {
+	previous := FFMPEG_PATH
+	FFMPEG_PATH = "/nonexistent/ffmpeg"
+	t.Cleanup(func() { FFMPEG_PATH = previous })
+
+	if speed, err := measureEncodeSpeed(); err == nil {
+		t.Errorf("measureEncodeSpeed = %v without ffmpeg, want an error", speed)
+	}
+}
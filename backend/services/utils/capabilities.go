@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// ListEncoders returns the encoders of the ffmpeg binary at path, mapped to their type:
+// 'V' for video, 'A' for audio and 'S' for subtitles.
+func ListEncoders(path string) (map[string]byte, error) {
+	output, err := ExecCommand(context.Background(), path, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		if missing := MissingBinary(path, err); missing != nil {
+			return nil, missing
+		}
+		return nil, fmt.Errorf("failed to list encoders of %s: %w", path, err)
+	}
+
+	// Encoders are listed after a legend ending in a " ------" line, as "<flags> <name> <description>",
+	// e.g. " V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10"
+	encoders := map[string]byte{}
+	listing := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !listing {
+			listing = len(fields) == 1 && strings.Trim(fields[0], "-") == ""
+			continue
+		}
+		if len(fields) < 2 || len(fields[0]) != 6 {
+			continue
+		}
+		encoders[fields[1]] = fields[0][0]
+	}
+	return encoders, nil
+}
+
+// ListHWAccels returns the hardware acceleration methods the ffmpeg binary at path was built with.
+func ListHWAccels(path string) ([]string, error) {
+	output, err := ExecCommand(context.Background(), path, "-hide_banner", "-hwaccels").Output()
+	if err != nil {
+		if missing := MissingBinary(path, err); missing != nil {
+			return nil, missing
+		}
+		return nil, fmt.Errorf("failed to list hwaccels of %s: %w", path, err)
+	}
+
+	// The methods follow a "Hardware acceleration methods:" heading, one per line
+	methods := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		methods = append(methods, line)
+	}
+	return methods, nil
+}
+
+// DetectCapabilities probes the ffmpeg binary for its encoders and hardware acceleration methods
+// and returns the options this server can honor with it.
+func DetectCapabilities() (types.Capabilities, error) {
+	encoders, err := ListEncoders(FFMPEG_PATH)
+	if err != nil {
+		return types.Capabilities{}, err
+	}
+	hwaccels, err := ListHWAccels(FFMPEG_PATH)
+	if err != nil {
+		return types.Capabilities{}, err
+	}
+
+	capabilities := types.Capabilities{
+		Codecs:         []string{},
+		Formats:        []string{},
+		VideoCodecs:    []string{},
+		PixelFormats:   []string{},
+		AudioCodecs:    []string{},
+		AudioFormats:   []string{},
+		PreviewFormats: []string{},
+		SegmentTypes:   []string{string(types.SegmentTS)},
+		PlaylistTypes:  []string{string(types.PlaylistVOD), string(types.PlaylistEvent), string(types.PlaylistLive)},
+		HWAccels:       hwaccels,
+	}
+
+	for codec := range CodecPixelFormats {
+		if encoders[codec] == 'V' {
+			capabilities.VideoCodecs = append(capabilities.VideoCodecs, codec)
+		}
+	}
+	// A codec option needs both of its encoders; the formats are those of the usable codecs
+	for codec, codecEncoders := range CodecEncoders {
+		if encoders[codecEncoders.Video] != 'V' || encoders[AudioEncoders[codecEncoders.Audio]] != 'A' {
+			continue
+		}
+		capabilities.Codecs = append(capabilities.Codecs, string(codec))
+		for _, format := range CodecFormats[codec] {
+			if !slices.Contains(capabilities.Formats, string(format)) {
+				capabilities.Formats = append(capabilities.Formats, string(format))
+			}
+		}
+	}
+	for pixFmt := range CodecPixelFormats[VideoCodec] {
+		capabilities.PixelFormats = append(capabilities.PixelFormats, pixFmt)
+	}
+	if ValidateSegmentType(VideoCodec, types.SegmentFMP4) == nil {
+		capabilities.SegmentTypes = append(capabilities.SegmentTypes, string(types.SegmentFMP4))
+	}
+
+	// Renditions are encoded with the encoder of their audioCodec; audio exports need their own encoder
+	for _, encoder := range AudioEncoders {
+		if encoders[encoder] == 'A' && !slices.Contains(capabilities.AudioCodecs, encoder) {
+			capabilities.AudioCodecs = append(capabilities.AudioCodecs, encoder)
+		}
+	}
+	for format, args := range AudioFormats {
+		codec := args[slices.Index(args, "-c:a")+1]
+		if encoders[codec] != 'A' {
+			continue
+		}
+		capabilities.AudioFormats = append(capabilities.AudioFormats, format)
+		if !slices.Contains(capabilities.AudioCodecs, codec) {
+			capabilities.AudioCodecs = append(capabilities.AudioCodecs, codec)
+		}
+	}
+
+	// Gif previews use ffmpeg's own gif encoder, mp4 previews libx264
+	for format, encoder := range map[string]string{"gif": "gif", "mp4": "libx264"} {
+		if encoders[encoder] == 'V' {
+			capabilities.PreviewFormats = append(capabilities.PreviewFormats, format)
+		}
+	}
+
+	for name := range Ladders {
+		capabilities.Ladders = append(capabilities.Ladders, name)
+	}
+
+	for _, preset := range types.Presets() {
+		capabilities.Resolutions = append(capabilities.Resolutions, preset)
+	}
+	slices.SortFunc(capabilities.Resolutions, func(a, b types.ResolutionPreset) int { return cmp.Compare(b.Height, a.Height) })
+
+	slices.Sort(capabilities.Codecs)
+	slices.Sort(capabilities.Formats)
+	slices.Sort(capabilities.VideoCodecs)
+	slices.Sort(capabilities.PixelFormats)
+	slices.Sort(capabilities.AudioCodecs)
+	slices.Sort(capabilities.AudioFormats)
+	slices.Sort(capabilities.PreviewFormats)
+	slices.Sort(capabilities.Ladders)
+	return capabilities, nil
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// ChaptersDataID identifies the JSON chapter list in the master playlist's EXT-X-SESSION-DATA.
+const ChaptersDataID = "com.pratikdev.transcoder.chapters"
+
+// ParseChapters parses the [CHAPTER] sections of ffmpeg's metadata format (ffmetadata), e.g.
+//
+//	;FFMETADATA1
+//	[CHAPTER]
+//	TIMEBASE=1/1000
+//	START=0
+//	END=60000
+//	title=Intro
+//
+// Chapters are returned in order of their start. Every chapter needs a START and an END after it;
+// without a TIMEBASE, times are in nanoseconds as in ffmpeg.
+func ParseChapters(data string) ([]types.Chapter, error) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != ";FFMETADATA1" {
+		return nil, fmt.Errorf("chapters must be in ffmetadata format, starting with ;FFMETADATA1")
+	}
+
+	var chapters []types.Chapter
+	var current *rawChapter
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		chapter, err := current.chapter()
+		if err != nil {
+			return fmt.Errorf("chapter %d: %w", len(chapters)+1, err)
+		}
+		chapters = append(chapters, chapter)
+		current = nil
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Values may continue on the next line after a trailing backslash
+		for strings.HasSuffix(line, `\`) && !strings.HasSuffix(line, `\\`) && scanner.Scan() {
+			line = line[:len(line)-1] + "\n" + strings.TrimSpace(scanner.Text())
+		}
+
+		switch {
+		case line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			if line == "[CHAPTER]" {
+				current = &rawChapter{timebaseNum: 1, timebaseDen: 1_000_000_000}
+			}
+			continue
+		}
+		if current == nil {
+			continue // Global or stream metadata
+		}
+
+		key, value, found := cutUnescaped(line)
+		if !found {
+			return nil, fmt.Errorf("chapter %d: invalid line %q", len(chapters)+1, line)
+		}
+		if err := current.set(strings.ToUpper(key), key, value); err != nil {
+			return nil, fmt.Errorf("chapter %d: %w", len(chapters)+1, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chapters: %w", err)
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	if len(chapters) == 0 {
+		return nil, fmt.Errorf("no [CHAPTER] sections found")
+	}
+
+	slices.SortStableFunc(chapters, func(a, b types.Chapter) int { return cmp.Compare(a.Start, b.Start) })
+	return chapters, nil
+}
+
+// rawChapter collects the fields of a [CHAPTER] section until it is complete.
+type rawChapter struct {
+	timebaseNum, timebaseDen int64
+	start, end               int64
+	hasStart, hasEnd         bool
+	title                    string
+}
+
+func (c *rawChapter) set(upperKey, key, value string) error {
+	switch upperKey {
+	case "TIMEBASE":
+		num, den, ok := strings.Cut(value, "/")
+		n, errNum := strconv.ParseInt(num, 10, 64)
+		d, errDen := strconv.ParseInt(den, 10, 64)
+		if !ok || errNum != nil || errDen != nil || n <= 0 || d <= 0 {
+			return fmt.Errorf("invalid TIMEBASE %q", value)
+		}
+		c.timebaseNum, c.timebaseDen = n, d
+	case "START", "END":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid %s %q", upperKey, value)
+		}
+		if upperKey == "START" {
+			c.start, c.hasStart = v, true
+		} else {
+			c.end, c.hasEnd = v, true
+		}
+	default:
+		if key == "title" {
+			c.title = value
+		}
+	}
+	return nil
+}
+
+func (c *rawChapter) chapter() (types.Chapter, error) {
+	if !c.hasStart || !c.hasEnd {
+		return types.Chapter{}, fmt.Errorf("START and END are required")
+	}
+	if c.end <= c.start {
+		return types.Chapter{}, fmt.Errorf("END %d is not after START %d", c.end, c.start)
+	}
+	timebase := float64(c.timebaseNum) / float64(c.timebaseDen)
+	return types.Chapter{
+		Title: c.title,
+		Start: float64(c.start) * timebase,
+		End:   float64(c.end) * timebase,
+	}, nil
+}
+
+// cutUnescaped splits an ffmetadata line at its first unescaped "=" and unescapes both sides;
+// "=", ";", "#", "\" and newlines are escaped with a backslash.
+func cutUnescaped(line string) (string, string, bool) {
+	var key, value strings.Builder
+	target := &key
+	found := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			target.WriteByte(line[i])
+		case line[i] == '=' && !found:
+			found = true
+			target = &value
+		default:
+			target.WriteByte(line[i])
+		}
+	}
+	return strings.TrimSpace(key.String()), value.String(), found
+}
+
+// NormalizeChapters fits chapters of the source into an output that starts at offset seconds
+// into the source and lasts duration seconds: chapters are shifted by offset, those outside the
+// output are dropped, the rest are clamped to it, and overlapping chapters are cut short where
+// the next one begins. Chapters must be sorted by start, as ParseChapters returns them.
+func NormalizeChapters(chapters []types.Chapter, offset, duration float64) []types.Chapter {
+	normalized := make([]types.Chapter, 0, len(chapters))
+	for _, chapter := range chapters {
+		chapter.Start = max(chapter.Start-offset, 0)
+		chapter.End = min(chapter.End-offset, duration)
+		if chapter.End <= chapter.Start {
+			continue
+		}
+		if last := len(normalized) - 1; last >= 0 && normalized[last].End > chapter.Start {
+			normalized[last].End = chapter.Start
+			if normalized[last].End <= normalized[last].Start {
+				normalized = normalized[:last] // Fully covered by the later chapter
+			}
+		}
+		normalized = append(normalized, chapter)
+	}
+	return normalized
+}
+
+// ChaptersJSON renders chapters as the JSON array an EXT-X-SESSION-DATA URI must point to,
+// with untitled chapters named as in ChaptersWebVTT.
+func ChaptersJSON(chapters []types.Chapter) ([]byte, error) {
+	titled := make([]types.Chapter, len(chapters))
+	for i, chapter := range chapters {
+		chapter.Title = chapterTitle(chapter, i)
+		titled[i] = chapter
+	}
+	return json.MarshalIndent(titled, "", "  ")
+}
+
+// ChaptersWebVTT renders chapters as a WebVTT chapters track, one cue per chapter.
+func ChaptersWebVTT(chapters []types.Chapter) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i, chapter := range chapters {
+		title := chapterTitle(chapter, i)
+		// "-->" would end the cue timings early and blank lines would end the cue
+		title = strings.ReplaceAll(title, "-->", "->")
+		title = strings.Join(strings.Fields(title), " ")
+		fmt.Fprintf(&b, "\n%d\n%s --> %s\n%s\n", i+1, vttTimestamp(chapter.Start), vttTimestamp(chapter.End), title)
+	}
+	return b.String()
+}
+
+// chapterTitle is the title of the i-th chapter, or "Chapter N" if it has none.
+func chapterTitle(chapter types.Chapter, i int) string {
+	if chapter.Title == "" {
+		return fmt.Sprintf("Chapter %d", i+1)
+	}
+	return chapter.Title
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp, HH:MM:SS.mmm.
+func vttTimestamp(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3_600_000, ms/60_000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestParseChapters(t *testing.T) {
+	data := ";FFMETADATA1\ntitle=Global\n\n" +
+		"[CHAPTER]\nTIMEBASE=1/1000\nSTART=60000\nEND=120000\ntitle=Middle\\=part\n" +
+		"[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=60000\ntitle=Intro\n" +
+		"[STREAM]\ntitle=ignored\n"
+
+	chapters, err := ParseChapters(data)
+	if err != nil {
+		t.Fatalf("ParseChapters: %v", err)
+	}
+	want := []types.Chapter{{Title: "Intro", Start: 0, End: 60}, {Title: "Middle=part", Start: 60, End: 120}}
+	if !reflect.DeepEqual(chapters, want) {
+		t.Errorf("ParseChapters = %+v, want %+v", chapters, want)
+	}
+}
+
+func TestParseChaptersRejectsMalformedFiles(t *testing.T) {
+	for name, data := range map[string]string{
+		"missing header":   "[CHAPTER]\nSTART=0\nEND=1\n",
+		"no chapters":      ";FFMETADATA1\ntitle=Global\n",
+		"missing END":      ";FFMETADATA1\n[CHAPTER]\nSTART=0\n",
+		"END before START": ";FFMETADATA1\n[CHAPTER]\nSTART=10\nEND=5\n",
+		"bad TIMEBASE":     ";FFMETADATA1\n[CHAPTER]\nTIMEBASE=1/0\nSTART=0\nEND=5\n",
+		"negative START":   ";FFMETADATA1\n[CHAPTER]\nSTART=-1\nEND=5\n",
+	} {
+		if _, err := ParseChapters(data); err == nil {
+			t.Errorf("%s: ParseChapters accepted %q", name, data)
+		}
+	}
+}
+
+func TestNormalizeChapters(t *testing.T) {
+	chapters := []types.Chapter{
+		{Title: "before", Start: 0, End: 5},
+		{Title: "cut", Start: 5, End: 20},
+		{Title: "overlapping", Start: 15, End: 30},
+		{Title: "after", Start: 40, End: 50},
+	}
+
+	got := NormalizeChapters(chapters, 10, 25)
+	want := []types.Chapter{
+		{Title: "cut", Start: 0, End: 5},
+		{Title: "overlapping", Start: 5, End: 20},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeChapters = %+v, want %+v", got, want)
+	}
+}
+
+func TestChaptersJSONAndWebVTT(t *testing.T) {
+	chapters := []types.Chapter{{Title: "Intro", Start: 0, End: 61.5}, {Start: 61.5, End: 3725}}
+
+	data, err := ChaptersJSON(chapters)
+	if err != nil {
+		t.Fatalf("ChaptersJSON: %v", err)
+	}
+	var decoded []map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("ChaptersJSON is not a JSON array: %v", err)
+	}
+	if len(decoded) != 2 || decoded[0]["title"] != "Intro" || decoded[1]["title"] != "Chapter 2" || decoded[1]["end"] != 3725.0 {
+		t.Errorf("ChaptersJSON = %s", data)
+	}
+
+	vtt := ChaptersWebVTT(chapters)
+	for _, want := range []string{"WEBVTT\n", "00:00:00.000 --> 00:01:01.500\nIntro\n", "01:02:05.000\nChapter 2\n"} {
+		if !strings.Contains(vtt, want) {
+			t.Errorf("ChaptersWebVTT is missing %q:\n%s", want, vtt)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// Encoders are the ffmpeg video encoder of a rendition and its default audio codec.
+type Encoders struct {
+	Video string
+	Audio types.AudioCodec
+}
+
+// CodecEncoders maps every codec option to its encoders.
+var CodecEncoders = map[types.Codec]Encoders{
+	types.CodecH264: {Video: VideoCodec, Audio: types.AudioAAC},
+	types.CodecVP9:  {Video: "libvpx-vp9", Audio: types.AudioOpus},
+	types.CodecAV1:  {Video: "libsvtav1", Audio: types.AudioAAC},
+}
+
+// AudioEncoders maps every audioCodec option to its ffmpeg encoder.
+var AudioEncoders = map[types.AudioCodec]string{
+	types.AudioAAC:  "aac",
+	types.AudioOpus: "libopus",
+	types.AudioAC3:  "ac3",
+}
+
+// AudioCodecStrings are the RFC 6381 codecs values of the audio codecs, as HLS CODECS attributes list them.
+var AudioCodecStrings = map[types.AudioCodec]string{
+	types.AudioAAC:  "mp4a.40.2", // AAC-LC
+	types.AudioOpus: "opus",
+	types.AudioAC3:  "ac-3",
+}
+
+// ValidateAudioCodec checks that audio in codec can be carried by the segments of format and
+// segmentType. WebM segments (DASH) only carry Opus here, and Opus isn't defined for MPEG-TS in HLS.
+func ValidateAudioCodec(codec types.AudioCodec, format types.OutputFormat, segmentType types.SegmentType) error {
+	if _, ok := AudioEncoders[codec]; !ok {
+		return fmt.Errorf("unknown audio codec %q", codec)
+	}
+	switch {
+	case format == types.FormatDASH && codec != types.AudioOpus:
+		return fmt.Errorf("audio codec %s can't be delivered as dash, whose WebM segments carry opus", codec)
+	case format == types.FormatHLS && segmentType == types.SegmentTS && codec == types.AudioOpus:
+		return fmt.Errorf("audio codec opus can't be carried in ts segments, use segmentType fmp4")
+	}
+	return nil
+}
+
+// CodecFormats lists the output formats each codec can be delivered in.
+var CodecFormats = map[types.Codec][]types.OutputFormat{
+	types.CodecH264: {types.FormatHLS},
+	types.CodecVP9:  {types.FormatDASH}, // WebM segments can't be referenced from HLS playlists
+	types.CodecAV1:  {types.FormatHLS},  // In fMP4 segments; AV1 in MPEG-TS isn't widely supported
+}
+
+// Speed presets of the AV1 encoder (libsvtav1's -preset).
+const (
+	MinAV1Speed     = 0
+	MaxAV1Speed     = 13
+	DefaultAV1Speed = 8
+)
+
+// AV1Slowdown returns roughly how many times longer encoding takes with AV1 at the given speed
+// preset than with H.264, as the ladder is encoded here. Slower presets take much longer.
+func AV1Slowdown(speed int) int {
+	switch {
+	case speed <= 2:
+		return 40
+	case speed <= 4:
+		return 20
+	case speed <= 6:
+		return 10
+	case speed <= 8:
+		return 5
+	case speed <= 10:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// ValidateCodecFormat checks that renditions in codec can be delivered in format.
+func ValidateCodecFormat(codec types.Codec, format types.OutputFormat) error {
+	formats, ok := CodecFormats[codec]
+	if !ok {
+		return fmt.Errorf("unknown codec %q", codec)
+	}
+	for _, supported := range formats {
+		if supported == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("codec %s can't be delivered as %s", codec, format)
+}
+
+// ParseFrameRate parses a frame rate as ffprobe reports it, e.g. "30000/1001" or "25".
+// It returns 0 when the rate is missing or invalid.
+func ParseFrameRate(value string) float64 {
+	num, den, found := strings.Cut(value, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return n / d
+}
+
+// vp9Levels are the VP9 levels with the largest picture size (in luma samples) and luma
+// sample rate each allows, in ascending order, as defined by the VP9 bitstream specification.
+var vp9Levels = []struct {
+	level      int // Level times ten, as written in the codec string
+	pictureMax int
+	rateMax    int64
+}{
+	{10, 36864, 829440},
+	{11, 73728, 2764800},
+	{20, 122880, 4608000},
+	{21, 245760, 9216000},
+	{30, 552960, 20736000},
+	{31, 983040, 36864000},
+	{40, 2228224, 83558400},
+	{41, 2228224, 160432128},
+	{50, 8912896, 311951360},
+	{51, 8912896, 588251136},
+	{52, 8912896, 1176502272},
+	{60, 35651584, 1176502272},
+	{61, 35651584, 2353004544},
+	{62, 35651584, 4706009088},
+}
+
+// h264Levels are the H.264 levels with the largest frame size and macroblock rate (in 16x16
+// macroblocks) each allows, in ascending order, as defined in table A-1 of the H.264 specification.
+var h264Levels = []struct {
+	level     int // Level times ten, as written in the codec string
+	frameMax  int
+	mbRateMax int64
+}{
+	{10, 99, 1485},
+	{11, 396, 3000},
+	{12, 396, 6000},
+	{13, 396, 11880},
+	{20, 396, 11880},
+	{21, 792, 19800},
+	{22, 1620, 20250},
+	{30, 1620, 40500},
+	{31, 3600, 108000},
+	{32, 5120, 216000},
+	{40, 8192, 245760},
+	{42, 8704, 522240},
+	{50, 22080, 589824},
+	{51, 36864, 983040},
+	{52, 36864, 2073600},
+	{60, 139264, 4177920},
+	{61, 139264, 8355840},
+	{62, 139264, 16711680},
+}
+
+// h264ProfileIndications are the profile_idc and constraint flags bytes of the libx264 profiles,
+// "" being the High profile libx264 picks for 8-bit 4:2:0. libx264's baseline is Constrained Baseline.
+var h264ProfileIndications = map[string][2]int{
+	"":         {0x64, 0x00},
+	"baseline": {0x42, 0xE0},
+	"main":     {0x4D, 0x40},
+	"high":     {0x64, 0x00},
+	"high10":   {0x6E, 0x00},
+	"high422":  {0x7A, 0x00},
+	"high444":  {0xF4, 0x00},
+}
+
+// H264Profiles are the H.264 profiles the profile option accepts. They only support 8-bit 4:2:0;
+// other pixel formats get the profile PixelFormatProfile requires.
+var H264Profiles = []string{"baseline", "main", "high"}
+
+// ValidateH264Profile checks that profile is one of H264Profiles and can encode pixFmt.
+func ValidateH264Profile(profile, pixFmt string) error {
+	if !slices.Contains(H264Profiles, profile) {
+		return fmt.Errorf("invalid profile %q, expected %s", profile, strings.Join(H264Profiles, ", "))
+	}
+	if pixFmt != "yuv420p" {
+		return fmt.Errorf("profile %s only supports pixFmt yuv420p, not %s", profile, pixFmt)
+	}
+	return nil
+}
+
+// ParseH264Level parses an H.264 level such as "3.1" or "4", returning it times ten as the codec
+// string writes it (31, 40). Only the levels of the H.264 specification are accepted.
+func ParseH264Level(value string) (int, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err == nil {
+		level := int(math.Round(number * 10))
+		for _, candidate := range h264Levels {
+			if candidate.level == level && math.Abs(number*10-float64(level)) < 1e-9 {
+				return level, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid level %q, expected an H.264 level such as 3.0, 3.1, 4.0 or 4.1", value)
+}
+
+// H264CodecString returns the RFC 6381 codecs value of an H.264 rendition, "avc1.PPCCLL", from
+// its profile (a libx264 profile name, "" for the default), level (times ten, 0 for the lowest
+// level fitting the picture), size and frame rate. Frame rates of 0 are taken as 30 fps.
+func H264CodecString(profile string, level, width, height int, frameRate float64) string {
+	indication, ok := h264ProfileIndications[profile]
+	if !ok {
+		indication = h264ProfileIndications[""]
+	}
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+
+	if level == 0 {
+		frame := ((width + 15) / 16) * ((height + 15) / 16)
+		rate := int64(float64(frame) * frameRate)
+		level = h264Levels[len(h264Levels)-1].level
+		for _, candidate := range h264Levels {
+			if frame <= candidate.frameMax && rate <= candidate.mbRateMax {
+				level = candidate.level
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("avc1.%02X%02X%02X", indication[0], indication[1], level)
+}
+
+// av1Levels are the AV1 levels (seq_level_idx) with the largest picture size (in luma samples)
+// and display rate (luma samples per second) each allows, in ascending order, as defined in
+// annex A of the AV1 specification. Levels 2.2, 2.3, 3.2, 3.3, 4.2 and 4.3 are undefined.
+var av1Levels = []struct {
+	index      int
+	pictureMax int
+	rateMax    int64
+}{
+	{0, 147456, 4423680},
+	{1, 278784, 8363520},
+	{4, 665856, 19975680},
+	{5, 1065024, 31950720},
+	{8, 2359296, 70778880},
+	{9, 2359296, 141557760},
+	{12, 8912896, 267386880},
+	{13, 8912896, 534773760},
+	{14, 8912896, 1069547520},
+	{16, 35651584, 1069547520},
+	{17, 35651584, 2139095040},
+	{18, 35651584, 4278190080},
+}
+
+// AV1CodecString returns the RFC 6381 codecs value of an AV1 rendition in the Main profile,
+// "av01.0.LLM.DD", from its size, frame rate and pixel format. Frame rates of 0 are taken as 30 fps.
+func AV1CodecString(width, height int, frameRate float64, pixFmt string) string {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	bitDepth := 8
+	if strings.Contains(pixFmt, "10le") {
+		bitDepth = 10
+	}
+
+	picture := width * height
+	rate := int64(float64(picture) * frameRate)
+	level := av1Levels[len(av1Levels)-1].index
+	for _, candidate := range av1Levels {
+		if picture <= candidate.pictureMax && rate <= candidate.rateMax {
+			level = candidate.index
+			break
+		}
+	}
+	return fmt.Sprintf("av01.0.%02dM.%02d", level, bitDepth)
+}
+
+// VP9CodecString returns the RFC 6381 codecs value of a VP9 rendition, "vp09.PP.LL.DD", from
+// its profile (as PixelFormatProfile returns it, "" meaning 0), size, frame rate and pixel format.
+// Frame rates of 0 are taken as 30 fps.
+func VP9CodecString(profile string, width, height int, frameRate float64, pixFmt string) string {
+	profileNumber, _ := strconv.Atoi(profile) // "" is profile 0
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	bitDepth := 8
+	if strings.Contains(pixFmt, "10le") {
+		bitDepth = 10
+	}
+
+	picture := width * height
+	rate := int64(float64(picture) * frameRate)
+	level := vp9Levels[len(vp9Levels)-1].level
+	for _, candidate := range vp9Levels {
+		if picture <= candidate.pictureMax && rate <= candidate.rateMax {
+			level = candidate.level
+			break
+		}
+	}
+	return fmt.Sprintf("vp09.%02d.%02d.%02d", profileNumber, level, bitDepth)
+}
@@ -0,0 +1,126 @@
+package utils
+
+import "testing"
+
+func TestAV1CodecString(t *testing.T) {
+	tests := []struct {
+		width, height int
+		frameRate     float64
+		pixFmt        string
+		want          string
+	}{
+		{640, 360, 30, "yuv420p", "av01.0.01M.08"},
+		{1280, 720, 30, "yuv420p", "av01.0.05M.08"},
+		{1280, 720, 0, "yuv420p", "av01.0.05M.08"}, // Unknown rates are taken as 30 fps
+		{1280, 720, 30, "yuv420p10le", "av01.0.05M.10"},
+		{1920, 1080, 30, "yuv420p", "av01.0.08M.08"},
+		{1920, 1080, 60, "yuv420p", "av01.0.09M.08"},
+		{3840, 2160, 30, "yuv420p", "av01.0.12M.08"},
+	}
+	for _, test := range tests {
+		got := AV1CodecString(test.width, test.height, test.frameRate, test.pixFmt)
+		if got != test.want {
+			t.Errorf("AV1CodecString(%d, %d, %v, %s) = %q, want %q", test.width, test.height, test.frameRate, test.pixFmt, got, test.want)
+		}
+	}
+}
+
+func TestAV1Slowdown(t *testing.T) {
+	previous := AV1Slowdown(MinAV1Speed)
+	for speed := MinAV1Speed + 1; speed <= MaxAV1Speed; speed++ {
+		slowdown := AV1Slowdown(speed)
+		if slowdown > previous || slowdown < 2 {
+			t.Errorf("AV1Slowdown(%d) = %d after %d, want faster presets to slow down less", speed, slowdown, previous)
+		}
+		previous = slowdown
+	}
+	if got := AV1Slowdown(DefaultAV1Speed); got != 5 {
+		t.Errorf("AV1Slowdown(%d) = %d, want 5", DefaultAV1Speed, got)
+	}
+}
+
+func TestH264CodecString(t *testing.T) {
+	tests := []struct {
+		profile       string
+		level         int
+		width, height int
+		frameRate     float64
+		want          string
+	}{
+		{"", 0, 640, 360, 30, "avc1.64001E"},
+		{"", 0, 1280, 720, 30, "avc1.64001F"},
+		{"", 0, 1280, 720, 0, "avc1.64001F"}, // Unknown rates are taken as 30 fps
+		{"", 0, 1280, 720, 60, "avc1.640020"},
+		{"", 0, 1920, 1080, 30, "avc1.640028"},
+		{"", 0, 3840, 2160, 30, "avc1.640033"},
+		{"baseline", 0, 1280, 720, 30, "avc1.42E01F"},
+		{"main", 0, 1280, 720, 30, "avc1.4D401F"},
+		{"high", 0, 1280, 720, 30, "avc1.64001F"},
+		{"high10", 0, 1280, 720, 30, "avc1.6E001F"},
+		{"high422", 0, 1280, 720, 30, "avc1.7A001F"},
+		{"high444", 0, 1280, 720, 30, "avc1.F4001F"},
+		{"main", 40, 1280, 720, 30, "avc1.4D4028"}, // A requested level is listed as is
+		{"baseline", 30, 640, 360, 30, "avc1.42E01E"},
+		{"extended", 0, 1280, 720, 30, "avc1.64001F"}, // Unknown profiles are taken as libx264's default
+	}
+	for _, test := range tests {
+		got := H264CodecString(test.profile, test.level, test.width, test.height, test.frameRate)
+		if got != test.want {
+			t.Errorf("H264CodecString(%q, %d, %d, %d, %v) = %q, want %q",
+				test.profile, test.level, test.width, test.height, test.frameRate, got, test.want)
+		}
+	}
+}
+
+func TestValidateH264Profile(t *testing.T) {
+	tests := []struct {
+		profile, pixFmt string
+		wantErr         bool
+	}{
+		{"baseline", "yuv420p", false},
+		{"main", "yuv420p", false},
+		{"high", "yuv420p", false},
+		{"high", "yuv420p10le", true}, // The listed profiles are 8-bit 4:2:0 only
+		{"main", "yuv444p", true},
+		{"high10", "yuv420p10le", true}, // Follows from pixFmt, can't be requested
+		{"extended", "yuv420p", true},
+		{"", "yuv420p", true},
+	}
+	for _, test := range tests {
+		if err := ValidateH264Profile(test.profile, test.pixFmt); (err != nil) != test.wantErr {
+			t.Errorf("ValidateH264Profile(%q, %s) = %v, want error %v", test.profile, test.pixFmt, err, test.wantErr)
+		}
+	}
+}
+
+func TestParseH264Level(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "3.1", want: 31},
+		{value: " 4 ", want: 40},
+		{value: "4.0", want: 40},
+		{value: "1", want: 10},
+		{value: "6.2", want: 62},
+		{value: "3.3", wantErr: true},
+		{value: "4.15", wantErr: true},
+		{value: "7", wantErr: true},
+		{value: "31", wantErr: true},
+		{value: "high", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseH264Level(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseH264Level(%q) = %d, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseH264Level(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// partSignature captures the stream properties that must match for parts to be joined without re-encoding.
+type partSignature struct {
+	videoCodec string
+	width      int
+	height     int
+	pixFmt     string
+	audioCodec string
+	sampleRate string
+	channels   int
+}
+
+// ConcatParts joins the given video files, in order, into output.
+// Parts sharing the same codecs and dimensions are joined losslessly with the concat demuxer;
+// otherwise they are re-encoded to the first part's dimensions with the concat filter.
+func ConcatParts(ctx context.Context, parts []string, output string) error {
+	if len(parts) == 0 {
+		return fmt.Errorf("no parts to concatenate")
+	}
+
+	signatures := make([]partSignature, 0, len(parts))
+	for _, part := range parts {
+		info, err := ProbeMedia(part)
+		if err != nil {
+			return fmt.Errorf("failed to probe part %s: %w", filepath.Base(part), err)
+		}
+		signature := signatureOf(info)
+		if signature.videoCodec == "" {
+			return fmt.Errorf("part %s has no video stream", filepath.Base(part))
+		}
+		signatures = append(signatures, signature)
+	}
+
+	compatible := true
+	for _, signature := range signatures[1:] {
+		if signature != signatures[0] {
+			compatible = false
+			break
+		}
+	}
+
+	if compatible {
+		return concatWithDemuxer(ctx, parts, output)
+	}
+
+	withAudio := true
+	for _, signature := range signatures {
+		if signature.audioCodec == "" {
+			withAudio = false
+			break
+		}
+	}
+	return concatWithFilter(ctx, parts, output, signatures[0].width, signatures[0].height, withAudio)
+}
+
+// signatureOf extracts the main video and first audio stream properties of a probed file.
+func signatureOf(info types.FFProbeOutput) partSignature {
+	var signature partSignature
+	if stream, ok := VideoStream(info); ok {
+		signature.videoCodec = stream.CodecName
+		signature.width = stream.Width
+		signature.height = stream.Height
+		signature.pixFmt = stream.PixFmt
+	}
+	for _, stream := range info.Streams {
+		if stream.CodecType == "audio" {
+			signature.audioCodec = stream.CodecName
+			signature.sampleRate = stream.SampleRate
+			signature.channels = stream.Channels
+			break
+		}
+	}
+	return signature
+}
+
+// concatWithDemuxer joins identically encoded parts by copying their streams.
+func concatWithDemuxer(ctx context.Context, parts []string, output string) error {
+	listPath := strings.TrimSuffix(output, filepath.Ext(output)) + "_concat.txt"
+
+	var list strings.Builder
+	for _, part := range parts {
+		absPath, err := filepath.Abs(part)
+		if err != nil {
+			return fmt.Errorf("failed to resolve part path %s: %w", part, err)
+		}
+		// Single quotes in paths are escaped as described in the concat demuxer docs
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(absPath, "'", `'\''`))
+	}
+
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write concat list %s: %w", listPath, err)
+	}
+	defer os.Remove(listPath)
+
+	args := []string{
+		"-y",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		output,
+	}
+	return runFFmpeg(ctx, "concatenation", args)
+}
+
+// concatWithFilter re-encodes parts with differing formats into a single stream of the given size.
+func concatWithFilter(ctx context.Context, parts []string, output string, width, height int, withAudio bool) error {
+	args := []string{"-y"}
+	for _, part := range parts {
+		args = append(args, "-i", part)
+	}
+
+	// Every part is fitted into the first part's frame, letterboxed if its aspect ratio differs
+	var filter strings.Builder
+	for i := range parts {
+		fmt.Fprintf(&filter, "[%d:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1[v%d];",
+			i, width, height, width, height, i)
+		if withAudio {
+			fmt.Fprintf(&filter, "[%d:a:0]aresample=48000,aformat=channel_layouts=stereo[a%d];", i, i)
+		}
+	}
+	for i := range parts {
+		fmt.Fprintf(&filter, "[v%d]", i)
+		if withAudio {
+			fmt.Fprintf(&filter, "[a%d]", i)
+		}
+	}
+
+	audioStreams := 0
+	if withAudio {
+		audioStreams = 1
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=%d[outv]", len(parts), audioStreams)
+	if withAudio {
+		filter.WriteString("[outa]")
+	}
+
+	args = append(args,
+		"-filter_complex", filter.String(),
+		"-map", "[outv]",
+	)
+	if withAudio {
+		args = append(args, "-map", "[outa]", "-c:a", "aac")
+	}
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "fast",
+		"-crf", "18", // Near lossless, as the result is transcoded again
+		output,
+	)
+	return runFFmpeg(ctx, "concatenation", args)
+}
+
+// runFFmpeg runs ffmpeg with the given arguments for the named operation, including its output in the error on failure.
+// It's run by the CommandRunner of ctx, if any.
+func runFFmpeg(ctx context.Context, operation string, args []string) error {
+	output, err := commandRunner(ctx)(ExecCommand(ctx, FFMPEG_PATH, args...))
+	if err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if missing := MissingBinary(FFMPEG_PATH, err); missing != nil {
+			return missing
+		}
+		return fmt.Errorf("[ffmpeg error]: %s failed: %v, output: %s", operation, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestUnusualContainers(t *testing.T) {
+	tests := []struct {
+		fixture       string
+		mediaType     string
+		codec         string
+		width, height int
+		filters       []string
+		copyReason    string
+	}{
+		{
+			fixture: "flv_h264_mp3", mediaType: "video/x-flv", codec: "h264", width: 854, height: 480,
+			filters: []string{}, copyReason: "height 480 is above the smallest preset",
+		},
+		{
+			fixture: "wmv_vc1_wmapro", mediaType: "video/x-ms-asf", codec: "vc1", width: 1440, height: 1080,
+			filters:    []string{"yadif=mode=send_frame:deint=interlaced", "scale=trunc(iw*sar/2)*2:ih", "setsar=1"},
+			copyReason: "video codec is vc1, not h264",
+		},
+		{
+			fixture: "ts_mpeg2_interlaced", mediaType: "video/mp2t", codec: "mpeg2video", width: 720, height: 576,
+			filters:    []string{"yadif=mode=send_frame:deint=interlaced", "scale=trunc(iw*sar/2)*2:ih", "setsar=1"},
+			copyReason: "video codec is mpeg2video, not h264",
+		},
+		{
+			fixture: "mkv_hevc_opus", mediaType: "video/x-matroska", codec: "hevc", width: 3840, height: 2160,
+			filters: []string{}, copyReason: "video codec is hevc, not h264",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			fakeProbe(t, tt.fixture)
+			// Named and filled without a signature, so only probing can tell what it is
+			source := sourceFile(t, "upload.bin")
+
+			if mediaType, err := SniffMediaType(source); err != nil || mediaType != tt.mediaType {
+				t.Errorf("SniffMediaType = %q, %v, want %q", mediaType, err, tt.mediaType)
+			}
+			info, err := ProbeMedia(source)
+			if err != nil {
+				t.Fatalf("ProbeMedia: %v", err)
+			}
+			stream, ok := VideoStream(info)
+			if !ok || stream.CodecName != tt.codec {
+				t.Fatalf("VideoStream = %s, %t, want %s", stream.CodecName, ok, tt.codec)
+			}
+			if width, height, err := VideoDimensions(info); err != nil || width != tt.width || height != tt.height {
+				t.Errorf("VideoDimensions = %dx%d, %v, want %dx%d", width, height, err, tt.width, tt.height)
+			}
+			if filters := InputFilters(stream, types.DeinterlaceAuto, 0); !reflect.DeepEqual(filters, tt.filters) {
+				t.Errorf("InputFilters = %q, want %q", filters, tt.filters)
+			}
+			// None of them can be segmented as is; they're re-encoded to H.264/AAC
+			if ok, reason := CanStreamCopy(info, tt.height, 0, "yuv420p"); ok || reason != tt.copyReason {
+				t.Errorf("CanStreamCopy = %t, %q, want false, %q", ok, reason, tt.copyReason)
+			}
+		})
+	}
+}
+
+func TestSniffSignatureOfUnusualContainers(t *testing.T) {
+	transportStream := bytes.Repeat(append([]byte{0x47}, make([]byte, 187)...), 3)
+	tests := map[string][]byte{
+		"video/x-flv":      []byte("FLV\x01\x05\x00\x00\x00\x09"),
+		"video/x-ms-asf":   {0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA},
+		"video/mp2t":       transportStream,
+		"video/x-matroska": append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x9F, 0x42, 0x82, 0x88}, "matroska"...),
+		"video/mpeg":       {0x00, 0x00, 0x01, 0xBA, 0x44, 0x00},
+	}
+	for want, header := range tests {
+		if got := sniffSignature(header); got != want {
+			t.Errorf("sniffSignature of a %s header = %q", want, got)
+		}
+	}
+}
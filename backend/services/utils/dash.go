@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MIME types of the WebM segments, as listed in the DASH manifest.
+const (
+	WebMVideoMIME = "video/webm"
+	WebMAudioMIME = "audio/webm"
+)
+
+// Names of the WebM segments ffmpeg's dash muxer writes for a rendition (see DASHMuxerArgs).
+// Every rendition is muxed on its own, so its video is always representation 0 and its audio 1.
+const (
+	dashInitTemplate  = "init-$RepresentationID$.webm"
+	dashMediaTemplate = "chunk-$RepresentationID$-$Number%05d$.webm"
+
+	// DASHVideoInitSegment is the init segment of a rendition's video, which can be probed for its size.
+	DASHVideoInitSegment = "init-0.webm"
+)
+
+// DASHMuxerArgs returns the arguments muxing a rendition into WebM segments of segmentDuration
+// seconds with ffmpeg's dash muxer, whose own manifest lists only that rendition.
+func DASHMuxerArgs(segmentDuration int, hasAudio bool) []string {
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		adaptationSets += " id=1,streams=a"
+	}
+	return []string{
+		"-f", "dash",
+		"-dash_segment_type", "webm",
+		"-seg_duration", strconv.Itoa(segmentDuration),
+		"-use_template", "1",
+		"-use_timeline", "0",
+		"-init_seg_name", dashInitTemplate,
+		"-media_seg_name", dashMediaTemplate,
+		"-adaptation_sets", adaptationSets,
+	}
+}
+
+// DASHRepresentation describes a video rendition listed in the DASH manifest of the ladder.
+type DASHRepresentation struct {
+	ID        string // Also the folder of the rendition's segments, relative to the manifest
+	Codecs    string // RFC 6381 codecs value, e.g. from VP9CodecString
+	Bandwidth int    // Peak bitrate in kbps
+	Width     int
+	Height    int
+	FrameRate string // As ffprobe reports it, e.g. "30000/1001", empty if unknown
+}
+
+type mpd struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Xmlns                     string    `xml:"xmlns,attr"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int                 `xml:"id,attr"`
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                 `xml:"startWithSAP,attr"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string             `xml:"id,attr"`
+	Codecs            string             `xml:"codecs,attr"`
+	Bandwidth         int                `xml:"bandwidth,attr"`
+	Width             int                `xml:"width,attr,omitempty"`
+	Height            int                `xml:"height,attr,omitempty"`
+	FrameRate         string             `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate int                `xml:"audioSamplingRate,attr,omitempty"`
+	BaseURL           string             `xml:"BaseURL"`
+	SegmentTemplate   mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale      int    `xml:"timescale,attr"`
+	Duration       int    `xml:"duration,attr"`
+	StartNumber    int    `xml:"startNumber,attr"`
+	Initialization string `xml:"initialization,attr"`
+	Media          string `xml:"media,attr"`
+}
+
+// DASHManifest renders the static DASH manifest of a ladder of WebM renditions, each muxed with
+// DASHMuxerArgs into a folder named after its ID. The Opus audio, when there is any, is the same
+// in every rendition and is listed once, from the folder of audioFrom.
+func DASHManifest(representations []DASHRepresentation, audioFrom string, duration float64, segmentDuration int) ([]byte, error) {
+	if len(representations) == 0 {
+		return nil, fmt.Errorf("no representations")
+	}
+
+	// The segment names within a rendition's folder, with the representation ID the muxer used
+	template := func(representation int) mpdSegmentTemplate {
+		id := strconv.Itoa(representation)
+		return mpdSegmentTemplate{
+			Timescale:      1000,
+			Duration:       segmentDuration * 1000,
+			StartNumber:    1,
+			Initialization: strings.ReplaceAll(dashInitTemplate, "$RepresentationID$", id),
+			Media:          strings.ReplaceAll(dashMediaTemplate, "$RepresentationID$", id),
+		}
+	}
+
+	video := mpdAdaptationSet{ID: 0, ContentType: "video", MimeType: WebMVideoMIME, SegmentAlignment: true, StartWithSAP: 1}
+	for _, representation := range representations {
+		frameRate := ""
+		if ParseFrameRate(representation.FrameRate) > 0 {
+			frameRate = representation.FrameRate
+		}
+		video.Representations = append(video.Representations, mpdRepresentation{
+			ID:              representation.ID,
+			Codecs:          representation.Codecs,
+			Bandwidth:       representation.Bandwidth * 1000,
+			Width:           representation.Width,
+			Height:          representation.Height,
+			FrameRate:       frameRate,
+			BaseURL:         representation.ID + "/",
+			SegmentTemplate: template(0),
+		})
+	}
+
+	manifest := mpd{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: fmt.Sprintf("PT%.3fS", duration),
+		MinBufferTime:             fmt.Sprintf("PT%dS", segmentDuration),
+		Period:                    mpdPeriod{ID: "0", Start: "PT0S", AdaptationSets: []mpdAdaptationSet{video}},
+	}
+	if audioFrom != "" {
+		manifest.Period.AdaptationSets = append(manifest.Period.AdaptationSets, mpdAdaptationSet{
+			ID: 1, ContentType: "audio", MimeType: WebMAudioMIME, SegmentAlignment: true, StartWithSAP: 1,
+			Representations: []mpdRepresentation{{
+				ID:                "audio",
+				Codecs:            "opus",
+				Bandwidth:         AudioBitrate * 1000,
+				AudioSamplingRate: 48000, // Opus always runs at 48 kHz
+				BaseURL:           audioFrom + "/",
+				SegmentTemplate:   template(1),
+			}},
+		})
+	}
+
+	output, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to render DASH manifest: %w", err)
+	}
+	return append([]byte(xml.Header), append(output, '\n')...), nil
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestValidateCodecFormat(t *testing.T) {
+	tests := []struct {
+		codec   types.Codec
+		format  types.OutputFormat
+		wantErr bool
+	}{
+		{types.CodecH264, types.FormatHLS, false},
+		{types.CodecH264, types.FormatDASH, true},
+		{types.CodecVP9, types.FormatDASH, false},
+		{types.CodecVP9, types.FormatHLS, true},
+		{types.CodecAV1, types.FormatHLS, false},
+		{types.CodecAV1, types.FormatDASH, true},
+		{"hevc", types.FormatHLS, true},
+	}
+	for _, test := range tests {
+		if err := ValidateCodecFormat(test.codec, test.format); (err != nil) != test.wantErr {
+			t.Errorf("ValidateCodecFormat(%s, %s) = %v, want error %v", test.codec, test.format, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateAudioCodec(t *testing.T) {
+	tests := []struct {
+		codec       types.AudioCodec
+		format      types.OutputFormat
+		segmentType types.SegmentType
+		wantErr     bool
+	}{
+		{types.AudioOpus, types.FormatDASH, types.SegmentTS, false},
+		{types.AudioAAC, types.FormatDASH, types.SegmentTS, true},
+		{types.AudioAC3, types.FormatDASH, types.SegmentFMP4, true},
+		{types.AudioAAC, types.FormatHLS, types.SegmentTS, false},
+		{types.AudioAC3, types.FormatHLS, types.SegmentTS, false},
+		{types.AudioOpus, types.FormatHLS, types.SegmentTS, true},
+		{types.AudioOpus, types.FormatHLS, types.SegmentFMP4, false},
+		{"mp3", types.FormatHLS, types.SegmentTS, true},
+	}
+	for _, test := range tests {
+		err := ValidateAudioCodec(test.codec, test.format, test.segmentType)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ValidateAudioCodec(%s, %s, %s) = %v, want error %v", test.codec, test.format, test.segmentType, err, test.wantErr)
+		}
+	}
+}
+
+func TestVP9CodecString(t *testing.T) {
+	tests := []struct {
+		profile       string
+		width, height int
+		frameRate     float64
+		pixFmt        string
+		want          string
+	}{
+		{"", 640, 360, 30, "yuv420p", "vp09.00.21.08"},
+		{"", 1280, 720, 30, "yuv420p", "vp09.00.31.08"},
+		{"", 1280, 720, 0, "yuv420p", "vp09.00.31.08"}, // Unknown rates are taken as 30 fps
+		{"", 1920, 1080, 30, "yuv420p", "vp09.00.40.08"},
+		{"", 1920, 1080, 60, "yuv420p", "vp09.00.41.08"},
+		{"2", 1280, 720, 30, "yuv420p10le", "vp09.02.31.10"},
+		{"", 16384, 16384, 120, "yuv420p", "vp09.00.62.08"}, // Beyond every level
+	}
+	for _, test := range tests {
+		got := VP9CodecString(test.profile, test.width, test.height, test.frameRate, test.pixFmt)
+		if got != test.want {
+			t.Errorf("VP9CodecString(%q, %d, %d, %v, %s) = %q, want %q",
+				test.profile, test.width, test.height, test.frameRate, test.pixFmt, got, test.want)
+		}
+	}
+}
+
+func TestDASHMuxerArgs(t *testing.T) {
+	for _, hasAudio := range []bool{false, true} {
+		args := DASHMuxerArgs(4, hasAudio)
+		values := map[string]string{}
+		for i := 0; i+1 < len(args); i += 2 {
+			values[args[i]] = args[i+1]
+		}
+
+		want := map[string]string{
+			"-f":                 "dash",
+			"-dash_segment_type": "webm",
+			"-seg_duration":      "4",
+			"-use_template":      "1",
+			"-use_timeline":      "0",
+			"-init_seg_name":     "init-$RepresentationID$.webm",
+			"-media_seg_name":    "chunk-$RepresentationID$-$Number%05d$.webm",
+			"-adaptation_sets":   "id=0,streams=v",
+		}
+		if hasAudio {
+			want["-adaptation_sets"] = "id=0,streams=v id=1,streams=a"
+		}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("DASHMuxerArgs(4, %v) = %q, want %v", hasAudio, args, want)
+		}
+	}
+}
+
+func TestDASHManifest(t *testing.T) {
+	representations := []DASHRepresentation{
+		{ID: "720P", Codecs: "vp09.00.31.08", Bandwidth: 2800, Width: 1280, Height: 720, FrameRate: "30000/1001"},
+		{ID: "360P", Codecs: "vp09.00.21.08", Bandwidth: 800, Width: 640, Height: 360, FrameRate: "N/A"},
+	}
+
+	t.Run("with audio", func(t *testing.T) {
+		output, err := DASHManifest(representations, "720P", 12.5, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(output), xml.Header) {
+			t.Errorf("manifest doesn't start with the XML header:\n%s", output)
+		}
+
+		var manifest mpd
+		if err := xml.Unmarshal(output, &manifest); err != nil {
+			t.Fatalf("manifest doesn't parse: %v\n%s", err, output)
+		}
+		if manifest.Type != "static" || manifest.MediaPresentationDuration != "PT12.500S" || manifest.MinBufferTime != "PT4S" {
+			t.Errorf("MPD = %+v", manifest)
+		}
+		sets := manifest.Period.AdaptationSets
+		if len(sets) != 2 {
+			t.Fatalf("got %d adaptation sets, want video and audio", len(sets))
+		}
+
+		video := sets[0]
+		if video.ContentType != "video" || video.MimeType != WebMVideoMIME || len(video.Representations) != 2 {
+			t.Fatalf("video adaptation set = %+v", video)
+		}
+		first := video.Representations[0]
+		if first.Codecs != "vp09.00.31.08" || first.Bandwidth != 2800000 || first.Width != 1280 || first.Height != 720 ||
+			first.FrameRate != "30000/1001" || first.BaseURL != "720P/" {
+			t.Errorf("720P representation = %+v", first)
+		}
+		if first.SegmentTemplate.Initialization != DASHVideoInitSegment || first.SegmentTemplate.Media != "chunk-0-$Number%05d$.webm" ||
+			first.SegmentTemplate.Duration != 4000 || first.SegmentTemplate.Timescale != 1000 {
+			t.Errorf("720P segment template = %+v", first.SegmentTemplate)
+		}
+		if video.Representations[1].FrameRate != "" {
+			t.Errorf("invalid frame rate listed: %+v", video.Representations[1])
+		}
+
+		audio := sets[1]
+		if audio.ContentType != "audio" || audio.MimeType != WebMAudioMIME || len(audio.Representations) != 1 {
+			t.Fatalf("audio adaptation set = %+v", audio)
+		}
+		track := audio.Representations[0]
+		if track.Codecs != "opus" || track.BaseURL != "720P/" || track.AudioSamplingRate != 48000 ||
+			track.SegmentTemplate.Initialization != "init-1.webm" || track.SegmentTemplate.Media != "chunk-1-$Number%05d$.webm" {
+			t.Errorf("audio representation = %+v", track)
+		}
+	})
+
+	t.Run("without audio", func(t *testing.T) {
+		output, err := DASHManifest(representations, "", 12.5, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest mpd
+		if err := xml.Unmarshal(output, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Period.AdaptationSets) != 1 || manifest.Period.AdaptationSets[0].ContentType != "video" {
+			t.Errorf("adaptation sets = %+v, want only video", manifest.Period.AdaptationSets)
+		}
+	})
+
+	t.Run("no representations", func(t *testing.T) {
+		if _, err := DASHManifest(nil, "", 12.5, 4); err == nil {
+			t.Error("DASHManifest accepted an empty ladder")
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// ArtifactKey identifies the output of transcoding the content with the given SHA-256 using options.
+// Options that only affect how a job runs, not what it produces, are left out, so such jobs share a key.
+func ArtifactKey(contentHash string, options types.TranscodeOptions) (string, error) {
+	options.Priority = types.PriorityNormal
+	options.KeepSource = false
+	options.MaxThreads = 0
+	options.Throttle = false
+
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode options: %w", err)
+	}
+	sum := sha256.Sum256(append([]byte(contentHash+"\n"), encoded...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LinkOutputArchive makes the archive of sourceTaskID available as the archive of taskID too.
+// The archive is hard-linked rather than copied, and its modification time is refreshed so that
+// RemoveExpiredOutputs measures its age from the reuse.
+func LinkOutputArchive(sourceTaskID, taskID string) error {
+	sourcePath, err := FindOutputArchive(sourceTaskID)
+	if err != nil {
+		return err
+	}
+	archivePath := GetOutputDirectory(taskID) + ".zip"
+	if err := os.Link(sourcePath, archivePath); err != nil {
+		return fmt.Errorf("failed to link archive %s: %w", sourcePath, err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(archivePath, now, now); err != nil {
+		os.Remove(archivePath)
+		return fmt.Errorf("failed to refresh archive %s: %w", archivePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+	"github.com/google/uuid"
+)
+
+// setNonZero sets v to a non-zero value of its kind.
+func setNonZero(t *testing.T, v reflect.Value) {
+	t.Helper()
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(7)
+	case reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		m.SetMapIndex(reflect.Zero(v.Type().Key()), reflect.ValueOf(1).Convert(v.Type().Elem()))
+		v.Set(m)
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 1, 1)
+		setNonZero(t, s.Index(0))
+		v.Set(s)
+	case reflect.Struct:
+		for i := range v.NumField() {
+			setNonZero(t, v.Field(i))
+		}
+	default:
+		t.Fatalf("no non-zero value for %s", v.Type())
+	}
+}
+
+func TestArtifactKeyDiffersByOutputOptions(t *testing.T) {
+	// Options that only change how the job runs, not its output
+	runtimeOnly := map[string]bool{"Priority": true, "KeepSource": true, "MaxThreads": true, "Throttle": true}
+
+	base, err := ArtifactKey("hash", types.TranscodeOptions{})
+	if err != nil {
+		t.Fatalf("ArtifactKey: %v", err)
+	}
+	if other, _ := ArtifactKey("other hash", types.TranscodeOptions{}); other == base {
+		t.Error("different content shares a key")
+	}
+
+	optionsType := reflect.TypeOf(types.TranscodeOptions{})
+	for i := range optionsType.NumField() {
+		field := optionsType.Field(i)
+		var options types.TranscodeOptions
+		setNonZero(t, reflect.ValueOf(&options).Elem().Field(i))
+
+		key, err := ArtifactKey("hash", options)
+		if err != nil {
+			t.Fatalf("ArtifactKey with %s: %v", field.Name, err)
+		}
+		if runtimeOnly[field.Name] && key != base {
+			t.Errorf("%s only affects how the job runs, but changes the key", field.Name)
+		}
+		if !runtimeOnly[field.Name] && key == base {
+			t.Errorf("%s changes the output, but not the key", field.Name)
+		}
+	}
+}
+
+func TestLinkOutputArchive(t *testing.T) {
+	useOutputDir(t)
+	sourceTaskID, taskID := uuid.NewString(), uuid.NewString()
+	sourcePath := GetOutputDirectory(sourceTaskID) + ".zip"
+	if err := os.WriteFile(sourcePath, []byte("zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	age(t, sourcePath, 2*time.Hour)
+
+	if err := LinkOutputArchive(sourceTaskID, taskID); err != nil {
+		t.Fatalf("LinkOutputArchive: %v", err)
+	}
+	archivePath, err := FindOutputArchive(taskID)
+	if err != nil {
+		t.Fatalf("FindOutputArchive of the reusing task: %v", err)
+	}
+	if content, _ := os.ReadFile(archivePath); string(content) != "zip" {
+		t.Errorf("linked archive holds %q", content)
+	}
+	// Both names share the file, so the source's age is refreshed too
+	if info, _ := os.Stat(sourcePath); time.Since(info.ModTime()) > time.Minute {
+		t.Errorf("archive modified %s ago, want refreshed", time.Since(info.ModTime()))
+	}
+
+	// Once the source archive has expired, there's nothing left to reuse
+	other := uuid.NewString()
+	if err := RemoveOutputArchive(sourceTaskID); err != nil {
+		t.Fatalf("RemoveOutputArchive: %v", err)
+	}
+	if err := LinkOutputArchive(sourceTaskID, other); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LinkOutputArchive of a removed archive returned %v, want os.ErrNotExist", err)
+	}
+	if _, err := FindOutputArchive(taskID); err != nil {
+		t.Errorf("the reusing task lost its archive with the source's: %v", err)
+	}
+}
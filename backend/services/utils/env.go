@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PratikDev/transcoder/logger"
+)
+
+// GetEnv returns the value of the environment variable named by key,
+// or fallback if the variable is unset or empty.
+func GetEnv(key, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// GetEnvFloat returns the environment variable named by key parsed as a positive float,
+// or fallback if the variable is unset or invalid.
+func GetEnvFloat(key string, fallback float64) float64 {
+	raw := GetEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value <= 0 {
+		logger.Warnf("Invalid value %q for %s, using default %v", raw, key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// GetEnvInt returns the environment variable named by key parsed as a positive integer,
+// or fallback if the variable is unset or invalid.
+func GetEnvInt(key string, fallback int) int {
+	raw := GetEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		logger.Warnf("Invalid value %q for %s, using default %v", raw, key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// GetEnvBool returns the environment variable named by key parsed as a boolean,
+// or fallback if the variable is unset or invalid.
+func GetEnvBool(key string, fallback bool) bool {
+	raw := GetEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		logger.Warnf("Invalid value %q for %s, using default %v", raw, key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// GetEnvDuration returns the environment variable named by key parsed as a positive duration
+// (e.g. "15s", "2m"), or fallback if the variable is unset or invalid.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	raw := GetEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		logger.Warnf("Invalid value %q for %s, using default %v", raw, key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// ErrFFmpegNotInstalled is returned when ffmpeg or ffprobe can't be run because the binary doesn't
+// exist, e.g. because it was removed after startup. Handlers answer it with 503 Service Unavailable.
+var ErrFFmpegNotInstalled = errors.New("ffmpeg not installed")
+
+// MissingBinary returns an error wrapping ErrFFmpegNotInstalled if err, returned by running the
+// binary at path, means it doesn't exist, and nil otherwise.
+func MissingBinary(path string, err error) error {
+	// A bare name isn't found in PATH; an explicit path fails to start with "no such file"
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s can't be found", ErrFFmpegNotInstalled, path)
+	}
+	return nil
+}
+
+// EnsureBinary checks that the executable at path (or found in PATH, for a plain name) exists.
+func EnsureBinary(path string) error {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return fmt.Errorf("executable %s not found: %w", path, err)
+	}
+	logger.Infof("Using %s", resolved)
+	return nil
+}
+
+// BinaryVersion returns the first line of "<path> -version", e.g. "ffmpeg version 6.1.1 ...",
+// which both ffmpeg and ffprobe print.
+func BinaryVersion(path string) (string, error) {
+	output, err := ExecCommand(context.Background(), path, "-version").Output()
+	if err != nil {
+		if missing := MissingBinary(path, err); missing != nil {
+			return "", missing
+		}
+		return "", fmt.Errorf("failed to get version of %s: %w", path, err)
+	}
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimSpace(firstLine), nil
+}
+
+// EnsureWritableDir creates dir if it doesn't exist and verifies that files can be written to it.
+func EnsureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	probePath := probe.Name()
+	probe.Close()
+
+	if err := os.Remove(probePath); err != nil {
+		return fmt.Errorf("failed to remove write check file %s: %w", filepath.Base(probePath), err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// missingBinaries points FFMPEG_PATH and FFPROBE_PATH at binaries that don't exist until the test ends.
+func missingBinaries(t *testing.T, ffmpeg, ffprobe string) {
+	previousFFmpeg, previousFFprobe := FFMPEG_PATH, FFPROBE_PATH
+	FFMPEG_PATH, FFPROBE_PATH = ffmpeg, ffprobe
+	t.Cleanup(func() { FFMPEG_PATH, FFPROBE_PATH = previousFFmpeg, previousFFprobe })
+}
+
+func TestMissingBinary(t *testing.T) {
+	for _, err := range []error{
+		&exec.Error{Name: "ffprobe", Err: exec.ErrNotFound},
+		&fs.PathError{Op: "fork/exec", Path: "/opt/ffmpeg/bin/ffprobe", Err: fs.ErrNotExist},
+	} {
+		missing := MissingBinary("ffprobe", err)
+		if !errors.Is(missing, ErrFFmpegNotInstalled) || missing.Error() != "ffmpeg not installed: ffprobe can't be found" {
+			t.Errorf("MissingBinary(%v) = %v, want ErrFFmpegNotInstalled naming ffprobe", err, missing)
+		}
+	}
+	for _, err := range []error{nil, errors.New("exit status 1"), fmt.Errorf("wrapped: %w", fs.ErrPermission)} {
+		if missing := MissingBinary("ffprobe", err); missing != nil {
+			t.Errorf("MissingBinary(%v) = %v, want nil", err, missing)
+		}
+	}
+}
+
+func TestProbesWithoutFFprobe(t *testing.T) {
+	for _, path := range []string{"transcoder-test-no-such-ffprobe", filepath.Join(t.TempDir(), "ffprobe")} {
+		missingBinaries(t, "ffmpeg", path)
+		source := sourceFile(t, "source.mp4")
+
+		if _, err := ProbeMedia(source); !errors.Is(err, ErrFFmpegNotInstalled) {
+			t.Errorf("ProbeMedia with FFPROBE_PATH=%s = %v, want ErrFFmpegNotInstalled", path, err)
+		}
+		if _, err := DetectInputDuration(source); !errors.Is(err, ErrFFmpegNotInstalled) {
+			t.Errorf("DetectInputDuration with FFPROBE_PATH=%s = %v, want ErrFFmpegNotInstalled", path, err)
+		}
+		if _, _, err := DetectVideoDimensions(source); !errors.Is(err, ErrFFmpegNotInstalled) {
+			t.Errorf("DetectVideoDimensions with FFPROBE_PATH=%s = %v, want ErrFFmpegNotInstalled", path, err)
+		}
+	}
+}
+
+func TestFFmpegRunsWithoutFFmpeg(t *testing.T) {
+	missingBinaries(t, filepath.Join(t.TempDir(), "ffmpeg"), "ffprobe")
+
+	if _, err := measureEncodeSpeed(); !errors.Is(err, ErrFFmpegNotInstalled) {
+		t.Errorf("measureEncodeSpeed = %v, want ErrFFmpegNotInstalled", err)
+	}
+	if err := runFFmpeg(context.Background(), "concat", []string{"-version"}); !errors.Is(err, ErrFFmpegNotInstalled) {
+		t.Errorf("runFFmpeg = %v, want ErrFFmpegNotInstalled", err)
+	}
+	if _, err := ListEncoders(FFMPEG_PATH); !errors.Is(err, ErrFFmpegNotInstalled) {
+		t.Errorf("ListEncoders = %v, want ErrFFmpegNotInstalled", err)
+	}
+}
+
+func TestBinaryVersion(t *testing.T) {
+	stdout := filepath.Join(t.TempDir(), "version.txt")
+	if err := os.WriteFile(stdout, []byte("ffmpeg version 6.1.1 Copyright (c) 2000-2023\nbuilt with gcc 13\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous := ExecCommand
+	ExecCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--", name}, args...)...)
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_STDOUT="+stdout)
+		return cmd
+	}
+	t.Cleanup(func() { ExecCommand = previous })
+
+	if version, err := BinaryVersion("ffmpeg"); err != nil || version != "ffmpeg version 6.1.1 Copyright (c) 2000-2023" {
+		t.Errorf("BinaryVersion = %q, %v, want the first line", version, err)
+	}
+
+	ExecCommand = previous
+	if _, err := BinaryVersion(filepath.Join(t.TempDir(), "ffmpeg")); !errors.Is(err, ErrFFmpegNotInstalled) {
+		t.Errorf("BinaryVersion of a missing binary = %v, want ErrFFmpegNotInstalled", err)
+	}
+}
+
+func TestEnsureBinary(t *testing.T) {
+	if err := EnsureBinary(os.Args[0]); err != nil {
+		t.Errorf("EnsureBinary(test binary) = %v", err)
+	}
+	if err := EnsureBinary("transcoder-test-no-such-ffmpeg"); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("EnsureBinary of a missing binary = %v, want exec.ErrNotFound", err)
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// TestHelperProcess isn't a real test. It's the fake ffprobe started by fakeProbe: it prints the
+// file named by FAKE_STDOUT and exits with FAKE_EXIT_CODE.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	if path := os.Getenv("FAKE_STDOUT"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			os.Stderr.WriteString(err.Error())
+			os.Exit(2)
+		}
+		os.Stdout.Write(data)
+	}
+	code, _ := strconv.Atoi(os.Getenv("FAKE_EXIT_CODE"))
+	os.Exit(code)
+}
+
+// fakeProbe makes ExecCommand start TestHelperProcess instead of ffprobe until the test ends, so
+// every probe reports testdata/probe/<fixture>.json. It returns the number of processes started.
+func fakeProbe(t *testing.T, fixture string) *atomic.Int32 {
+	t.Helper()
+	stdout, err := filepath.Abs(filepath.Join("testdata", "probe", fixture+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stdout); err != nil {
+		t.Fatalf("missing fixture: %v", err)
+	}
+
+	started := new(atomic.Int32)
+	previous := ExecCommand
+	ExecCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		started.Add(1)
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--", name}, args...)...)
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_STDOUT="+stdout)
+		return cmd
+	}
+	t.Cleanup(func() { ExecCommand = previous })
+	return started
+}
+
+// sourceFile creates an empty file standing in for a probed source.
+func sourceFile(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("not really video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
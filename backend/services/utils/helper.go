@@ -3,70 +3,583 @@ package utils
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/PratikDev/transcoder/logger"
 	"github.com/PratikDev/transcoder/types"
+	"github.com/google/uuid"
 )
 
-// Pre-compile regex patterns for efficiency.
-// These will be used by ParseFFmpegProgress.
+// Storage locations, configurable through the UPLOAD_DIR, OUTPUT_DIR and SOURCE_ARCHIVE_DIR environment variables.
 var (
-	// frameRegex matches "frame= N" (or "frame=N") and captures N (the frame number).
-	frameRegex = regexp.MustCompile(`frame=\s*(\d+)`)
+	UPLOAD_DIR         = GetEnv("UPLOAD_DIR", "./uploads")         // Directory to temporarily store uploaded videos
+	OUTPUT_DIR         = GetEnv("OUTPUT_DIR", "./output")          // Directory for transcoded output
+	SOURCE_ARCHIVE_DIR = GetEnv("SOURCE_ARCHIVE_DIR", "./sources") // Directory for sources kept after transcoding
+)
+
+// Binaries used for transcoding and probing, configurable through the FFMPEG_PATH and FFPROBE_PATH
+// environment variables. Plain names are looked up in PATH.
+var (
+	FFMPEG_PATH  = GetEnv("FFMPEG_PATH", "ffmpeg")
+	FFPROBE_PATH = GetEnv("FFPROBE_PATH", "ffprobe")
+)
 
-	// timeRegex matches "time=HH:MM:SS.ms" and captures the timestamp string.
-	timeRegex = regexp.MustCompile(`time=\s*([\d:.]+)`)
+// ExecCommand creates every ffmpeg and ffprobe process. Tests can replace it to run a fake binary
+// instead, e.g. one printing canned progress or ffprobe JSON, failing, or blocking until killed,
+// so the pipeline can be exercised without ffmpeg installed.
+var ExecCommand = exec.CommandContext
 
-	// speedRegex matches "speed= N.Mx" and captures N.M (the speed multiplier).
-	speedRegex = regexp.MustCompile(`speed=\s*([\d.]+)x`)
+// CommandRunner runs a prepared ffmpeg command to completion and returns its combined output, like
+// exec.Cmd.CombinedOutput. A task's jobs run their commands through one that lets the task be paused.
+type CommandRunner func(cmd *exec.Cmd) ([]byte, error)
+
+type commandRunnerKey struct{}
+
+// WithCommandRunner returns a copy of ctx that has the ffmpeg commands run with it, such as audio
+// extraction or preview clips, run by run.
+func WithCommandRunner(ctx context.Context, run CommandRunner) context.Context {
+	return context.WithValue(ctx, commandRunnerKey{}, run)
+}
+
+// commandRunner returns the CommandRunner WithCommandRunner stored in ctx, or exec.Cmd.CombinedOutput.
+func commandRunner(ctx context.Context) CommandRunner {
+	if run, ok := ctx.Value(commandRunnerKey{}).(CommandRunner); ok {
+		return run
+	}
+	return (*exec.Cmd).CombinedOutput
+}
+
+// VBV multipliers applied to a rendition's target bitrate, configurable through
+// the MAXRATE_FACTOR and BUFSIZE_FACTOR environment variables.
+var (
+	MAXRATE_FACTOR = GetEnvFloat("MAXRATE_FACTOR", 1.07) // -maxrate = bitrate × factor
+	BUFSIZE_FACTOR = GetEnvFloat("BUFSIZE_FACTOR", 1.5)  // -bufsize = bitrate × factor
 )
 
+// Job timeout settings. A job may run for JOB_TIMEOUT_FACTOR times the input duration
+// (configurable through the environment), but never less than MinJobTimeout.
+var JOB_TIMEOUT_FACTOR = GetEnvFloat("JOB_TIMEOUT_FACTOR", 10)
+
+const MinJobTimeout = 5 * time.Minute
+
+// PROGRESS_UPDATE_INTERVAL is the least time between two progress updates of the same rendition.
+// ffmpeg reports progress more often, which would flood status streams.
+var PROGRESS_UPDATE_INTERVAL = GetEnvDuration("PROGRESS_UPDATE_INTERVAL", 500*time.Millisecond)
+
+// OUTPUT_QUOTA_MB caps how much output a single task may write, 0 disables the limit.
+var OUTPUT_QUOTA_MB = GetEnvInt("OUTPUT_QUOTA_MB", 0)
+
+// MAX_OUTPUT_HEIGHT caps the height of the renditions produced, e.g. 1080 to never produce 4K
+// renditions, 0 disables the limit. Requests can lower it further with maxHeight.
+var MAX_OUTPUT_HEIGHT = GetEnvInt("MAX_OUTPUT_HEIGHT", 0)
+
+// SegmentDuration is the target length of HLS segments in seconds.
+const SegmentDuration = 4
+
+// ForceKeyFramesExpr returns the -force_key_frames expression placing a keyframe at every multiple
+// of segmentDuration seconds, so segments of every rendition start at the same timestamps even when
+// the encoder adds keyframes of its own, e.g. at scene cuts.
+func ForceKeyFramesExpr(segmentDuration int) string {
+	return fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentDuration)
+}
+
+// Bounds that per-resolution bitrate overrides are clamped to, in kbps.
 const (
-	UPLOAD_DIR = "./uploads" // Directory to temporarily store uploaded videos
-	OUTPUT_DIR = "./output"  // Directory for transcoded output
+	MinBitrateOverride = 200
+	MaxBitrateOverride = 50000
 )
 
+// GenerateToken returns a random hex-encoded secret suitable for authorizing access to a task.
+func GenerateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 // GetFilenameLessExt returns the filename without its extension.
 func GetFilenameLessExt(fileName string) string {
 	return strings.TrimSuffix(fileName, strings.ToLower(filepath.Ext(fileName)))
 }
 
-// ParseFFmpegProgress parses a single progress line string from FFmpeg's stderr
-// using regular expressions to extract frame, timemark, and speed.
-func ParseFFmpegProgress(line string) (frame, timemark, speed string) {
-	frameMatch := frameRegex.FindStringSubmatch(line)
-	if len(frameMatch) > 1 {
-		frame = frameMatch[1]
+// VideoCodec is the encoder used for renditions of the default codec, h264.
+const VideoCodec = "libx264"
+
+// AudioBitrate is the audio bitrate of every rendition, in kbps.
+const AudioBitrate = 128
+
+// CodecPixelFormats lists the pixel formats each encoder supports, mapped to the
+// encoder profile they require ("" when the encoder's default profile handles it).
+var CodecPixelFormats = map[string]map[string]string{
+	"libx264": {
+		"yuv420p":     "",
+		"yuv422p":     "high422",
+		"yuv444p":     "high444",
+		"yuv420p10le": "high10",
+		"yuv422p10le": "high422",
+		"yuv444p10le": "high444",
+	},
+	"libsvtav1": {
+		"yuv420p":     "",
+		"yuv420p10le": "", // Both are in AV1's Main profile
+	},
+	"libvpx-vp9": {
+		"yuv420p":     "",
+		"yuv444p":     "1",
+		"yuv420p10le": "2",
+		"yuv444p10le": "3",
+	},
+}
+
+// FMP4Codecs lists the video encoders whose output can be carried in fragmented MP4 segments.
+var FMP4Codecs = map[string]bool{
+	"libx264":   true,
+	"libx265":   true,
+	"libsvtav1": true,
+}
+
+// TSCodecs lists the video encoders whose output can be carried in MPEG-TS segments.
+var TSCodecs = map[string]bool{
+	"libx264": true,
+	"libx265": true,
+}
+
+// ValidateSegmentType checks that codec can be packaged into segments of the given type.
+func ValidateSegmentType(codec string, segmentType types.SegmentType) error {
+	if segmentType == types.SegmentFMP4 && !FMP4Codecs[codec] {
+		return fmt.Errorf("codec %s can't be packaged into fmp4 segments", codec)
+	}
+	if segmentType == types.SegmentTS && !TSCodecs[codec] {
+		return fmt.Errorf("codec %s can't be packaged into ts segments", codec)
+	}
+	return nil
+}
+
+// PixelFormatProfile validates that codec can encode pixFmt and returns the profile it requires.
+func PixelFormatProfile(codec, pixFmt string) (string, error) {
+	formats, ok := CodecPixelFormats[codec]
+	if !ok {
+		return "", fmt.Errorf("unknown codec %q", codec)
+	}
+
+	profile, ok := formats[pixFmt]
+	if !ok {
+		supported := make([]string, 0, len(formats))
+		for format := range formats {
+			supported = append(supported, format)
+		}
+		slices.Sort(supported)
+		return "", fmt.Errorf("pixel format %q is not supported by %s (supported: %s)", pixFmt, codec, strings.Join(supported, ", "))
+	}
+	return profile, nil
+}
+
+// ParseBitrateOverrides parses a JSON object mapping resolutions to video bitrates in kbps,
+// e.g. {"1080P":5000,"720P":3000}. Values are clamped to [MinBitrateOverride, MaxBitrateOverride].
+// An empty string yields no overrides.
+func ParseBitrateOverrides(raw string) (map[types.Resolutions]int, error) {
+	overrides := map[types.Resolutions]int{}
+	if strings.TrimSpace(raw) == "" {
+		return overrides, nil
+	}
+
+	var values map[string]int
+	if err := json.Unmarshal([]byte(raw), &values); err != nil {
+		return nil, fmt.Errorf("bitrates must be a JSON object of resolution to kbps: %w", err)
+	}
+
+	for key, bitrate := range values {
+		res, err := types.ParseResolution(key)
+		if err != nil {
+			return nil, err
+		}
+		if bitrate <= 0 {
+			return nil, fmt.Errorf("bitrate for %s must be positive, got %d", res.String(), bitrate)
+		}
+		overrides[res] = min(max(bitrate, MinBitrateOverride), MaxBitrateOverride)
+	}
+
+	return overrides, nil
+}
+
+// ParseTimestamp parses a time offset given either in seconds ("90", "90.5")
+// or as [HH:]MM:SS[.ms] ("01:30", "00:01:30.5").
+func ParseTimestamp(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
 	}
 
-	timeMatch := timeRegex.FindStringSubmatch(line)
-	if len(timeMatch) > 1 {
-		timemark = timeMatch[1]
+	seconds := 0.0
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		seconds = seconds*60 + n
 	}
+	return seconds, nil
+}
+
+// FormatSeconds formats an offset in seconds for use as an ffmpeg time argument.
+func FormatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
 
-	speedMatch := speedRegex.FindStringSubmatch(line)
-	if len(speedMatch) > 1 {
-		speed = speedMatch[1]
+// TrimmedDuration returns the length of the portion of an input of the given duration
+// between start and end (0 meaning the end of the input), never less than zero.
+func TrimmedDuration(duration, start, end float64) float64 {
+	if end <= 0 || end > duration {
+		end = duration
 	}
+	return max(0, end-start)
+}
+
+// JobTimeout returns how long a job transcoding an input of the given duration (in seconds) may run.
+func JobTimeout(inputDuration float64) time.Duration {
+	scaled := time.Duration(inputDuration * JOB_TIMEOUT_FACTOR * float64(time.Second))
+	return max(MinJobTimeout, scaled)
+}
 
+// VBVRates returns the -maxrate and -bufsize values in kbps for a target bitrate in kbps.
+func VBVRates(bitrate int) (maxrate, bufsize int) {
+	maxrate = int(math.Round(float64(bitrate) * MAXRATE_FACTOR))
+	bufsize = int(math.Round(float64(bitrate) * BUFSIZE_FACTOR))
 	return
 }
 
+// ParseProgressBlock parses one block of ffmpeg's -progress output, i.e. the key=value lines
+// up to and including the terminating "progress=continue" or "progress=end" line.
+// Values reported as "N/A", negative or malformed values are left empty. Time is only set when
+// the output position could be parsed, so an empty Time means the block carries no usable progress.
+func ParseProgressBlock(block string) types.FFmpegProgress {
+	var progress types.FFmpegProgress
+	hasOutTime := false
+
+	for _, line := range strings.Split(block, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "N/A" {
+			continue
+		}
+
+		switch key {
+		case "frame":
+			if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+				progress.Frame = strconv.FormatUint(n, 10)
+			}
+		case "fps":
+			progress.FPS = progressRate(value)
+		case "bitrate":
+			progress.Bitrate = progressRate(strings.TrimSpace(strings.TrimSuffix(value, "kbits/s")))
+		case "speed":
+			progress.Speed = progressRate(strings.TrimSpace(strings.TrimSuffix(value, "x")))
+		case "out_time":
+			if !strings.HasPrefix(value, "-") { // Negative before the first frame is written
+				progress.Time = value
+			}
+		case "out_time_us":
+			// out_time_ms is also in microseconds (a long-standing ffmpeg quirk), so only out_time_us is used
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				progress.OutTime = float64(us) / 1e6
+				hasOutTime = true
+			}
+		case "progress":
+			progress.Done = value == "end"
+		}
+	}
+
+	// Older ffmpeg builds only report out_time
+	if !hasOutTime && progress.Time != "" {
+		seconds, err := ParseTimestamp(progress.Time)
+		if err != nil {
+			progress.Time = ""
+		}
+		progress.OutTime = seconds
+	}
+
+	return progress
+}
+
+// progressRate returns value if it's a finite, non-negative number as ffmpeg reports rates,
+// otherwise "".
+func progressRate(value string) string {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return ""
+	}
+	return value
+}
+
+// SpeedAverage accumulates ffmpeg's speed multipliers to report the average encoding speed.
+// The zero value is ready to use.
+type SpeedAverage struct {
+	sum   float64
+	count int
+}
+
+// Add records a speed as reported by ffmpeg (e.g. "3.2", without the trailing "x"). Missing and
+// non-positive values, reported before the first frame is encoded, are ignored.
+func (a *SpeedAverage) Add(speed string) {
+	value, err := strconv.ParseFloat(speed, 64)
+	if err != nil || value <= 0 || math.IsInf(value, 0) {
+		return
+	}
+	a.sum += value
+	a.count++
+}
+
+// Merge adds the samples of other to a.
+func (a *SpeedAverage) Merge(other SpeedAverage) {
+	a.sum += other.sum
+	a.count += other.count
+}
+
+// Mean returns the average speed rounded to two decimals, or 0 if no speed was recorded.
+func (a SpeedAverage) Mean() float64 {
+	if a.count == 0 {
+		return 0
+	}
+	return math.Round(a.sum/float64(a.count)*100) / 100
+}
+
+// ProgressPercent returns how far into an output of the given duration (in seconds) position is, as a
+// percentage within [0, 100]. It returns false when either value is unusable (negative, NaN or
+// infinite, or a zero duration), in which case no progress should be reported.
+func ProgressPercent(position, duration float64) (float64, bool) {
+	if math.IsNaN(position) || math.IsInf(position, 0) || position < 0 {
+		return 0, false
+	}
+	if math.IsNaN(duration) || math.IsInf(duration, 0) || duration <= 0 {
+		return 0, false
+	}
+	return min(position/duration*100, 100), true
+}
+
+// segmentAlignmentTolerance is how far apart, in seconds, corresponding segments of two renditions may end.
+const segmentAlignmentTolerance = 0.1
+
+// ReadSegmentDurations returns the #EXTINF durations of every segment in a media playlist.
+func ReadSegmentDurations(playlistPath string) ([]float64, error) {
+	content, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playlist %s: %w", playlistPath, err)
+	}
+
+	durations := []float64{}
+	for _, line := range strings.Split(string(content), "\n") {
+		value, found := strings.CutPrefix(strings.TrimSpace(line), "#EXTINF:")
+		if !found {
+			continue
+		}
+		value, _, _ = strings.Cut(value, ",")
+		duration, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment duration %q in %s: %w", value, playlistPath, err)
+		}
+		durations = append(durations, duration)
+	}
+
+	return durations, nil
+}
+
+// VerifySegmentAlignment checks that all renditions are cut into the same number of segments
+// with matching boundaries, so players can switch between them seamlessly.
+func VerifySegmentAlignment(playlists []types.TranscoderPlaylist) error {
+	if len(playlists) < 2 {
+		return nil
+	}
+
+	reference := playlists[0]
+	referenceDurations, err := ReadSegmentDurations(reference.PlaylistPath)
+	if err != nil {
+		return err
+	}
+
+	mismatches := []string{}
+	for _, playlist := range playlists[1:] {
+		durations, err := ReadSegmentDurations(playlist.PlaylistPath)
+		if err != nil {
+			return err
+		}
+
+		if len(durations) != len(referenceDurations) {
+			mismatches = append(mismatches, fmt.Sprintf("%s has %d segments but %s has %d",
+				playlist.PlaylistFilename, len(durations), reference.PlaylistFilename, len(referenceDurations)))
+			continue
+		}
+
+		// Compare where each segment ends rather than individual durations, so rounding doesn't accumulate
+		var end, referenceEnd float64
+		for i := range durations {
+			end += durations[i]
+			referenceEnd += referenceDurations[i]
+			if math.Abs(end-referenceEnd) > segmentAlignmentTolerance {
+				mismatches = append(mismatches, fmt.Sprintf("segment %d of %s ends at %.3fs but at %.3fs in %s",
+					i, playlist.PlaylistFilename, end, referenceEnd, reference.PlaylistFilename))
+				break
+			}
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("renditions are not keyframe aligned: %s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// VerifyRendition checks that an HLS media playlist is actually playable, which ffmpeg succeeding
+// doesn't guarantee for some edge inputs: it must list at least one segment, every file it refers
+// to must exist and not be empty, its segments must add up to about expectedDuration (unchecked
+// if 0, e.g. for a sliding live window) and ffprobe must find a video stream in it.
+func VerifyRendition(playlistPath string, expectedDuration float64) error {
+	durations, err := ReadSegmentDurations(playlistPath)
+	if err != nil {
+		return err
+	}
+	if len(durations) == 0 {
+		return fmt.Errorf("%s lists no segments", filepath.Base(playlistPath))
+	}
+
+	if expectedDuration > 0 {
+		total := 0.0
+		for _, duration := range durations {
+			total += duration
+		}
+		// Segments are cut at keyframes, so the total can be off by up to a segment
+		tolerance := max(float64(SegmentDuration), expectedDuration*0.02)
+		if math.Abs(total-expectedDuration) > tolerance {
+			return fmt.Errorf("segments of %s add up to %.3fs, expected about %.3fs", filepath.Base(playlistPath), total, expectedDuration)
+		}
+	}
+
+	files, err := playlistFiles(playlistPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(filepath.Dir(playlistPath), filepath.FromSlash(file)))
+		if err != nil {
+			return fmt.Errorf("%s refers to a missing file: %w", filepath.Base(playlistPath), err)
+		}
+		if info.Size() == 0 {
+			return fmt.Errorf("%s refers to the empty file %s", filepath.Base(playlistPath), file)
+		}
+	}
+
+	if _, err := DetectPlaylistResolution(playlistPath); err != nil {
+		return fmt.Errorf("%s is not readable: %w", filepath.Base(playlistPath), err)
+	}
+	return nil
+}
+
+// DetectPlaylistBitrate returns the average bitrate, in bits per second, of the rendition of an HLS
+// media playlist, from the size of its segments and their #EXTINF durations. CRF encoding spends
+// far less than the preset bitrate on simple content, so the measured rate tells players more.
+func DetectPlaylistBitrate(playlistPath string) (int, error) {
+	average, _, err := playlistBitrates(playlistPath)
+	return average, err
+}
+
+// DetectPlaylistPeakBitrate returns the bitrate, in bits per second, of the largest segment of an
+// HLS media playlist relative to its duration, which BANDWIDTH must not be exceeded by.
+func DetectPlaylistPeakBitrate(playlistPath string) (int, error) {
+	_, peak, err := playlistBitrates(playlistPath)
+	return peak, err
+}
+
+// playlistBitrates measures the average and peak segment bitrates of an HLS media playlist. The
+// init segment of fMP4 renditions is left out, as it's fetched once rather than with every segment.
+func playlistBitrates(playlistPath string) (average, peak int, err error) {
+	content, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read playlist %s: %w", playlistPath, err)
+	}
+
+	var totalBytes int64
+	var totalDuration float64
+	duration := -1.0 // Of the segment whose URI comes next, -1 until an #EXTINF is read
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if value, found := strings.CutPrefix(line, "#EXTINF:"); found {
+			value, _, _ = strings.Cut(value, ",")
+			if duration, err = strconv.ParseFloat(value, 64); err != nil {
+				return 0, 0, fmt.Errorf("invalid segment duration %q in %s: %w", value, playlistPath, err)
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || duration < 0 {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(filepath.Dir(playlistPath), filepath.FromSlash(line)))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s refers to a missing segment: %w", filepath.Base(playlistPath), err)
+		}
+		totalBytes += info.Size()
+		totalDuration += duration
+		if duration > 0 {
+			peak = max(peak, int(float64(info.Size()*8)/duration))
+		}
+		duration = -1
+	}
+
+	if totalDuration <= 0 {
+		return 0, 0, fmt.Errorf("%s lists no segments with a duration", filepath.Base(playlistPath))
+	}
+	return int(float64(totalBytes*8) / totalDuration), peak, nil
+}
+
+// playlistFiles returns the files a media playlist refers to: its segments and, for fMP4
+// segments, the init segment of its EXT-X-MAP tag.
+func playlistFiles(playlistPath string) ([]string, error) {
+	content, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playlist %s: %w", playlistPath, err)
+	}
+
+	files := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if mapTag, found := strings.CutPrefix(line, "#EXT-X-MAP:"); found {
+			if _, uri, found := strings.Cut(mapTag, `URI="`); found {
+				uri, _, _ = strings.Cut(uri, `"`)
+				files = append(files, uri)
+			}
+			continue
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
 // DetectResolution uses ffprobe to detect the resolution of a playlist file.
 func DetectPlaylistResolution(playlistPath string) (types.ResolutionPreset, error) {
-	cmd := exec.Command("ffprobe",
+	cmd := ExecCommand(context.Background(), FFPROBE_PATH,
 		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height,codec_type",
+		"-select_streams", "v",
+		"-show_entries", videoStreamEntries,
 		"-of", "json",
 		playlistPath,
 	)
@@ -77,6 +590,9 @@ func DetectPlaylistResolution(playlistPath string) (types.ResolutionPreset, erro
 
 	err := cmd.Run()
 	if err != nil {
+		if missing := MissingBinary(FFPROBE_PATH, err); missing != nil {
+			return types.ResolutionPreset{}, missing
+		}
 		return types.ResolutionPreset{}, fmt.Errorf("ffprobe command failed on playlist %s: %w, stderr: %s", playlistPath, err, stderr.String())
 	}
 
@@ -85,28 +601,263 @@ func DetectPlaylistResolution(playlistPath string) (types.ResolutionPreset, erro
 		return types.ResolutionPreset{}, fmt.Errorf("failed to parse ffprobe output for playlist %s: %w", playlistPath, err)
 	}
 
-	var width, height int
-	for _, stream := range result.Streams {
-		if stream.CodecType == "video" {
-			width = stream.Width
-			height = stream.Height
-			break
+	stream, _ := VideoStream(result)
+	width, height := stream.Width, stream.Height
+	if width == 0 || height == 0 {
+		return types.ResolutionPreset{}, fmt.Errorf("could not detect playlist resolution for %s", playlistPath)
+	}
+
+	return types.ResolutionPreset{Width: width, Height: height}, nil
+}
+
+// DetectVideoDimensions uses ffprobe to detect the width and height of a video file as displayed,
+// see VideoDimensions.
+func DetectVideoDimensions(path string) (width, height int, err error) {
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return VideoDimensions(info)
+}
+
+// VideoDimensions returns the width and height of the main video stream of a probed file as
+// displayed. Width and height are swapped for videos rotated by 90 or 270 degrees, since ffmpeg
+// rotates such videos upright while decoding them.
+func VideoDimensions(info types.FFProbeOutput) (width, height int, err error) {
+	if stream, ok := VideoStream(info); ok {
+		width = stream.Width
+		height = stream.Height
+		if rotation := StreamRotation(stream); rotation == 90 || rotation == 270 {
+			width, height = height, width
 		}
 	}
 
 	if width == 0 || height == 0 {
-		return types.ResolutionPreset{}, fmt.Errorf("could not detect playlist resolution for %s", playlistPath)
+		return 0, 0, fmt.Errorf("could not detect video resolution for %s", info.Format.Filename)
 	}
 
-	return types.ResolutionPreset{Width: width, Height: height}, nil
+	return width, height, nil
+}
+
+// DetectRotation uses ffprobe to detect how many degrees clockwise (0, 90, 180 or 270)
+// the main video stream has to be rotated to be displayed upright.
+func DetectRotation(path string) (int, error) {
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return 0, err
+	}
+	if stream, ok := VideoStream(info); ok {
+		return StreamRotation(stream), nil
+	}
+	return 0, fmt.Errorf("no video stream found in %s", path)
+}
+
+// StreamRotation returns the clockwise rotation (0, 90, 180 or 270) of a probed stream.
+// The display matrix side data takes precedence over the legacy "rotate" tag; its angle is
+// counterclockwise, so a matrix rotation of -90 is a 90 degree clockwise rotation.
+func StreamRotation(stream types.FFProbeStream) int {
+	rotation := 0
+	if tag, ok := stream.Tags["rotate"]; ok {
+		if value, err := strconv.Atoi(strings.TrimSpace(tag)); err == nil {
+			rotation = value
+		}
+	}
+	for _, sideData := range stream.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			rotation = -sideData.Rotation
+			break
+		}
+	}
+
+	// Normalize to [0, 360) and snap to a right angle
+	rotation = ((rotation % 360) + 360) % 360
+	return (rotation + 45) / 90 % 4 * 90
 }
 
 // DetectVideoResolution uses ffprobe to detect the resolution of a video file.
 func DetectVideoResolution(path string) (types.Resolutions, error) {
-	cmd := exec.Command("ffprobe",
+	width, height, err := DetectVideoDimensions(path)
+	if err != nil {
+		return 0, err
+	}
+	return MatchResolution(width, height), nil
+}
+
+// MatchResolution maps video dimensions to one of the predefined resolutions.
+// Without an exact match, e.g. for a 1920x816 cinematic crop, it picks the tallest preset that
+// isn't taller than the source, since renditions are scaled by height and shouldn't upscale it.
+// Sources shorter than every preset map to the smallest one.
+func MatchResolution(width, height int) types.Resolutions {
+	// Find the closest matching resolution in our predefined map
+	for resEnum, preset := range types.Presets() {
+		if preset.Width == width && preset.Height == height {
+			return resEnum
+		}
+	}
+
+	match := types.Resolutions(MinLadderHeight())
+	for resEnum, preset := range types.Presets() {
+		if preset.Height <= height && resEnum > match {
+			match = resEnum
+		}
+	}
+	logger.Infof("No exact resolution match found for %dx%d. Using the nearest lower preset %s.", width, height, match.String())
+	return match
+}
+
+// MinLadderHeight returns the height of the smallest predefined resolution.
+func MinLadderHeight() int {
+	minHeight := 0
+	for _, preset := range types.Presets() {
+		if minHeight == 0 || preset.Height < minHeight {
+			minHeight = preset.Height
+		}
+	}
+	return minHeight
+}
+
+// NativePreset returns a preset that keeps the source dimensions, for inputs smaller than every
+// predefined resolution. The height is rounded down to an even number as required by libx264, and
+// the bitrate is scaled from the smallest preset by pixel count.
+func NativePreset(width, height int) types.ResolutionPreset {
+	smallest := types.Presets()[types.Resolutions(MinLadderHeight())]
+	pixelRatio := float64(width*height) / float64(smallest.Width*smallest.Height)
+
+	return types.ResolutionPreset{
+		Width:   width &^ 1,
+		Height:  height &^ 1,
+		Bitrate: max(MinBitrateOverride, int(float64(smallest.Bitrate)*pixelRatio)),
+	}
+}
+
+// DetectColorTransfer uses ffprobe to read the transfer characteristics of the main video stream,
+// see ColorTransfer.
+func DetectColorTransfer(path string) (string, error) {
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return "", err
+	}
+	return ColorTransfer(info), nil
+}
+
+// ColorTransfer returns the transfer characteristics of the main video stream of a probed file,
+// e.g. "bt709", "smpte2084" (PQ) or "arib-std-b67" (HLG). It returns "" if the source doesn't declare one.
+func ColorTransfer(info types.FFProbeOutput) string {
+	stream, _ := VideoStream(info)
+	if stream.ColorTransfer == "unknown" {
+		return ""
+	}
+	return stream.ColorTransfer
+}
+
+// IsHDRTransfer reports whether a color transfer characteristic denotes HDR content.
+func IsHDRTransfer(transfer string) bool {
+	return transfer == "smpte2084" || transfer == "arib-std-b67"
+}
+
+// TonemapFilter returns the filter chain converting HDR frames to SDR BT.709 in the given pixel format.
+// Frames are linearized, tone-mapped with the Hable curve in floating point, then converted back to BT.709.
+func TonemapFilter(pixFmt string) string {
+	return "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+		"tonemap=tonemap=hable:desat=0," +
+		"zscale=t=bt709:m=bt709:r=tv,format=" + pixFmt
+}
+
+// DetectInputDuration uses ffprobe to get the duration of the input video.
+func DetectInputDuration(path string) (float64, error) {
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return 0, err
+	}
+	return InputDuration(info)
+}
+
+// InputDuration returns the duration of a probed file in seconds, as its container records it.
+func InputDuration(info types.FFProbeOutput) (float64, error) {
+	durationStr := strings.TrimSpace(info.Format.Duration)
+	duration, err := strconv.ParseFloat(durationStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse input duration '%s': %w", durationStr, err)
+	}
+	return duration, nil
+}
+
+// DetectSourceBitrate uses ffprobe to detect the bitrate of the first video stream in kbps.
+// Containers such as Matroska don't record per-stream bitrates; the video bitrate is then
+// estimated from the overall bitrate minus the known bitrates of the other streams.
+func DetectSourceBitrate(path string) (int, error) {
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return 0, err
+	}
+	return SourceBitrate(info)
+}
+
+// SourceBitrate returns the bitrate of the first video stream of a probed file in kbps, see DetectSourceBitrate.
+func SourceBitrate(info types.FFProbeOutput) (int, error) {
+	stream, ok := VideoStream(info)
+	if !ok {
+		return 0, fmt.Errorf("no video stream")
+	}
+	if bps, err := strconv.Atoi(stream.BitRate); err == nil && bps > 0 {
+		return max(bps/1000, 1), nil
+	}
+
+	bps, err := strconv.Atoi(info.Format.BitRate)
+	if err != nil || bps <= 0 {
+		return 0, fmt.Errorf("bitrate of %s is unknown", info.Format.Filename)
+	}
+	for _, other := range info.Streams {
+		if other.Index == stream.Index {
+			continue
+		}
+		if otherBps, err := strconv.Atoi(other.BitRate); err == nil && otherBps > 0 {
+			bps -= otherBps
+		}
+	}
+	if bps <= 0 {
+		return 0, fmt.Errorf("bitrate of the video in %s is unknown", info.Format.Filename)
+	}
+	return max(bps/1000, 1), nil
+}
+
+// CapBitrate limits a rendition's bitrate in kbps to the bitrate of its source, since encoding
+// above it only wastes space without adding quality. It never goes below MinBitrateOverride,
+// and a sourceKbps of 0 (unknown) leaves the bitrate as is.
+func CapBitrate(bitrate, sourceKbps int) int {
+	if sourceKbps <= 0 {
+		return bitrate
+	}
+	return min(bitrate, max(sourceKbps, MinBitrateOverride))
+}
+
+// ProbeMedia uses ffprobe to read the full stream and format information of a media file.
+// Results are cached per path until the file changes, so the several probes of a job's source
+// (validation, resolution, duration, bitrate, streams) spawn a single ffprobe process.
+func ProbeMedia(path string) (types.FFProbeOutput, error) {
+	key, cacheable := statProbeKey(path)
+	if cacheable {
+		if info, ok := probes.get(key); ok {
+			return info, nil
+		}
+	}
+
+	info, err := runProbe(path)
+	if err != nil {
+		return types.FFProbeOutput{}, err
+	}
+	if cacheable {
+		probes.put(key, info)
+	}
+	return info, nil
+}
+
+// runProbe runs ffprobe on path, bypassing the cache.
+func runProbe(path string) (types.FFProbeOutput, error) {
+	cmd := ExecCommand(context.Background(), FFPROBE_PATH,
 		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height,codec_type",
+		"-show_streams",
+		"-show_format",
 		"-of", "json",
 		path,
 	)
@@ -117,76 +868,309 @@ func DetectVideoResolution(path string) (types.Resolutions, error) {
 
 	err := cmd.Run()
 	if err != nil {
-		return 0, fmt.Errorf("ffprobe command failed: %w, stderr: %s", err, stderr.String())
+		if missing := MissingBinary(FFPROBE_PATH, err); missing != nil {
+			return types.FFProbeOutput{}, missing
+		}
+		return types.FFProbeOutput{}, fmt.Errorf("ffprobe command failed on %s: %w, stderr: %s", path, err, stderr.String())
 	}
 
 	var result types.FFProbeOutput
 	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
-		return 0, fmt.Errorf("failed to parse ffprobe output: %w", err)
+		return types.FFProbeOutput{}, fmt.Errorf("failed to parse ffprobe output for %s: %w", path, err)
 	}
 
-	var width, height int
-	for _, stream := range result.Streams {
-		if stream.CodecType == "video" {
-			width = stream.Width
-			height = stream.Height
-			break
+	return result, nil
+}
+
+// VideoStream returns the main video stream of a probed file. Cover art is stored as a video
+// stream flagged attached_pic, often ahead of the real video, so such streams and streams without
+// dimensions are passed over, and the largest of the rest is picked, preferring even dimensions.
+// If no stream qualifies, the first video stream is returned.
+func VideoStream(info types.FFProbeOutput) (types.FFProbeStream, bool) {
+	var best, first *types.FFProbeStream
+	for i := range info.Streams {
+		stream := &info.Streams[i]
+		if stream.CodecType != "video" {
+			continue
+		}
+		if first == nil {
+			first = stream
+		}
+		if stream.Disposition["attached_pic"] == 1 || stream.Width <= 0 || stream.Height <= 0 {
+			continue
+		}
+		if best == nil || betterVideoStream(*stream, *best) {
+			best = stream
 		}
 	}
 
-	if width == 0 || height == 0 {
-		return 0, fmt.Errorf("could not detect video resolution for %s", path)
+	switch {
+	case best != nil:
+		return *best, true
+	case first != nil:
+		return *first, true
+	default:
+		return types.FFProbeStream{}, false
 	}
+}
 
-	// Find the closest matching resolution in our predefined map
-	for resEnum, preset := range types.RESOLUTIONS {
-		if preset.Width == width && preset.Height == height {
-			return resEnum, nil
-		}
+// betterVideoStream reports whether a is a better main video stream than b: even dimensions,
+// which every encoder accepts, win over odd ones, then the larger picture wins.
+func betterVideoStream(a, b types.FFProbeStream) bool {
+	aEven := a.Width%2 == 0 && a.Height%2 == 0
+	bEven := b.Width%2 == 0 && b.Height%2 == 0
+	if aEven != bEven {
+		return aEven
 	}
+	return a.Width*a.Height > b.Width*b.Height
+}
 
-	// Default to P720 if no exact match is found
-	log.Printf("No exact resolution match found for %dx%d. Defaulting to P720.", width, height)
-	return types.P720, nil
+// videoStreamEntries are the ffprobe entries VideoStream needs to pick the main video stream.
+const videoStreamEntries = "stream=index,width,height,codec_type:stream_disposition=attached_pic"
+
+// DenoiseStrengths maps the named strengths of the denoise option to hqdn3d's luma strength.
+var DenoiseStrengths = map[string]float64{
+	"light":  2,
+	"medium": 4, // hqdn3d's own default
+	"strong": 8,
 }
 
-// DetectInputDuration uses ffprobe to get the duration of the input video.
-func DetectInputDuration(path string) (float64, error) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		path,
-	)
+// MaxDenoise is the highest denoise strength accepted; stronger settings smear any detail away.
+const MaxDenoise = 20.0
 
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, fmt.Errorf("failed to detect input duration: %w", err)
+// ParseDenoise parses a denoise strength, either one of DenoiseStrengths or a number in (0, MaxDenoise].
+func ParseDenoise(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if strength, ok := DenoiseStrengths[value]; ok {
+		return strength, nil
 	}
 
-	durationStr := strings.TrimSpace(string(output))
-	duration, err := strconv.ParseFloat(durationStr, 64)
+	strength, err := strconv.ParseFloat(value, 64)
+	if err != nil || strength <= 0 || strength > MaxDenoise {
+		return 0, fmt.Errorf("denoise must be light, medium, strong or a strength between 0 and %g, got %q", MaxDenoise, value)
+	}
+	return strength, nil
+}
+
+// IsInterlaced reports whether ffprobe found a video stream to be interlaced. Many files don't
+// record their field order at all, which counts as progressive.
+func IsInterlaced(stream types.FFProbeStream) bool {
+	switch stream.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true
+	}
+	return false
+}
+
+// DetectInterlaced uses ffprobe to check whether the main video stream of the file at path is interlaced.
+func DetectInterlaced(path string) (bool, error) {
+	info, err := ProbeMedia(path)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse input duration '%s': %w", durationStr, err)
+		return false, err
 	}
-	return duration, nil
+	stream, ok := VideoStream(info)
+	if !ok {
+		return false, fmt.Errorf("no video stream found in %s", path)
+	}
+	return IsInterlaced(stream), nil
 }
 
-// GetTargetResolutions returns a list of available resolutions that are less than or equal to the provided resolution.
-// It filters out resolutions that have a width or height of 0.
-func GetTargetResolutions(resolution types.Resolutions) []types.Resolutions {
+// InputFilters returns the filters that normalize a video stream before it is scaled: interlaced
+// sources (common in MPEG-2 and VC-1 broadcast captures) are deinterlaced as deinterlace asks,
+// noise is reduced with hqdn3d if denoise is positive, and anamorphic sources (non-square pixels,
+// as on DVDs) are resampled to square pixels so the scaled output keeps the intended display
+// aspect ratio. Denoising comes after deinterlacing, which would otherwise mix up the fields.
+func InputFilters(stream types.FFProbeStream, deinterlace types.DeinterlaceMode, denoise float64) []string {
+	filters := []string{}
+
+	switch {
+	case deinterlace == types.DeinterlaceOn:
+		filters = append(filters, "yadif=mode=send_frame:deint=all")
+	case deinterlace == types.DeinterlaceAuto && IsInterlaced(stream):
+		// Only frames flagged as interlaced are touched, so mixed content stays intact
+		filters = append(filters, "yadif=mode=send_frame:deint=interlaced")
+	}
+
+	if denoise > 0 {
+		// The chroma and temporal strengths follow from the luma one
+		filters = append(filters, "hqdn3d="+strconv.FormatFloat(denoise, 'f', -1, 64))
+	}
+
+	switch stream.SampleAspect {
+	case "", "1:1", "0:1", "N/A":
+	default:
+		filters = append(filters, "scale=trunc(iw*sar/2)*2:ih", "setsar=1")
+	}
+
+	return filters
+}
+
+// CanStreamCopy reports whether a probed source already matches the smallest rendition profile
+// closely enough to be segmented with stream copy instead of being re-encoded: H.264 video in the
+// requested pixel format no taller than the smallest preset, upright, with square progressive
+// pixels, and AAC audio if any. Otherwise it also returns why the source has to be re-encoded.
+func CanStreamCopy(info types.FFProbeOutput, height, rotation int, pixFmt string) (bool, string) {
+	video, ok := VideoStream(info)
+	switch {
+	case !ok:
+		return false, "no video stream"
+	case video.CodecName != "h264":
+		return false, fmt.Sprintf("video codec is %s, not h264", video.CodecName)
+	case video.PixFmt != pixFmt:
+		return false, fmt.Sprintf("pixel format is %s, not %s", video.PixFmt, pixFmt)
+	case height > MinLadderHeight():
+		return false, fmt.Sprintf("height %d is above the smallest preset", height)
+	case rotation != 0:
+		return false, "video is rotated"
+	case len(InputFilters(video, types.DeinterlaceAuto, 0)) > 0:
+		return false, "video is interlaced or anamorphic"
+	}
+
+	for _, stream := range info.Streams {
+		if stream.CodecType == "audio" && stream.CodecName != "aac" {
+			return false, fmt.Sprintf("audio codec is %s, not aac", stream.CodecName)
+		}
+	}
+	return true, ""
+}
+
+// GetTargetResolutions returns the available resolutions that are less than or equal to the provided resolution,
+// highest first. It filters out resolutions that have a width or height of 0, and those taller than
+// MAX_OUTPUT_HEIGHT or maxHeight (either 0 meaning no limit).
+// If maxRenditions is positive and the ladder is longer, it is thinned evenly down to maxRenditions
+// entries, always keeping the highest and, with room for more than one, the lowest resolution.
+func GetTargetResolutions(resolution types.Resolutions, maxRenditions, maxHeight int) []types.Resolutions {
+	if MAX_OUTPUT_HEIGHT > 0 && (maxHeight <= 0 || maxHeight > MAX_OUTPUT_HEIGHT) {
+		maxHeight = MAX_OUTPUT_HEIGHT
+	}
+
 	availableResolutions := []types.Resolutions{}
-	for res, preset := range types.RESOLUTIONS {
+	for res, preset := range types.Presets() {
+		if maxHeight > 0 && preset.Height > maxHeight {
+			continue
+		}
 		if res <= resolution && preset.Width > 0 && preset.Height > 0 {
 			availableResolutions = append(availableResolutions, res)
 		}
 	}
-	return availableResolutions
+	slices.SortFunc(availableResolutions, func(a, b types.Resolutions) int { return int(b - a) })
+
+	if maxRenditions <= 0 || len(availableResolutions) <= maxRenditions {
+		return availableResolutions
+	}
+	if maxRenditions == 1 {
+		return availableResolutions[:1]
+	}
+
+	// Pick evenly spaced rungs, rounding to the nearest index
+	last := len(availableResolutions) - 1
+	thinned := make([]types.Resolutions, 0, maxRenditions)
+	for i := range maxRenditions {
+		index := (i*last*2 + maxRenditions - 1) / (2 * (maxRenditions - 1))
+		thinned = append(thinned, availableResolutions[index])
+	}
+	return thinned
+}
+
+// GetOutputDirectory returns the output directory path for a given task ID. (e.g., /output/<task-id>)
+func GetOutputDirectory(taskID string) string {
+	return filepath.Join(OUTPUT_DIR, taskID)
+}
+
+// ArchiveSource moves a task's source file into SOURCE_ARCHIVE_DIR, named after the task ID,
+// and returns its new path.
+func ArchiveSource(taskID, sourcePath string) (string, error) {
+	archivedPath := filepath.Join(SOURCE_ARCHIVE_DIR, taskID+strings.ToLower(filepath.Ext(sourcePath)))
+	if err := os.Rename(sourcePath, archivedPath); err != nil {
+		return "", fmt.Errorf("failed to archive source %s: %w", sourcePath, err)
+	}
+	return archivedPath, nil
+}
+
+// FindArchivedSource returns the path of the source kept for taskID by ArchiveSource.
+// It returns an error wrapping os.ErrNotExist if no source was kept.
+func FindArchivedSource(taskID string) (string, error) {
+	// Task IDs are UUIDs; anything else could escape the archive directory or match other files
+	if err := uuid.Validate(taskID); err != nil {
+		return "", fmt.Errorf("invalid task ID %q: %w", taskID, os.ErrNotExist)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(SOURCE_ARCHIVE_DIR, taskID+".*"))
+	if err != nil {
+		return "", err
+	}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+			return match, nil
+		}
+	}
+	return "", fmt.Errorf("no kept source for task %s: %w", taskID, os.ErrNotExist)
+}
+
+// FindOutputArchive returns the path of the zip archive produced for taskID.
+// It returns an error wrapping os.ErrNotExist if the task ID is malformed or has no archive.
+func FindOutputArchive(taskID string) (string, error) {
+	// Task IDs are UUIDs; anything else could escape the output directory
+	if err := uuid.Validate(taskID); err != nil {
+		return "", fmt.Errorf("invalid task ID %q: %w", taskID, os.ErrNotExist)
+	}
+
+	archivePath := GetOutputDirectory(taskID) + ".zip"
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("no archive for task %s: %w", taskID, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("no archive for task %s: %w", taskID, os.ErrNotExist)
+	}
+	return archivePath, nil
+}
+
+// RemoveOutputArchive removes the zip archive produced for a given task ID, if there is one.
+func RemoveOutputArchive(taskID string) error {
+	archivePath := GetOutputDirectory(taskID) + ".zip"
+	if err := os.Remove(archivePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove archive %s: %w", archivePath, err)
+	}
+	return nil
+}
+
+// RemoveExpiredOutputs removes the task archives and unzipped output folders in OUTPUT_DIR last
+// modified more than ttl ago, e.g. those left behind by a previous run, and returns how many were
+// removed. It must not run while tasks are writing their output.
+func RemoveExpiredOutputs(ttl time.Duration) (int, error) {
+	entries, err := os.ReadDir(OUTPUT_DIR)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		// Only archives and folders named after a task are managed here
+		name := entry.Name()
+		if entry.IsDir() {
+			if uuid.Validate(name) != nil {
+				continue
+			}
+		} else if !entry.Type().IsRegular() || !strings.HasSuffix(name, ".zip") || uuid.Validate(strings.TrimSuffix(name, ".zip")) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+		outputPath := filepath.Join(OUTPUT_DIR, name)
+		if err := os.RemoveAll(outputPath); err != nil {
+			return removed, fmt.Errorf("failed to remove expired output %s: %w", outputPath, err)
+		}
+		removed++
+	}
+	return removed, nil
 }
 
 // RemoveOutputDirectory removes the output directory for a given task ID.
 func RemoveOutputDirectory(taskID string) error {
-	outputDir := filepath.Join(OUTPUT_DIR, taskID)
+	outputDir := GetOutputDirectory(taskID)
 	if err := os.RemoveAll(outputDir); err != nil {
 		return fmt.Errorf("failed to remove output directory %s: %w", outputDir, err)
 	}
@@ -196,14 +1180,106 @@ func RemoveOutputDirectory(taskID string) error {
 
 // CreateOutputDirectory creates an output directory for a given task ID. (e.g., /output/<task-id>)
 // It returns the path to the created directory or an error if it fails.
+// Calling it again for an existing directory is a no-op and returns the same path.
 func CreateOutputDirectory(taskID string) (string, error) {
-	outputDir := filepath.Join(OUTPUT_DIR, taskID)
+	outputDir := GetOutputDirectory(taskID)
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create output directory %s: %w", outputDir, err)
 	}
 	return outputDir, nil
 }
 
+// DirSize returns the total size in bytes of all files under path.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Segments may be renamed or removed by ffmpeg while we walk
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure size of %s: %w", path, err)
+	}
+	return size, nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it into place, so a
+// reader of path (e.g. a player polling a playlist) sees either the old or the complete new
+// contents, never a partly written file. The rename is only atomic within a filesystem, which
+// holds as both files are in the same directory.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm) // CreateTemp creates files readable by the owner only
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// BuildOutputManifest lists every file under the given output folder with its size.
+// Files inside a resolution sub-folder (e.g. 720P/) are tagged with that resolution.
+func BuildOutputManifest(outputFolder string) ([]types.OutputFile, error) {
+	files := []types.OutputFile{}
+
+	err := filepath.Walk(outputFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(outputFolder, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		resolution := ""
+		if dir, _, found := strings.Cut(relPath, "/"); found && dir != SubtitlesFolder && dir != AudioTracksFolder {
+			resolution = dir
+		}
+
+		files = append(files, types.OutputFile{
+			Path:       relPath,
+			Size:       info.Size(),
+			Resolution: resolution,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build output manifest for %s: %w", outputFolder, err)
+	}
+
+	return files, nil
+}
+
 // ZipOutputFolder creates a zip archive from a source directory.
 func ZipOutputFolder(srcPath string, destZipPath string) error {
 	zipFile, err := os.Create(destZipPath)
@@ -212,10 +1288,15 @@ func ZipOutputFolder(srcPath string, destZipPath string) error {
 	}
 	defer zipFile.Close()
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	return WriteZip(zipFile, srcPath)
+}
+
+// WriteZip writes a zip archive of every file under srcPath to w as it goes, so it can stream an
+// archive that was never written to disk. Entries are the same as ZipOutputFolder writes.
+func WriteZip(w io.Writer, srcPath string) error {
+	zipWriter := zip.NewWriter(w)
 
-	return filepath.Walk(srcPath, func(filePath string, info os.FileInfo, err error) error {
+	err := filepath.Walk(srcPath, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -233,7 +1314,7 @@ func ZipOutputFolder(srcPath string, destZipPath string) error {
 		if err != nil {
 			return err
 		}
-		zipFileHeader.Name = relPath
+		zipFileHeader.Name = filepath.ToSlash(relPath)
 		zipFileHeader.Method = zip.Deflate // Use compression
 
 		writer, err := zipWriter.CreateHeader(zipFileHeader)
@@ -250,4 +1331,8 @@ func ZipOutputFolder(srcPath string, destZipPath string) error {
 		_, err = io.Copy(writer, fileToZip)
 		return err
 	})
+	if err != nil {
+		return err
+	}
+	return zipWriter.Close() // Writes the central directory
 }
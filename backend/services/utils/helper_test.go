@@ -0,0 +1,743 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+	"github.com/google/uuid"
+)
+
+// useOutputDir points OUTPUT_DIR at a fresh temporary directory for the duration of the test.
+func useOutputDir(t *testing.T) string {
+	t.Helper()
+	previous := OUTPUT_DIR
+	OUTPUT_DIR = t.TempDir()
+	t.Cleanup(func() { OUTPUT_DIR = previous })
+	return OUTPUT_DIR
+}
+
+// age sets the modification time of path to ago in the past.
+func age(t *testing.T, path string, ago time.Duration) {
+	t.Helper()
+	then := time.Now().Add(-ago)
+	if err := os.Chtimes(path, then, then); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseProgressBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  types.FFmpegProgress
+	}{
+		{
+			name: "complete block",
+			block: "frame=240\nfps=48.00\nbitrate=2048.5kbits/s\nout_time_us=10000000\n" +
+				"out_time=00:00:10.000000\nspeed=2.01x\nprogress=continue\n",
+			want: types.FFmpegProgress{Frame: "240", FPS: "48.00", Bitrate: "2048.5", Speed: "2.01", Time: "00:00:10.000000", OutTime: 10},
+		},
+		{
+			name:  "final block",
+			block: "frame=300\nout_time_us=12500000\nout_time=00:00:12.500000\nprogress=end\n",
+			want:  types.FFmpegProgress{Frame: "300", Time: "00:00:12.500000", OutTime: 12.5, Done: true},
+		},
+		{
+			name:  "N/A before the first frame",
+			block: "frame=0\nfps=0.00\nbitrate=N/A\nout_time_us=N/A\nout_time=N/A\nspeed=N/A\nprogress=continue\n",
+			want:  types.FFmpegProgress{Frame: "0", FPS: "0.00"},
+		},
+		{
+			name:  "negative position",
+			block: "out_time_us=-23220\nout_time=-00:00:00.023220\nprogress=continue\n",
+			want:  types.FFmpegProgress{},
+		},
+		{
+			name:  "negative and malformed rates",
+			block: "frame=-1\nfps=abc\nbitrate=-5kbits/s\nspeed=NaNx\nout_time_us=1000000\nprogress=continue\n",
+			want:  types.FFmpegProgress{OutTime: 1},
+		},
+		{
+			name:  "infinite speed",
+			block: "speed=+Infx\nout_time_us=500000\nprogress=continue\n",
+			want:  types.FFmpegProgress{OutTime: 0.5},
+		},
+		{
+			name:  "only out_time, as older builds report",
+			block: "out_time=00:01:02.500000\nprogress=continue\n",
+			want:  types.FFmpegProgress{Time: "00:01:02.500000", OutTime: 62.5},
+		},
+		{
+			name:  "malformed out_time",
+			block: "out_time=00:xx:02\nprogress=continue\n",
+			want:  types.FFmpegProgress{},
+		},
+		{
+			name:  "partial block without terminator",
+			block: "frame=12\nfps=24",
+			want:  types.FFmpegProgress{Frame: "12", FPS: "24"},
+		},
+		{
+			name:  "CRLF line endings and padding",
+			block: "frame= 60\r\nspeed= 1.5x \r\nout_time_us=2000000\r\nprogress=continue\r\n",
+			want:  types.FFmpegProgress{Frame: "60", Speed: "1.5", OutTime: 2},
+		},
+		{
+			name:  "lines without a value",
+			block: "garbage\n=\nframe\nprogress=continue\n",
+			want:  types.FFmpegProgress{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseProgressBlock(tt.block); got != tt.want {
+				t.Errorf("ParseProgressBlock(%q) = %+v, want %+v", tt.block, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProgressBlockRates(t *testing.T) {
+	// Blocks as written by ffmpeg 6.1 with -progress pipe:1, before and after the first frame
+	first := "frame=0\nfps=0.0\nstream_0_0_q=0.0\nbitrate=N/A\ntotal_size=48\nout_time_us=N/A\nout_time_ms=N/A\n" +
+		"out_time=N/A\ndup_frames=0\ndrop_frames=0\nspeed=N/A\nprogress=continue\n"
+	later := "frame=157\nfps=62.61\nstream_0_0_q=29.0\nbitrate=1283.4kbits/s\ntotal_size=851968\nout_time_us=5310000\n" +
+		"out_time_ms=5310000\nout_time=00:00:05.310000\ndup_frames=0\ndrop_frames=0\nspeed=2.12x\nprogress=continue\n"
+
+	if got := ParseProgressBlock(first); got.FPS != "0.0" || got.Bitrate != "" || got.Speed != "" || got.Time != "" {
+		t.Errorf("first block = %+v, want fps 0.0 and no bitrate, speed or time", got)
+	}
+	want := types.FFmpegProgress{Frame: "157", FPS: "62.61", Bitrate: "1283.4", Speed: "2.12", Time: "00:00:05.310000", OutTime: 5.31}
+	if got := ParseProgressBlock(later); got != want {
+		t.Errorf("later block = %+v, want %+v", got, want)
+	}
+}
+
+func FuzzParseProgressBlock(f *testing.F) {
+	f.Add("frame=240\nfps=48.00\nbitrate=2048.5kbits/s\nout_time_us=10000000\nout_time=00:00:10.000000\nspeed=2.01x\nprogress=continue\n")
+	f.Add("frame=0\nbitrate=N/A\nout_time_us=N/A\nout_time=N/A\nspeed=N/A\nprogress=continue\n")
+	f.Add("out_time_us=-23220\nout_time=-00:00:00.023220\nprogress=end\n")
+	f.Add("out_time=99:99:99.99\nspeed=1e400x\n")
+	f.Add("frame=")
+
+	f.Fuzz(func(t *testing.T, block string) {
+		progress := ParseProgressBlock(block)
+
+		if progress.OutTime < 0 || math.IsNaN(progress.OutTime) || math.IsInf(progress.OutTime, 0) {
+			t.Fatalf("OutTime = %v from %q", progress.OutTime, block)
+		}
+		if strings.HasPrefix(progress.Time, "-") {
+			t.Fatalf("negative Time %q from %q", progress.Time, block)
+		}
+		for field, value := range map[string]string{"FPS": progress.FPS, "Bitrate": progress.Bitrate, "Speed": progress.Speed} {
+			if value != "" && progressRate(value) == "" {
+				t.Fatalf("%s = %q from %q", field, value, block)
+			}
+		}
+		if percent, ok := ProgressPercent(progress.OutTime, 60); ok && (percent < 0 || percent > 100) {
+			t.Fatalf("ProgressPercent(%v, 60) = %v", progress.OutTime, percent)
+		}
+	})
+}
+
+func TestRemoveExpiredOutputs(t *testing.T) {
+	outputDir := useOutputDir(t)
+
+	expiredArchive := filepath.Join(outputDir, uuid.NewString()+".zip")
+	freshArchive := filepath.Join(outputDir, uuid.NewString()+".zip")
+	expiredFolder := filepath.Join(outputDir, uuid.NewString())
+	freshFolder := filepath.Join(outputDir, uuid.NewString())
+	unmanagedFolder := filepath.Join(outputDir, "keep-me")
+	unmanagedArchive := filepath.Join(outputDir, "keep-me.zip")
+
+	for _, path := range []string{expiredArchive, freshArchive, unmanagedArchive} {
+		if err := os.WriteFile(path, []byte("zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{expiredFolder, freshFolder, unmanagedFolder} {
+		if err := os.MkdirAll(filepath.Join(path, "720P"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "main.m3u8"), []byte("#EXTM3U\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{expiredArchive, expiredFolder, unmanagedFolder, unmanagedArchive} {
+		age(t, path, 2*time.Hour)
+	}
+
+	removed, err := RemoveExpiredOutputs(time.Hour)
+	if err != nil {
+		t.Fatalf("RemoveExpiredOutputs: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("removed = %d, want 2", removed)
+	}
+	for _, path := range []string{expiredArchive, expiredFolder} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", filepath.Base(path))
+		}
+	}
+	for _, path := range []string{freshArchive, freshFolder, unmanagedFolder, unmanagedArchive} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestInputFilters(t *testing.T) {
+	progressive := types.FFProbeStream{FieldOrder: "progressive", SampleAspect: "1:1"}
+	interlaced := types.FFProbeStream{FieldOrder: "tt", SampleAspect: "1:1"}
+	anamorphic := types.FFProbeStream{FieldOrder: "bb", SampleAspect: "64:45"}
+
+	tests := []struct {
+		name        string
+		stream      types.FFProbeStream
+		deinterlace types.DeinterlaceMode
+		denoise     float64
+		want        []string
+	}{
+		{name: "progressive", stream: progressive, deinterlace: types.DeinterlaceAuto, want: []string{}},
+		{name: "interlaced", stream: interlaced, deinterlace: types.DeinterlaceAuto, want: []string{"yadif=mode=send_frame:deint=interlaced"}},
+		{name: "interlaced with deinterlacing off", stream: interlaced, deinterlace: types.DeinterlaceOff, want: []string{}},
+		{name: "forced on progressive", stream: progressive, deinterlace: types.DeinterlaceOn, want: []string{"yadif=mode=send_frame:deint=all"}},
+		{name: "denoise", stream: progressive, deinterlace: types.DeinterlaceAuto, denoise: 4, want: []string{"hqdn3d=4"}},
+		{
+			name: "denoise after deinterlacing, before square pixels", stream: anamorphic, deinterlace: types.DeinterlaceAuto, denoise: 1.5,
+			want: []string{"yadif=mode=send_frame:deint=interlaced", "hqdn3d=1.5", "scale=trunc(iw*sar/2)*2:ih", "setsar=1"},
+		},
+		{name: "unknown aspect", stream: types.FFProbeStream{SampleAspect: "0:1"}, deinterlace: types.DeinterlaceAuto, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := InputFilters(tt.stream, tt.deinterlace, tt.denoise); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("InputFilters = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectInterlaced(t *testing.T) {
+	for fixture, want := range map[string]bool{"ts_mpeg2_interlaced": true, "upright": false} {
+		t.Run(fixture, func(t *testing.T) {
+			fakeProbe(t, fixture)
+			if interlaced, err := DetectInterlaced(sourceFile(t, "source.mp4")); err != nil || interlaced != want {
+				t.Errorf("DetectInterlaced = %t, %v, want %t", interlaced, err, want)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.m3u8")
+
+	if err := os.WriteFile(path, []byte("old contents, longer than the new ones"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("#EXTM3U\n"), 0644); err != nil {
+		t.Fatalf("WriteFileAtomic: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "#EXTM3U\n" {
+		t.Errorf("contents = %q, %v; want the new playlist only", data, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0644 {
+		t.Errorf("permissions = %v, want 0644", perm)
+	}
+	assertOnlyFiles(t, dir, "index.m3u8")
+}
+
+func TestWriteFileAtomicRemovesTempFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	// Renaming a file over a non-empty directory fails, even for root.
+	path := filepath.Join(dir, "index.m3u8")
+	if err := os.MkdirAll(filepath.Join(path, "segment"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, []byte("#EXTM3U\n"), 0644); err == nil {
+		t.Fatal("WriteFileAtomic replaced a directory")
+	}
+	assertOnlyFiles(t, dir, "index.m3u8")
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "index.m3u8"), nil, 0644); err == nil {
+		t.Error("WriteFileAtomic wrote into a missing directory")
+	}
+}
+
+// assertOnlyFiles fails the test if dir holds anything but the named entries, e.g. a leftover temp file.
+func assertOnlyFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("%s holds %v, want %v", dir, got, names)
+	}
+}
+
+func TestCreateAndRemoveOutputDirectory(t *testing.T) {
+	outputDir := useOutputDir(t)
+	taskID := uuid.NewString()
+
+	path, err := CreateOutputDirectory(taskID)
+	if err != nil {
+		t.Fatalf("CreateOutputDirectory: %v", err)
+	}
+	if want := filepath.Join(outputDir, taskID); path != want || path != GetOutputDirectory(taskID) {
+		t.Errorf("CreateOutputDirectory = %q, want %q", path, want)
+	}
+	if err := os.WriteFile(filepath.Join(path, "index.m3u8"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second call keeps what is already there
+	if again, err := CreateOutputDirectory(taskID); err != nil || again != path {
+		t.Fatalf("CreateOutputDirectory again = %q, %v", again, err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "index.m3u8")); err != nil {
+		t.Errorf("existing output was lost: %v", err)
+	}
+
+	if err := RemoveOutputDirectory(taskID); err != nil {
+		t.Fatalf("RemoveOutputDirectory: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("output directory still exists: %v", err)
+	}
+}
+
+func TestArchiveSource(t *testing.T) {
+	previous := SOURCE_ARCHIVE_DIR
+	SOURCE_ARCHIVE_DIR = t.TempDir()
+	t.Cleanup(func() { SOURCE_ARCHIVE_DIR = previous })
+	taskID := uuid.NewString()
+
+	if _, err := FindArchivedSource(taskID); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("FindArchivedSource before archiving = %v, want os.ErrNotExist", err)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "upload.MP4")
+	if err := os.WriteFile(sourcePath, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivedPath, err := ArchiveSource(taskID, sourcePath)
+	if err != nil {
+		t.Fatalf("ArchiveSource: %v", err)
+	}
+	if want := filepath.Join(SOURCE_ARCHIVE_DIR, taskID+".mp4"); archivedPath != want {
+		t.Errorf("ArchiveSource = %q, want %q", archivedPath, want)
+	}
+	if _, err := os.Stat(sourcePath); !os.IsNotExist(err) {
+		t.Errorf("source still exists after archiving: %v", err)
+	}
+	if data, err := os.ReadFile(archivedPath); err != nil || string(data) != "source" {
+		t.Errorf("archived source = %q, %v", data, err)
+	}
+
+	if found, err := FindArchivedSource(taskID); err != nil || found != archivedPath {
+		t.Errorf("FindArchivedSource = %q, %v, want %q", found, err, archivedPath)
+	}
+	if _, err := FindArchivedSource(uuid.NewString()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("FindArchivedSource of another task = %v, want os.ErrNotExist", err)
+	}
+	if _, err := FindArchivedSource("../" + taskID); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("FindArchivedSource of a malformed ID = %v, want os.ErrNotExist", err)
+	}
+
+	// A source that is already gone can't be archived
+	if _, err := ArchiveSource(uuid.NewString(), sourcePath); err == nil {
+		t.Error("ArchiveSource of a missing file succeeded")
+	}
+}
+
+func TestParseBitrateOverrides(t *testing.T) {
+	overrides, err := ParseBitrateOverrides(`{"1080P":5000,"720p":1,"480":900000}`)
+	if err != nil {
+		t.Fatalf("ParseBitrateOverrides: %v", err)
+	}
+	want := map[types.Resolutions]int{
+		types.P1080: 5000,
+		types.P720:  MinBitrateOverride,
+		types.P480:  MaxBitrateOverride,
+	}
+	if !reflect.DeepEqual(overrides, want) {
+		t.Errorf("ParseBitrateOverrides = %v, want %v", overrides, want)
+	}
+
+	if overrides, err := ParseBitrateOverrides("  "); err != nil || len(overrides) != 0 {
+		t.Errorf("ParseBitrateOverrides(blank) = %v, %v; want no overrides", overrides, err)
+	}
+
+	for _, raw := range []string{`[5000]`, `{"1080P":"fast"}`, `{"999P":3000}`, `{"720P":0}`, `{"720P":-300}`} {
+		if _, err := ParseBitrateOverrides(raw); err == nil {
+			t.Errorf("ParseBitrateOverrides accepted %s", raw)
+		}
+	}
+}
+
+func TestVBVRates(t *testing.T) {
+	previousMaxrate, previousBufsize := MAXRATE_FACTOR, BUFSIZE_FACTOR
+	t.Cleanup(func() { MAXRATE_FACTOR, BUFSIZE_FACTOR = previousMaxrate, previousBufsize })
+
+	tests := []struct {
+		maxrateFactor, bufsizeFactor float64
+		bitrate, maxrate, bufsize    int
+	}{
+		{maxrateFactor: 1.07, bufsizeFactor: 1.5, bitrate: 4000, maxrate: 4280, bufsize: 6000},
+		{maxrateFactor: 1.07, bufsizeFactor: 1.5, bitrate: 1001, maxrate: 1071, bufsize: 1502},
+		{maxrateFactor: 1, bufsizeFactor: 2, bitrate: 2500, maxrate: 2500, bufsize: 5000},
+	}
+	for _, tt := range tests {
+		MAXRATE_FACTOR, BUFSIZE_FACTOR = tt.maxrateFactor, tt.bufsizeFactor
+		maxrate, bufsize := VBVRates(tt.bitrate)
+		if maxrate != tt.maxrate || bufsize != tt.bufsize {
+			t.Errorf("VBVRates(%d) with factors %v/%v = %d, %d; want %d, %d",
+				tt.bitrate, tt.maxrateFactor, tt.bufsizeFactor, maxrate, bufsize, tt.maxrate, tt.bufsize)
+		}
+	}
+}
+
+func TestGetEnvFloat(t *testing.T) {
+	for raw, want := range map[string]float64{"": 1.5, "2.25": 2.25, "0": 1.5, "-1": 1.5, "fast": 1.5} {
+		t.Setenv("TEST_FACTOR", raw)
+		if got := GetEnvFloat("TEST_FACTOR", 1.5); got != want {
+			t.Errorf("GetEnvFloat(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func TestNativePreset(t *testing.T) {
+	if got := MinLadderHeight(); got != 360 {
+		t.Fatalf("MinLadderHeight = %d, want 360", got)
+	}
+
+	tests := []struct {
+		width, height int
+		want          types.ResolutionPreset
+	}{
+		{width: 320, height: 240, want: types.ResolutionPreset{Width: 320, Height: 240, Bitrate: 333}},
+		{width: 177, height: 145, want: types.ResolutionPreset{Width: 176, Height: 144, Bitrate: MinBitrateOverride}},
+		{width: 640, height: 358, want: types.ResolutionPreset{Width: 640, Height: 358, Bitrate: 994}},
+	}
+	for _, tt := range tests {
+		if got := NativePreset(tt.width, tt.height); got != tt.want {
+			t.Errorf("NativePreset(%d, %d) = %+v, want %+v", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for value, want := range map[string]float64{
+		"90":          90,
+		" 90.5 ":      90.5,
+		"01:30":       90,
+		"00:01:30.5":  90.5,
+		"1:00:00":     3600,
+		"0":           0,
+		"00:00:00.25": 0.25,
+	} {
+		if got, err := ParseTimestamp(value); err != nil || got != want {
+			t.Errorf("ParseTimestamp(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "-5", "1:2:3:4", "ab:30", "01:-30", "Inf", "NaN", "1::2"} {
+		if got, err := ParseTimestamp(value); err == nil {
+			t.Errorf("ParseTimestamp(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestTrimmedDuration(t *testing.T) {
+	tests := []struct {
+		duration, start, end, want float64
+	}{
+		{duration: 60, want: 60},                     // Not trimmed
+		{duration: 60, start: 10, want: 50},          // Up to the end of the input
+		{duration: 60, start: 10, end: 25, want: 15}, // Both offsets
+		{duration: 60, start: 10, end: 90, want: 50}, // End past the input
+		{duration: 60, start: 70, want: 0},           // Start past the input
+	}
+	for _, tt := range tests {
+		if got := TrimmedDuration(tt.duration, tt.start, tt.end); got != tt.want {
+			t.Errorf("TrimmedDuration(%v, %v, %v) = %v, want %v", tt.duration, tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	if got := FormatSeconds(90.5); got != "90.500" {
+		t.Errorf("FormatSeconds(90.5) = %q, want 90.500", got)
+	}
+}
+
+func TestMatchResolution(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          types.Resolutions
+	}{
+		{width: 1920, height: 1080, want: types.P1080}, // Exact
+		{width: 1920, height: 816, want: types.P720},   // 2.35:1 crop of 1080p
+		{width: 1280, height: 536, want: types.P480},   // 2.39:1 crop of 720p
+		{width: 3840, height: 1600, want: types.P1440},
+		{width: 4096, height: 2160, want: types.P2160}, // DCI 4K, wider than the preset
+		{width: 1440, height: 1080, want: types.P1080}, // 4:3 at 1080 lines
+		{width: 640, height: 352, want: types.P360},    // Below every preset keeps the smallest
+	}
+	for _, tt := range tests {
+		if got := MatchResolution(tt.width, tt.height); got != tt.want {
+			t.Errorf("MatchResolution(%d, %d) = %s, want %s", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestGetTargetResolutions(t *testing.T) {
+	all := []types.Resolutions{types.P2160, types.P1440, types.P1080, types.P720, types.P480, types.P360}
+	capped := []types.Resolutions{types.P1080, types.P720, types.P480, types.P360}
+	tests := []struct {
+		name                     string
+		serverMax                int
+		resolution               types.Resolutions
+		maxRenditions, maxHeight int
+		want                     []types.Resolutions
+	}{
+		{name: "no limit", resolution: types.P2160, want: all},
+		{name: "below source", resolution: types.P720, want: all[3:]},
+		{name: "server ceiling", serverMax: 1080, resolution: types.P2160, want: capped},
+		{name: "request ceiling", resolution: types.P2160, maxHeight: 1080, want: capped},
+		{name: "request lowers server", serverMax: 1080, resolution: types.P2160, maxHeight: 480, want: all[4:]},
+		{name: "request cannot raise server", serverMax: 1080, resolution: types.P2160, maxHeight: 2160, want: capped},
+		{name: "ceiling between presets", resolution: types.P2160, maxHeight: 1000, want: all[3:]},
+		{name: "ceiling then thinning", serverMax: 1080, resolution: types.P2160, maxRenditions: 2, want: []types.Resolutions{types.P1080, types.P360}},
+		{name: "ceiling below every preset", resolution: types.P2160, maxHeight: 240, want: []types.Resolutions{}},
+		// Thinning keeps the source rung and spreads the rest evenly down to the lowest
+		{name: "1080 capped to 1", resolution: types.P1080, maxRenditions: 1, want: []types.Resolutions{types.P1080}},
+		{name: "1080 capped to 2", resolution: types.P1080, maxRenditions: 2, want: []types.Resolutions{types.P1080, types.P360}},
+		{name: "1080 capped to 3", resolution: types.P1080, maxRenditions: 3, want: []types.Resolutions{types.P1080, types.P480, types.P360}},
+		{name: "720 capped to 1", resolution: types.P720, maxRenditions: 1, want: []types.Resolutions{types.P720}},
+		{name: "720 capped to 2", resolution: types.P720, maxRenditions: 2, want: []types.Resolutions{types.P720, types.P360}},
+		{name: "720 capped to 3", resolution: types.P720, maxRenditions: 3, want: all[3:]},
+		{name: "2160 capped to 1", resolution: types.P2160, maxRenditions: 1, want: []types.Resolutions{types.P2160}},
+		{name: "2160 capped to 2", resolution: types.P2160, maxRenditions: 2, want: []types.Resolutions{types.P2160, types.P360}},
+		{name: "2160 capped to 3", resolution: types.P2160, maxRenditions: 3, want: []types.Resolutions{types.P2160, types.P720, types.P360}},
+		{name: "2160 capped to 4", resolution: types.P2160, maxRenditions: 4, want: []types.Resolutions{types.P2160, types.P1080, types.P720, types.P360}},
+		{name: "cap above the ladder", resolution: types.P2160, maxRenditions: 10, want: all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := MAX_OUTPUT_HEIGHT
+			MAX_OUTPUT_HEIGHT = tt.serverMax
+			t.Cleanup(func() { MAX_OUTPUT_HEIGHT = old })
+
+			got := GetTargetResolutions(tt.resolution, tt.maxRenditions, tt.maxHeight)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("GetTargetResolutions(%s, %d, %d) = %v, want %v", tt.resolution, tt.maxRenditions, tt.maxHeight, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPixelFormatProfile(t *testing.T) {
+	tests := []struct {
+		codec, pixFmt string
+		want          string
+		wantErr       bool
+	}{
+		{codec: "libx264", pixFmt: "yuv420p", want: ""},
+		{codec: "libx264", pixFmt: "yuv422p", want: "high422"},
+		{codec: "libx264", pixFmt: "yuv444p", want: "high444"},
+		{codec: "libx264", pixFmt: "yuv420p10le", want: "high10"},
+		{codec: "libx264", pixFmt: "yuv422p10le", want: "high422"},
+		{codec: "libx264", pixFmt: "yuv444p10le", want: "high444"},
+		{codec: "libsvtav1", pixFmt: "yuv420p", want: ""},
+		{codec: "libsvtav1", pixFmt: "yuv420p10le", want: ""},
+		{codec: "libvpx-vp9", pixFmt: "yuv420p", want: ""},
+		{codec: "libvpx-vp9", pixFmt: "yuv444p", want: "1"},
+		{codec: "libvpx-vp9", pixFmt: "yuv420p10le", want: "2"},
+		{codec: "libvpx-vp9", pixFmt: "yuv444p10le", want: "3"},
+		{codec: "libsvtav1", pixFmt: "yuv444p", wantErr: true},
+		{codec: "libsvtav1", pixFmt: "yuv422p10le", wantErr: true},
+		{codec: "libvpx-vp9", pixFmt: "yuv422p", wantErr: true},
+		{codec: "libx264", pixFmt: "nv12", wantErr: true},
+		{codec: "libx264", pixFmt: "", wantErr: true},
+		{codec: "libx265", pixFmt: "yuv420p", wantErr: true},
+	}
+	for _, tt := range tests {
+		profile, err := PixelFormatProfile(tt.codec, tt.pixFmt)
+		if (err != nil) != tt.wantErr || profile != tt.want {
+			t.Errorf("PixelFormatProfile(%s, %q) = %q, %v, want %q (error: %v)", tt.codec, tt.pixFmt, profile, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// The error lists what the codec supports
+	_, err := PixelFormatProfile("libsvtav1", "yuv444p")
+	if err == nil || !strings.Contains(err.Error(), "supported: yuv420p, yuv420p10le") {
+		t.Errorf("PixelFormatProfile(libsvtav1, yuv444p) = %v, want the supported formats listed", err)
+	}
+}
+
+func TestValidateSegmentType(t *testing.T) {
+	tests := []struct {
+		codec       string
+		segmentType types.SegmentType
+		valid       bool
+	}{
+		{codec: "libx264", segmentType: types.SegmentTS, valid: true},
+		{codec: "libx264", segmentType: types.SegmentFMP4, valid: true},
+		{codec: "libsvtav1", segmentType: types.SegmentFMP4, valid: true},
+		{codec: "libsvtav1", segmentType: types.SegmentTS, valid: false},
+		{codec: "libvpx-vp9", segmentType: types.SegmentFMP4, valid: false},
+	}
+	for _, tt := range tests {
+		if err := ValidateSegmentType(tt.codec, tt.segmentType); (err == nil) != tt.valid {
+			t.Errorf("ValidateSegmentType(%s, %s) = %v, want valid %v", tt.codec, tt.segmentType, err, tt.valid)
+		}
+	}
+}
+
+func TestCanStreamCopy(t *testing.T) {
+	video := types.FFProbeStream{CodecType: "video", CodecName: "h264", Height: 360, PixFmt: "yuv420p", FieldOrder: "progressive", SampleAspect: "1:1"}
+	aac := types.FFProbeStream{CodecType: "audio", CodecName: "aac"}
+	with := func(change func(*types.FFProbeStream)) types.FFProbeStream {
+		stream := video
+		change(&stream)
+		return stream
+	}
+
+	tests := []struct {
+		name     string
+		streams  []types.FFProbeStream
+		height   int
+		rotation int
+		want     bool
+	}{
+		{name: "small h264 with aac", streams: []types.FFProbeStream{video, aac}, height: 360, want: true},
+		{name: "small h264 without audio", streams: []types.FFProbeStream{video}, height: 240, want: true},
+		{name: "above the smallest preset", streams: []types.FFProbeStream{video, aac}, height: 480},
+		{name: "hevc", streams: []types.FFProbeStream{with(func(s *types.FFProbeStream) { s.CodecName = "hevc" }), aac}, height: 360},
+		{name: "10-bit", streams: []types.FFProbeStream{with(func(s *types.FFProbeStream) { s.PixFmt = "yuv420p10le" }), aac}, height: 360},
+		{name: "rotated", streams: []types.FFProbeStream{video, aac}, height: 360, rotation: 90},
+		{name: "interlaced", streams: []types.FFProbeStream{with(func(s *types.FFProbeStream) { s.FieldOrder = "tt" }), aac}, height: 360},
+		{name: "anamorphic", streams: []types.FFProbeStream{with(func(s *types.FFProbeStream) { s.SampleAspect = "4:3" }), aac}, height: 360},
+		{name: "mp3 audio", streams: []types.FFProbeStream{video, {CodecType: "audio", CodecName: "mp3"}}, height: 360},
+		{name: "audio only", streams: []types.FFProbeStream{aac}, height: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := CanStreamCopy(types.FFProbeOutput{Streams: tt.streams}, tt.height, tt.rotation, "yuv420p")
+			if ok != tt.want || (!ok && reason == "") {
+				t.Errorf("CanStreamCopy = %v, %q; want %v with a reason when false", ok, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceBitrate(t *testing.T) {
+	video := types.FFProbeStream{Index: 0, CodecType: "video", CodecName: "h264"}
+	tests := []struct {
+		name    string
+		info    types.FFProbeOutput
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "stream bitrate",
+			info: types.FFProbeOutput{Streams: []types.FFProbeStream{withBitRate(video, "2500000")}},
+			want: 2500,
+		},
+		{
+			name: "estimated from the container minus the audio, as for Matroska",
+			info: types.FFProbeOutput{
+				Streams: []types.FFProbeStream{video, {Index: 1, CodecType: "audio", BitRate: "128000"}},
+				Format:  types.FFProbeFormat{BitRate: "3128000"},
+			},
+			want: 3000,
+		},
+		{name: "tiny bitrate rounds up to 1 kbps", info: types.FFProbeOutput{Streams: []types.FFProbeStream{withBitRate(video, "300")}}, want: 1},
+		{name: "unknown", info: types.FFProbeOutput{Streams: []types.FFProbeStream{video}}, wantErr: true},
+		{name: "no video", info: types.FFProbeOutput{Streams: []types.FFProbeStream{{CodecType: "audio", BitRate: "128000"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := SourceBitrate(tt.info)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: SourceBitrate = %d, %v; want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func withBitRate(stream types.FFProbeStream, bitRate string) types.FFProbeStream {
+	stream.BitRate = bitRate
+	return stream
+}
+
+func TestCapBitrate(t *testing.T) {
+	tests := []struct{ bitrate, source, want int }{
+		{bitrate: 4000, source: 6000, want: 4000}, // Source above the rendition
+		{bitrate: 4000, source: 1500, want: 1500},
+		{bitrate: 4000, source: 50, want: MinBitrateOverride},
+		{bitrate: 4000, source: 0, want: 4000}, // Unknown source bitrate
+	}
+	for _, tt := range tests {
+		if got := CapBitrate(tt.bitrate, tt.source); got != tt.want {
+			t.Errorf("CapBitrate(%d, %d) = %d, want %d", tt.bitrate, tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestSpeedAverage(t *testing.T) {
+	var average SpeedAverage
+	if got := average.Mean(); got != 0 {
+		t.Errorf("Mean of no samples = %v, want 0", got)
+	}
+
+	// Samples from before the first frame, and garbage, don't count
+	for _, speed := range []string{"N/A", "0", "", "-1", "inf", "2.5", "3", "3.2"} {
+		average.Add(speed)
+	}
+	if got := average.Mean(); got != 2.9 {
+		t.Errorf("Mean = %v, want 2.9", got)
+	}
+
+	var other SpeedAverage
+	other.Add("6.1")
+	average.Merge(other)
+	if got := average.Mean(); got != 3.7 {
+		t.Errorf("Mean after Merge = %v, want 3.7", got)
+	}
+
+	// Means are rounded to two decimals
+	var thirds SpeedAverage
+	for _, speed := range []string{"1", "1", "2"} {
+		thirds.Add(speed)
+	}
+	if got := thirds.Mean(); got != 1.33 {
+		t.Errorf("Mean = %v, want 1.33", got)
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	for raw, want := range map[string]bool{"": true, "false": false, "0": false, "FALSE": false, "true": true, "1": true, "off": true} {
+		t.Setenv("TEST_FLAG", raw)
+		if got := GetEnvBool("TEST_FLAG", true); got != want {
+			t.Errorf("GetEnvBool(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
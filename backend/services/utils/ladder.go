@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// Ladders are the named presets of the ladder option, each a curated set of renditions, highest first.
+var Ladders = map[string][]types.RenditionSpec{
+	// Low bitrates for phones on cellular networks
+	"mobile": {
+		{Resolution: types.P480, Bitrate: 1200, Codec: types.CodecH264},
+		{Resolution: types.P360, Bitrate: 700, Codec: types.CodecH264},
+	},
+	// The usual ladder of a web player, a little leaner than the presets
+	"web": {
+		{Resolution: types.P1080, Bitrate: 5000, Codec: types.CodecH264},
+		{Resolution: types.P720, Bitrate: 3000, Codec: types.CodecH264},
+		{Resolution: types.P480, Bitrate: 1500, Codec: types.CodecH264},
+		{Resolution: types.P360, Bitrate: 800, Codec: types.CodecH264},
+	},
+	// Only the high resolutions, at bitrates high enough to keep nearly all of the detail
+	"archive": {
+		{Resolution: types.P2160, Bitrate: 20000, Codec: types.CodecH264},
+		{Resolution: types.P1440, Bitrate: 12000, Codec: types.CodecH264},
+		{Resolution: types.P1080, Bitrate: 8000, Codec: types.CodecH264},
+		{Resolution: types.P720, Bitrate: 5000, Codec: types.CodecH264},
+	},
+}
+
+// ResolveLadder returns the renditions of the named ladder preset (case-insensitive).
+func ResolveLadder(name string) ([]types.RenditionSpec, error) {
+	if specs, ok := Ladders[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return slices.Clone(specs), nil
+	}
+
+	names := make([]string, 0, len(Ladders))
+	for name := range Ladders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return nil, fmt.Errorf("ladder %q is not supported (supported: %s)", name, strings.Join(names, ", "))
+}
+
+// FitLadder keeps the resolutions of available (highest first) that ladder lists. A source below
+// every rung of the ladder keeps its highest available resolution instead, so it's still transcoded.
+func FitLadder(available []types.Resolutions, ladder []types.RenditionSpec) []types.Resolutions {
+	fitted := slices.DeleteFunc(slices.Clone(available), func(res types.Resolutions) bool {
+		return !slices.ContainsFunc(ladder, func(spec types.RenditionSpec) bool { return spec.Resolution == res })
+	})
+	if len(fitted) == 0 && len(available) > 0 {
+		return available[:1]
+	}
+	return fitted
+}
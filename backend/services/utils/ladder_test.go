@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestResolveLadder(t *testing.T) {
+	tests := []struct {
+		name        string
+		resolutions []types.Resolutions
+	}{
+		{name: "mobile", resolutions: []types.Resolutions{types.P480, types.P360}},
+		{name: "web", resolutions: []types.Resolutions{types.P1080, types.P720, types.P480, types.P360}},
+		{name: "archive", resolutions: []types.Resolutions{types.P2160, types.P1440, types.P1080, types.P720}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := ResolveLadder(" " + strings.ToUpper(tt.name) + " ")
+			if err != nil {
+				t.Fatalf("ResolveLadder: %v", err)
+			}
+			var resolutions []types.Resolutions
+			for i, spec := range specs {
+				resolutions = append(resolutions, spec.Resolution)
+				if _, ok := types.Presets()[spec.Resolution]; !ok {
+					t.Errorf("%s isn't a preset resolution", spec.Resolution)
+				}
+				if spec.Codec != types.CodecH264 {
+					t.Errorf("%s is %s, want every ladder in h264", spec.Resolution, spec.Codec)
+				}
+				if spec.Bitrate < MinBitrateOverride || (i > 0 && spec.Bitrate >= specs[i-1].Bitrate) {
+					t.Errorf("%s at %d kbps, want bitrates decreasing with the resolution", spec.Resolution, spec.Bitrate)
+				}
+			}
+			if !slices.Equal(resolutions, tt.resolutions) {
+				t.Errorf("resolutions = %v, want %v", resolutions, tt.resolutions)
+			}
+
+			// The presets themselves can't be changed through the result
+			specs[0].Bitrate = 1
+			if Ladders[tt.name][0].Bitrate == 1 {
+				t.Error("ResolveLadder returned the preset itself")
+			}
+		})
+	}
+	if len(Ladders) != len(tests) {
+		t.Errorf("%d ladders defined, %d tested", len(Ladders), len(tests))
+	}
+
+	_, err := ResolveLadder("tv")
+	if err == nil || !strings.Contains(err.Error(), "archive, mobile, web") {
+		t.Errorf("ResolveLadder(tv) = %v, want an error listing the ladders", err)
+	}
+}
+
+func TestFitLadder(t *testing.T) {
+	mobile := Ladders["mobile"]
+	tests := []struct {
+		name      string
+		available []types.Resolutions
+		want      []types.Resolutions
+	}{
+		{name: "1080p source", available: []types.Resolutions{types.P1080, types.P720, types.P480, types.P360}, want: []types.Resolutions{types.P480, types.P360}},
+		{name: "480p source", available: []types.Resolutions{types.P480, types.P360}, want: []types.Resolutions{types.P480, types.P360}},
+		{name: "360p source", available: []types.Resolutions{types.P360}, want: []types.Resolutions{types.P360}},
+		{name: "none", available: nil, want: nil},
+	}
+	for _, tt := range tests {
+		if got := FitLadder(tt.available, mobile); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: FitLadder = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A 480p source is below every rung of the archive ladder, and keeps its highest resolution
+	available := []types.Resolutions{types.P480, types.P360}
+	if got := FitLadder(available, Ladders["archive"]); !slices.Equal(got, []types.Resolutions{types.P480}) {
+		t.Errorf("FitLadder below the archive ladder = %v, want [480P]", got)
+	}
+	if !slices.Equal(available, []types.Resolutions{types.P480, types.P360}) {
+		t.Errorf("FitLadder modified its input: %v", available)
+	}
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// sniffLength is how much of a file SniffMediaType looks at, as much as http.DetectContentType considers.
+const sniffLength = 512
+
+// UnknownMediaType is returned by SniffMediaType for files ffprobe can read but whose type isn't listed in mediaTypeExtensions.
+const UnknownMediaType = "application/octet-stream"
+
+// mediaTypeExtensions maps the media types SniffMediaType detects to the extensions files of that
+// type are named with. The first one is canonical and is used to store uploads of that type.
+var mediaTypeExtensions = map[string][]string{
+	"video/mp4":                     {".mp4", ".m4v", ".mov", ".3gp", ".3g2", ".f4v"},
+	"video/quicktime":               {".mov", ".mp4", ".m4v"},
+	"video/x-matroska":              {".mkv", ".webm", ".mk3d"},
+	"video/webm":                    {".webm", ".mkv"},
+	"video/mp2t":                    {".ts", ".m2ts", ".mts", ".tsv"},
+	"video/x-msvideo":               {".avi"},
+	"video/x-flv":                   {".flv"},
+	"video/x-ms-asf":                {".wmv", ".asf"},
+	"video/mpeg":                    {".mpg", ".mpeg", ".vob", ".m2v"},
+	"video/ogg":                     {".ogv", ".ogg"},
+	"image/gif":                     {".gif"},
+	"application/vnd.apple.mpegurl": {".m3u8"},
+}
+
+// formatMediaTypes maps ffprobe format names to media types, for files without a recognizable signature.
+var formatMediaTypes = map[string]string{
+	"mov":      "video/mp4",
+	"matroska": "video/x-matroska",
+	"mpegts":   "video/mp2t",
+	"avi":      "video/x-msvideo",
+	"flv":      "video/x-flv",
+	"asf":      "video/x-ms-asf",
+	"mpeg":     "video/mpeg",
+	"ogg":      "video/ogg",
+	"gif":      "image/gif",
+	"hls":      "application/vnd.apple.mpegurl",
+}
+
+// SniffMediaType determines the media type of the file at path from its content, regardless of
+// its name. The first bytes are matched against the signatures of common video containers and
+// then http.DetectContentType. Content neither recognizes as media is probed with ffprobe: files
+// it can read get the type of their format, or UnknownMediaType, and an error is returned otherwise.
+func SniffMediaType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	file.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	header = header[:n]
+
+	if mediaType := sniffSignature(header); mediaType != "" {
+		return mediaType, nil
+	}
+	mediaType, _, _ := strings.Cut(http.DetectContentType(header), ";")
+	if IsMediaType(mediaType) && mediaType != UnknownMediaType {
+		return mediaType, nil
+	}
+
+	// Some containers have no fixed signature (e.g. QuickTime files starting with a moov atom)
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return "", fmt.Errorf("content looks like %s and is not a readable media file: %w", mediaType, err)
+	}
+	for _, format := range strings.Split(info.Format.FormatName, ",") {
+		if mediaType, ok := formatMediaTypes[format]; ok {
+			return mediaType, nil
+		}
+	}
+	return UnknownMediaType, nil
+}
+
+// IsStillImage reports whether ffprobe read the file as a single image (e.g. a jpg or png) rather
+// than video. Images get a video stream and a nominal one-frame duration, so they pass the other
+// probes.
+func IsStillImage(info types.FFProbeOutput) bool {
+	for _, format := range strings.Split(info.Format.FormatName, ",") {
+		if format == "image2" || strings.HasSuffix(format, "_pipe") {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffSignature matches the start of a file against the signatures of common video containers.
+func sniffSignature(header []byte) string {
+	switch {
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		if string(header[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}): // EBML
+		if bytes.Contains(header, []byte("webm")) { // DocType
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case isTransportStream(header, 188, 0), isTransportStream(header, 192, 4): // MPEG-TS, or M2TS with a 4-byte timecode per packet
+		return "video/mp2t"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "AVI ":
+		return "video/x-msvideo"
+	case bytes.HasPrefix(header, []byte("FLV\x01")):
+		return "video/x-flv"
+	case bytes.HasPrefix(header, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}): // ASF header object GUID
+		return "video/x-ms-asf"
+	case bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xBA}), bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xB3}): // Pack or sequence header
+		return "video/mpeg"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "video/ogg"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "image/gif"
+	case bytes.HasPrefix(bytes.TrimLeft(bytes.TrimPrefix(header, []byte("\xEF\xBB\xBF")), " \t\r\n"), []byte("#EXTM3U")):
+		return "application/vnd.apple.mpegurl"
+	}
+	return ""
+}
+
+// isTransportStream reports whether header holds consecutive transport stream packets of the given
+// size, each starting with the 0x47 sync byte at offset.
+func isTransportStream(header []byte, packetSize, offset int) bool {
+	packets := 0
+	for i := offset; i < len(header); i += packetSize {
+		if header[i] != 0x47 {
+			return false
+		}
+		packets++
+	}
+	return packets >= 2
+}
+
+// IsMediaType reports whether files of mediaType can be transcoded: video and audio types, the
+// types in mediaTypeExtensions, and UnknownMediaType for files only ffprobe recognized.
+func IsMediaType(mediaType string) bool {
+	if _, ok := mediaTypeExtensions[mediaType]; ok {
+		return true
+	}
+	return strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") ||
+		mediaType == "application/ogg" || mediaType == UnknownMediaType
+}
+
+// MediaTypeExtension returns the canonical extension of mediaType, or "" if it has none.
+func MediaTypeExtension(mediaType string) string {
+	if extensions := mediaTypeExtensions[mediaType]; len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
+
+// ExtensionMatchesMediaType reports whether a file named with ext may hold content of mediaType.
+// Extensions that aren't associated with any type, and types without extensions, always match.
+func ExtensionMatchesMediaType(ext, mediaType string) bool {
+	ext = strings.ToLower(ext)
+	extensions, ok := mediaTypeExtensions[mediaType]
+	if !ok {
+		return true
+	}
+	for _, known := range extensions {
+		if known == ext {
+			return true
+		}
+	}
+	for _, others := range mediaTypeExtensions {
+		for _, known := range others {
+			if known == ext {
+				return false // The extension belongs to another type
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// failProbe makes ExecCommand start a TestHelperProcess that fails, as ffprobe does on files it can't read.
+func failProbe(t *testing.T) {
+	t.Helper()
+	previous := ExecCommand
+	ExecCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestHelperProcess$", "--", name)
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_EXIT_CODE=1")
+		return cmd
+	}
+	t.Cleanup(func() { ExecCommand = previous })
+}
+
+// packets returns count transport stream packets of size bytes, with the sync byte at offset.
+func packets(count, size, offset int) []byte {
+	packet := make([]byte, size)
+	packet[offset] = 0x47
+	return bytes.Repeat(packet, count)
+}
+
+func TestSniffMediaType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{name: "mp4", content: []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2"), want: "video/mp4"},
+		{name: "quicktime", content: []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), want: "video/quicktime"},
+		{name: "matroska", content: []byte("\x1A\x45\xDF\xA3\x9F\x42\x82\x88matroska"), want: "video/x-matroska"},
+		{name: "webm", content: []byte("\x1A\x45\xDF\xA3\x9F\x42\x82\x84webm"), want: "video/webm"},
+		{name: "mpeg-ts", content: packets(2, 188, 0), want: "video/mp2t"},
+		{name: "m2ts", content: packets(2, 192, 4), want: "video/mp2t"},
+		{name: "avi", content: []byte("RIFF\x00\x10\x00\x00AVI LIST"), want: "video/x-msvideo"},
+		{name: "flv", content: []byte("FLV\x01\x05\x00\x00\x00\x09"), want: "video/x-flv"},
+		{name: "asf", content: []byte("\x30\x26\xB2\x75\x8E\x66\xCF\x11\xA6\xD9"), want: "video/x-ms-asf"},
+		{name: "mpeg-ps", content: []byte("\x00\x00\x01\xBA\x44\x00\x04"), want: "video/mpeg"},
+		{name: "ogg", content: []byte("OggS\x00\x02"), want: "video/ogg"},
+		{name: "gif", content: []byte("GIF89a\x01\x00\x01\x00"), want: "image/gif"},
+		{name: "hls playlist", content: []byte("\xEF\xBB\xBF\n#EXTM3U\n#EXT-X-VERSION:3\n"), want: "application/vnd.apple.mpegurl"},
+		{name: "mp3", content: []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), want: "audio/mpeg"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "upload.bin")
+		if err := os.WriteFile(path, test.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := SniffMediaType(path)
+		if err != nil || got != test.want {
+			t.Errorf("%s: SniffMediaType = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestSniffMediaTypeFallsBackToFFprobe(t *testing.T) {
+	// A QuickTime file starting with its moov atom has no signature to recognize
+	path := filepath.Join(t.TempDir(), "upload.mov")
+	if err := os.WriteFile(path, []byte("\x00\x00\x00\x08moov\x00\x00\x00\x6Cmvhd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("readable", func(t *testing.T) {
+		fakeProbe(t, "upright")
+		if got, err := SniffMediaType(path); err != nil || got != "video/mp4" {
+			t.Errorf("SniffMediaType = %q, %v, want video/mp4 from ffprobe's format", got, err)
+		}
+	})
+
+	t.Run("not media", func(t *testing.T) {
+		failProbe(t)
+		text := sourceFile(t, "movie.mp4") // Plain text, whatever the name says
+		if got, err := SniffMediaType(text); err == nil || !strings.Contains(err.Error(), "text/plain") {
+			t.Errorf("SniffMediaType = %q, %v, want an error naming the detected text/plain", got, err)
+		}
+	})
+}
+
+func TestSniffMediaTypeMissingFile(t *testing.T) {
+	if _, err := SniffMediaType(filepath.Join(t.TempDir(), "missing.mp4")); err == nil {
+		t.Error("SniffMediaType succeeded on a missing file")
+	}
+}
+
+func TestExtensionMatchesMediaType(t *testing.T) {
+	tests := []struct {
+		ext, mediaType string
+		want           bool
+	}{
+		{".mp4", "video/mp4", true},
+		{".MOV", "video/mp4", true},
+		{".mkv", "video/webm", true},
+		{".mkv", "video/mp4", false}, // Spoofed: a Matroska extension on MP4 content
+		{".avi", "video/mp2t", false},
+		{".txt", "video/mp4", true},  // Extensions of no known type aren't judged
+		{".mp4", "audio/mpeg", true}, // Nor are types without extensions
+	}
+	for _, test := range tests {
+		if got := ExtensionMatchesMediaType(test.ext, test.mediaType); got != test.want {
+			t.Errorf("ExtensionMatchesMediaType(%q, %q) = %v, want %v", test.ext, test.mediaType, got, test.want)
+		}
+	}
+}
+
+func TestIsMediaType(t *testing.T) {
+	for mediaType, want := range map[string]bool{
+		"video/mp4":                     true,
+		"audio/mpeg":                    true,
+		"application/ogg":               true,
+		"image/gif":                     true,
+		"application/vnd.apple.mpegurl": true,
+		UnknownMediaType:                true,
+		"image/png":                     false,
+		"text/plain":                    false,
+		"application/pdf":               false,
+	} {
+		if got := IsMediaType(mediaType); got != want {
+			t.Errorf("IsMediaType(%q) = %v, want %v", mediaType, got, want)
+		}
+	}
+	if got := MediaTypeExtension("video/quicktime"); got != ".mov" {
+		t.Errorf("MediaTypeExtension(video/quicktime) = %q, want .mov", got)
+	}
+	if got := MediaTypeExtension("audio/mpeg"); got != "" {
+		t.Errorf("MediaTypeExtension(audio/mpeg) = %q, want none", got)
+	}
+}
+
+func TestIsStillImage(t *testing.T) {
+	for formatName, want := range map[string]bool{
+		"image2":                  true,
+		"png_pipe":                true,
+		"jpeg_pipe":               true,
+		"mov,mp4,m4a,3gp,3g2,mj2": false,
+		"matroska,webm":           false,
+		"gif":                     false, // Animated
+		"":                        false,
+	} {
+		info := types.FFProbeOutput{Format: types.FFProbeFormat{FormatName: formatName}}
+		if got := IsStillImage(info); got != want {
+			t.Errorf("IsStillImage(%q) = %v, want %v", formatName, got, want)
+		}
+	}
+}
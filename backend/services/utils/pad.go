@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+const (
+	DefaultPadColor = "black"
+
+	minPadSize = 16   // Smaller frames aren't worth encoding
+	maxPadSize = 8192 // Beyond what any encoder in the ladder accepts
+)
+
+// PadColors are the color names accepted for padding, besides hex colors. ffmpeg knows many more,
+// but these are the ones players are commonly letterboxed with.
+var PadColors = []string{"black", "white", "gray", "red", "green", "blue", "yellow", "orange", "purple", "pink", "navy"}
+
+// hexColorPattern matches a hex RGB or RGBA color, with or without a leading "#" or "0x".
+var hexColorPattern = regexp.MustCompile(`^(#|0x)?([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// ParsePad parses the frame size of the pad option as "WxH", e.g. "1080x1080". Both dimensions must
+// be even, as yuv420p requires, and between minPadSize and maxPadSize.
+func ParsePad(value string) (types.PadSpec, error) {
+	widthValue, heightValue, found := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "x")
+	width, widthErr := strconv.Atoi(widthValue)
+	height, heightErr := strconv.Atoi(heightValue)
+	if !found || widthErr != nil || heightErr != nil {
+		return types.PadSpec{}, fmt.Errorf("pad must be a frame size such as 1080x1080, got %q", value)
+	}
+	for _, size := range []int{width, height} {
+		if size < minPadSize || size > maxPadSize {
+			return types.PadSpec{}, fmt.Errorf("pad dimensions must be between %d and %d, got %dx%d", minPadSize, maxPadSize, width, height)
+		}
+		if size%2 != 0 {
+			return types.PadSpec{}, fmt.Errorf("pad dimensions must be even, got %dx%d", width, height)
+		}
+	}
+	return types.PadSpec{Width: width, Height: height, Color: DefaultPadColor}, nil
+}
+
+// ParsePadColor parses the background color of the padding: one of PadColors or a hex color
+// such as "#1a1a1a". The result is in the form ffmpeg's pad filter takes.
+func ParsePadColor(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if slices.Contains(PadColors, strings.ToLower(value)) {
+		return strings.ToLower(value), nil
+	}
+	if match := hexColorPattern.FindStringSubmatch(value); match != nil {
+		return "0x" + strings.ToLower(match[2]), nil
+	}
+	return "", fmt.Errorf("pad color must be one of %s or a hex color such as #1a1a1a, got %q", strings.Join(PadColors, ", "), value)
+}
+
+// PadFilter returns the filters that fit a video into the frame of pad: it's scaled down (or up)
+// until it fits, keeping its aspect ratio, and centered on a background of pad's color. Both
+// dimensions of the scaled video are kept even, so the padding is the same on either side.
+func PadFilter(pad types.PadSpec) string {
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=%s,setsar=1",
+		pad.Width, pad.Height, pad.Width, pad.Height, pad.Color)
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestParsePad(t *testing.T) {
+	for value, want := range map[string]types.PadSpec{
+		"1080x1080":   {Width: 1080, Height: 1080, Color: DefaultPadColor},
+		" 1080X1920 ": {Width: 1080, Height: 1920, Color: DefaultPadColor},
+		"16x8192":     {Width: 16, Height: 8192, Color: DefaultPadColor},
+	} {
+		if got, err := ParsePad(value); err != nil || got != want {
+			t.Errorf("ParsePad(%q) = %+v, %v, want %+v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "1080", "1080x", "x1080", "1080:1080", "1080x1080x2", "-1080x1080", "1081x1080", "1080x1079", "14x14", "8194x1080"} {
+		if got, err := ParsePad(value); err == nil {
+			t.Errorf("ParsePad(%q) = %+v, want an error", value, got)
+		}
+	}
+}
+
+func TestParsePadColor(t *testing.T) {
+	for value, want := range map[string]string{
+		"black":     "black",
+		" White ":   "white",
+		"#1A1A1A":   "0x1a1a1a",
+		"0x00ff00":  "0x00ff00",
+		"ff000080":  "0xff000080",
+		"#FFFFFF00": "0xffffff00",
+	} {
+		if got, err := ParsePadColor(value); err != nil || got != want {
+			t.Errorf("ParsePadColor(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "beige", "#fff", "#12345", "0x1234567", "#gggggg", "black@0.5", "red:white"} {
+		if got, err := ParsePadColor(value); err == nil {
+			t.Errorf("ParsePadColor(%q) = %q, want an error", value, got)
+		}
+	}
+}
+
+func TestPadFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		pad  types.PadSpec
+		want string
+	}{
+		{
+			name: "square for social",
+			pad:  types.PadSpec{Width: 1080, Height: 1080, Color: "black"},
+			want: "scale=1080:1080:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=1080:1080:(ow-iw)/2:(oh-ih)/2:color=black,setsar=1",
+		},
+		{
+			name: "portrait",
+			pad:  types.PadSpec{Width: 1080, Height: 1920, Color: "0x1a1a1a"},
+			want: "scale=1080:1920:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=1080:1920:(ow-iw)/2:(oh-ih)/2:color=0x1a1a1a,setsar=1",
+		},
+		{
+			name: "widescreen",
+			pad:  types.PadSpec{Width: 1920, Height: 1080, Color: "white"},
+			want: "scale=1920:1080:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=1920:1080:(ow-iw)/2:(oh-ih)/2:color=white,setsar=1",
+		},
+	}
+	for _, tt := range tests {
+		if got := PadFilter(tt.pad); got != tt.want {
+			t.Errorf("%s: PadFilter = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
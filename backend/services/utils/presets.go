@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// LoadResolutionPresets reads a resolution ladder from a JSON file holding an array of presets,
+// e.g. [{"height":1080,"width":1920,"bitrate":6500},{"height":720,"width":1280,"bitrate":4000}],
+// and validates it with ValidateResolutionPresets.
+func LoadResolutionPresets(path string) (map[types.Resolutions]types.ResolutionPreset, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolution presets: %w", err)
+	}
+
+	var ladder []types.ResolutionPreset
+	if err := json.Unmarshal(content, &ladder); err != nil {
+		return nil, fmt.Errorf("resolution presets in %s must be a JSON array of height, width and bitrate: %w", path, err)
+	}
+	if err := ValidateResolutionPresets(ladder); err != nil {
+		return nil, fmt.Errorf("invalid resolution presets in %s: %w", path, err)
+	}
+
+	presets := make(map[types.Resolutions]types.ResolutionPreset, len(ladder))
+	for _, preset := range ladder {
+		presets[types.Resolutions(preset.Height)] = preset
+	}
+	return presets, nil
+}
+
+// ValidateResolutionPresets checks that a ladder has at least one preset, that every dimension and
+// bitrate is positive, that dimensions are even as the encoders require, and that a taller preset
+// is also wider and has a higher bitrate than every shorter one. Heights must be unique, as presets
+// are keyed by height.
+func ValidateResolutionPresets(ladder []types.ResolutionPreset) error {
+	if len(ladder) == 0 {
+		return fmt.Errorf("no presets given")
+	}
+
+	for _, preset := range ladder {
+		if preset.Height <= 0 || preset.Width <= 0 || preset.Bitrate <= 0 {
+			return fmt.Errorf("preset %dx%d at %d kbps must have a positive height, width and bitrate", preset.Width, preset.Height, preset.Bitrate)
+		}
+		if preset.Height%2 != 0 || preset.Width%2 != 0 {
+			return fmt.Errorf("preset %dx%d must have even dimensions", preset.Width, preset.Height)
+		}
+	}
+
+	sorted := slices.SortedFunc(slices.Values(ladder), func(a, b types.ResolutionPreset) int { return cmp.Compare(a.Height, b.Height) })
+	for i := 1; i < len(sorted); i++ {
+		lower, higher := sorted[i-1], sorted[i]
+		switch {
+		case higher.Height == lower.Height:
+			return fmt.Errorf("height %d is listed more than once", higher.Height)
+		case higher.Width <= lower.Width:
+			return fmt.Errorf("preset %dx%d must be wider than the shorter %dx%d", higher.Width, higher.Height, lower.Width, lower.Height)
+		case higher.Bitrate <= lower.Bitrate:
+			return fmt.Errorf("%dp must have a higher bitrate than %dp, got %d kbps and %d kbps", higher.Height, lower.Height, higher.Bitrate, lower.Bitrate)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// presetsFile writes content to a presets file and returns its path.
+func presetsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "presets.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadResolutionPresets(t *testing.T) {
+	path := presetsFile(t, `[{"height":720,"width":1280,"bitrate":3500},{"height":1080,"width":1920,"bitrate":5000},{"height":540,"width":960,"bitrate":2000}]`)
+	presets, err := LoadResolutionPresets(path)
+	if err != nil {
+		t.Fatalf("LoadResolutionPresets: %v", err)
+	}
+	want := map[types.Resolutions]types.ResolutionPreset{
+		types.P1080: {Height: 1080, Width: 1920, Bitrate: 5000},
+		types.P720:  {Height: 720, Width: 1280, Bitrate: 3500},
+		540:         {Height: 540, Width: 960, Bitrate: 2000},
+	}
+	if !reflect.DeepEqual(presets, want) {
+		t.Errorf("LoadResolutionPresets = %v, want %v", presets, want)
+	}
+
+	if _, err := LoadResolutionPresets(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadResolutionPresets of a missing file = %v, want os.ErrNotExist", err)
+	}
+	for _, content := range []string{
+		`{"height":720,"width":1280,"bitrate":3500}`,
+		`[{"height":"720p"}]`,
+		`[]`,
+		`[{"height":720,"width":1280,"bitrate":0}]`,
+	} {
+		if _, err := LoadResolutionPresets(presetsFile(t, content)); err == nil || !strings.Contains(err.Error(), "presets.json") {
+			t.Errorf("LoadResolutionPresets(%s) = %v, want an error naming the file", content, err)
+		}
+	}
+}
+
+func TestValidateResolutionPresets(t *testing.T) {
+	if err := ValidateResolutionPresets(slices.Collect(maps.Values(types.DefaultPresets))); err != nil {
+		t.Errorf("ValidateResolutionPresets(built-in presets) = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		ladder []types.ResolutionPreset
+	}{
+		{name: "empty"},
+		{name: "zero height", ladder: []types.ResolutionPreset{{Height: 0, Width: 640, Bitrate: 1000}}},
+		{name: "negative bitrate", ladder: []types.ResolutionPreset{{Height: 360, Width: 640, Bitrate: -1}}},
+		{name: "odd width", ladder: []types.ResolutionPreset{{Height: 360, Width: 641, Bitrate: 1000}}},
+		{name: "odd height", ladder: []types.ResolutionPreset{{Height: 361, Width: 640, Bitrate: 1000}}},
+		{name: "duplicate height", ladder: []types.ResolutionPreset{{Height: 360, Width: 640, Bitrate: 1000}, {Height: 360, Width: 480, Bitrate: 800}}},
+		{name: "narrower when taller", ladder: []types.ResolutionPreset{{Height: 720, Width: 640, Bitrate: 3000}, {Height: 360, Width: 640, Bitrate: 1000}}},
+		{name: "cheaper when taller", ladder: []types.ResolutionPreset{{Height: 720, Width: 1280, Bitrate: 1000}, {Height: 360, Width: 640, Bitrate: 1000}}},
+	}
+	for _, tt := range tests {
+		if err := ValidateResolutionPresets(tt.ladder); err == nil {
+			t.Errorf("%s: ValidateResolutionPresets accepted %v", tt.name, tt.ladder)
+		}
+	}
+}
+
+func TestConfiguredPresets(t *testing.T) {
+	presets, err := LoadResolutionPresets(presetsFile(t, `[{"height":1080,"width":1920,"bitrate":5000},{"height":540,"width":960,"bitrate":2000}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types.SetPresets(presets)
+	t.Cleanup(func() { types.SetPresets(types.DefaultPresets) })
+
+	if got := GetTargetResolutions(types.P2160, 0, 0); !reflect.DeepEqual(got, []types.Resolutions{types.P1080, 540}) {
+		t.Errorf("GetTargetResolutions = %v, want the configured ladder", got)
+	}
+	if got := MatchResolution(1280, 720); got != 540 {
+		t.Errorf("MatchResolution(1280, 720) = %s, want the configured 540P", got)
+	}
+	if got := MinLadderHeight(); got != 540 {
+		t.Errorf("MinLadderHeight = %d, want 540", got)
+	}
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// PreviewFormats are the formats of the preview clip: a looping gif, or a muted H.264 mp4.
+var PreviewFormats = []string{"gif", "mp4"}
+
+const (
+	DefaultPreviewDuration = 5.0  // Seconds of the source in a preview clip
+	MaxPreviewDuration     = 30.0 // Longer previews make huge gifs
+
+	previewWidth = 480 // Previews are scaled down to this width, keeping the aspect ratio
+	previewFPS   = 12  // Enough for a smooth gif at a fraction of the size
+)
+
+// ValidatePreviewFormat checks that format is one of PreviewFormats.
+func ValidatePreviewFormat(format string) error {
+	if slices.Contains(PreviewFormats, format) {
+		return nil
+	}
+	return fmt.Errorf("preview format %q is not supported (supported: %s)", format, strings.Join(PreviewFormats, ", "))
+}
+
+// previewFilter scales the preview down and lowers its frame rate.
+func previewFilter() string {
+	return fmt.Sprintf("fps=%d,scale=%d:-2:flags=lanczos", previewFPS, previewWidth)
+}
+
+// PreviewPaletteArgs returns the ffmpeg arguments for the first pass of a gif preview, which
+// computes a palette from the clip into palettePath. A palette made for the clip looks far better
+// than the generic one ffmpeg uses otherwise.
+func PreviewPaletteArgs(inputPath, palettePath string, start, duration float64) []string {
+	return []string{
+		"-y",
+		"-ss", FormatSeconds(start),
+		"-t", FormatSeconds(duration),
+		"-i", inputPath,
+		"-vf", previewFilter() + ",palettegen=stats_mode=diff",
+		palettePath,
+	}
+}
+
+// PreviewGIFArgs returns the ffmpeg arguments for the second pass of a gif preview, which encodes
+// the clip with the palette from PreviewPaletteArgs and loops it forever.
+func PreviewGIFArgs(inputPath, palettePath, outPath string, start, duration float64) []string {
+	return []string{
+		"-y",
+		"-ss", FormatSeconds(start),
+		"-t", FormatSeconds(duration),
+		"-i", inputPath,
+		"-i", palettePath,
+		"-lavfi", previewFilter() + "[clip];[clip][1:v]paletteuse=dither=bayer:bayer_scale=5",
+		"-loop", "0",
+		outPath,
+	}
+}
+
+// PreviewMP4Args returns the ffmpeg arguments for a muted mp4 preview.
+func PreviewMP4Args(inputPath, outPath string, start, duration float64) []string {
+	return []string{
+		"-y",
+		"-ss", FormatSeconds(start),
+		"-t", FormatSeconds(duration),
+		"-i", inputPath,
+		"-vf", previewFilter(),
+		"-an",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "28",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		outPath,
+	}
+}
+
+// GeneratePreviewClip writes duration seconds of inputPath, from start on, to outPath as a short
+// preview in the given format. Gifs are made in two passes, the first computing their palette.
+func GeneratePreviewClip(ctx context.Context, inputPath, outPath string, start, duration float64, format string) error {
+	if err := ValidatePreviewFormat(format); err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("preview duration must be positive, got %.3fs", duration)
+	}
+
+	if format == "mp4" {
+		return runFFmpeg(ctx, "preview clip", PreviewMP4Args(inputPath, outPath, start, duration))
+	}
+
+	palettePath := outPath + ".palette.png"
+	defer os.Remove(palettePath) // Only needed for the second pass
+	if err := runFFmpeg(ctx, "preview palette", PreviewPaletteArgs(inputPath, palettePath, start, duration)); err != nil {
+		return err
+	}
+	return runFFmpeg(ctx, "preview gif", PreviewGIFArgs(inputPath, palettePath, outPath, start, duration))
+}
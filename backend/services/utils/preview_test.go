@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// recordFFmpeg makes ExecCommand start a TestHelperProcess exiting with exitCode instead of
+// ffmpeg, standing in for each run by writing the file named by its last argument. The returned
+// function lists the arguments of every run so far.
+func recordFFmpeg(t *testing.T, exitCode int) func() [][]string {
+	t.Helper()
+	var runs [][]string
+	previous := ExecCommand
+	ExecCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		runs = append(runs, args)
+		if exitCode == 0 {
+			os.WriteFile(args[len(args)-1], []byte("output"), 0644)
+		}
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestHelperProcess$", "--", name)
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_EXIT_CODE="+strconv.Itoa(exitCode))
+		return cmd
+	}
+	t.Cleanup(func() { ExecCommand = previous })
+	return func() [][]string { return runs }
+}
+
+func TestGeneratePreviewGIF(t *testing.T) {
+	runs := recordFFmpeg(t, 0)
+	out := filepath.Join(t.TempDir(), "preview.gif")
+	palette := out + ".palette.png"
+
+	if err := GeneratePreviewClip(context.Background(), "source.mp4", out, 12.5, 5, "gif"); err != nil {
+		t.Fatalf("GeneratePreviewClip: %v", err)
+	}
+
+	want := [][]string{
+		{
+			"-y", "-ss", "12.500", "-t", "5.000", "-i", "source.mp4",
+			"-vf", "fps=12,scale=480:-2:flags=lanczos,palettegen=stats_mode=diff",
+			palette,
+		},
+		{
+			"-y", "-ss", "12.500", "-t", "5.000", "-i", "source.mp4", "-i", palette,
+			"-lavfi", "fps=12,scale=480:-2:flags=lanczos[clip];[clip][1:v]paletteuse=dither=bayer:bayer_scale=5",
+			"-loop", "0",
+			out,
+		},
+	}
+	if got := runs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ffmpeg runs:\n%q\nwant:\n%q", got, want)
+	}
+	if _, err := os.Stat(palette); !os.IsNotExist(err) {
+		t.Errorf("palette of the first pass was kept: %v", err)
+	}
+}
+
+func TestGeneratePreviewMP4(t *testing.T) {
+	runs := recordFFmpeg(t, 0)
+	out := filepath.Join(t.TempDir(), "preview.mp4")
+
+	if err := GeneratePreviewClip(context.Background(), "source.mp4", out, 0, 5, "mp4"); err != nil {
+		t.Fatalf("GeneratePreviewClip: %v", err)
+	}
+	got := runs()
+	if len(got) != 1 {
+		t.Fatalf("ffmpeg ran %d times, want a single pass", len(got))
+	}
+	args := got[0]
+	if !slices.Contains(args, "-an") || args[len(args)-1] != out || slices.ContainsFunc(args, func(arg string) bool { return arg == "-lavfi" }) {
+		t.Errorf("ffmpeg args = %q, want a muted clip written to %s", args, out)
+	}
+}
+
+func TestGeneratePreviewClipFailures(t *testing.T) {
+	t.Run("palette pass fails", func(t *testing.T) {
+		runs := recordFFmpeg(t, 1)
+		out := filepath.Join(t.TempDir(), "preview.gif")
+		if err := GeneratePreviewClip(context.Background(), "source.mp4", out, 0, 5, "gif"); err == nil {
+			t.Error("GeneratePreviewClip succeeded although the palette pass failed")
+		}
+		if got := runs(); len(got) != 1 {
+			t.Errorf("ffmpeg ran %d times, want the gif pass skipped", len(got))
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		runs := recordFFmpeg(t, 0)
+		out := filepath.Join(t.TempDir(), "preview.webp")
+		if err := GeneratePreviewClip(context.Background(), "source.mp4", out, 0, 5, "webp"); err == nil {
+			t.Error("GeneratePreviewClip accepted format webp")
+		}
+		if err := GeneratePreviewClip(context.Background(), "source.mp4", out, 0, 0, "gif"); err == nil {
+			t.Error("GeneratePreviewClip accepted a zero duration")
+		}
+		if got := runs(); len(got) != 0 {
+			t.Errorf("ffmpeg ran for invalid options: %q", got)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// PROBE_CACHE_SIZE is how many files ProbeMedia keeps the ffprobe output of. A job probes its
+// source several times (upload validation, the transcoder, stream detection), so a handful of
+// entries per concurrent job is plenty.
+var PROBE_CACHE_SIZE = GetEnvInt("PROBE_CACHE_SIZE", 64)
+
+// probeKey identifies a probed file. The size and modification time are part of it, so a file
+// rewritten at the same path is probed again rather than served stale.
+type probeKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// probeCache holds the ffprobe output of the most recently probed files, evicting the oldest
+// entry once it holds PROBE_CACHE_SIZE of them.
+type probeCache struct {
+	mu      sync.Mutex
+	entries map[string]probeEntry // Keyed by path
+	order   []string              // Paths from oldest to newest
+}
+
+type probeEntry struct {
+	key  probeKey
+	info types.FFProbeOutput
+}
+
+var probes = &probeCache{entries: make(map[string]probeEntry)}
+
+// statProbeKey returns the cache key of the file at path, false if it can't be stat'ed.
+func statProbeKey(path string) (probeKey, bool) {
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		return probeKey{}, false
+	}
+	return probeKey{path: path, size: stat.Size(), modTime: stat.ModTime()}, true
+}
+
+// get returns the cached output for key, if the file hasn't changed since it was probed.
+func (c *probeCache) get(key probeKey) (types.FFProbeOutput, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key.path]
+	if !ok || entry.key != key {
+		return types.FFProbeOutput{}, false
+	}
+	return entry.info, true
+}
+
+// put stores the output for key, replacing any older output of the same path.
+func (c *probeCache) put(key probeKey, info types.FFProbeOutput) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key.path]; ok {
+		c.removeLocked(key.path)
+	}
+	for len(c.order) >= PROBE_CACHE_SIZE {
+		c.removeLocked(c.order[0])
+	}
+	c.entries[key.path] = probeEntry{key: key, info: info}
+	c.order = append(c.order, key.path)
+}
+
+// ForgetProbe drops the cached ffprobe output of the file at path, e.g. once it's deleted.
+func ForgetProbe(path string) {
+	probes.mu.Lock()
+	defer probes.mu.Unlock()
+
+	if _, ok := probes.entries[path]; ok {
+		probes.removeLocked(path)
+	}
+}
+
+func (c *probeCache) removeLocked(path string) {
+	delete(c.entries, path)
+	for i, cached := range c.order {
+		if cached == path {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
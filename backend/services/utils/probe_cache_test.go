@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProbeMediaCachesUntilTheFileChanges(t *testing.T) {
+	started := fakeProbe(t, "upright")
+	source := sourceFile(t, "cached.mp4")
+
+	for range 2 {
+		if _, err := ProbeMedia(source); err != nil {
+			t.Fatalf("ProbeMedia: %v", err)
+		}
+	}
+	if n := started.Load(); n != 1 {
+		t.Fatalf("ffprobe ran %d times for an unchanged file, want 1", n)
+	}
+
+	// Rewritten with a different size
+	if err := os.WriteFile(source, []byte("a different video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ProbeMedia(source)
+	if n := started.Load(); n != 2 {
+		t.Fatalf("ffprobe ran %d times after the file grew, want 2", n)
+	}
+
+	// Same size, but modified
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(source, later, later); err != nil {
+		t.Fatal(err)
+	}
+	ProbeMedia(source)
+	if n := started.Load(); n != 3 {
+		t.Fatalf("ffprobe ran %d times after the file was touched, want 3", n)
+	}
+
+	ForgetProbe(source)
+	ProbeMedia(source)
+	if n := started.Load(); n != 4 {
+		t.Fatalf("ffprobe ran %d times after ForgetProbe, want 4", n)
+	}
+}
+
+func TestProbeCacheEvictsTheOldestEntry(t *testing.T) {
+	previous := PROBE_CACHE_SIZE
+	PROBE_CACHE_SIZE = 2
+	t.Cleanup(func() { PROBE_CACHE_SIZE = previous })
+	started := fakeProbe(t, "upright")
+
+	first, second, third := sourceFile(t, "first.mp4"), sourceFile(t, "second.mp4"), sourceFile(t, "third.mp4")
+	for _, source := range []string{first, second, third, second, first} {
+		ProbeMedia(source)
+	}
+	// first was evicted by third, so it's probed again; second stayed cached
+	if n := started.Load(); n != 4 {
+		t.Errorf("ffprobe ran %d times, want 4", n)
+	}
+}
+
+func TestProbeMediaConcurrentCallers(t *testing.T) {
+	fakeProbe(t, "rotated_display_matrix")
+	sources := []string{sourceFile(t, "a.mp4"), sourceFile(t, "b.mp4"), sourceFile(t, "c.mp4")}
+
+	var wg sync.WaitGroup
+	for i := range 24 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			source := sources[i%len(sources)]
+			info, err := ProbeMedia(source)
+			if err != nil {
+				t.Errorf("ProbeMedia: %v", err)
+				return
+			}
+			if width, height, err := VideoDimensions(info); err != nil || width != 1080 || height != 1920 {
+				t.Errorf("VideoDimensions = %dx%d, %v", width, height, err)
+			}
+			if i%5 == 0 {
+				ForgetProbe(source)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeRendition writes a media playlist listing four-second segments, with an EXT-X-MAP tag for
+// init if it isn't empty, next to files (names to content). It returns the playlist's path.
+func writeRendition(t *testing.T, init string, segments []string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	playlist := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n#EXT-X-PLAYLIST-TYPE:VOD\n"
+	if init != "" {
+		playlist += "#EXT-X-MAP:URI=\"" + init + "\"\n"
+	}
+	for _, name := range segments {
+		playlist += "#EXTINF:4.000000,\n" + name + "\n"
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "video_720Pp.m3u8")
+	if err := os.WriteFile(path, []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyRendition(t *testing.T) {
+	both := []string{"seg_000.ts", "seg_001.ts"}
+	written := map[string]string{"seg_000.ts": "data", "seg_001.ts": "data"}
+	withInit := map[string]string{"seg_000.ts": "data", "seg_001.ts": "data", "init.mp4": "data"}
+
+	tests := []struct {
+		name     string
+		init     string
+		segments []string
+		files    map[string]string
+		expected float64
+		wantErr  string // Part of the error, "" for a playable rendition
+	}{
+		{name: "playable", segments: both, files: written, expected: 8},
+		{name: "off by less than a segment", segments: both, files: written, expected: 11.5},
+		{name: "live window", segments: both, files: written, expected: 0},
+		{name: "fmp4", init: "init.mp4", segments: both, files: withInit, expected: 8},
+		{name: "no segments", segments: nil, files: written, expected: 8, wantErr: "lists no segments"},
+		{name: "too short", segments: both, files: written, expected: 60, wantErr: "add up to 8.000s"},
+		{name: "missing segment", segments: both, files: map[string]string{"seg_000.ts": "data"}, expected: 8, wantErr: "missing file"},
+		{name: "empty segment", segments: both, files: map[string]string{"seg_000.ts": "data", "seg_001.ts": ""}, expected: 8, wantErr: "empty file seg_001.ts"},
+		{name: "missing init", init: "init.mp4", segments: both, files: written, expected: 8, wantErr: "missing file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeProbe(t, "upright")
+			err := VerifyRendition(writeRendition(t, tt.init, tt.segments, tt.files), tt.expected)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyRendition = %v, want a playable rendition", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyRendition = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("unreadable", func(t *testing.T) {
+		failProbe(t)
+		err := VerifyRendition(writeRendition(t, "", both, written), 8)
+		if err == nil || !strings.Contains(err.Error(), "not readable") {
+			t.Errorf("VerifyRendition = %v, want an error from ffprobe", err)
+		}
+	})
+
+	t.Run("missing playlist", func(t *testing.T) {
+		if err := VerifyRendition(filepath.Join(t.TempDir(), "missing.m3u8"), 8); err == nil {
+			t.Error("VerifyRendition accepted a missing playlist")
+		}
+	})
+}
+
+func TestDetectPlaylistBitrate(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]int{"init.mp4": 1000, "seg_000.m4s": 4000, filepath.Join("part", "seg_001.m4s"): 500}
+	for name, size := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playlist := filepath.Join(dir, "video_720Pp.m3u8")
+	content := "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4.000000,\nseg_000.m4s\n#EXTINF:2.000,\npart/seg_001.m4s\n#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(playlist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 4500 bytes over six seconds, leaving out the init segment; the first segment peaks at 8000 bps
+	if average, err := DetectPlaylistBitrate(playlist); err != nil || average != 6000 {
+		t.Errorf("DetectPlaylistBitrate = %d, %v, want 6000", average, err)
+	}
+	if peak, err := DetectPlaylistPeakBitrate(playlist); err != nil || peak != 8000 {
+		t.Errorf("DetectPlaylistPeakBitrate = %d, %v, want 8000", peak, err)
+	}
+}
+
+func TestDetectPlaylistBitrateFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		wantErr  string
+	}{
+		{name: "missing segment", playlist: "#EXTINF:4.0,\nseg_009.ts\n", wantErr: "missing segment"},
+		{name: "invalid duration", playlist: "#EXTINF:four,\nseg_000.ts\n", wantErr: "invalid segment duration"},
+		{name: "no segments", playlist: "#EXTM3U\n#EXT-X-ENDLIST\n", wantErr: "lists no segments"},
+		{name: "zero duration", playlist: "#EXTINF:0,\nseg_000.ts\n", wantErr: "lists no segments"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "seg_000.ts"), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		playlist := filepath.Join(dir, "video_720Pp.m3u8")
+		if err := os.WriteFile(playlist, []byte(tt.playlist), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DetectPlaylistBitrate(playlist); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: DetectPlaylistBitrate = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+	if _, err := DetectPlaylistBitrate(filepath.Join(t.TempDir(), "missing.m3u8")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("DetectPlaylistBitrate of a missing playlist = %v, want os.ErrNotExist", err)
+	}
+}
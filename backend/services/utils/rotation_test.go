@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestDetectRotation(t *testing.T) {
+	tests := []struct {
+		fixture       string
+		rotation      int
+		width, height int
+	}{
+		{fixture: "rotated_display_matrix", rotation: 90, width: 1080, height: 1920},
+		{fixture: "rotated_legacy_tag", rotation: 270, width: 720, height: 1280},
+		{fixture: "upright", rotation: 0, width: 1920, height: 1080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			fakeProbe(t, tt.fixture)
+			source := sourceFile(t, tt.fixture+".mp4")
+
+			rotation, err := DetectRotation(source)
+			if err != nil || rotation != tt.rotation {
+				t.Errorf("DetectRotation = %d, %v, want %d", rotation, err, tt.rotation)
+			}
+			width, height, err := DetectVideoDimensions(source)
+			if err != nil || width != tt.width || height != tt.height {
+				t.Errorf("DetectVideoDimensions = %dx%d, %v, want %dx%d", width, height, err, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestStreamRotation(t *testing.T) {
+	matrix := func(rotation int) []types.FFProbeSideData {
+		return []types.FFProbeSideData{{SideDataType: "Display Matrix", Rotation: rotation}}
+	}
+	tests := []struct {
+		name   string
+		stream types.FFProbeStream
+		want   int
+	}{
+		{name: "no rotation", stream: types.FFProbeStream{}, want: 0},
+		{name: "matrix -90", stream: types.FFProbeStream{SideDataList: matrix(-90)}, want: 90},
+		{name: "matrix 90", stream: types.FFProbeStream{SideDataList: matrix(90)}, want: 270},
+		{name: "matrix 180", stream: types.FFProbeStream{SideDataList: matrix(180)}, want: 180},
+		{name: "matrix -180", stream: types.FFProbeStream{SideDataList: matrix(-180)}, want: 180},
+		{name: "tag", stream: types.FFProbeStream{Tags: map[string]string{"rotate": "90"}}, want: 90},
+		{name: "tag over a full turn", stream: types.FFProbeStream{Tags: map[string]string{"rotate": "450"}}, want: 90},
+		{name: "malformed tag", stream: types.FFProbeStream{Tags: map[string]string{"rotate": "sideways"}}, want: 0},
+		{name: "off a right angle", stream: types.FFProbeStream{SideDataList: matrix(-88)}, want: 90},
+		{
+			name:   "matrix over tag",
+			stream: types.FFProbeStream{Tags: map[string]string{"rotate": "90"}, SideDataList: matrix(-270)},
+			want:   270,
+		},
+		{
+			name:   "other side data",
+			stream: types.FFProbeStream{SideDataList: []types.FFProbeSideData{{SideDataType: "Stereo 3D"}}},
+			want:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StreamRotation(tt.stream); got != tt.want {
+				t.Errorf("StreamRotation = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
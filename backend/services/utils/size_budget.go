@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+const (
+	// containerOverhead is the share of the target size reserved for MPEG-TS/fMP4 packaging
+	// and playlists, which isn't accounted for by the encoder bitrates.
+	containerOverhead = 0.05
+
+	// MinBudgetBitrateFraction is the floor of a budgeted rendition relative to its preset bitrate.
+	// Renditions that would fall below it are dropped instead, starting with the largest.
+	MinBudgetBitrateFraction = 0.25
+)
+
+// BudgetBitrates picks video bitrates in kbps so that the renditions, each with AudioBitrate
+// kbps of audio, add up to about targetMB megabytes over duration seconds. The budget is split
+// in proportion to the preset bitrates, which are never exceeded. While the budget can't give
+// every rendition at least MinBudgetBitrateFraction of its preset bitrate, the largest rendition
+// is dropped. It returns the kept resolutions, highest first, with their bitrates, and an error
+// if even the smallest rendition doesn't fit.
+func BudgetBitrates(resolutions []types.Resolutions, presets map[types.Resolutions]types.ResolutionPreset, targetMB int, duration float64) ([]types.Resolutions, map[types.Resolutions]int, error) {
+	if duration <= 0 {
+		return nil, nil, fmt.Errorf("invalid duration %f", duration)
+	}
+
+	kept := slices.Clone(resolutions)
+	slices.SortFunc(kept, func(a, b types.Resolutions) int { return cmp.Compare(b, a) })
+
+	// Total kbps the whole output can average over the duration
+	totalKbps := float64(targetMB) * (1 << 20) * 8 / 1000 / duration * (1 - containerOverhead)
+
+	for len(kept) > 0 {
+		videoKbps := totalKbps - float64(AudioBitrate*len(kept))
+
+		presetSum, floorSum := 0.0, 0.0
+		for _, res := range kept {
+			presetSum += float64(presets[res].Bitrate)
+			floorSum += float64(budgetFloor(presets[res].Bitrate))
+		}
+
+		if videoKbps >= floorSum {
+			scale := min(videoKbps/presetSum, 1)
+			bitrates := make(map[types.Resolutions]int, len(kept))
+			for _, res := range kept {
+				preset := presets[res].Bitrate
+				bitrates[res] = max(budgetFloor(preset), int(float64(preset)*scale))
+			}
+			return kept, bitrates, nil
+		}
+		kept = kept[1:]
+	}
+
+	return nil, nil, fmt.Errorf("target size of %d MB is too small for %.1fs of video", targetMB, duration)
+}
+
+// budgetFloor returns the lowest bitrate a rendition with the given preset bitrate may be budgeted.
+func budgetFloor(presetBitrate int) int {
+	return min(presetBitrate, max(MinBitrateOverride, int(float64(presetBitrate)*MinBudgetBitrateFraction)))
+}
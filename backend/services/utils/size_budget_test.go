@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestBudgetBitrates(t *testing.T) {
+	ladder := []types.Resolutions{types.P360, types.P720, types.P480} // Order doesn't matter
+	presets := types.Presets()
+
+	tests := []struct {
+		name     string
+		targetMB int
+		want     map[types.Resolutions]int
+	}{
+		{
+			name:     "budget above the presets keeps them",
+			targetMB: 100,
+			want:     map[types.Resolutions]int{types.P720: 4000, types.P480: 2000, types.P360: 1000},
+		},
+		{
+			name:     "budget split in proportion to the presets",
+			targetMB: 50,
+			want:     map[types.Resolutions]int{types.P720: 2057, types.P480: 1028, types.P360: 514},
+		},
+		{
+			name:     "largest rendition dropped below its floor",
+			targetMB: 15,
+			want:     map[types.Resolutions]int{types.P480: 626, types.P360: 313},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, bitrates, err := BudgetBitrates(ladder, presets, tt.targetMB, 100)
+			if err != nil {
+				t.Fatalf("BudgetBitrates: %v", err)
+			}
+			if !maps.Equal(bitrates, tt.want) {
+				t.Errorf("bitrates = %v, want %v", bitrates, tt.want)
+			}
+			wantKept := slices.Sorted(maps.Keys(tt.want))
+			slices.Reverse(wantKept)
+			if !slices.Equal(kept, wantKept) {
+				t.Errorf("kept = %v, want %v", kept, wantKept)
+			}
+		})
+	}
+
+	if _, _, err := BudgetBitrates(ladder, presets, 3, 100); err == nil {
+		t.Error("BudgetBitrates fit 100 seconds into 3 MB")
+	}
+	if _, _, err := BudgetBitrates(ladder, presets, 50, 0); err == nil {
+		t.Error("BudgetBitrates accepted a zero duration")
+	}
+}
+
+func TestBudgetFloor(t *testing.T) {
+	for preset, want := range map[int]int{4000: 1000, 600: MinBitrateOverride, 150: 150} {
+		if got := budgetFloor(preset); got != want {
+			t.Errorf("budgetFloor(%d) = %d, want %d", preset, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+// SubtitlesFolder is the folder of the output holding the extracted subtitles and their playlists.
+const SubtitlesFolder = "subtitles"
+
+// textSubtitleCodecs are the subtitle codecs ffmpeg can convert to WebVTT. Bitmap subtitles
+// (e.g. hdmv_pgs_subtitle, dvd_subtitle) would need OCR and are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+// IsTextSubtitle reports whether subtitles in codec can be converted to WebVTT.
+func IsTextSubtitle(codec string) bool {
+	return textSubtitleCodecs[codec]
+}
+
+// languageTags maps the ISO 639-2 codes containers tag streams with to the shorter RFC 5646
+// tags HLS expects, for common languages. Other codes are used as they are.
+var languageTags = map[string]string{
+	"ara": "ar", "chi": "zh", "zho": "zh", "cze": "cs", "ces": "cs", "dan": "da", "dut": "nl",
+	"nld": "nl", "eng": "en", "fin": "fi", "fre": "fr", "fra": "fr", "ger": "de", "deu": "de",
+	"gre": "el", "ell": "el", "heb": "he", "hin": "hi", "hun": "hu", "ind": "id", "ita": "it",
+	"jpn": "ja", "kor": "ko", "nor": "no", "pol": "pl", "por": "pt", "rum": "ro", "ron": "ro",
+	"rus": "ru", "spa": "es", "swe": "sv", "tha": "th", "tur": "tr", "ukr": "uk", "vie": "vi",
+}
+
+// LanguageTag returns the RFC 5646 tag of a stream's language tag, or "" if it's missing or undetermined.
+func LanguageTag(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if language == "" || language == "und" {
+		return ""
+	}
+	if tag, ok := languageTags[language]; ok {
+		return tag
+	}
+	return language
+}
+
+// SubtitleStreams returns the subtitle streams of a probed file, in stream order.
+func SubtitleStreams(info types.FFProbeOutput) []types.SubtitleStream {
+	var streams []types.SubtitleStream
+	for _, stream := range info.Streams {
+		if stream.CodecType != "subtitle" {
+			continue
+		}
+		streams = append(streams, types.SubtitleStream{
+			Index:    stream.Index,
+			Codec:    stream.CodecName,
+			Language: LanguageTag(stream.Tags["language"]),
+			Title:    stream.Tags["title"],
+			Default:  stream.Disposition["default"] == 1,
+			Forced:   stream.Disposition["forced"] == 1,
+		})
+	}
+	return streams
+}
+
+// DetectSubtitleStreams probes the file at path for embedded subtitle streams.
+// A file without subtitles has none and no error.
+func DetectSubtitleStreams(path string) ([]types.SubtitleStream, error) {
+	info, err := ProbeMedia(path)
+	if err != nil {
+		return nil, err
+	}
+	return SubtitleStreams(info), nil
+}
+
+// ExtractSubtitle converts the subtitle stream at streamIndex of inputPath, between startTime and
+// endTime (0 meaning the end), to a WebVTT file at outPath.
+func ExtractSubtitle(ctx context.Context, inputPath, outPath string, streamIndex int, startTime, endTime float64) error {
+	args := []string{"-y"}
+	if startTime > 0 {
+		args = append(args, "-ss", FormatSeconds(startTime))
+	}
+	args = append(args, "-i", inputPath)
+	if endTime > 0 {
+		args = append(args, "-t", FormatSeconds(endTime-startTime))
+	}
+	args = append(args, "-map", fmt.Sprintf("0:%d", streamIndex), "-c:s", "webvtt", outPath)
+
+	return runFFmpeg(ctx, "subtitle extraction", args)
+}
+
+// SubtitlePlaylist returns an HLS media playlist serving the WebVTT file vttName as a single
+// segment covering the whole duration, in seconds.
+func SubtitlePlaylist(vttName string, duration float64) string {
+	return strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d", int(math.Ceil(duration))),
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		fmt.Sprintf("#EXTINF:%.3f,", duration),
+		vttName,
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\n")
+}
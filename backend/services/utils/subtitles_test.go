@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestDetectSubtitleStreams(t *testing.T) {
+	fakeProbe(t, "subtitles")
+
+	streams, err := DetectSubtitleStreams(sourceFile(t, "subtitles.mkv"))
+	if err != nil {
+		t.Fatalf("DetectSubtitleStreams: %v", err)
+	}
+	want := []types.SubtitleStream{
+		{Index: 2, Codec: "subrip", Language: "en", Default: true},
+		{Index: 3, Codec: "hdmv_pgs_subtitle", Language: "de"},
+		{Index: 4, Codec: "ass", Language: "fr", Title: "Français (signs)", Forced: true},
+		{Index: 5, Codec: "dvd_subtitle"},
+		{Index: 6, Codec: "mov_text"},
+	}
+	if !slices.Equal(streams, want) {
+		t.Errorf("DetectSubtitleStreams = %+v, want %+v", streams, want)
+	}
+
+	// Only the text streams can be converted to WebVTT; bitmap ones are left out
+	var text []int
+	for _, stream := range streams {
+		if IsTextSubtitle(stream.Codec) {
+			text = append(text, stream.Index)
+		}
+	}
+	if !slices.Equal(text, []int{2, 4, 6}) {
+		t.Errorf("text subtitle streams = %v, want 2, 4 and 6", text)
+	}
+
+	fakeProbe(t, "upright")
+	if streams, err := DetectSubtitleStreams(sourceFile(t, "upright.mp4")); err != nil || len(streams) != 0 {
+		t.Errorf("DetectSubtitleStreams without subtitles = %+v, %v, want none", streams, err)
+	}
+}
+
+func TestLanguageTag(t *testing.T) {
+	for language, want := range map[string]string{
+		"eng":   "en",
+		"ENG ":  "en",
+		"fre":   "fr",
+		"fra":   "fr",
+		"chi":   "zh",
+		"en":    "en",
+		"tlh":   "tlh",
+		"und":   "",
+		"":      "",
+		" UND ": "",
+	} {
+		if got := LanguageTag(language); got != want {
+			t.Errorf("LanguageTag(%q) = %q, want %q", language, got, want)
+		}
+	}
+}
+
+func TestSubtitlePlaylist(t *testing.T) {
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:61\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:60.060,\n0.vtt\n#EXT-X-ENDLIST\n"
+	if got := SubtitlePlaylist("0.vtt", 60.06); got != want {
+		t.Errorf("SubtitlePlaylist = %q, want %q", got, want)
+	}
+	if got := SubtitlePlaylist("1.vtt", 8); !strings.Contains(got, "#EXT-X-TARGETDURATION:8\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:8.000,\n1.vtt\n") {
+		t.Errorf("SubtitlePlaylist of a whole duration = %q", got)
+	}
+}
+
+func TestExtractSubtitle(t *testing.T) {
+	runs := recordFFmpeg(t, 0)
+	out := filepath.Join(t.TempDir(), "0.vtt")
+
+	if err := ExtractSubtitle(context.Background(), "source.mkv", out, 4, 2.5, 10); err != nil {
+		t.Fatalf("ExtractSubtitle: %v", err)
+	}
+	want := []string{"-y", "-ss", "2.500", "-i", "source.mkv", "-t", "7.500", "-map", "0:4", "-c:s", "webvtt", out}
+	if got := runs(); len(got) != 1 || !slices.Equal(got[0], want) {
+		t.Errorf("runs = %v, want %v", got, want)
+	}
+
+	recordFFmpeg(t, 1)
+	if err := ExtractSubtitle(context.Background(), "source.mkv", out, 4, 0, 0); err == nil || !strings.Contains(err.Error(), "subtitle extraction failed") {
+		t.Errorf("ExtractSubtitle of a failing run = %v, want it reported", err)
+	}
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/PratikDev/transcoder/types"
+)
+
+func TestDetectSkipsCoverArt(t *testing.T) {
+	fakeProbe(t, "cover_art")
+	source := sourceFile(t, "cover_art.mp4")
+
+	width, height, err := DetectVideoDimensions(source)
+	if err != nil || width != 1280 || height != 720 {
+		t.Errorf("DetectVideoDimensions = %dx%d, %v, want the 1280x720 video, not the 600x600 cover", width, height, err)
+	}
+	if resolution, err := DetectVideoResolution(source); err != nil || resolution != types.Resolutions(720) {
+		t.Errorf("DetectVideoResolution = %s, %v, want 720P", resolution, err)
+	}
+	if transfer, err := DetectColorTransfer(source); err != nil || transfer != "bt709" {
+		t.Errorf("DetectColorTransfer = %q, %v, want the video's bt709", transfer, err)
+	}
+	if preset, err := DetectPlaylistResolution(source); err != nil || preset.Width != 1280 || preset.Height != 720 {
+		t.Errorf("DetectPlaylistResolution = %+v, %v, want 1280x720", preset, err)
+	}
+
+	// Parts to concatenate are compared by their main video stream too
+	info, err := ProbeMedia(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature := signatureOf(info); signature.videoCodec != "h264" || signature.width != 1280 || signature.audioCodec != "aac" {
+		t.Errorf("signatureOf = %+v, want the h264 video and aac audio", signature)
+	}
+}
+
+func TestVideoStream(t *testing.T) {
+	video := func(index, width, height int) types.FFProbeStream {
+		return types.FFProbeStream{Index: index, CodecType: "video", Width: width, Height: height}
+	}
+	cover := video(0, 600, 600)
+	cover.Disposition = map[string]int{"attached_pic": 1}
+	audio := types.FFProbeStream{Index: 9, CodecType: "audio"}
+
+	tests := []struct {
+		name    string
+		streams []types.FFProbeStream
+		want    int // Index of the picked stream, -1 for none
+	}{
+		{name: "single", streams: []types.FFProbeStream{audio, video(1, 1920, 1080)}, want: 1},
+		{name: "cover art first", streams: []types.FFProbeStream{cover, video(1, 640, 360)}, want: 1},
+		{name: "largest", streams: []types.FFProbeStream{video(0, 640, 360), video(1, 1920, 1080), video(2, 1280, 720)}, want: 1},
+		{name: "even over larger odd", streams: []types.FFProbeStream{video(0, 1921, 1081), video(1, 1280, 720)}, want: 1},
+		{name: "no dimensions", streams: []types.FFProbeStream{video(0, 0, 0), video(1, 320, 240)}, want: 1},
+		{name: "only cover art", streams: []types.FFProbeStream{audio, cover}, want: 0},
+		{name: "no video", streams: []types.FFProbeStream{audio}, want: -1},
+	}
+	for _, tt := range tests {
+		stream, ok := VideoStream(types.FFProbeOutput{Streams: tt.streams})
+		if tt.want < 0 {
+			if ok {
+				t.Errorf("%s: VideoStream = %+v, want none", tt.name, stream)
+			}
+			continue
+		}
+		if !ok || stream.Index != tt.want {
+			t.Errorf("%s: VideoStream = stream %d, %v, want stream %d", tt.name, stream.Index, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes and close codes used by WebSocketConn (RFC 6455).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	WebSocketCloseNormal    = 1000 // The purpose of the connection is fulfilled, e.g. the task finished
+	WebSocketCloseGoingAway = 1001 // The server is going away or the client left
+
+	wsAcceptGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxControlLength = 125              // Control frame payloads are limited by the protocol
+	wsMaxMessageLength = 64 << 10         // Larger client messages are rejected; clients aren't expected to send data
+	wsWriteTimeout     = 10 * time.Second // How long a single frame write may take before the client is considered gone
+)
+
+// WebSocketConn is a minimal server side WebSocket connection, covering just what status
+// streaming needs: sending text messages and pings, answering pings and honoring close frames.
+// Data messages sent by the client are read and discarded.
+type WebSocketConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex // Serializes frame writes from the handler and the read loop
+
+	done      chan struct{} // Closed once the read loop stops
+	closeOnce sync.Once
+}
+
+// UpgradeWebSocket performs the opening handshake and takes over the connection of r.
+// On failure it writes an HTTP error response and returns an error.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("websocket upgrade requires GET, got %s", r.Method)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade request", http.StatusBadRequest)
+		return nil, errors.New("missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over connection: %w", err)
+	}
+	// The read loop waits for the client indefinitely and writes set their own deadline, so the
+	// HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT deadlines must not carry over. net/http clears them
+	// when hijacking; the stream relies on it, so it's done explicitly.
+	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to lift connection deadlines: %w", err)
+	}
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+
+	netConn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := io.WriteString(netConn, response); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to complete websocket handshake: %w", err)
+	}
+
+	c := &WebSocketConn{
+		conn:   netConn,
+		reader: rw.Reader, // May already hold bytes the client sent after the handshake
+		done:   make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// headerHasToken reports whether the comma-separated header contains token (case-insensitive).
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Done is closed when the client closed the connection or it broke.
+func (c *WebSocketConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// WriteText sends data as a single text message.
+func (c *WebSocketConn) WriteText(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+// WritePing sends a ping, which the client answers with a pong.
+func (c *WebSocketConn) WritePing() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+// Close sends a close frame with the given code and reason, then closes the connection.
+func (c *WebSocketConn) Close(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason[:min(len(reason), wsMaxControlLength-2)]...)
+
+	err := c.writeFrame(wsOpClose, payload)
+	c.conn.Close()
+	return err
+}
+
+// writeFrame writes a single unmasked, unfragmented frame, as servers must.
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode} // FIN bit set
+	switch length := len(payload); {
+	case length <= 125:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readLoop handles frames sent by the client until the connection ends:
+// pings are answered with pongs, a close frame is echoed, and data messages are discarded.
+func (c *WebSocketConn) readLoop() {
+	defer c.closeOnce.Do(func() { close(c.done) })
+
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				c.conn.Close()
+				return
+			}
+		case wsOpClose:
+			// Echo the client's status code, as the closing handshake requires
+			code := uint16(WebSocketCloseNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			c.Close(code, "")
+			return
+		}
+	}
+}
+
+// readFrame reads a single client frame, unmasking its payload.
+func (c *WebSocketConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	if !masked {
+		return 0, nil, errors.New("client frames must be masked")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	switch opcode {
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlLength {
+			return 0, nil, fmt.Errorf("control frame of %d bytes is too large", length)
+		}
+	case wsOpText, wsOpBinary, wsOpContinuation:
+		if length > wsMaxMessageLength {
+			return 0, nil, fmt.Errorf("message of %d bytes is too large", length)
+		}
+	default:
+		return 0, nil, fmt.Errorf("unknown websocket opcode %#x", opcode)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
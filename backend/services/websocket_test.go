@@ -0,0 +1,210 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket performs the opening handshake against server and returns the raw connection.
+func dialWebSocket(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request := "GET / HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", response.StatusCode)
+	}
+	if got := response.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	return conn, reader
+}
+
+// writeClientFrame sends a single masked frame, as clients must.
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+// readServerFrame reads a single unmasked frame with a payload shorter than 126 bytes.
+func readServerFrame(t *testing.T, conn net.Conn, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if head[1]&0x80 != 0 || head[1]&0x7F > 125 {
+		t.Fatalf("unexpected frame header %#x", head)
+	}
+	payload := make([]byte, head[1])
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestWebSocketAnswersPingsAndClose(t *testing.T) {
+	upgraded := make(chan *WebSocketConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			t.Errorf("UpgradeWebSocket: %v", err)
+			return
+		}
+		upgraded <- ws
+	}))
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, server)
+	ws := <-upgraded
+
+	writeClientFrame(t, conn, wsOpPing, []byte("hello"))
+	if opcode, payload := readServerFrame(t, conn, reader); opcode != wsOpPong || string(payload) != "hello" {
+		t.Fatalf("answered ping with opcode %#x and %q, want a pong echoing it", opcode, payload)
+	}
+
+	// Text sent by the client is discarded without ending the connection
+	writeClientFrame(t, conn, wsOpText, []byte("ignored"))
+	if err := ws.WritePing(); err != nil {
+		t.Fatalf("WritePing: %v", err)
+	}
+	if opcode, _ := readServerFrame(t, conn, reader); opcode != wsOpPing {
+		t.Fatalf("got opcode %#x, want a ping", opcode)
+	}
+
+	writeClientFrame(t, conn, wsOpClose, binary.BigEndian.AppendUint16(nil, WebSocketCloseGoingAway))
+	opcode, payload := readServerFrame(t, conn, reader)
+	if opcode != wsOpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != WebSocketCloseGoingAway {
+		t.Fatalf("answered close with opcode %#x and %v, want the close code echoed", opcode, payload)
+	}
+	select {
+	case <-ws.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed after the client closed the connection")
+	}
+}
+
+func TestWebSocketRejectsUnmaskedFrames(t *testing.T) {
+	upgraded := make(chan *WebSocketConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			t.Errorf("UpgradeWebSocket: %v", err)
+			return
+		}
+		upgraded <- ws
+	}))
+	defer server.Close()
+
+	conn, _ := dialWebSocket(t, server)
+	ws := <-upgraded
+	if _, err := conn.Write([]byte{0x80 | wsOpText, 2, 'h', 'i'}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ws.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection kept open after an unmasked client frame")
+	}
+}
+
+func TestUpgradeWebSocketOutlivesServerTimeouts(t *testing.T) {
+	upgraded := make(chan *WebSocketConn, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			t.Errorf("UpgradeWebSocket: %v", err)
+			return
+		}
+		upgraded <- ws
+	}))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, server)
+	ws := <-upgraded
+
+	// Well past both server timeouts, the connection must still be usable both ways
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-ws.Done():
+		t.Fatal("read loop stopped once the server read timeout passed")
+	default:
+	}
+	if err := ws.WriteText([]byte("still here")); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2)
+	if _, err := reader.Read(header); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if header[0] != 0x81 {
+		t.Fatalf("frame header = %#x, want a final text frame", header[0])
+	}
+	payload := make([]byte, header[1])
+	if _, err := reader.Read(payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	if string(payload) != "still here" {
+		t.Fatalf("payload = %q", payload)
+	}
+	ws.Close(1000, "")
+}
+
+func TestUpgradeWebSocketRejectsPlainRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := UpgradeWebSocket(w, r); err == nil {
+			t.Error("UpgradeWebSocket accepted a request without upgrade headers")
+		}
+	}))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", response.StatusCode)
+	}
+	if !strings.Contains(response.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Content-Type = %q", response.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,34 @@
+package types
+
+import (
+	"context"
+	"errors"
+)
+
+// CancelReason explains why a task was stopped before it finished.
+// It is used as the cause of a task's context, so it implements error.
+type CancelReason string
+
+const (
+	CancelReasonUser     CancelReason = "user"     // The client cancelled the task
+	CancelReasonTimeout  CancelReason = "timeout"  // The task ran longer than its job timeout
+	CancelReasonShutdown CancelReason = "shutdown" // The server is shutting down
+	CancelReasonQuota    CancelReason = "quota"    // The task's output exceeded the size quota
+	CancelReasonExpired  CancelReason = "expired"  // The task waited in the queue longer than allowed without starting
+
+	CancelReasonDisconnected CancelReason = "disconnected" // Every status subscriber of a cancelOnDisconnect task left and none came back in time
+)
+
+func (r CancelReason) Error() string {
+	return "task stopped: " + string(r)
+}
+
+// CancelReasonFromContext returns the reason ctx was cancelled with, or an empty reason
+// if ctx isn't done or was cancelled without one.
+func CancelReasonFromContext(ctx context.Context) CancelReason {
+	var reason CancelReason
+	if errors.As(context.Cause(ctx), &reason) {
+		return reason
+	}
+	return ""
+}
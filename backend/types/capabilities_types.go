@@ -0,0 +1,17 @@
+package types
+
+// Capabilities describes the options this server instance can honor, which depend on the ffmpeg build it runs with.
+type Capabilities struct {
+	Codecs         []string           `json:"codecs"`         // Values accepted by the codec option
+	Formats        []string           `json:"formats"`        // Values accepted by the format option
+	VideoCodecs    []string           `json:"videoCodecs"`    // Video encoders the server knows how to use and ffmpeg provides
+	PixelFormats   []string           `json:"pixelFormats"`   // Values accepted by the pixFmt option
+	AudioCodecs    []string           `json:"audioCodecs"`    // Audio encoders the server uses and ffmpeg provides
+	AudioFormats   []string           `json:"audioFormats"`   // Values accepted by the audioFormat option
+	PreviewFormats []string           `json:"previewFormats"` // Values accepted by the previewFormat option
+	SegmentTypes   []string           `json:"segmentTypes"`   // Values accepted by the segmentType option
+	PlaylistTypes  []string           `json:"playlistTypes"`  // Values accepted by the playlistType option
+	Ladders        []string           `json:"ladders"`        // Values accepted by the ladder option
+	HWAccels       []string           `json:"hwaccels"`       // Hardware acceleration methods reported by ffmpeg
+	Resolutions    []ResolutionPreset `json:"resolutions"`    // Resolution ladder, highest first
+}
@@ -0,0 +1,17 @@
+package types
+
+// EncodeEstimate predicts how long transcoding a source with a set of options takes on this server.
+type EncodeEstimate struct {
+	Renditions   []RenditionEstimate `json:"renditions"`   // Highest rendition first
+	TotalSeconds float64             `json:"totalSeconds"` // Renditions share the CPU, so the job takes about the sum of their times
+	Duration     float64             `json:"duration"`     // Seconds of video to transcode, after trimming
+	SpeedFactor  float64             `json:"speedFactor"`  // Luma samples per second this server encodes with H.264, as benchmarked
+}
+
+// RenditionEstimate is the predicted encoding time of a single rendition.
+type RenditionEstimate struct {
+	Resolution string  `json:"resolution"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Seconds    float64 `json:"seconds"`
+}
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// JobPriority orders queued jobs; higher priorities are started first.
+type JobPriority int
+
+// Enum values for JobPriority
+const (
+	PriorityLow JobPriority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// returns the string representation of JobPriority.
+func (p JobPriority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// ParseJobPriority parses "low", "normal" or "high" (case-insensitive).
+func ParseJobPriority(value string) (JobPriority, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("invalid priority %q, expected low, normal or high", value)
+	}
+}
+
+// JobDetails describes a single job in depth, for a job detail view.
+type JobDetails struct {
+	JobInfo
+	ElapsedMs   int64               `json:"elapsedMs"`   // Time spent running so far, or waiting while still queued
+	Status      StatusUpdate        `json:"status"`      // Latest status update of the task
+	Resolutions map[string]TaskData `json:"resolutions"` // Latest progress of each rendition, keyed by resolution
+
+	ArchiveAvailable bool `json:"archiveAvailable"` // Whether the zip archive can be downloaded
+	OutputAvailable  bool `json:"outputAvailable"`  // Whether the output folder exists, e.g. for unzipped output
+}
+
+// JobInfo describes a job known to the scheduler.
+type JobInfo struct {
+	TaskID      string `json:"taskId"`
+	Priority    string `json:"priority"`            // Priority requested at submission
+	State       string `json:"state"`               // "queued" or "running", or "paused" in job details
+	SubmittedAt int64  `json:"submittedAt"`         // Unix timestamp in milliseconds
+	StartedAt   int64  `json:"startedAt,omitempty"` // Unix timestamp in milliseconds, once running
+}
@@ -1,24 +1,89 @@
 package types
 
-import "context"
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
 
 // TaskStatus represents the current state of a transcoding task.
 type TaskStatus struct {
-	LastUpdate StatusUpdate
-	Cancel     context.CancelFunc
+	LastUpdate  StatusUpdate
+	Resolutions map[string]TaskData     // Latest data reported for each rendition, keyed by resolution
+	Cancel      context.CancelCauseFunc // Cancels the task's context with the given cause
+	Token       string                  // Secret handed to the client that created the task, required to access it
+	RequestID   string                  // Correlation ID of the request that created the task
+	PublishMu   *sync.Mutex             // Held while an update is recorded and published, so subscribers get them in order
+
+	Processes map[*os.Process]struct{} // Running ffmpeg processes of the task, which pausing stops
+	Paused    bool                     // Whether the task was paused; processes started meanwhile are stopped right away
+	Deadline  time.Time                // When the task times out, zero until it started; pausing doesn't postpone it
+
+	DisconnectGrace time.Duration // How long the task may go without subscribers once they all left before it's cancelled, 0 to never
+	OrphanTimer     *time.Timer   // Pending cancellation of the task after its last subscriber left
 }
 
 type TaskData struct {
-	Resolution string  `json:"resolution"` // Target resolution for the transcoding task
-	Frame      string  `json:"frame"`      // Ongoing frame for the transcoding task
-	Timestamp  int64   `json:"timestamp"`  // Unix timestamp of the video that is being transcoded
-	Progress   float64 `json:"progress"`   // Progress of completion for the task (0-100)
+	Resolution string  `json:"resolution"`        // Target resolution for the transcoding task
+	Frame      string  `json:"frame"`             // Ongoing frame for the transcoding task
+	Timestamp  int64   `json:"timestamp"`         // Unix timestamp of the video that is being transcoded
+	Progress   float64 `json:"progress"`          // Progress of completion for the task (0-100)
+	FPS        string  `json:"fps,omitempty"`     // Frames encoded per second
+	Bitrate    string  `json:"bitrate,omitempty"` // Current output bitrate in kbits/s
+
+	AvgSpeed float64 `json:"avgSpeed,omitempty"` // Average encoding speed of the rendition so far, as a multiple of realtime
+
+	QueuePosition        int   `json:"queuePosition,omitempty"`        // Position of a queued task, 1 being the next to start
+	EstimatedWaitSeconds int64 `json:"estimatedWaitSeconds,omitempty"` // Expected wait of a queued task before it starts, absent while unknown
+
+	OutputBytes int64 `json:"outputBytes,omitempty"` // Bytes written to the task's output folder so far
+
+	TimeoutSeconds int64 `json:"timeoutSeconds,omitempty"` // Time left before a paused task times out, as pausing doesn't stop its timeout
+
+	ErrorCode string `json:"errorCode,omitempty"` // Machine-readable cause of a failure, e.g. "storage_full"
+
+	Reason CancelReason `json:"reason,omitempty"` // Why the task was stopped early: "user", "timeout", "shutdown" or "quota"
+
+	MasterPlaylist string   `json:"masterPlaylist,omitempty"` // Master playlist path relative to the output directory (unzipped output only)
+	Playlists      []string `json:"playlists,omitempty"`      // Rendition playlist paths relative to the output directory (unzipped output only)
+
+	Completion *CompletionData `json:"completion,omitempty"` // Manifest of the produced output, only set on the final "completed" update
+}
+
+// OutputFile describes a single file produced by a transcoding task.
+type OutputFile struct {
+	Path       string `json:"path"`                 // Path relative to the task's output folder
+	Size       int64  `json:"size"`                 // Size in bytes
+	Resolution string `json:"resolution,omitempty"` // Rendition the file belongs to, empty for shared files like the master playlist
+}
+
+// CompletionData summarizes the output of a finished transcoding task.
+type CompletionData struct {
+	Files       []OutputFile `json:"files"`                 // Every file produced for the task
+	ArchivePath string       `json:"archivePath,omitempty"` // Zip archive path relative to the output directory, if archived
+	ArchiveSize int64        `json:"archiveSize,omitempty"` // Zip archive size in bytes, if archived
+	AudioPath   string       `json:"audioPath,omitempty"`   // Standalone audio file path relative to the task's output folder, if exported
+	PreviewPath string       `json:"previewPath,omitempty"` // Preview clip path relative to the task's output folder, if generated
+	Subtitles   []string     `json:"subtitles,omitempty"`   // Subtitle playlist paths relative to the task's output folder, if extracted
+	AudioTracks []string     `json:"audioTracks,omitempty"` // Audio rendition playlist paths relative to the task's output folder, if encoded separately
+
+	FailedRenditions []string `json:"failedRenditions,omitempty"` // Renditions dropped under the bestEffort failure policy
+
+	Bitrates map[string]int `json:"bitrates,omitempty"` // Video bitrate in kbps chosen per resolution, only set when a target size was given
+
+	AvgSpeed        float64            `json:"avgSpeed,omitempty"`        // Average encoding speed over the whole job, as a multiple of realtime
+	RenditionSpeeds map[string]float64 `json:"renditionSpeeds,omitempty"` // Average encoding speed per resolution
 }
 
 // StatusUpdate represents a single progress update to be sent to the client via SSE.
 type StatusUpdate struct {
-	Type      string   `json:"type"`      // e.g., "started", "progress", "canceled", "completed", "failed"
+	Type      string   `json:"type"`      // e.g., "queued", "started", "resolution_started", "progress", "warning", "canceled", "completed", "failed", "timed_out", "expired"
 	Message   string   `json:"message"`   // Detailed message
 	Data      TaskData `json:"data"`      // Additional data related to the task
 	Timestamp int64    `json:"timestamp"` // Unix timestamp for when the update occurred
+
+	// Latest data of every rendition, keyed by resolution, attached to per-rendition updates so
+	// clients always have a consistent view of renditions that progress concurrently
+	Resolutions map[string]TaskData `json:"resolutions,omitempty"`
 }
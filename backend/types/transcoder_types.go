@@ -2,6 +2,8 @@ package types
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // source file information.
@@ -9,21 +11,332 @@ type TranscoderSource struct {
 	File     string
 	Filename string
 	Extname  string
+	Parts    []string // Uploaded parts, in order, to be concatenated into File before transcoding
+
+	ContentHash string // Hex SHA-256 of the uploaded content, empty if it wasn't uploaded with this job
+	MediaType   string // Media type sniffed from the uploaded content, empty if it wasn't uploaded with this job
+}
+
+// per-job options supplied by the client alongside the upload.
+type TranscodeOptions struct {
+	Zip           bool                // Archive the output folder into a zip and remove the folder afterwards
+	ZipOnDownload bool                // Keep the output folder and zip it on the fly when it's downloaded, instead of archiving it
+	Bitrates      map[Resolutions]int // Per-resolution video bitrate overrides in kbps
+
+	TargetSizeMB int // Approximate total output size to fit the renditions into, 0 uses the preset bitrates
+
+	SmartCopy bool // Segment sources already matching the smallest rendition with stream copy instead of re-encoding
+
+	Chapters []Chapter // Chapter markers of the source, published as WebVTT and JSON chapter lists
+
+	IFramePlaylist  bool // Also generate an I-frame-only (trick-play) playlist per rendition
+	VerifyAlignment bool // Check that segment boundaries line up across renditions after transcoding
+
+	MaxThreads int  // Limit on the threads each ffmpeg process may use, 0 leaves it to ffmpeg
+	Throttle   bool // Read the input at its native frame rate (-re), capping encoding at realtime speed
+
+	SceneCut bool // Let the encoder add keyframes at scene cuts, with keyframes still forced at segment boundaries
+
+	Subtitles bool // Extract the text subtitle streams of the source to WebVTT, listed as HLS subtitle renditions
+
+	AudioTracks bool // Encode every audio stream of the source to an HLS audio rendition of its own, e.g. one per language
+
+	StartTime float64 // Offset in seconds to start transcoding from
+	EndTime   float64 // Offset in seconds to stop transcoding at, 0 means the end of the input
+
+	PixFmt string // Output pixel format passed to -pix_fmt, e.g. "yuv420p" or "yuv420p10le"
+
+	Tonemap bool // Convert HDR (PQ/HLG) sources to SDR BT.709
+
+	Deinterlace DeinterlaceMode // When the source is deinterlaced before scaling
+	Denoise     float64         // Luma strength of the hqdn3d denoiser applied before scaling, 0 to skip
+
+	Pad PadSpec // Exact frame the video is letterboxed into before the ladder scales it, zero to keep the source's frame
+
+	Priority JobPriority // Position in the job queue relative to other waiting jobs
+
+	MaxRenditions int // Upper limit on the renditions produced, 0 keeps the whole ladder
+	MaxHeight     int // Height of the tallest rendition allowed, 0 leaves it to MAX_OUTPUT_HEIGHT
+
+	Ladder []RenditionSpec // Renditions of a named ladder preset, limiting the resolutions produced; empty for the full ladder
+
+	KeepSource bool // Move the source into SOURCE_ARCHIVE_DIR after transcoding instead of deleting it
+
+	CancelOnDisconnect bool // Cancel the job once its status subscribers have all left and none came back within the grace period
+
+	AudioFormat string // Also export the audio as a standalone file in this format ("mp3" or "m4a"), empty to skip
+
+	PreviewFormat   string  // Also produce a short looping preview clip in this format ("gif" or "mp4"), empty to skip
+	PreviewStart    float64 // Offset of the preview clip in seconds, relative to StartTime
+	PreviewDuration float64 // Length of the preview clip in seconds
+
+	FailurePolicy FailurePolicy // What happens to the job when a single rendition fails
+
+	Codec  Codec        // Video codec of the renditions
+	Format OutputFormat // Adaptive streaming format of the output
+	Speed  int          // Speed preset of the AV1 encoder, from 0 (slowest, best quality) to 13
+
+	AudioCodec AudioCodec // Audio codec of the renditions
+
+	Profile string // H.264 profile ("baseline", "main" or "high"), empty for the one the pixel format needs
+	Level   string // H.264 level, e.g. "3.1", empty to let the encoder pick
+
+	SegmentType SegmentType  // Container of the media segments
+	Layout      OutputLayout // Where the files of each rendition are written
+
+	PlaylistType PlaylistType // Kind of rendition playlists to produce
+	ListSize     int          // Number of segments kept in a live playlist's sliding window
+}
+
+// FailurePolicy decides how a job reacts to a rendition failing.
+type FailurePolicy string
+
+const (
+	FailFast   FailurePolicy = "failFast"   // Any failed rendition fails the whole job
+	BestEffort FailurePolicy = "bestEffort" // Failed renditions are dropped; the job completes with the rest
+)
+
+// ParseFailurePolicy parses "failFast" or "bestEffort" (case-insensitive).
+func ParseFailurePolicy(value string) (FailurePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "failfast":
+		return FailFast, nil
+	case "besteffort":
+		return BestEffort, nil
+	default:
+		return FailFast, fmt.Errorf("invalid failure policy %q, expected failFast or bestEffort", value)
+	}
+}
+
+// Codec selects the video codec of the renditions, along with the audio codec that goes with it.
+type Codec string
+
+const (
+	CodecH264 Codec = "h264" // H.264 video with AAC audio
+	CodecVP9  Codec = "vp9"  // VP9 video with Opus audio in WebM, delivered as DASH
+	CodecAV1  Codec = "av1"  // AV1 video with AAC audio in fMP4 segments, delivered as HLS
+)
+
+// ParseCodec parses "h264", "vp9" or "av1" (case-insensitive).
+func ParseCodec(value string) (Codec, error) {
+	switch codec := Codec(strings.ToLower(strings.TrimSpace(value))); codec {
+	case CodecH264, CodecVP9, CodecAV1:
+		return codec, nil
+	default:
+		return CodecH264, fmt.Errorf("invalid codec %q, expected h264, vp9 or av1", value)
+	}
+}
+
+// AudioCodec selects the audio codec of the renditions.
+type AudioCodec string
+
+const (
+	AudioAAC  AudioCodec = "aac"  // AAC-LC, the default with h264 and av1
+	AudioOpus AudioCodec = "opus" // Opus, the default with vp9 and the only one WebM segments carry here
+	AudioAC3  AudioCodec = "ac3"  // Dolby Digital
+)
+
+// ParseAudioCodec parses "aac", "opus" or "ac3" (case-insensitive).
+func ParseAudioCodec(value string) (AudioCodec, error) {
+	switch codec := AudioCodec(strings.ToLower(strings.TrimSpace(value))); codec {
+	case AudioAAC, AudioOpus, AudioAC3:
+		return codec, nil
+	default:
+		return AudioAAC, fmt.Errorf("invalid audio codec %q, expected aac, opus or ac3", value)
+	}
+}
+
+// OutputFormat selects the adaptive streaming format of the output.
+type OutputFormat string
+
+const (
+	FormatHLS  OutputFormat = "hls"  // HLS playlists, with main.m3u8 as the master playlist
+	FormatDASH OutputFormat = "dash" // DASH manifests, with main.mpd as the manifest of the whole ladder
+)
+
+// ParseOutputFormat parses "hls" or "dash" (case-insensitive).
+func ParseOutputFormat(value string) (OutputFormat, error) {
+	switch format := OutputFormat(strings.ToLower(strings.TrimSpace(value))); format {
+	case FormatHLS, FormatDASH:
+		return format, nil
+	default:
+		return FormatHLS, fmt.Errorf("invalid format %q, expected hls or dash", value)
+	}
+}
+
+// OutputLayout selects where the files of each rendition are written in the output folder.
+type OutputLayout string
+
+const (
+	LayoutNested OutputLayout = "nested" // A folder per resolution, holding its playlist and segments
+	LayoutFlat   OutputLayout = "flat"   // Every file next to the master playlist, named after its resolution
+)
+
+// ParseOutputLayout parses "nested" or "flat" (case-insensitive).
+func ParseOutputLayout(value string) (OutputLayout, error) {
+	switch layout := OutputLayout(strings.ToLower(strings.TrimSpace(value))); layout {
+	case LayoutNested, LayoutFlat:
+		return layout, nil
+	default:
+		return LayoutNested, fmt.Errorf("invalid layout %q, expected nested or flat", value)
+	}
+}
+
+// PadSpec is a frame size the video is scaled to fit and padded to, e.g. 1080x1080 for square
+// delivery. A zero Width means no padding.
+type PadSpec struct {
+	Width  int
+	Height int
+	Color  string // Background of the padding, as ffmpeg's pad filter takes it
+}
+
+// DeinterlaceMode selects when the source is deinterlaced.
+type DeinterlaceMode string
+
+const (
+	DeinterlaceAuto DeinterlaceMode = "auto" // Only sources ffprobe reports as interlaced, and only their interlaced frames
+	DeinterlaceOn   DeinterlaceMode = "on"   // Every frame, for interlaced sources that are flagged as progressive
+	DeinterlaceOff  DeinterlaceMode = "off"  // Never
+)
+
+// ParseDeinterlaceMode parses "auto", "on" or "off" (case-insensitive). "true" and "false" are
+// accepted for on and off.
+func ParseDeinterlaceMode(value string) (DeinterlaceMode, error) {
+	switch mode := DeinterlaceMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case DeinterlaceAuto, DeinterlaceOn, DeinterlaceOff:
+		return mode, nil
+	case "true":
+		return DeinterlaceOn, nil
+	case "false":
+		return DeinterlaceOff, nil
+	default:
+		return DeinterlaceAuto, fmt.Errorf("invalid deinterlace mode %q, expected auto, on or off", value)
+	}
+}
+
+// SegmentType selects the container of the media segments.
+type SegmentType string
+
+const (
+	SegmentTS   SegmentType = "ts"   // MPEG-TS segments
+	SegmentFMP4 SegmentType = "fmp4" // Fragmented MP4 (CMAF) segments with an init segment, usable for both HLS and DASH
+)
+
+// ParseSegmentType parses "ts" or "fmp4" (case-insensitive).
+func ParseSegmentType(value string) (SegmentType, error) {
+	switch segmentType := SegmentType(strings.ToLower(strings.TrimSpace(value))); segmentType {
+	case SegmentTS, SegmentFMP4:
+		return segmentType, nil
+	default:
+		return SegmentTS, fmt.Errorf("invalid segment type %q, expected ts or fmp4", value)
+	}
+}
+
+// PlaylistType selects how rendition playlists are written.
+type PlaylistType string
+
+const (
+	PlaylistVOD   PlaylistType = "vod"   // Complete playlist, written as EXT-X-PLAYLIST-TYPE:VOD
+	PlaylistEvent PlaylistType = "event" // Growing playlist that keeps every segment, written as EXT-X-PLAYLIST-TYPE:EVENT
+	PlaylistLive  PlaylistType = "live"  // Sliding window of the most recent segments, older segments are deleted
+)
+
+// DefaultLiveListSize is the number of segments kept in a live playlist when none is requested.
+const DefaultLiveListSize = 6
+
+// ParsePlaylistType parses "vod", "event" or "live" (case-insensitive).
+func ParsePlaylistType(value string) (PlaylistType, error) {
+	switch playlistType := PlaylistType(strings.ToLower(strings.TrimSpace(value))); playlistType {
+	case PlaylistVOD, PlaylistEvent, PlaylistLive:
+		return playlistType, nil
+	default:
+		return PlaylistVOD, fmt.Errorf("invalid playlist type %q, expected vod, event or live", value)
+	}
+}
+
+// DefaultTranscodeOptions returns the options used when the client doesn't specify any.
+func DefaultTranscodeOptions() TranscodeOptions {
+	return TranscodeOptions{
+		Zip:      true,
+		PixFmt:   "yuv420p",
+		Priority: PriorityNormal,
+
+		Codec:         CodecH264,
+		Format:        FormatHLS,
+		AudioCodec:    AudioAAC,
+		FailurePolicy: FailFast,
+		SegmentType:   SegmentTS,
+		Layout:        LayoutNested,
+		PlaylistType:  PlaylistVOD,
+		Deinterlace:   DeinterlaceAuto,
+	}
+}
+
+// RenditionSpec is one rendition of a ladder preset.
+type RenditionSpec struct {
+	Resolution Resolutions
+	Bitrate    int   // Video bitrate in kbps
+	Codec      Codec // Video codec; the renditions of a ladder share theirs
 }
 
 // information about a generated HLS playlist for a specific resolution.
 type TranscoderPlaylist struct {
+	Target               Resolutions // Rung of the ladder the rendition was made for
 	Resolution           ResolutionPreset
 	PlaylistFilename     string
 	PlaylistPathFromMain string
 	PlaylistPath         string
+
+	IFramePlaylistPathFromMain string // Empty unless an I-frame-only playlist was generated
+}
+
+// Chapter is a named section of a video, with its start and end in seconds.
+type Chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// SubtitleStream is a subtitle stream embedded in a source.
+type SubtitleStream struct {
+	Index    int    // Index of the stream in the source
+	Codec    string // Codec as ffprobe names it, e.g. "subrip"
+	Language string // RFC 5646 language tag from the stream metadata, empty if untagged
+	Title    string // Title from the stream metadata, if any
+	Default  bool   // Whether the stream is flagged to be shown by default
+	Forced   bool   // Whether the stream only covers foreign-language parts
 }
 
+// SubtitleTrack is a subtitle stream extracted to WebVTT, with the HLS playlist serving it.
+type SubtitleTrack struct {
+	SubtitleStream
+	Name         string // Name shown to viewers
+	PlaylistPath string // Playlist path relative to the output folder
+}
+
+// AudioStream describes an audio stream of the source.
+type AudioStream struct {
+	Index    int    // Index of the stream in the source
+	Codec    string // Codec as ffprobe names it, e.g. "aac"
+	Language string // RFC 5646 language tag from the stream metadata, empty if untagged
+	Title    string // Title from the stream metadata, if any
+	Channels int    // Number of channels, 0 if unknown
+	Default  bool   // Whether the stream is flagged to be played by default
+}
+
+// AudioTrack is an audio stream encoded to an HLS audio rendition of its own.
+type AudioTrack struct {
+	AudioStream
+	Name         string // Name shown to viewers
+	PlaylistPath string // Playlist path relative to the output folder
+}
+
+// ResolutionPreset
 // video width, height and bitrate.
 type ResolutionPreset struct {
-	Height  int
-	Width   int
-	Bitrate int
+	Height  int `json:"height"`
+	Width   int `json:"width"`
+	Bitrate int `json:"bitrate"` // kbps
 }
 
 // Resolutions enum type
@@ -39,8 +352,8 @@ const (
 	P360  Resolutions = 360
 )
 
-// map from Resolutions enum to ResolutionPreset struct
-var RESOLUTIONS = map[Resolutions]ResolutionPreset{
+// DefaultPresets is the built-in resolution ladder, keyed by height.
+var DefaultPresets = map[Resolutions]ResolutionPreset{
 	P2160: {Height: 2160, Width: 3840, Bitrate: 14000}, // 4K resolution
 	P1440: {Height: 1440, Width: 2560, Bitrate: 9000},  // 2K resolution
 	P1080: {Height: 1080, Width: 1920, Bitrate: 6500},  // 1080p resolution
@@ -49,16 +362,79 @@ var RESOLUTIONS = map[Resolutions]ResolutionPreset{
 	P360:  {Height: 360, Width: 640, Bitrate: 1000},    // 360p resolution
 }
 
+// presets is the resolution ladder in use, DefaultPresets unless SetPresets replaced it.
+var presets = DefaultPresets
+
+// Presets returns the resolution ladder in use, keyed by height. Callers must not modify it.
+func Presets() map[Resolutions]ResolutionPreset {
+	return presets
+}
+
+// SetPresets replaces the resolution ladder, e.g. with one loaded from a config file. It isn't
+// safe for concurrent use, so it must only be called at startup, before any job runs.
+func SetPresets(ladder map[Resolutions]ResolutionPreset) {
+	presets = ladder
+}
+
 // returns the string representation of Resolutions.
 func (r Resolutions) String() string {
 	return fmt.Sprintf("%dP", int(r))
 }
 
+// ParseResolution parses a resolution string such as "1080P", "1080p" or "1080"
+// into one of the known Resolutions.
+func ParseResolution(value string) (Resolutions, error) {
+	trimmed := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "P")
+	height, err := strconv.Atoi(trimmed)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resolution %q", value)
+	}
+
+	res := Resolutions(height)
+	if _, ok := Presets()[res]; !ok {
+		return 0, fmt.Errorf("unsupported resolution %q", value)
+	}
+	return res, nil
+}
+
+// FFmpegProgress holds the values parsed from a single ffmpeg -progress block.
+// Fields are left empty when ffmpeg reports them as missing (e.g. "bitrate=N/A").
+type FFmpegProgress struct {
+	Frame   string // Number of frames encoded so far
+	Time    string // Position in the output as HH:MM:SS.ms
+	Speed   string // Encoding speed as a multiple of realtime, without the trailing "x"
+	FPS     string // Frames encoded per second
+	Bitrate string // Current output bitrate in kbits/s
+
+	OutTime float64 // Position in the output in seconds, set along with Time
+	Done    bool    // Whether this was the final block
+}
+
 // FFProbeStream represents a single stream in the FFProbe output.
 type FFProbeStream struct {
-	CodecType string `json:"codec_type"`
-	Width     int    `json:"width"`
-	Height    int    `json:"height"`
+	Index         int    `json:"index"`
+	CodecName     string `json:"codec_name,omitempty"`
+	CodecType     string `json:"codec_type"`
+	Width         int    `json:"width,omitempty"`
+	Height        int    `json:"height,omitempty"`
+	PixFmt        string `json:"pix_fmt,omitempty"`
+	ColorTransfer string `json:"color_transfer,omitempty"`
+	FieldOrder    string `json:"field_order,omitempty"`         // "progressive", or "tt", "bb", "tb", "bt" for interlaced video
+	SampleAspect  string `json:"sample_aspect_ratio,omitempty"` // Pixel aspect ratio, e.g. "1:1", or "16:15" for anamorphic video
+	RFrameRate    string `json:"r_frame_rate,omitempty"`
+	SampleRate    string `json:"sample_rate,omitempty"`
+	Channels      int    `json:"channels,omitempty"`
+	BitRate       string `json:"bit_rate,omitempty"`
+
+	Tags         map[string]string `json:"tags,omitempty"`           // Stream tags; older files carry their rotation in "rotate"
+	Disposition  map[string]int    `json:"disposition,omitempty"`    // Flags such as "default" and "forced", set to 1
+	SideDataList []FFProbeSideData `json:"side_data_list,omitempty"` // Side data such as the display matrix of rotated videos
+}
+
+// FFProbeSideData represents a side data entry of a stream in the FFProbe output.
+type FFProbeSideData struct {
+	SideDataType string `json:"side_data_type"`
+	Rotation     int    `json:"rotation,omitempty"` // Counterclockwise rotation of the display matrix, in degrees
 }
 
 // FFProbeFormat represents the format information in the FFProbe output.
@@ -66,6 +442,7 @@ type FFProbeFormat struct {
 	Filename   string `json:"filename"`
 	NbStreams  int    `json:"nb_streams"`
 	FormatName string `json:"format_name"`
+	FormatLong string `json:"format_long_name,omitempty"`
 	Duration   string `json:"duration"`
 	Size       string `json:"size"`
 	BitRate    string `json:"bit_rate"`
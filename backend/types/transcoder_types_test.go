@@ -0,0 +1,21 @@
+package types
+
+import "testing"
+
+func TestParseResolutionUsesPresets(t *testing.T) {
+	if res, err := ParseResolution("720"); err != nil || res != P720 {
+		t.Errorf("ParseResolution(720) = %v, %v, want 720P", res, err)
+	}
+	if _, err := ParseResolution("540"); err == nil {
+		t.Error("ParseResolution(540) accepted a height the built-in ladder doesn't have")
+	}
+
+	SetPresets(map[Resolutions]ResolutionPreset{540: {Height: 540, Width: 960, Bitrate: 2000}})
+	t.Cleanup(func() { SetPresets(DefaultPresets) })
+	if res, err := ParseResolution("540"); err != nil || res != 540 {
+		t.Errorf("ParseResolution(540) = %v, %v, want the configured 540P", res, err)
+	}
+	if _, err := ParseResolution("720"); err == nil {
+		t.Error("ParseResolution(720) accepted a height the configured ladder doesn't have")
+	}
+}